@@ -10,8 +10,10 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
@@ -57,18 +59,12 @@ func handleEcho(conn net.Conn) {
 	defer conn.Close()
 	log.Printf("new session from %s", conn.RemoteAddr().String())
 
-	buf := make([]byte, 4096)
-	for {
-		n, err := conn.Read(buf)
-		if err != nil {
-			log.Printf("read: %v", err)
-			return
-		}
-		if _, err := conn.Write(buf[:n]); err != nil {
-			log.Printf("write: %v", err)
-			return
-		}
+	// io.Copy returns once the client has closed its side.
+	if _, err := io.Copy(conn, conn); err != nil {
+		log.Printf("echo: %v", err)
+		return
 	}
+	log.Printf("session from %s done", conn.RemoteAddr().String())
 }
 
 func runClient(addr string) {
@@ -79,10 +75,15 @@ func runClient(addr string) {
 	defer conn.Close()
 	log.Printf("connected to %s", conn.RemoteAddr())
 
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		buf := make([]byte, 4096)
 		for {
 			n, err := conn.Read(buf)
+			if err == io.EOF {
+				return
+			}
 			if err != nil {
 				log.Printf("read: %v", err)
 				return
@@ -97,4 +98,14 @@ func runClient(addr string) {
 			log.Fatalf("write: %v", err)
 		}
 	}
+
+	// Half-close so the server sees io.EOF, then wait for the last
+	// echoes. Without CloseWrite (the kernel module) just hang up.
+	if err := conn.CloseWrite(); err != nil {
+		if !errors.Is(err, errors.ErrUnsupported) {
+			log.Printf("close write: %v", err)
+		}
+		return
+	}
+	<-done
 }
@@ -9,6 +9,7 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"io"
 	"log"
@@ -56,9 +57,11 @@ func runReceiver(addr, outPath string) {
 	}
 	defer f.Close()
 
+	// io.Copy returns once the sender has closed its side, so every
+	// byte it sent has been written to f.
 	n, err := io.Copy(f, conn)
 	if err != nil {
-		log.Printf("receive error: %v", err)
+		log.Printf("receive error after %d bytes: %v", n, err)
 	}
 	log.Printf("received %d bytes → %s", n, outPath)
 }
@@ -99,5 +102,15 @@ func runSender(addr, inPath string) {
 			log.Fatalf("read: %v", readErr)
 		}
 	}
+
+	// Tell the receiver the file is complete, and wait for it to hang
+	// up so that nothing is still in flight when we close.
+	if err := conn.CloseWrite(); err == nil {
+		if _, err := io.Copy(io.Discard, conn); err != nil {
+			log.Printf("waiting for receiver: %v", err)
+		}
+	} else if !errors.Is(err, errors.ErrUnsupported) {
+		log.Fatalf("close write: %v", err)
+	}
 	log.Printf("sent %d bytes", total)
 }
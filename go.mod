@@ -2,7 +2,10 @@ module github.com/amosdavis/pool-go
 
 go 1.21.3
 
-require github.com/cucumber/godog v0.15.1
+require (
+	github.com/cucumber/godog v0.15.1
+	golang.org/x/crypto v0.31.0
+)
 
 require (
 	github.com/cucumber/gherkin/go/v26 v26.2.0 // indirect
@@ -12,4 +15,5 @@ require (
 	github.com/hashicorp/go-memdb v1.3.4 // indirect
 	github.com/hashicorp/golang-lru v0.5.4 // indirect
 	github.com/spf13/pflag v1.0.7 // indirect
+	golang.org/x/sys v0.28.0 // indirect
 )
@@ -0,0 +1,234 @@
+//go:build linux
+
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/amosdavis/pool-go/poolioc"
+)
+
+// Ack is the completion of a write sent with WriteAsync. It completes
+// once the peer acknowledges delivery of the message, or with the
+// error that prevented it.
+type Ack struct {
+	conn   *Conn
+	result <-chan error // the backend's report of delivery
+	done   chan struct{}
+	err    error // backend error, mapped when reported
+}
+
+// acker completes the Acks of a Conn. A single goroutine runs while
+// any are pending, collecting the results the backend has reported at
+// each change of its state, rather than one goroutine per write.
+type acker struct {
+	mu      sync.Mutex
+	pending []*Ack
+	running bool
+	added   chan struct{} // wakes the running collector for a new Ack
+}
+
+// newAck returns the Ack of a write whose delivery the backend reports
+// on result, starting the Conn's collector if it is not running.
+func (c *Conn) newAck(result <-chan error) *Ack {
+	a := &Ack{conn: c, result: result, done: make(chan struct{})}
+	k := &c.acks
+	k.mu.Lock()
+	if k.added == nil {
+		k.added = make(chan struct{}, 1)
+	}
+	k.pending = append(k.pending, a)
+	start := !k.running
+	k.running = true
+	k.mu.Unlock()
+
+	if start {
+		go c.collectAcks()
+	} else {
+		select {
+		case k.added <- struct{}{}:
+		default:
+		}
+	}
+	return a
+}
+
+// collectAcks completes pending Acks as the backend reports them, and
+// returns once none is left. Between sweeps it waits for the oldest
+// Ack's result, a new Ack, or the backend's next change of state; a
+// backend that cannot report one is polled every sendPoll.
+func (c *Conn) collectAcks() {
+	k := &c.acks
+	for {
+		ready := c.ready()
+		k.mu.Lock()
+		k.pending = slices.DeleteFunc(k.pending, (*Ack).poll)
+		if len(k.pending) == 0 {
+			k.running = false
+			k.mu.Unlock()
+			return
+		}
+		oldest := k.pending[0]
+		k.mu.Unlock()
+
+		var poll *time.Timer
+		var polled <-chan time.Time
+		if ready == nil {
+			poll = time.NewTimer(sendPoll)
+			polled = poll.C
+		}
+		select {
+		case err := <-oldest.result:
+			oldest.finish(err)
+		case <-ready:
+		case <-polled:
+		case <-k.added:
+		}
+		if poll != nil {
+			poll.Stop()
+		}
+	}
+}
+
+// poll completes a if the backend has reported its result, and
+// reports whether a is complete. Only the collector calls it.
+func (a *Ack) poll() bool {
+	select {
+	case <-a.done:
+		return true
+	default:
+	}
+	select {
+	case err := <-a.result:
+		a.finish(err)
+		return true
+	default:
+		return false
+	}
+}
+
+func (a *Ack) finish(err error) {
+	a.err = err
+	close(a.done)
+}
+
+// Done returns a channel that is closed when the write completes.
+func (a *Ack) Done() <-chan struct{} {
+	return a.done
+}
+
+// Err returns nil if the peer acknowledged delivery, or why it did
+// not, as an [*OpError]. A peer that answered with a POOL error code is
+// reported with the [poolioc.WireError] as its cause, which matches the
+// sentinel for the code, such as [ErrOverload]. Err returns nil until
+// Done is closed.
+func (a *Ack) Err() error {
+	select {
+	case <-a.done:
+		return a.conn.opError("write", a.err)
+	default:
+		return nil
+	}
+}
+
+// Wait blocks until the write completes and returns [Ack.Err], or
+// returns the context's error if ctx is done first. The write itself
+// is not cancelled.
+func (a *Ack) Wait(ctx context.Context) error {
+	return a.conn.opError("write", a.wait(ctx))
+}
+
+func (a *Ack) wait(ctx context.Context) error {
+	select {
+	case <-a.done:
+		return a.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sendAcked sends data on ch with FlagRequireAck as [Conn.send] sends
+// other writes, compressed if ch has compression on. A backend that
+// does not implement [poolioc.AckBackend] cannot report delivery.
+func (c *Conn) sendAcked(ctx context.Context, ch uint8, data []byte) (*Ack, error) {
+	ab, ok := c.dev.(poolioc.AckBackend)
+	if !ok {
+		return nil, fmt.Errorf("pool: backend cannot acknowledge delivery: %w", errors.ErrUnsupported)
+	}
+	var result <-chan error
+	err := c.sendWith(ctx, ch, PriorityDefault, 0, data, func(ctx context.Context, flags uint8, b []byte) (err error) {
+		result, err = ab.SendAcked(ctx, c.sessionIdx, ch, flags, b)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.newAck(result), nil
+}
+
+// WriteAsync sends b as one message with FlagRequireAck and returns
+// once it is queued, without waiting for the peer. The returned Ack
+// completes when the peer acknowledges delivery, so many acknowledged
+// writes can be in flight at once. The message must fit in a single
+// backend message (see [ErrMessageTooLarge]). Delivery is reported by
+// the pooludp backend (POOL_BACKEND=udp) only: on /dev/pool, whose
+// kernel module does not pass acknowledgements to userspace, WriteAsync
+// fails with an error wrapping [errors.ErrUnsupported]. The write
+// deadline applies to queueing only.
+func (c *Conn) WriteAsync(ctx context.Context, b []byte) (*Ack, error) {
+	if c.isClosed() {
+		return nil, ErrClosed
+	}
+	wctx, stop := c.writeDeadline.merge(ctx)
+	defer stop()
+	a, err := c.sendAcked(wctx, c.channel, b)
+	return a, c.ioError("write", err, &c.writeDeadline)
+}
+
+// WriteAcked is like [Conn.WriteAsync] but waits for the peer to
+// acknowledge delivery. If the peer reports a POOL error code for the
+// message, it fails with an [*OpError] whose cause is the
+// [poolioc.WireError]. The write deadline applies
+// to the whole call.
+func (c *Conn) WriteAcked(ctx context.Context, b []byte) error {
+	if c.isClosed() {
+		return ErrClosed
+	}
+	wctx, stop := c.writeDeadline.merge(ctx)
+	defer stop()
+	a, err := c.sendAcked(wctx, c.channel, b)
+	if err == nil {
+		err = a.wait(wctx)
+	}
+	return c.ioError("write", err, &c.writeDeadline)
+}
+
+// WriteAsync is like [Conn.WriteAsync] on this channel.
+func (cc *ChannelConn) WriteAsync(ctx context.Context, b []byte) (*Ack, error) {
+	if cc.isClosed() {
+		return nil, ErrClosed
+	}
+	wctx, stop := cc.writeDeadline.merge(ctx)
+	defer stop()
+	a, err := cc.conn.sendAcked(wctx, cc.channel, b)
+	return a, cc.ioError("write", err, &cc.writeDeadline)
+}
+
+// WriteAcked is like [Conn.WriteAcked] on this channel.
+func (cc *ChannelConn) WriteAcked(ctx context.Context, b []byte) error {
+	if cc.isClosed() {
+		return ErrClosed
+	}
+	wctx, stop := cc.writeDeadline.merge(ctx)
+	defer stop()
+	a, err := cc.conn.sendAcked(wctx, cc.channel, b)
+	if err == nil {
+		err = a.wait(wctx)
+	}
+	return cc.ioError("write", err, &cc.writeDeadline)
+}
@@ -3,6 +3,7 @@
 package pool
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"syscall"
@@ -48,30 +49,93 @@ func (a *Addr) PeerAddrBytes() [16]byte {
 
 // ResolveAddr parses an address string into an Addr.
 // The address can be "host:port" where host is an IPv4 address, an IPv6
-// address (with or without brackets), or a hostname.
+// address (with or without brackets), or a hostname. An empty host
+// resolves to the unspecified address.
+//
+// The network selects the address family: "pool4" accepts only IPv4
+// addresses, "pool6" only IPv6 addresses and "pool" either. For a
+// hostname, the first suitable address is returned.
 func ResolveAddr(network, address string) (*Addr, error) {
+	addrs, err := resolveAddrs(context.Background(), nil, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return addrs[0], nil
+}
+
+// resolveAddrs resolves address into every suitable Addr for network,
+// in the order returned by the resolver r (net.DefaultResolver if nil).
+func resolveAddrs(ctx context.Context, r *net.Resolver, network, address string) ([]*Addr, error) {
+	ipNet, err := ipNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		r = net.DefaultResolver
+	}
+
 	host, portStr, err := net.SplitHostPort(address)
 	if err != nil {
 		return nil, fmt.Errorf("pool: invalid address %q: %w", address, err)
 	}
 
-	port, err := net.LookupPort("tcp", portStr)
+	port, err := r.LookupPort(ctx, "tcp", portStr)
 	if err != nil {
 		return nil, fmt.Errorf("pool: invalid port %q: %w", portStr, err)
 	}
 
-	ip := net.ParseIP(host)
-	if ip == nil {
+	var ips []net.IP
+	switch ip := net.ParseIP(host); {
+	case host == "":
+		if ipNet == "ip4" {
+			ips = []net.IP{net.IPv4zero}
+		} else {
+			ips = []net.IP{net.IPv6unspecified}
+		}
+	case ip != nil:
+		ips = []net.IP{ip}
+	default:
 		// Hostname — resolve it
-		addrs, err := net.LookupIP(host)
+		ips, err = r.LookupIP(ctx, ipNet, host)
 		if err != nil {
 			return nil, fmt.Errorf("pool: cannot resolve %q: %w", host, err)
 		}
-		if len(addrs) == 0 {
-			return nil, fmt.Errorf("pool: no addresses for %q", host)
+	}
+
+	addrs := make([]*Addr, 0, len(ips))
+	for _, ip := range ips {
+		if matchesNetwork(ipNet, ip) {
+			addrs = append(addrs, &Addr{IP: ip, Port: port})
 		}
-		ip = addrs[0]
 	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("pool: no suitable address found for %q on network %q", host, network)
+	}
+	return addrs, nil
+}
+
+// ipNetwork maps a POOL network name to the IP network used for lookups.
+func ipNetwork(network string) (string, error) {
+	switch network {
+	case "pool":
+		return "ip", nil
+	case "pool4":
+		return "ip4", nil
+	case "pool6":
+		return "ip6", nil
+	default:
+		return "", fmt.Errorf("pool: unsupported network %q", network)
+	}
+}
 
-	return &Addr{IP: ip, Port: port}, nil
+// matchesNetwork reports whether ip belongs to the family of ipNet.
+func matchesNetwork(ipNet string, ip net.IP) bool {
+	switch ipNet {
+	case "ip4":
+		return ip.To4() != nil
+	case "ip6":
+		return ip.To4() == nil
+	default:
+		return true
+	}
 }
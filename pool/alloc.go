@@ -0,0 +1,134 @@
+//go:build linux
+
+package pool
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/amosdavis/pool-go/poolioc"
+)
+
+// ChannelRange is a block of channels reserved on a Conn with
+// [Conn.ReserveChannels]. [Conn.AllocateChannel] never picks a channel
+// in a reserved block; the block's own Allocate does.
+type ChannelRange struct {
+	conn        *Conn
+	first, last uint8
+}
+
+// allocator holds the reserved ranges of a Conn and serializes
+// allocations. Its zero value is ready to use.
+type allocator struct {
+	mu     sync.Mutex
+	ranges []*ChannelRange
+}
+
+// Channels returns the channels subscribed on the session.
+func (c *Conn) Channels() (poolioc.ChannelSet, error) {
+	bitmap, err := c.dev.ChannelList(c.sessionIdx)
+	if err != nil {
+		return poolioc.ChannelSet{}, c.opError("channels", err)
+	}
+	return poolioc.ChannelSet(bitmap), nil
+}
+
+// allocate opens a ChannelConn on the lowest channel from first to last
+// that is neither in use nor reserved by a range other than owner.
+func (c *Conn) allocate(first, last uint8, owner *ChannelRange) (*ChannelConn, error) {
+	c.alloc.mu.Lock()
+	defer c.alloc.mu.Unlock()
+
+	if c.isClosed() {
+		return nil, ErrClosed
+	}
+	if owner != nil && !slices.Contains(c.alloc.ranges, owner) {
+		return nil, ErrClosed
+	}
+	used, err := c.Channels()
+	if err != nil {
+		return nil, err
+	}
+	used.Add(c.channel)
+	c.demux.known(&used)
+	for _, r := range c.alloc.ranges {
+		if r == owner {
+			continue
+		}
+		for ch := int(r.first); ch <= int(r.last); ch++ {
+			used.Add(uint8(ch))
+		}
+	}
+	for ch := int(first); ch <= int(last); ch++ {
+		if !used.Has(uint8(ch)) {
+			return c.OpenChannel(uint8(ch))
+		}
+	}
+	return nil, ErrNoFreeChannel
+}
+
+// AllocateChannel opens a [ChannelConn] on a channel that is free: not
+// subscribed on the session, not open on the Conn, and not in a range
+// reserved with [Conn.ReserveChannels]. Allocations on a Conn are
+// serialized, so concurrent callers never get the same channel; the
+// channel is free again once the ChannelConn is closed. It fails with
+// [ErrNoFreeChannel] if there is none.
+//
+// Channels opened with [Conn.OpenChannel] by number are seen as used,
+// but are not kept from an allocation that happens at the same time.
+func (c *Conn) AllocateChannel() (*ChannelConn, error) {
+	return c.allocate(0, poolioc.MaxChannels-1, nil)
+}
+
+// ReserveChannels reserves the channels from first to last inclusive,
+// so that AllocateChannel leaves them to the returned range. It fails
+// with [ErrChannelsReserved] if any of them is already reserved.
+// Channels already open in the block stay open.
+func (c *Conn) ReserveChannels(first, last uint8) (*ChannelRange, error) {
+	if first > last {
+		return nil, fmt.Errorf("pool: reserve channels %d-%d: empty range", first, last)
+	}
+	c.alloc.mu.Lock()
+	defer c.alloc.mu.Unlock()
+
+	if c.isClosed() {
+		return nil, ErrClosed
+	}
+	for _, r := range c.alloc.ranges {
+		if first <= r.last && r.first <= last {
+			return nil, fmt.Errorf("pool: reserve channels %d-%d: %w (%d-%d)", first, last, ErrChannelsReserved, r.first, r.last)
+		}
+	}
+	r := &ChannelRange{conn: c, first: first, last: last}
+	c.alloc.ranges = append(c.alloc.ranges, r)
+	return r, nil
+}
+
+// First returns the first channel of the range.
+func (r *ChannelRange) First() uint8 { return r.first }
+
+// Last returns the last channel of the range.
+func (r *ChannelRange) Last() uint8 { return r.last }
+
+// Contains reports whether ch is in the range.
+func (r *ChannelRange) Contains(ch uint8) bool {
+	return r.first <= ch && ch <= r.last
+}
+
+// Allocate is like [Conn.AllocateChannel] but picks a channel in the
+// range. It fails with [ErrClosed] once the range is released.
+func (r *ChannelRange) Allocate() (*ChannelConn, error) {
+	return r.conn.allocate(r.first, r.last, r)
+}
+
+// Release gives the channels of the range back to AllocateChannel.
+// ChannelConns allocated from it stay open.
+func (r *ChannelRange) Release() {
+	a := &r.conn.alloc
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if i := slices.Index(a.ranges, r); i >= 0 {
+		a.ranges = slices.Delete(a.ranges, i, i+1)
+	}
+}
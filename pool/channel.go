@@ -3,69 +3,128 @@
 package pool
 
 import (
+	"context"
 	"net"
 	"sync"
 	"time"
-
-	"github.com/amosdavis/pool-go/poolioc"
 )
 
 // ChannelConn wraps a [Conn] to operate on a specific POOL channel.
 // It implements [net.Conn]. The channel is subscribed on creation and
-// unsubscribed on Close.
+// unsubscribed on Close, except for channels accepted with
+// [Conn.AcceptChannel], which are subscribed only with
+// [DemuxConfig.AutoSubscribe].
+//
+// A ChannelConn has deadlines of its own, independent of those of its
+// Conn and of other channels.
 type ChannelConn struct {
 	conn    *Conn
 	channel uint8
 
-	mu     sync.Mutex
-	closed bool
+	mu         sync.Mutex
+	closed     bool
+	subscribed bool // unsubscribe on Close
+
+	readDeadline  deadline
+	writeDeadline deadline
+
+	in   *streamReader
+	msgs framer
 }
 
 // OpenChannel subscribes to a channel on an existing Conn and returns
 // a [ChannelConn] for reading and writing on that channel.
 func (c *Conn) OpenChannel(channel uint8) (*ChannelConn, error) {
 	if err := c.dev.ChannelSubscribe(c.sessionIdx, channel); err != nil {
-		return nil, mapErrno(err)
+		return nil, c.opError("subscribe", err)
 	}
-	return &ChannelConn{
-		conn:    c,
-		channel: channel,
-	}, nil
+	c.demux.open(channel)
+	return c.newChannelConn(channel, true), nil
 }
 
-// Read reads data from this channel.
-func (cc *ChannelConn) Read(b []byte) (int, error) {
+// newChannelConn returns a ChannelConn on a channel already recorded
+// as open with the demultiplexer.
+func (c *Conn) newChannelConn(channel uint8, subscribed bool) *ChannelConn {
+	cc := &ChannelConn{
+		conn:          c,
+		channel:       channel,
+		subscribed:    subscribed,
+		readDeadline:  makeDeadline(),
+		writeDeadline: makeDeadline(),
+		in:            newStreamReader(ReadMode(c.in.mode.Load())),
+	}
+	cc.msgs.max.Store(c.msgs.max.Load())
+	return cc
+}
+
+// ioError is like [Conn.ioError] for this channel.
+func (cc *ChannelConn) ioError(op string, err error, dl *deadline) error {
+	if err == nil {
+		return nil
+	}
+	if cc.isClosed() {
+		return ErrClosed
+	}
+	if err := dl.shutErr(); err != nil {
+		return err
+	}
+	if dl.expired() {
+		err = &timeoutError{}
+	}
+	return cc.conn.opError(op, err)
+}
+
+// isClosed reports whether Close has been called.
+func (cc *ChannelConn) isClosed() bool {
 	cc.mu.Lock()
-	if cc.closed {
-		cc.mu.Unlock()
+	defer cc.mu.Unlock()
+	return cc.closed
+}
+
+// Read reads data from this channel, honoring its read mode as
+// [Conn.Read] does.
+func (cc *ChannelConn) Read(b []byte) (int, error) {
+	return cc.ReadContext(context.Background(), b)
+}
+
+// ReadContext is like [ChannelConn.Read] but also returns when ctx is
+// done, with ctx.Err(). The read deadline still applies.
+func (cc *ChannelConn) ReadContext(ctx context.Context, b []byte) (int, error) {
+	if cc.isClosed() {
 		return 0, ErrClosed
 	}
-	cc.mu.Unlock()
 
-	n, err := cc.conn.dev.RecvBytes(cc.conn.sessionIdx, cc.channel, b)
-	return n, mapErrno(err)
+	rctx, stop := cc.readDeadline.merge(ctx)
+	defer stop()
+	n, err := cc.in.read(rctx, func(ctx context.Context, b []byte) (int, error) {
+		info, err := cc.conn.recv(ctx, cc.channel, b)
+		return info.Len, err
+	}, b)
+	return n, cc.ioError("read", err, &cc.readDeadline)
 }
 
 // Write writes data to this channel.
 func (cc *ChannelConn) Write(b []byte) (int, error) {
-	cc.mu.Lock()
-	if cc.closed {
-		cc.mu.Unlock()
-		return 0, ErrClosed
-	}
-	cc.mu.Unlock()
+	return cc.WriteContext(context.Background(), b)
+}
 
-	if len(b) > poolioc.MaxPayload {
-		return 0, ErrMessageTooLarge
+// WriteContext is like [ChannelConn.Write] but also returns when ctx is
+// done, with ctx.Err(). The write deadline still applies.
+func (cc *ChannelConn) WriteContext(ctx context.Context, b []byte) (int, error) {
+	if cc.isClosed() {
+		return 0, ErrClosed
 	}
 
-	if err := cc.conn.dev.SendBytes(cc.conn.sessionIdx, cc.channel, b); err != nil {
-		return 0, mapErrno(err)
+	wctx, stop := cc.writeDeadline.merge(ctx)
+	defer stop()
+	if err := cc.conn.send(wctx, cc.channel, PriorityDefault, 0, b); err != nil {
+		return 0, cc.ioError("write", err, &cc.writeDeadline)
 	}
 	return len(b), nil
 }
 
 // Close unsubscribes from the channel. The underlying session is NOT closed.
+// A channel accepted without subscribing is left as it is.
 func (cc *ChannelConn) Close() error {
 	cc.mu.Lock()
 	defer cc.mu.Unlock()
@@ -74,24 +133,41 @@ func (cc *ChannelConn) Close() error {
 		return ErrClosed
 	}
 	cc.closed = true
+	cc.conn.demux.release(cc.channel)
 
-	return mapErrno(cc.conn.dev.ChannelUnsubscribe(cc.conn.sessionIdx, cc.channel))
+	if !cc.subscribed {
+		return nil
+	}
+	return cc.conn.opError("close", cc.conn.dev.ChannelUnsubscribe(cc.conn.sessionIdx, cc.channel))
 }
 
 // LocalAddr returns the local address.
-func (cc *ChannelConn) LocalAddr() net.Addr  { return cc.conn.LocalAddr() }
+func (cc *ChannelConn) LocalAddr() net.Addr { return cc.conn.LocalAddr() }
 
 // RemoteAddr returns the remote peer address.
 func (cc *ChannelConn) RemoteAddr() net.Addr { return cc.conn.RemoteAddr() }
 
-// SetDeadline is not supported on ChannelConn; use the parent Conn.
-func (cc *ChannelConn) SetDeadline(t time.Time) error      { return nil }
+// SetDeadline sets both read and write deadlines for this channel.
+// Like [net.Conn], the deadline also applies to pending calls; an
+// expired deadline fails them with a [net.Error] whose Timeout method
+// reports true.
+func (cc *ChannelConn) SetDeadline(t time.Time) error {
+	cc.readDeadline.set(t)
+	cc.writeDeadline.set(t)
+	return nil
+}
 
-// SetReadDeadline is not supported on ChannelConn; use the parent Conn.
-func (cc *ChannelConn) SetReadDeadline(t time.Time) error   { return nil }
+// SetReadDeadline sets the deadline for reads on this channel.
+func (cc *ChannelConn) SetReadDeadline(t time.Time) error {
+	cc.readDeadline.set(t)
+	return nil
+}
 
-// SetWriteDeadline is not supported on ChannelConn; use the parent Conn.
-func (cc *ChannelConn) SetWriteDeadline(t time.Time) error  { return nil }
+// SetWriteDeadline sets the deadline for writes on this channel.
+func (cc *ChannelConn) SetWriteDeadline(t time.Time) error {
+	cc.writeDeadline.set(t)
+	return nil
+}
 
 // Channel returns the channel number.
 func (cc *ChannelConn) Channel() uint8 { return cc.channel }
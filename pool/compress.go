@@ -0,0 +1,491 @@
+//go:build linux
+
+package pool
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/lzw"
+	"compress/zlib"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"syscall"
+
+	"github.com/amosdavis/pool-go/poolioc"
+)
+
+// Compression is a payload codec from the standard library.
+type Compression uint8
+
+const (
+	CompressNone  Compression = iota
+	CompressFlate             // compress/flate, default level
+	CompressGzip              // compress/gzip
+	CompressZlib              // compress/zlib
+	CompressLZW               // compress/lzw, LSB order, 8-bit literals
+)
+
+var compressionNames = [...]string{
+	CompressNone:  "none",
+	CompressFlate: "flate",
+	CompressGzip:  "gzip",
+	CompressZlib:  "zlib",
+	CompressLZW:   "lzw",
+}
+
+func (z Compression) String() string {
+	if int(z) < len(compressionNames) {
+		return compressionNames[z]
+	}
+	return fmt.Sprintf("Compression(%d)", uint8(z))
+}
+
+func (z Compression) valid() bool {
+	return z > CompressNone && z <= CompressLZW
+}
+
+// A message sent with FlagCompressed starts with an opcode: a codec
+// ID followed by the message compressed with that codec, or one of the
+// negotiation messages below, which the demultiplexer or Read consumes.
+const (
+	opOffer  = 0x80 // followed by the codecs the sender may use, preferred first
+	opAnswer = 0x81 // followed by the codec the receiver chose, or CompressNone
+)
+
+// CompressionStats counts the compression of a channel's messages, or
+// of all a Conn's channels.
+type CompressionStats struct {
+	Codec Compression // codec writes use, CompressNone if off or not yet agreed
+
+	Compressed uint64 // messages sent compressed
+	Skipped    uint64 // messages sent as is because compressing did not help
+	BytesIn    uint64 // size of the messages sent compressed
+	BytesOut   uint64 // size they were sent as
+
+	Decompressed uint64 // compressed messages received
+	BytesRecv    uint64 // size they were received as
+	BytesDecoded uint64 // size they decompressed to
+}
+
+// Ratio returns the compressed size of the messages sent compressed as
+// a fraction of their original size, or 1 if none were.
+func (s CompressionStats) Ratio() float64 {
+	if s.BytesIn == 0 {
+		return 1
+	}
+	return float64(s.BytesOut) / float64(s.BytesIn)
+}
+
+func (s *CompressionStats) add(o CompressionStats) {
+	s.Compressed += o.Compressed
+	s.Skipped += o.Skipped
+	s.BytesIn += o.BytesIn
+	s.BytesOut += o.BytesOut
+	s.Decompressed += o.Decompressed
+	s.BytesRecv += o.BytesRecv
+	s.BytesDecoded += o.BytesDecoded
+}
+
+// codecState is the compression state of one channel.
+type codecState struct {
+	prefs   []Compression // codecs to offer, preferred first; nil if off
+	offered bool
+	answer  []byte           // answer to the peer's offer, not yet sent
+	stats   CompressionStats // stats.Codec is the codec writes use
+
+	held     []byte // decompressed message too large for the last read
+	heldInfo poolioc.MsgInfo
+}
+
+// choose picks a codec from an offer: our most preferred one offered
+// if we have preferences, else the first we know.
+func (cs *codecState) choose(offer []byte) Compression {
+	if cs.prefs != nil {
+		for _, c := range cs.prefs {
+			if bytes.IndexByte(offer, byte(c)) >= 0 {
+				return c
+			}
+		}
+		return CompressNone
+	}
+	for _, b := range offer {
+		if c := Compression(b); c.valid() {
+			return c
+		}
+	}
+	return CompressNone
+}
+
+// compressor holds the compression state of a Conn's channels. Its
+// zero value is ready to use.
+type compressor struct {
+	mu    sync.Mutex
+	chans map[uint8]*codecState
+}
+
+// state returns the state of ch. z.mu must be held.
+func (z *compressor) state(ch uint8) *codecState {
+	if z.chans == nil {
+		z.chans = make(map[uint8]*codecState)
+	}
+	cs, ok := z.chans[ch]
+	if !ok {
+		cs = &codecState{}
+		z.chans[ch] = cs
+	}
+	return cs
+}
+
+func (z *compressor) set(ch uint8, codecs []Compression) error {
+	codecs = slices.DeleteFunc(slices.Clone(codecs), func(c Compression) bool { return c == CompressNone })
+	for _, c := range codecs {
+		if !c.valid() {
+			return fmt.Errorf("pool: unknown compression %v", c)
+		}
+	}
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	cs := z.state(ch)
+	cs.prefs, cs.offered, cs.stats.Codec = nil, false, CompressNone
+	if len(codecs) > 0 {
+		cs.prefs = codecs
+	}
+	return nil
+}
+
+// pending returns the negotiation messages waiting to be sent on ch:
+// our answer to the peer's offer and our own offer, either nil.
+func (z *compressor) pending(ch uint8) (answer, offer []byte) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	cs := z.state(ch)
+	if cs.prefs != nil && !cs.offered {
+		offer = []byte{opOffer}
+		for _, c := range cs.prefs {
+			offer = append(offer, byte(c))
+		}
+	}
+	return cs.answer, offer
+}
+
+// sent records that the negotiation message b, from pending, was sent
+// on ch.
+func (z *compressor) sent(ch uint8, b []byte) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	cs := z.state(ch)
+	switch b[0] {
+	case opOffer:
+		cs.offered = true
+	case opAnswer:
+		if bytes.Equal(cs.answer, b) {
+			cs.answer = nil
+		}
+	}
+}
+
+// control applies a codec offer or answer received on ch. It reports
+// whether payload was one, and whether an answer is now waiting to be
+// sent. A malformed one is left to decode, which rejects it.
+func (z *compressor) control(ch uint8, payload []byte) (ok, answer bool) {
+	if len(payload) == 0 {
+		return false, false
+	}
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	cs := z.state(ch)
+
+	switch payload[0] {
+	case opOffer:
+		cs.answer = []byte{opAnswer, byte(cs.choose(payload[1:]))}
+		return true, true
+	case opAnswer:
+		if len(payload) != 2 {
+			return false, false
+		}
+		if c := Compression(payload[1]); c == CompressNone || slices.Contains(cs.prefs, c) {
+			cs.stats.Codec = c
+		}
+		return true, false
+	}
+	return false, false
+}
+
+// compress returns data compressed with the codec of ch, or nil if
+// compression is off or would not make data smaller. tried reports
+// whether compression was on, so that the message counts in the stats
+// once it is sent.
+func (z *compressor) compress(ch uint8, data []byte) (out []byte, tried bool) {
+	z.mu.Lock()
+	codec := z.state(ch).stats.Codec
+	z.mu.Unlock()
+	if codec == CompressNone || len(data) == 0 {
+		return nil, false
+	}
+	out = encode(codec, data)
+	if out == nil || len(out) >= len(data) {
+		return nil, true
+	}
+	return out, true
+}
+
+// counted records in the stats of ch a sent message of n bytes, which
+// went out compressed as out, or as is if out is nil.
+func (z *compressor) counted(ch uint8, n int, out []byte) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	st := &z.state(ch).stats
+	if out == nil {
+		st.Skipped++
+		return
+	}
+	st.Compressed++
+	st.BytesIn += uint64(n)
+	st.BytesOut += uint64(len(out))
+}
+
+// decode decompresses a message received with FlagCompressed.
+func (z *compressor) decode(ch uint8, payload []byte) ([]byte, error) {
+	if len(payload) == 0 || !Compression(payload[0]).valid() {
+		return nil, ErrBadMessage
+	}
+	data, err := decode(Compression(payload[0]), payload[1:])
+	if err != nil {
+		return nil, err
+	}
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	st := &z.state(ch).stats
+	st.Decompressed++
+	st.BytesRecv += uint64(len(payload))
+	st.BytesDecoded += uint64(len(data))
+	return data, nil
+}
+
+// hold keeps a decompressed message that did not fit the reader's
+// buffer for the next read.
+func (z *compressor) hold(ch uint8, data []byte, info poolioc.MsgInfo) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	cs := z.state(ch)
+	cs.held, cs.heldInfo = data, info
+}
+
+// takeHeld copies a held message into buf. It reports false if there
+// is none.
+func (z *compressor) takeHeld(ch uint8, buf []byte) (poolioc.MsgInfo, bool, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	cs, ok := z.chans[ch]
+	if !ok || cs.held == nil {
+		return poolioc.MsgInfo{}, false, nil
+	}
+	if len(cs.held) > len(buf) {
+		return poolioc.MsgInfo{}, true, syscall.EMSGSIZE
+	}
+	info := cs.heldInfo
+	info.Len = copy(buf, cs.held)
+	cs.held = nil
+	return info, true, nil
+}
+
+func (z *compressor) stats(ch uint8) CompressionStats {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.state(ch).stats
+}
+
+func (z *compressor) total() CompressionStats {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	var t CompressionStats
+	for _, cs := range z.chans {
+		t.add(cs.stats)
+	}
+	return t
+}
+
+// maxDecoded bounds the size of a decompressed message.
+const maxDecoded = DefaultMaxMessageSize
+
+// writers reuses flate, gzip and zlib writers, which are costly to
+// allocate.
+var writers [CompressLZW + 1]sync.Pool
+
+// encode returns data compressed with codec, behind its opcode.
+func encode(codec Compression, data []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(byte(codec))
+	var w io.WriteCloser
+	switch codec {
+	case CompressFlate:
+		if fw, ok := writers[codec].Get().(*flate.Writer); ok {
+			fw.Reset(&buf)
+			w = fw
+		} else {
+			w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+		}
+	case CompressGzip:
+		if gw, ok := writers[codec].Get().(*gzip.Writer); ok {
+			gw.Reset(&buf)
+			w = gw
+		} else {
+			w = gzip.NewWriter(&buf)
+		}
+	case CompressZlib:
+		if zw, ok := writers[codec].Get().(*zlib.Writer); ok {
+			zw.Reset(&buf)
+			w = zw
+		} else {
+			w = zlib.NewWriter(&buf)
+		}
+	case CompressLZW:
+		w = lzw.NewWriter(&buf, lzw.LSB, 8)
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil
+	}
+	if err := w.Close(); err != nil {
+		return nil
+	}
+	if codec != CompressLZW {
+		writers[codec].Put(w)
+	}
+	return buf.Bytes()
+}
+
+// decode decompresses b with codec.
+func decode(codec Compression, b []byte) ([]byte, error) {
+	var r io.Reader
+	var err error
+	src := bytes.NewReader(b)
+	switch codec {
+	case CompressFlate:
+		r = flate.NewReader(src)
+	case CompressGzip:
+		r, err = gzip.NewReader(src)
+	case CompressZlib:
+		r, err = zlib.NewReader(src)
+	case CompressLZW:
+		r = lzw.NewReader(src, lzw.LSB, 8)
+	}
+	if err != nil {
+		return nil, ErrBadMessage
+	}
+	data, err := io.ReadAll(io.LimitReader(r, maxDecoded+1))
+	if err != nil || len(data) > maxDecoded {
+		return nil, ErrBadMessage
+	}
+	return data, nil
+}
+
+// recv receives one message on ch, decompressing messages sent with
+// FlagCompressed and taking in codec offers and answers that the
+// demultiplexer has not. A decompressed message that does not fit buf
+// is kept for the next call, which fails with EMSGSIZE until buf is
+// large enough, as a backend would.
+func (c *Conn) recv(ctx context.Context, ch uint8, buf []byte) (poolioc.MsgInfo, error) {
+	if info, ok, err := c.comp.takeHeld(ch, buf); ok {
+		return info, err
+	}
+	for {
+		info, err := c.receive(ctx, ch, buf)
+		if err != nil || info.Flags&poolioc.FlagCompressed == 0 {
+			return info, err
+		}
+		if c.control(ch, buf[:info.Len]) {
+			continue
+		}
+		data, err := c.comp.decode(ch, buf[:info.Len])
+		if err != nil {
+			return poolioc.MsgInfo{}, err
+		}
+		if len(data) > len(buf) {
+			c.comp.hold(ch, data, info)
+			return poolioc.MsgInfo{}, syscall.EMSGSIZE
+		}
+		info.Len = copy(buf, data)
+		return info, nil
+	}
+}
+
+// control takes in a codec offer or answer received on ch, reporting
+// false if payload is neither. The answer to an offer is sent by a
+// goroutine of its own, so that a read never waits on a write, unless
+// a write on ch sends it first. The goroutine gives up once the Conn
+// is closed.
+func (c *Conn) control(ch uint8, payload []byte) bool {
+	ok, answer := c.comp.control(ch, payload)
+	if answer {
+		go func() {
+			_ = c.schedule(c.ctx, ch, PriorityDefault, 0, func(ctx context.Context, flags uint8) error {
+				return c.negotiate(ctx, ch, flags)
+			})
+		}()
+	}
+	return ok
+}
+
+// negotiate sends the negotiation messages pending on ch, ahead of the
+// message being written, if any. It runs in the scheduler's turn.
+func (c *Conn) negotiate(ctx context.Context, ch uint8, flags uint8) error {
+	answer, offer := c.comp.pending(ch)
+	for _, b := range [][]byte{answer, offer} {
+		if b == nil {
+			continue
+		}
+		if err := sendMsg(ctx, c.dev, c.sessionIdx, ch, flags|poolioc.FlagCompressed, b); err != nil {
+			return err
+		}
+		c.comp.sent(ch, b)
+	}
+	return nil
+}
+
+// SetCompression enables compression of the messages written on the
+// Conn's channel, offering the peer the given codecs in order of
+// preference. With no codecs, or only CompressNone, it turns
+// compression off. The backend must carry message flags (see
+// [poolioc.MessageBackend]); otherwise SetCompression fails with an
+// error wrapping [errors.ErrUnsupported].
+//
+// With its next message on the channel, the Conn offers its codecs;
+// the peer answers with its choice, and messages are sent as is until
+// the answer is in. The answer is taken in by the demultiplexer if it
+// is running (see [Conn.StartDemux]), or else by the next read on the
+// channel. Compressed messages are sent with FlagCompressed; a message
+// that would not get smaller is sent as is.
+func (c *Conn) SetCompression(codecs ...Compression) error {
+	return c.setCompression(c.channel, codecs)
+}
+
+func (c *Conn) setCompression(ch uint8, codecs []Compression) error {
+	if _, ok := c.dev.(poolioc.MessageBackend); !ok {
+		return fmt.Errorf("pool: backend cannot send compressed messages: %w", errors.ErrUnsupported)
+	}
+	return c.comp.set(ch, codecs)
+}
+
+// CompressionStats reports compression across all the Conn's
+// channels, to read alongside [Conn.Telemetry]. Codec is that of the
+// Conn's own channel.
+func (c *Conn) CompressionStats() CompressionStats {
+	t := c.comp.total()
+	t.Codec = c.comp.stats(c.channel).Codec
+	return t
+}
+
+// SetCompression is like [Conn.SetCompression] for this channel.
+func (cc *ChannelConn) SetCompression(codecs ...Compression) error {
+	return cc.conn.setCompression(cc.channel, codecs)
+}
+
+// CompressionStats reports compression on this channel.
+func (cc *ChannelConn) CompressionStats() CompressionStats {
+	return cc.conn.comp.stats(cc.channel)
+}
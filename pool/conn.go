@@ -3,6 +3,9 @@
 package pool
 
 import (
+	"context"
+	"errors"
+	"io"
 	"net"
 	"sync"
 	"time"
@@ -15,124 +18,168 @@ import (
 // All methods are safe for concurrent use. Read and Write operate on
 // the default channel (0). Use [Conn.OpenChannel] for multi-channel I/O.
 type Conn struct {
-	dev        *poolioc.Device
+	dev        poolioc.Backend
+	release    func() // drops the Conn's reference to dev
 	sessionIdx uint32
 	localAddr  *Addr
 	remoteAddr *Addr
 	channel    uint8
 
-	mu           sync.Mutex
-	closed       bool
-	readDeadline  time.Time
-	writeDeadline time.Time
+	mu     sync.Mutex
+	closed bool
+
+	ctx  context.Context // done once the Conn is closed
+	stop context.CancelFunc
+
+	readDeadline  deadline
+	writeDeadline deadline
+
+	in    *streamReader
+	msgs  framer
+	sched scheduler
+	comp  compressor
+	acks  acker
+	demux demux
+	alloc allocator
 }
 
-// newConn creates a Conn from an established session.
-func newConn(dev *poolioc.Device, idx uint32, local, remote *Addr, ch uint8) *Conn {
+// newConn creates a Conn from an established session. Close calls
+// release once the session is closed.
+func newConn(dev poolioc.Backend, release func(), idx uint32, local, remote *Addr, ch uint8) *Conn {
+	ctx, stop := context.WithCancel(context.Background())
 	return &Conn{
-		dev:        dev,
-		sessionIdx: idx,
-		localAddr:  local,
-		remoteAddr: remote,
-		channel:    ch,
+		dev:           dev,
+		release:       release,
+		sessionIdx:    idx,
+		localAddr:     local,
+		remoteAddr:    remote,
+		channel:       ch,
+		ctx:           ctx,
+		stop:          stop,
+		readDeadline:  makeDeadline(),
+		writeDeadline: makeDeadline(),
+		in:            newStreamReader(StreamMode),
 	}
 }
 
 // Read reads data from the POOL session.
 // It implements [io.Reader].
+//
+// In [StreamMode], the default, a message larger than b is returned
+// over several reads. In [MessageMode], each read returns one message
+// and fails with [ErrBufferTooSmall] if b cannot hold it.
+//
+// Once the peer has closed its side, with [Conn.CloseWrite] or by
+// closing the session, and everything it sent has been read, Read
+// returns [io.EOF]. A peer that closed with a reason (see
+// [Conn.CloseWriteReason]) is reported as an [*OpError] wrapping a
+// [*poolioc.ShutdownError]. The kernel module does not report that the
+// peer closed the session, so on /dev/pool a session that has ended
+// fails reads with an [*OpError] wrapping ENOTCONN instead.
+//
+// The read waits on the device without a helper goroutine; when the read
+// deadline passes, the pending receive is abandoned and b is not written
+// to afterwards.
 func (c *Conn) Read(b []byte) (int, error) {
-	c.mu.Lock()
-	if c.closed {
-		c.mu.Unlock()
+	return c.ReadContext(context.Background(), b)
+}
+
+// ReadContext is like [Conn.Read] but also returns when ctx is done,
+// with ctx.Err(). The read deadline still applies.
+func (c *Conn) ReadContext(ctx context.Context, b []byte) (int, error) {
+	if c.isClosed() {
 		return 0, ErrClosed
 	}
-	deadline := c.readDeadline
-	c.mu.Unlock()
-
 	if len(b) == 0 {
 		return 0, nil
 	}
 
-	type result struct {
-		n   int
-		err error
-	}
-
-	ch := make(chan result, 1)
-	go func() {
-		n, err := c.dev.RecvBytes(c.sessionIdx, c.channel, b)
-		ch <- result{n, err}
-	}()
-
-	if !deadline.IsZero() {
-		timer := time.NewTimer(time.Until(deadline))
-		defer timer.Stop()
-
-		select {
-		case r := <-ch:
-			return r.n, mapErrno(r.err)
-		case <-timer.C:
-			return 0, &timeoutError{}
-		}
-	}
-
-	r := <-ch
-	return r.n, mapErrno(r.err)
+	rctx, stop := c.readDeadline.merge(ctx)
+	defer stop()
+	n, err := c.in.read(rctx, func(ctx context.Context, b []byte) (int, error) {
+		info, err := c.recv(ctx, c.channel, b)
+		return info.Len, err
+	}, b)
+	return n, c.ioError("read", err, &c.readDeadline)
 }
 
 // Write writes data to the POOL session.
 // It implements [io.Writer].
 func (c *Conn) Write(b []byte) (int, error) {
-	c.mu.Lock()
-	if c.closed {
-		c.mu.Unlock()
+	return c.WriteContext(context.Background(), b)
+}
+
+// WriteContext is like [Conn.Write] but also returns when ctx is done,
+// with ctx.Err(). The write deadline still applies.
+func (c *Conn) WriteContext(ctx context.Context, b []byte) (int, error) {
+	if c.isClosed() {
 		return 0, ErrClosed
 	}
-	deadline := c.writeDeadline
-	c.mu.Unlock()
-
 	if len(b) == 0 {
 		return 0, nil
 	}
 
-	if len(b) > poolioc.MaxPayload {
-		return 0, ErrMessageTooLarge
+	wctx, stop := c.writeDeadline.merge(ctx)
+	defer stop()
+	if err := c.send(wctx, c.channel, PriorityDefault, 0, b); err != nil {
+		return 0, c.ioError("write", err, &c.writeDeadline)
 	}
+	return len(b), nil
+}
 
-	type result struct {
-		err error
+// ioError maps an error from the operation op, a read or write.
+// Errors caused by a concurrent Close are reported as [ErrClosed] and
+// errors caused by an expired deadline as a timeout.
+func (c *Conn) ioError(op string, err error, dl *deadline) error {
+	if err == nil {
+		return nil
 	}
-
-	ch := make(chan result, 1)
-	go func() {
-		err := c.dev.SendBytes(c.sessionIdx, c.channel, b)
-		ch <- result{err}
-	}()
-
-	if !deadline.IsZero() {
-		timer := time.NewTimer(time.Until(deadline))
-		defer timer.Stop()
-
-		select {
-		case r := <-ch:
-			if r.err != nil {
-				return 0, mapErrno(r.err)
-			}
-			return len(b), nil
-		case <-timer.C:
-			return 0, &timeoutError{}
-		}
+	if c.isClosed() {
+		return ErrClosed
+	}
+	if err := dl.shutErr(); err != nil {
+		return err
 	}
+	if dl.expired() {
+		err = &timeoutError{}
+	}
+	return c.opError(op, err)
+}
 
-	r := <-ch
-	if r.err != nil {
-		return 0, mapErrno(r.err)
+// opError wraps an error from the operation op on the session in an
+// [OpError]. The end of a channel stays [io.EOF] and a closed device
+// [ErrClosed], as [io.Reader] and [net.Conn] callers expect, and a
+// context canceled by the caller is returned as is.
+func (c *Conn) opError(op string, err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case endOfStream(err):
+		return io.EOF
+	case sentinel(err) == ErrClosed:
+		return ErrClosed
+	case errors.Is(err, context.Canceled):
+		return err
 	}
-	return len(b), nil
+	return &OpError{
+		Op:      op,
+		Net:     "pool",
+		Source:  c.LocalAddr(),
+		Addr:    c.RemoteAddr(),
+		Session: int(c.sessionIdx),
+		Err:     err,
+	}
+}
+
+// isClosed reports whether Close has been called.
+func (c *Conn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
 }
 
-// Close closes the POOL session.
-// It implements [io.Closer].
+// Close closes the POOL session and releases the Conn's reference to
+// its device. It implements [io.Closer].
 func (c *Conn) Close() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -141,8 +188,12 @@ func (c *Conn) Close() error {
 		return ErrClosed
 	}
 	c.closed = true
+	c.stop()
+	c.demux.stop()
 
-	return mapErrno(c.dev.CloseSession(c.sessionIdx))
+	err := c.dev.CloseSession(c.sessionIdx)
+	c.release()
+	return c.opError("close", err)
 }
 
 // LocalAddr returns the local address.
@@ -159,27 +210,22 @@ func (c *Conn) RemoteAddr() net.Addr {
 }
 
 // SetDeadline sets both read and write deadlines.
+// Like [net.Conn], the deadline also applies to pending calls.
 func (c *Conn) SetDeadline(t time.Time) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.readDeadline = t
-	c.writeDeadline = t
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
 	return nil
 }
 
 // SetReadDeadline sets the deadline for Read calls.
 func (c *Conn) SetReadDeadline(t time.Time) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.readDeadline = t
+	c.readDeadline.set(t)
 	return nil
 }
 
 // SetWriteDeadline sets the deadline for Write calls.
 func (c *Conn) SetWriteDeadline(t time.Time) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.writeDeadline = t
+	c.writeDeadline.set(t)
 	return nil
 }
 
@@ -193,7 +239,7 @@ func (c *Conn) SessionIndex() uint32 {
 func (c *Conn) Telemetry() (*poolioc.Telemetry, error) {
 	sessions, err := c.dev.Sessions()
 	if err != nil {
-		return nil, mapErrno(err)
+		return nil, c.opError("telemetry", err)
 	}
 	for i := range sessions {
 		if sessions[i].Index == c.sessionIdx {
@@ -201,14 +247,14 @@ func (c *Conn) Telemetry() (*poolioc.Telemetry, error) {
 			return &t, nil
 		}
 	}
-	return nil, ErrNotEstablished
+	return nil, c.opError("telemetry", ErrNotEstablished)
 }
 
 // SessionInfo returns detailed session information.
 func (c *Conn) SessionInfo() (*poolioc.SessionInfo, error) {
 	sessions, err := c.dev.Sessions()
 	if err != nil {
-		return nil, mapErrno(err)
+		return nil, c.opError("session info", err)
 	}
 	for i := range sessions {
 		if sessions[i].Index == c.sessionIdx {
@@ -216,8 +262,59 @@ func (c *Conn) SessionInfo() (*poolioc.SessionInfo, error) {
 			return &info, nil
 		}
 	}
-	return nil, ErrNotEstablished
+	return nil, c.opError("session info", ErrNotEstablished)
 }
 
 // Verify interface compliance at compile time.
 var _ net.Conn = (*Conn)(nil)
+
+// sendBytes sends data on a session channel, giving up when ctx is done.
+func sendBytes(ctx context.Context, dev poolioc.Backend, idx uint32, ch uint8, data []byte) error {
+	if cb, ok := dev.(poolioc.ContextBackend); ok {
+		return cb.SendBytesContext(ctx, idx, ch, data)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// The backend cannot be interrupted: send from a copy so that an
+	// abandoned call never reads the caller's buffer after we return.
+	buf := append([]byte(nil), data...)
+	done := make(chan error, 1)
+	go func() { done <- dev.SendBytes(idx, ch, buf) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// recvBytes receives a message into b, giving up when ctx is done.
+func recvBytes(ctx context.Context, dev poolioc.Backend, idx uint32, ch uint8, b []byte) (int, error) {
+	if cb, ok := dev.(poolioc.ContextBackend); ok {
+		return cb.RecvBytesContext(ctx, idx, ch, b)
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	// The backend cannot be interrupted: receive into a private buffer
+	// so that an abandoned call never writes into b after we return.
+	type result struct {
+		n   int
+		err error
+	}
+	buf := make([]byte, len(b))
+	done := make(chan result, 1)
+	go func() {
+		n, err := dev.RecvBytes(idx, ch, buf)
+		done <- result{n, err}
+	}()
+	select {
+	case r := <-done:
+		return copy(b, buf[:r.n]), r.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
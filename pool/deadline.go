@@ -0,0 +1,125 @@
+//go:build linux
+
+package pool
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// deadline is an abstraction for handling timeouts, modeled on the
+// deadline type behind net.Pipe. Changing the deadline affects
+// operations that are already waiting on it.
+//
+// The deadline is expressed as a context so that it can be passed to a
+// backend and combined with a caller's context without extra goroutines.
+type deadline struct {
+	mu     sync.Mutex // Guards timer, ctx and cancel
+	timer  *time.Timer
+	ctx    context.Context // Must be non-nil; done when the deadline passes
+	cancel context.CancelFunc
+	err    error // set by shut
+}
+
+func makeDeadline() deadline {
+	ctx, cancel := context.WithCancel(context.Background())
+	return deadline{ctx: ctx, cancel: cancel}
+}
+
+// set sets the point in time when the deadline will time out.
+// A timeout event is signaled by canceling the context returned by
+// context. Once a timeout has occurred, the deadline can be refreshed
+// by specifying a t value in the future.
+//
+// A zero value for t prevents timeout.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.err != nil {
+		return // shut for good
+	}
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.ctx.Done() // Wait for the timer callback to finish and cancel
+	}
+	d.timer = nil
+
+	// Time is zero, then there is no deadline.
+	expired := d.ctx.Err() != nil
+	if t.IsZero() {
+		if expired {
+			d.renew()
+		}
+		return
+	}
+
+	// Time in the future, setup a timer to cancel in the future.
+	if dur := time.Until(t); dur > 0 {
+		if expired {
+			d.renew()
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, cancel)
+		return
+	}
+
+	// Time in the past, so cancel immediately.
+	d.cancel()
+}
+
+// shut makes the deadline pass for good: operations waiting on it
+// return, and [deadline.shutErr] reports err from then on. Later calls
+// to set have no effect.
+func (d *deadline) shut(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	d.err = err
+	d.cancel()
+}
+
+// shutErr returns the error given to shut, or nil.
+func (d *deadline) shutErr() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.err
+}
+
+// renew replaces an expired context. d.mu must be held.
+func (d *deadline) renew() {
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+}
+
+// context returns a context that is done when the deadline is exceeded.
+func (d *deadline) context() context.Context {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.ctx
+}
+
+// expired reports whether the deadline has passed.
+func (d *deadline) expired() bool {
+	return d.context().Err() != nil
+}
+
+// merge returns a context that is done when either ctx is done or the
+// deadline passes. The returned stop function must be called to release
+// resources.
+func (d *deadline) merge(ctx context.Context) (context.Context, func()) {
+	dctx := d.context()
+	if ctx.Done() == nil {
+		return dctx, func() {}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(dctx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
@@ -0,0 +1,386 @@
+//go:build linux
+
+package pool
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+
+	"github.com/amosdavis/pool-go/poolioc"
+)
+
+// DefaultDemuxQueueLen is the number of messages the demultiplexer
+// buffers per channel unless [DemuxConfig] says otherwise.
+const DefaultDemuxQueueLen = 64
+
+// DemuxConfig configures the demultiplexer of a Conn. The zero value
+// is the default configuration.
+type DemuxConfig struct {
+	// QueueLen bounds the messages buffered per channel; zero means
+	// DefaultDemuxQueueLen. The reader never waits for a channel: while
+	// a channel's queue is full, messages received on it are discarded,
+	// and its reader gets ErrChannelOverflow in their place once it has
+	// read what is queued. Other channels are not held back.
+	QueueLen int
+
+	// AutoSubscribe subscribes each channel the peer starts sending on
+	// with ChannelSubscribe as soon as it is seen, before it is
+	// accepted; the ChannelConn returned for it unsubscribes on Close.
+	// Otherwise accepted channels are not subscribed.
+	AutoSubscribe bool
+}
+
+// inMsg is a received message, or the error of a lost one.
+type inMsg struct {
+	data []byte
+	info poolioc.MsgInfo
+	err  error
+}
+
+// inbox is the queue of one channel known to the demultiplexer.
+type inbox struct {
+	msgs       []inMsg
+	refs       int  // readers of the channel: the Conn and its ChannelConns
+	subscribed bool // subscribed by AutoSubscribe
+}
+
+// demux is the per-Conn reader that receives messages on every channel
+// and queues them per channel. It also tracks which channels are open
+// before it runs. Its zero value is ready to use.
+type demux struct {
+	mu      sync.Mutex
+	running bool
+	cfg     DemuxConfig
+	inboxes map[uint8]*inbox // channels open or waiting to be accepted
+	backlog []uint8          // channels waiting to be accepted, in order seen
+	err     error            // why the reader stopped
+	changed chan struct{}    // closed and replaced on every change
+	cancel  context.CancelFunc
+}
+
+// box returns the inbox of ch, creating it if needed. d.mu must be
+// held.
+func (d *demux) box(ch uint8) *inbox {
+	if d.inboxes == nil {
+		d.inboxes = make(map[uint8]*inbox)
+	}
+	b, ok := d.inboxes[ch]
+	if !ok {
+		b = &inbox{}
+		d.inboxes[ch] = b
+	}
+	return b
+}
+
+// watch returns a channel that is closed at the next change. d.mu must
+// be held.
+func (d *demux) watch() <-chan struct{} {
+	if d.changed == nil {
+		d.changed = make(chan struct{})
+	}
+	return d.changed
+}
+
+// signal wakes everything waiting for a change. d.mu must be held.
+func (d *demux) signal() {
+	if d.changed != nil {
+		close(d.changed)
+		d.changed = nil
+	}
+}
+
+// isRunning reports whether the reader has been started.
+func (d *demux) isRunning() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.running
+}
+
+// open records a reader of ch.
+func (d *demux) open(ch uint8) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.box(ch).refs++
+}
+
+// known adds the channels that are open, or waiting to be accepted, to
+// set.
+func (d *demux) known(set *poolioc.ChannelSet) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for ch := range d.inboxes {
+		set.Add(ch)
+	}
+}
+
+// release drops a reader of ch. Once the channel has none, messages
+// still queued on it are discarded, and new ones are offered to
+// AcceptChannel again.
+func (d *demux) release(ch uint8) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	b, ok := d.inboxes[ch]
+	if !ok {
+		return
+	}
+	if b.refs--; b.refs <= 0 {
+		delete(d.inboxes, ch)
+		d.signal()
+	}
+}
+
+// stop stops the reader, if it is running.
+func (d *demux) stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cancel != nil {
+		d.cancel()
+	}
+}
+
+// fail records why the reader stopped.
+func (d *demux) fail(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.err = err
+	d.signal()
+}
+
+// put queues m on its channel. A channel not seen before is added to
+// the backlog, subscribed first if AutoSubscribe is set. put does not
+// wait for space: while the queue is full, it discards m and queues
+// ErrChannelOverflow once in its place, except for the end of the
+// channel, which is always queued.
+func (d *demux) put(c *Conn, m inMsg) {
+	ch := m.info.Channel
+	d.mu.Lock()
+	_, seen := d.inboxes[ch]
+	auto := d.cfg.AutoSubscribe
+	d.mu.Unlock()
+	subscribed := false
+	if !seen && auto {
+		subscribed = c.dev.ChannelSubscribe(c.sessionIdx, ch) == nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	b, ok := d.inboxes[ch]
+	if !ok {
+		b = d.box(ch)
+		b.subscribed = subscribed
+		d.backlog = append(d.backlog, ch)
+	}
+	switch n := len(b.msgs); {
+	case n < d.cfg.QueueLen || shutdown(m.err):
+		b.msgs = append(b.msgs, m)
+	case b.msgs[n-1].err != ErrChannelOverflow:
+		b.msgs = append(b.msgs, inMsg{info: poolioc.MsgInfo{Channel: ch}, err: ErrChannelOverflow})
+	default:
+		return
+	}
+	d.signal()
+}
+
+// recv takes the next message queued on ch into buf. Like a backend,
+// it fails with EMSGSIZE, leaving the message queued, if buf is too
+// small, and keeps failing with the end of the channel once the peer
+// has closed it. Once the queue is empty and the reader has stopped, it
+// returns the reader's error.
+func (d *demux) recv(ctx context.Context, ch uint8, buf []byte) (poolioc.MsgInfo, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for {
+		if b, ok := d.inboxes[ch]; ok && len(b.msgs) > 0 {
+			m := b.msgs[0]
+			if m.err == nil && len(m.data) > len(buf) {
+				return poolioc.MsgInfo{}, syscall.EMSGSIZE
+			}
+			if shutdown(m.err) {
+				return m.info, m.err
+			}
+			b.msgs[0] = inMsg{}
+			b.msgs = b.msgs[1:]
+			d.signal()
+			info := m.info
+			if m.err == nil {
+				info.Len = copy(buf, m.data)
+			}
+			return info, m.err
+		}
+		if d.err != nil {
+			return poolioc.MsgInfo{}, d.err
+		}
+		changed := d.watch()
+		d.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+		}
+		d.mu.Lock()
+		if err := ctx.Err(); err != nil {
+			return poolioc.MsgInfo{}, err
+		}
+	}
+}
+
+// accept takes the next channel from the backlog that nobody has opened
+// since it was seen, and records the ChannelConn as its reader.
+func (d *demux) accept(ctx context.Context) (uint8, bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for {
+		for len(d.backlog) > 0 {
+			ch := d.backlog[0]
+			d.backlog = d.backlog[1:]
+			b, ok := d.inboxes[ch]
+			if !ok || b.refs > 0 {
+				continue
+			}
+			b.refs++
+			return ch, b.subscribed, nil
+		}
+		if d.err != nil {
+			return 0, false, d.err
+		}
+		changed := d.watch()
+		d.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+		}
+		d.mu.Lock()
+		if err := ctx.Err(); err != nil {
+			return 0, false, err
+		}
+	}
+}
+
+// lost reports whether err stands for one message lost in transit
+// rather than the end of the session: pooludp reports messages it could
+// not reassemble as ETIME or EPROTO, and goes on receiving.
+func lost(err error) bool {
+	return errors.Is(err, syscall.ETIME) || errors.Is(err, syscall.EPROTO)
+}
+
+// shutdown reports whether err is the end of one channel, which the
+// peer closed for writing, rather than of the session.
+func shutdown(err error) bool {
+	var se *poolioc.ShutdownError
+	return errors.As(err, &se) && !se.Session
+}
+
+// readAll is the demultiplexer's reader. It receives messages on any
+// channel until the session ends or ctx is done. The end of a channel
+// is queued like a message; codec offers and answers are taken in
+// here rather than queued. A message over DefaultMaxMessageSize is
+// received only to be dropped, and its channel's reader gets
+// ErrMessageTooLarge in its place.
+func (c *Conn) readAll(ctx context.Context, db poolioc.DemuxBackend) {
+	buf := make([]byte, poolioc.MaxPayload)
+	for {
+		info, err := db.RecvAny(ctx, c.sessionIdx, buf)
+		if errors.Is(err, syscall.EMSGSIZE) && (len(buf) < DefaultMaxMessageSize || info.Len > len(buf)) {
+			buf = make([]byte, max(min(2*len(buf), DefaultMaxMessageSize), info.Len))
+			continue
+		}
+		if err != nil && !lost(err) && !shutdown(err) {
+			c.demux.fail(err)
+			return
+		}
+		if err == nil && info.Flags&poolioc.FlagCompressed != 0 && c.control(info.Channel, buf[:info.Len]) {
+			continue
+		}
+		m := inMsg{info: info, err: err}
+		switch {
+		case err == nil && info.Len > DefaultMaxMessageSize:
+			m = inMsg{info: poolioc.MsgInfo{Channel: info.Channel}, err: ErrMessageTooLarge}
+			buf = make([]byte, poolioc.MaxPayload)
+		case err == nil:
+			m.data = bytes.Clone(buf[:info.Len])
+		}
+		c.demux.put(c, m)
+	}
+}
+
+// receive receives the next message on ch, without decompressing it:
+// from the demultiplexer's queue if it is running, or else from the
+// backend. Once the peer has closed the session and everything queued
+// has been read, every channel reads as closed by the peer, on the
+// backends that report it (see [poolioc.ShutdownError]).
+func (c *Conn) receive(ctx context.Context, ch uint8, buf []byte) (poolioc.MsgInfo, error) {
+	if c.demux.isRunning() {
+		return c.demux.recv(ctx, ch, buf)
+	}
+	if mb, ok := c.dev.(poolioc.MessageBackend); ok {
+		return mb.RecvMsg(ctx, c.sessionIdx, ch, buf)
+	}
+	n, err := recvBytes(ctx, c.dev, c.sessionIdx, ch, buf)
+	return poolioc.MsgInfo{Len: n, Channel: ch}, err
+}
+
+// StartDemux starts a single reader for the Conn that receives the
+// messages of every channel and queues them per channel, in bounded
+// queues, for Read on the Conn and its ChannelConns. Messages on
+// channels that are not open are offered to [Conn.AcceptChannel].
+// Start it before reading; it has no effect if already running, and
+// stops when the Conn is closed.
+//
+// StartDemux needs a backend that can receive from any channel (see
+// [poolioc.DemuxBackend]), such as the userspace stack of package
+// pooludp. On /dev/pool it fails with an error wrapping
+// [errors.ErrUnsupported], since the kernel module receives per
+// channel only.
+func (c *Conn) StartDemux(cfg DemuxConfig) error {
+	if c.isClosed() {
+		return ErrClosed
+	}
+	db, ok := c.dev.(poolioc.DemuxBackend)
+	if !ok {
+		return fmt.Errorf("pool: backend cannot receive from any channel: %w", errors.ErrUnsupported)
+	}
+	if _, err := db.RecvAny(context.Background(), c.sessionIdx, nil); err != nil {
+		if errors.Is(err, errors.ErrUnsupported) {
+			return fmt.Errorf("pool: backend cannot receive from any channel: %w", err)
+		}
+		return c.opError("demux", err)
+	}
+	if cfg.QueueLen <= 0 {
+		cfg.QueueLen = DefaultDemuxQueueLen
+	}
+
+	d := &c.demux
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.running {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	d.running, d.cfg, d.cancel = true, cfg, cancel
+	d.box(c.channel).refs++
+	go c.readAll(ctx, db)
+	return nil
+}
+
+// AcceptChannel waits for the peer to send on a channel that is not
+// open on this side and returns a [ChannelConn] for it, whose reads
+// start with the message that revealed it. It starts the
+// demultiplexer with the default configuration if [Conn.StartDemux]
+// has not been called. Closing the ChannelConn discards what is still
+// queued on the channel; later messages on it are offered again.
+func (c *Conn) AcceptChannel(ctx context.Context) (*ChannelConn, error) {
+	if err := c.StartDemux(DemuxConfig{}); err != nil {
+		return nil, err
+	}
+	ch, subscribed, err := c.demux.accept(ctx)
+	if err != nil {
+		if c.isClosed() {
+			return nil, ErrClosed
+		}
+		return nil, c.opError("accept", err)
+	}
+	return c.newChannelConn(ch, subscribed), nil
+}
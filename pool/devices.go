@@ -0,0 +1,147 @@
+//go:build linux
+
+package pool
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"github.com/amosdavis/pool-go/poolioc"
+)
+
+// A DeviceManager shares devices between the connections and listeners
+// of a process. Each [Conn] and [Listener] holds a reference to its
+// device, which is closed once the last of them is closed, so a
+// connection accepted by a Listener outlives it.
+//
+// Dialed connections share up to [DeviceManager.SetShards] devices,
+// one by default; each Listener gets a device of its own, which the
+// connections it accepts share. The zero value is ready to use and
+// safe for concurrent use.
+type DeviceManager struct {
+	mu     sync.Mutex
+	n      int             // shards for dialing; zero means 1
+	shards []*sharedDevice // devices dialed sessions are spread over, nil until opened
+	next   int             // shard the next dial uses
+	open   int             // devices open, shared or not
+}
+
+// DefaultDeviceManager is the DeviceManager used by [Dialer] and
+// [ListenConfig] when neither names a Backend or a DeviceManager.
+var DefaultDeviceManager = &DeviceManager{}
+
+// sharedDevice is a device handed out by a DeviceManager, with the
+// number of connections and listeners using it.
+type sharedDevice struct {
+	m     *DeviceManager
+	dev   poolioc.Backend
+	close func() error
+	slot  int // index in m.shards, or -1 for a listener's own device
+	refs  int // guarded by m.mu
+}
+
+// SetShards sets the number of devices dialed sessions are spread
+// over, round-robin, to reduce contention on a single descriptor. It
+// applies to later dials; n below 1 means 1.
+func (m *DeviceManager) SetShards(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.n = n
+}
+
+// NumDevices returns the number of devices the manager has open.
+func (m *DeviceManager) NumDevices() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.open
+}
+
+// dial returns a shared device for a dialed session and the function
+// that releases it.
+func (m *DeviceManager) dial() (poolioc.Backend, func(), error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := max(m.n, 1)
+	for len(m.shards) < n {
+		m.shards = append(m.shards, nil)
+	}
+	i := m.next % n
+	m.next = (m.next + 1) % n
+
+	sd := m.shards[i]
+	if sd == nil {
+		var err error
+		if sd, err = m.openLocked(i); err != nil {
+			return nil, nil, err
+		}
+		m.shards[i] = sd
+	}
+	return sd.dev, sd.acquireLocked(), nil
+}
+
+// listen returns a device of the listener's own, holding no reference
+// yet.
+func (m *DeviceManager) listen() (*sharedDevice, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.openLocked(-1)
+}
+
+// openLocked opens a device for slot. m.mu must be held.
+func (m *DeviceManager) openLocked(slot int) (*sharedDevice, error) {
+	dev, closeFn, err := openDevice()
+	if err != nil {
+		return nil, err
+	}
+	m.open++
+	return &sharedDevice{m: m, dev: dev, close: closeFn, slot: slot}, nil
+}
+
+// acquire takes a reference to the device and returns the function
+// that drops it; the device is closed when the last reference is
+// dropped. A nil *sharedDevice stands for a caller-supplied Backend,
+// which is never closed.
+func (sd *sharedDevice) acquire() func() {
+	if sd == nil {
+		return func() {}
+	}
+	sd.m.mu.Lock()
+	defer sd.m.mu.Unlock()
+	return sd.acquireLocked()
+}
+
+// acquireLocked is acquire with sd.m.mu held.
+func (sd *sharedDevice) acquireLocked() func() {
+	sd.refs++
+	var once sync.Once
+	return func() { once.Do(sd.release) }
+}
+
+// release drops a reference, closing the device with the last one.
+func (sd *sharedDevice) release() {
+	m := sd.m
+	m.mu.Lock()
+	if sd.refs--; sd.refs > 0 {
+		m.mu.Unlock()
+		return
+	}
+	if sd.slot >= 0 && sd.slot < len(m.shards) && m.shards[sd.slot] == sd {
+		m.shards[sd.slot] = nil
+	}
+	m.open--
+	m.mu.Unlock()
+	_ = sd.close()
+}
+
+// openDevice opens a new device on the backend POOL_BACKEND names,
+// which may be one registered with [poolioc.RegisterBackend], such as
+// the userspace stack of package pooludp.
+func openDevice() (poolioc.Backend, func() error, error) {
+	dev, err := poolioc.OpenBackend(os.Getenv(poolioc.BackendEnv))
+	if err != nil {
+		return nil, nil, err
+	}
+	return dev, dev.(io.Closer).Close, nil
+}
@@ -3,79 +3,447 @@
 package pool
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math"
 	"net"
 	"time"
 
 	"github.com/amosdavis/pool-go/poolioc"
 )
 
+// A Dialer contains options for connecting to a POOL peer.
+// It mirrors [net.Dialer].
+//
+// The zero value for each field is equivalent to dialing without that
+// option. Dialing with the zero value of Dialer is therefore equivalent
+// to just calling the [Dial] function.
+//
+// It is safe to call Dialer's methods concurrently.
+type Dialer struct {
+	// Timeout is the maximum amount of time a dial will wait for the
+	// handshake to complete. If Deadline is also set, it may fail
+	// earlier. The default is no timeout.
+	Timeout time.Duration
+
+	// Deadline is the absolute point in time after which dials fail.
+	// If Timeout is set, it may fail earlier. Zero means no deadline.
+	Deadline time.Time
+
+	// LocalAddr is the local address to dial from. It must be of the
+	// same address family as the remote address. No backend can bind
+	// a local address yet, so a dial fails with an error wrapping
+	// [errors.ErrUnsupported] if LocalAddr names a port or an IP other
+	// than the unspecified address. If nil or unspecified, the backend
+	// selects the source address by routing.
+	LocalAddr *Addr
+
+	// Transport selects the POOL transport: poolioc.TransportTCP (the
+	// default), poolioc.TransportRaw or poolioc.TransportAuto.
+	Transport uint8
+
+	// Version selects the protocol version: poolioc.Version for the
+	// classic X25519 handshake or poolioc.VersionPQC for hybrid
+	// X25519 + ML-KEM-768. Zero selects the module default.
+	Version uint8
+
+	// KeepAlive is the heartbeat interval for the session, rounded up
+	// to whole seconds. Zero selects poolioc.HeartbeatSec. Heartbeats
+	// drive session telemetry and cannot be disabled, so negative
+	// values are rejected.
+	//
+	// The kernel module cannot be given Transport, Version or
+	// KeepAlive yet: on a [poolioc.Device], whether /dev/pool or the
+	// fake backend, a dial that sets them to other than their defaults
+	// fails with an error wrapping [errors.ErrUnsupported]. The pooludp
+	// stack honours them.
+	KeepAlive time.Duration
+
+	// Resolver optionally specifies an alternate resolver to use for
+	// hostnames. If nil, net.DefaultResolver is used.
+	Resolver *net.Resolver
+
+	// FallbackDelay specifies the length of time to wait before
+	// spawning a fallback connection when a hostname resolves to both
+	// IPv4 and IPv6 addresses ("Happy Eyeballs", RFC 8305). The
+	// primary family is that of the first resolved address. If zero,
+	// a default delay of 300ms is used.
+	FallbackDelay time.Duration
+
+	// Control, if not nil, is called with the backend before the
+	// handshake starts. Returning an error aborts the dial with an
+	// [*OpError] wrapping it. Unless it was supplied in Backend, the
+	// backend may be shared with other connections.
+	Control func(network, address string, dev poolioc.Backend) error
+
+	// Backend is the device implementation used for the session.
+	// If nil, a device is taken from Devices. A caller-supplied
+	// Backend is never closed by the pool package.
+	Backend poolioc.Backend
+
+	// Devices shares devices between connections when Backend is nil.
+	// If nil, DefaultDeviceManager is used.
+	Devices *DeviceManager
+}
+
+// ContextDialer is the dialing interface shared by [net.Dialer],
+// [Dialer] and proxy libraries such as golang.org/x/net/proxy.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Verify interface compliance at compile time.
+var _ ContextDialer = (*Dialer)(nil)
+
 // Dial connects to a POOL peer at the given address.
 // The network must be "pool", "pool4", or "pool6".
-// The address is "host:port".
+// The address is "host:port". When a hostname resolves to several
+// addresses, each is tried until one connects; see [Dialer] for how
+// IPv4 and IPv6 addresses are raced.
 //
 //	conn, err := pool.Dial("pool", "10.0.0.1:9253")
 //	conn, err := pool.Dial("pool6", "[::1]:9253")
 func Dial(network, address string) (*Conn, error) {
-	return DialTimeout(network, address, 0)
+	var d Dialer
+	return d.dial(context.Background(), network, address)
 }
 
 // DialTimeout acts like [Dial] but imposes a timeout on the handshake.
 // A timeout of zero means no limit.
 func DialTimeout(network, address string, timeout time.Duration) (*Conn, error) {
-	addr, err := ResolveAddr(network, address)
+	d := Dialer{Timeout: timeout}
+	return d.dial(context.Background(), network, address)
+}
+
+// Dial connects to a POOL peer at the given address using the
+// Dialer's options. See [Dial] for a description of the arguments.
+// The returned connection is a [*Conn].
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to a POOL peer at the given address using the
+// provided context. If the context expires before the handshake
+// completes, an error is returned and any session established later is
+// closed. Once connected, the context has no effect on the connection.
+// The returned connection is a [*Conn].
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d.dial(ctx, network, address)
+}
+
+func (d *Dialer) dial(ctx context.Context, network, address string) (*Conn, error) {
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	if !d.Deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, d.Deadline)
+		defer cancel()
+	}
+
+	addrs, err := resolveAddrs(ctx, d.Resolver, network, address)
+	if err != nil {
+		return nil, d.dialError(network, nil, err)
+	}
+
+	primaries, fallbacks := partition(addrs)
+	return d.dialParallel(ctx, network, address, primaries, fallbacks)
+}
+
+// dialParallel races two copies of dialSerial, giving the first a
+// head start, as described in RFC 8305 ("Happy Eyeballs"). It returns
+// the first established connection and closes the others.
+func (d *Dialer) dialParallel(ctx context.Context, network, address string, primaries, fallbacks []*Addr) (*Conn, error) {
+	if len(fallbacks) == 0 {
+		return d.dialSerial(ctx, network, address, primaries)
+	}
+
+	returned := make(chan struct{})
+	defer close(returned)
+
+	type dialResult struct {
+		conn    *Conn
+		err     error
+		primary bool
+		done    bool
+	}
+	results := make(chan dialResult) // unbuffered
+
+	startRacer := func(ctx context.Context, primary bool) {
+		addrs := primaries
+		if !primary {
+			addrs = fallbacks
+		}
+		c, err := d.dialSerial(ctx, network, address, addrs)
+		select {
+		case results <- dialResult{conn: c, err: err, primary: primary, done: true}:
+		case <-returned:
+			if c != nil {
+				c.Close()
+			}
+		}
+	}
+
+	var primary, fallback dialResult
+
+	// Start the main racer.
+	primaryCtx, primaryCancel := context.WithCancel(ctx)
+	defer primaryCancel()
+	go startRacer(primaryCtx, true)
+
+	// Start the timer for the fallback racer.
+	fallbackTimer := time.NewTimer(d.fallbackDelay())
+	defer fallbackTimer.Stop()
+
+	for {
+		select {
+		case <-fallbackTimer.C:
+			fallbackCtx, fallbackCancel := context.WithCancel(ctx)
+			defer fallbackCancel()
+			go startRacer(fallbackCtx, false)
+
+		case res := <-results:
+			if res.err == nil {
+				return res.conn, nil
+			}
+			if res.primary {
+				primary = res
+			} else {
+				fallback = res
+			}
+			if primary.done && fallback.done {
+				return nil, primary.err
+			}
+			if res.primary && fallbackTimer.Stop() {
+				// If we were able to stop the timer, that means it
+				// was running (hadn't yet started the fallback), but
+				// we just got an error on the primary path, so start
+				// the fallback immediately (in 0 nanoseconds).
+				fallbackTimer.Reset(0)
+			}
+		}
+	}
+}
+
+// dialSerial tries each address in turn and returns the first
+// connection established, or the first error if all fail. Each attempt
+// gets an equal share of the time remaining before the deadline.
+func (d *Dialer) dialSerial(ctx context.Context, network, address string, addrs []*Addr) (*Conn, error) {
+	var firstErr error
+	for i, addr := range addrs {
+		if err := ctx.Err(); err != nil {
+			return nil, d.dialError(network, addr, err)
+		}
+
+		dialCtx := ctx
+		if dl, ok := ctx.Deadline(); ok {
+			partial := partialDeadline(time.Now(), dl, len(addrs)-i)
+			if partial.Before(dl) {
+				var cancel context.CancelFunc
+				dialCtx, cancel = context.WithDeadline(ctx, partial)
+				defer cancel()
+			}
+		}
+
+		c, err := d.dialOne(dialCtx, network, address, addr)
+		if err == nil {
+			return c, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// dialOne performs the handshake with a single resolved address.
+func (d *Dialer) dialOne(ctx context.Context, network, address string, addr *Addr) (*Conn, error) {
+	req, err := d.connectReq(addr)
 	if err != nil {
-		return nil, err
+		return nil, d.dialError(network, addr, err)
 	}
 
-	dev, err := poolioc.Open()
+	dev, release, err := d.backend()
 	if err != nil {
-		return nil, mapErrno(err)
+		return nil, d.dialError(network, addr, err)
+	}
+
+	if d.Control != nil {
+		if err := d.Control(network, address, dev); err != nil {
+			release()
+			return nil, d.dialError(network, addr, err)
+		}
+	}
+
+	if d.Backend != nil {
+		dialStart()
+	}
+	idx, err := connect(ctx, dev, req)
+	if d.Backend != nil {
+		// A caller-supplied Backend is never closed; what is released
+		// with the Conn is its record as an outbound session.
+		release = dialDone(dev, idx, err != nil)
+	}
+	if err != nil {
+		release()
+		return nil, d.dialError(network, addr, err)
+	}
+
+	return newConn(dev, release, uint32(idx), resolveLocalAddr(addr), addr, 0), nil
+}
+
+// backend returns the device to dial on and the function that releases
+// it: the caller-supplied Backend, or a shared device.
+func (d *Dialer) backend() (poolioc.Backend, func(), error) {
+	if d.Backend != nil {
+		return d.Backend, func() {}, nil
+	}
+	m := d.Devices
+	if m == nil {
+		m = DefaultDeviceManager
+	}
+	return m.dial()
+}
+
+// dialError wraps an error from resolving or connecting to addr in an
+// [OpError]. A context canceled by the caller is returned as is.
+func (d *Dialer) dialError(network string, addr *Addr, err error) error {
+	if errors.Is(err, context.Canceled) {
+		return err
+	}
+	e := &OpError{Op: "dial", Net: network, Session: -1, Err: err}
+	if d.LocalAddr != nil {
+		e.Source = d.LocalAddr
+	}
+	if addr != nil {
+		e.Addr = addr
+	}
+	return e
+}
+
+// fallbackDelay returns the head start given to the primary address
+// family before the fallback family is tried.
+func (d *Dialer) fallbackDelay() time.Duration {
+	if d.FallbackDelay > 0 {
+		return d.FallbackDelay
+	}
+	return 300 * time.Millisecond
+}
+
+// partition divides an address list into two categories, using the
+// family of the first address: primaries share its family and fallbacks
+// do not.
+func partition(addrs []*Addr) (primaries, fallbacks []*Addr) {
+	primaryV4 := addrs[0].IP.To4() != nil
+	for _, a := range addrs {
+		if (a.IP.To4() != nil) == primaryV4 {
+			primaries = append(primaries, a)
+		} else {
+			fallbacks = append(fallbacks, a)
+		}
+	}
+	return primaries, fallbacks
+}
+
+// partialDeadline returns the deadline to use for a single address,
+// when multiple addresses are pending.
+func partialDeadline(now, deadline time.Time, addrsRemaining int) time.Time {
+	const saneMinimum = 2 * time.Second
+	timeRemaining := deadline.Sub(now)
+	if timeRemaining <= 0 {
+		return deadline
 	}
+	// Tentatively allocate equal time to each remaining address.
+	timeout := timeRemaining / time.Duration(addrsRemaining)
+	// If the time per address is too short, steal from the end of the list.
+	if timeout < saneMinimum {
+		if timeRemaining < saneMinimum {
+			timeout = timeRemaining
+		} else {
+			timeout = saneMinimum
+		}
+	}
+	return now.Add(timeout)
+}
 
+// boundLocal reports whether LocalAddr asks for a particular source
+// address or port, which no backend can bind.
+func (d *Dialer) boundLocal() bool {
+	l := d.LocalAddr
+	return l != nil && (l.Port != 0 || l.IP != nil && !l.IP.IsUnspecified())
+}
+
+// connectReq builds the connect request for addr from the Dialer's
+// options.
+func (d *Dialer) connectReq(addr *Addr) (poolioc.ConnectReq, error) {
 	req := poolioc.ConnectReq{
 		PeerAddr:   addr.PeerAddrBytes(),
 		PeerPort:   uint16(addr.Port),
 		AddrFamily: addr.AddrFamily(),
+		Transport:  d.Transport,
+		Version:    d.Version,
 	}
 
-	type dialResult struct {
+	if d.LocalAddr != nil && d.LocalAddr.IP != nil && d.LocalAddr.AddrFamily() != req.AddrFamily {
+		return req, fmt.Errorf("pool: local address %s does not match family of %s", d.LocalAddr, addr)
+	}
+	if d.boundLocal() {
+		return req, fmt.Errorf("pool: cannot bind local address %s: %w", d.LocalAddr, errors.ErrUnsupported)
+	}
+	if d.Transport > poolioc.TransportAuto {
+		return req, fmt.Errorf("pool: unknown transport %d", d.Transport)
+	}
+	if d.Version != 0 && d.Version != poolioc.Version && d.Version != poolioc.VersionPQC {
+		return req, fmt.Errorf("pool: unsupported protocol version %d", d.Version)
+	}
+
+	switch {
+	case d.KeepAlive < 0:
+		return req, fmt.Errorf("pool: negative KeepAlive %v", d.KeepAlive)
+	case d.KeepAlive > 0:
+		secs := (d.KeepAlive + time.Second - 1) / time.Second
+		if secs > math.MaxUint16 {
+			secs = math.MaxUint16
+		}
+		req.HeartbeatSec = uint16(secs)
+	}
+	return req, nil
+}
+
+// connect performs the handshake, giving up when ctx is done.
+func connect(ctx context.Context, dev poolioc.Backend, req poolioc.ConnectReq) (int, error) {
+	if cb, ok := dev.(poolioc.ContextBackend); ok {
+		return cb.ConnectContext(ctx, req)
+	}
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+
+	type result struct {
 		idx int
 		err error
 	}
-
-	ch := make(chan dialResult, 1)
+	ch := make(chan result, 1)
 	go func() {
 		idx, err := dev.Connect(req)
-		ch <- dialResult{idx, err}
+		ch <- result{idx, err}
 	}()
 
-	if timeout > 0 {
-		timer := time.NewTimer(timeout)
-		defer timer.Stop()
-
-		select {
-		case r := <-ch:
-			if r.err != nil {
-				dev.Close()
-				return nil, mapErrno(r.err)
+	select {
+	case r := <-ch:
+		return r.idx, r.err
+	case <-ctx.Done():
+		// Tear down a handshake that completes after we gave up.
+		go func() {
+			if r := <-ch; r.err == nil {
+				_ = dev.CloseSession(uint32(r.idx))
 			}
-			local := resolveLocalAddr(addr)
-			return newConn(dev, uint32(r.idx), local, addr, 0), nil
-		case <-timer.C:
-			dev.Close()
-			return nil, &timeoutError{}
-		}
+		}()
+		return -1, ctx.Err()
 	}
-
-	r := <-ch
-	if r.err != nil {
-		dev.Close()
-		return nil, mapErrno(r.err)
-	}
-
-	local := resolveLocalAddr(addr)
-	return newConn(dev, uint32(r.idx), local, addr, 0), nil
 }
 
 // resolveLocalAddr builds a best-effort local address.
@@ -96,8 +464,5 @@ func resolveLocalAddr(remote *Addr) *Addr {
 // Resolve creates a POOL address from a network and address string,
 // without connecting.
 func Resolve(network, address string) (*Addr, error) {
-	if network != "pool" && network != "pool4" && network != "pool6" {
-		return nil, fmt.Errorf("pool: unsupported network %q", network)
-	}
 	return ResolveAddr(network, address)
 }
@@ -19,5 +19,41 @@
 // bracket notation), and hostnames. All traffic is encrypted with
 // ChaCha20-Poly1305 and authenticated with HMAC-SHA256.
 //
-// This package requires Linux with the pool.ko kernel module loaded.
+// POOL carries messages, but [Conn.Read] presents them as a byte stream
+// by default, so bufio.Reader, io.ReadFull and similar work with any
+// buffer size. [Conn.SetReadMode] with [MessageMode] returns one message
+// per Read instead; [Conn.WriteMessage] and [Conn.ReadMessage] keep
+// message boundaries for messages of any size.
+//
+// Writes on all channels of a Conn pass through one scheduler. Each
+// channel has a [Priority] class, set with SetPriority; while writes
+// are waiting, higher classes are sent first by weighted round-robin,
+// so bulk transfers cannot starve control traffic or be starved by it.
+// [Conn.ChannelStats] reports how long each channel's writes waited.
+//
+// [Conn.SetCompression] compresses a channel's messages with a codec
+// from the standard library, negotiated with the peer, and sends them
+// with FlagCompressed. Reads decompress them transparently.
+//
+// By default each read receives from the backend on its own channel.
+// [Conn.StartDemux] starts one reader per Conn instead, which queues
+// incoming messages per channel with bounded buffers, and
+// [Conn.AcceptChannel] returns a [ChannelConn] for each channel the
+// peer starts sending on.
+//
+// Read returns [io.EOF] once the peer has closed the session, or closed
+// the channel for writing with [Conn.CloseWrite], and everything it sent
+// has been read, so io.Copy terminates as it does on a TCP connection.
+//
+// Other failures of reads, writes, dials and Accept are reported as an
+// [*OpError] whose cause is the backend's errno or the POOL error code
+// the peer sent. It matches the sentinel for its cause with
+// [errors.Is], so that callers can tell [ErrOverload], which is worth
+// retrying, from [ErrAuthFailed], which is not.
+//
+// This package requires Linux with the pool.ko kernel module loaded, or
+// POOL_BACKEND=udp in the environment to run on the userspace stack in
+// package pooludp instead, which the program must import (import _
+// "github.com/amosdavis/pool-go/pooludp" will do) for the name to be
+// known.
 package pool
@@ -3,9 +3,15 @@
 package pool
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"os"
 	"syscall"
+
+	"github.com/amosdavis/pool-go/poolioc"
 )
 
 // Sentinel errors for POOL operations.
@@ -13,7 +19,8 @@ var (
 	// ErrSessionFull indicates the kernel session table is full (ENOSPC).
 	ErrSessionFull = errors.New("pool: session table full")
 
-	// ErrAuthFailed indicates the POOL handshake authentication failed.
+	// ErrAuthFailed indicates the POOL handshake authentication failed
+	// (AUTH_FAIL, EACCES or EKEYREJECTED).
 	ErrAuthFailed = errors.New("pool: authentication failed")
 
 	// ErrClosed indicates the connection or listener has been closed.
@@ -22,7 +29,10 @@ var (
 	// ErrTimeout indicates a deadline was exceeded.
 	ErrTimeout = errors.New("pool: operation timed out")
 
-	// ErrMessageTooLarge indicates the message exceeds MaxPayload.
+	// ErrMessageTooLarge indicates the message exceeds what the backend
+	// can send (EMSGSIZE): MaxPayload for the kernel module, or
+	// pooludp.MaxMessage for the userspace stack. WriteMessage and
+	// ReadMessage return it for messages over the maximum message size.
 	ErrMessageTooLarge = errors.New("pool: message too large")
 
 	// ErrBufferTooSmall indicates the receive buffer is too small (EMSGSIZE).
@@ -33,23 +43,192 @@ var (
 
 	// ErrNetUnreachable indicates the peer is unreachable.
 	ErrNetUnreachable = errors.New("pool: network unreachable")
+
+	// ErrBadMessage indicates data received by ReadMessage that was not
+	// framed by WriteMessage.
+	ErrBadMessage = errors.New("pool: malformed message")
+
+	// ErrFragTimeout indicates a fragmented message was dropped because
+	// its fragments did not all arrive within FragTimeoutMS (ETIME).
+	ErrFragTimeout = errors.New("pool: fragment reassembly timed out")
+
+	// ErrNoFreeChannel indicates that every channel AllocateChannel may
+	// pick is in use or reserved.
+	ErrNoFreeChannel = errors.New("pool: no free channel")
+
+	// ErrChannelsReserved indicates that ReserveChannels asked for
+	// channels already reserved on the Conn.
+	ErrChannelsReserved = errors.New("pool: channels already reserved")
+
+	// ErrWriteClosed indicates a write on a channel closed for writing
+	// with CloseWrite (EPIPE).
+	ErrWriteClosed = errors.New("pool: closed for writing")
+
+	// ErrChannelOverflow indicates that messages received on a channel
+	// were discarded because its demultiplexer queue was full (see
+	// [DemuxConfig]).
+	ErrChannelOverflow = errors.New("pool: channel queue overflowed")
 )
 
-// mapErrno converts a syscall.Errno to a typed POOL error.
-func mapErrno(err error) error {
-	if err == nil {
+// Sentinel errors for the POOL error codes a peer reports on the wire
+// (see [poolioc.WireError]). AUTH_FAIL is reported as [ErrAuthFailed]
+// and FRAG_TIMEOUT as [ErrFragTimeout].
+var (
+	// ErrDecryptFailed indicates the peer could not decrypt or
+	// authenticate a packet (DECRYPT_FAIL).
+	ErrDecryptFailed = errors.New("pool: decryption failed")
+
+	// ErrSeqInvalid indicates the peer rejected a sequence number
+	// (SEQ_INVALID).
+	ErrSeqInvalid = errors.New("pool: invalid sequence number")
+
+	// ErrMTUExceeded indicates a packet exceeded the path MTU
+	// (MTU_EXCEEDED).
+	ErrMTUExceeded = errors.New("pool: MTU exceeded")
+
+	// ErrConfigRejected indicates the peer rejected a configuration
+	// change (CONFIG_REJECT).
+	ErrConfigRejected = errors.New("pool: configuration rejected")
+
+	// ErrRekeyFailed indicates a session rekey failed (REKEY_FAIL).
+	ErrRekeyFailed = errors.New("pool: rekey failed")
+
+	// ErrJournalFull indicates the peer's change journal is full
+	// (JOURNAL_FULL).
+	ErrJournalFull = errors.New("pool: journal full")
+
+	// ErrOverload indicates the peer is overloaded and shedding load
+	// (OVERLOAD), or a queue of the backend is full (ENOBUFS). Unlike
+	// ErrAuthFailed, it is worth retrying later.
+	ErrOverload = errors.New("pool: peer overloaded")
+
+	// ErrVersionMismatch indicates the peers share no protocol version
+	// (VERSION_MISMATCH, EPROTONOSUPPORT).
+	ErrVersionMismatch = errors.New("pool: protocol version mismatch")
+
+	// ErrConnRefused indicates nothing listens at the remote address
+	// (ECONNREFUSED).
+	ErrConnRefused = errors.New("pool: connection refused")
+)
+
+// wireErrors maps POOL wire error codes to their sentinel errors.
+var wireErrors = [...]error{
+	poolioc.ErrAuthFail:        ErrAuthFailed,
+	poolioc.ErrDecryptFail:     ErrDecryptFailed,
+	poolioc.ErrSeqInvalid:      ErrSeqInvalid,
+	poolioc.ErrFragTimeout:     ErrFragTimeout,
+	poolioc.ErrMTUExceeded:     ErrMTUExceeded,
+	poolioc.ErrConfigReject:    ErrConfigRejected,
+	poolioc.ErrRekeyFail:       ErrRekeyFailed,
+	poolioc.ErrJournalFull:     ErrJournalFull,
+	poolioc.ErrOverload:        ErrOverload,
+	poolioc.ErrVersionMismatch: ErrVersionMismatch,
+}
+
+// OpError is the error type returned by the methods of [Conn] and
+// [ChannelConn] that reach the backend, by dialing, and by [Listener].
+// Like [net.OpError], it describes the operation, network type and
+// addresses of an error.
+//
+// Err is the cause as the backend reported it: usually a
+// [syscall.Errno] or the [poolioc.WireError] a peer sent. [errors.Is]
+// matches an OpError against the sentinel error for its cause as well,
+// so that, say, a peer's OVERLOAD code is both a poolioc.WireError and
+// [ErrOverload].
+type OpError struct {
+	// Op is the operation that failed: "dial", "listen", "accept",
+	// "read", "write" or "close", or for the other Conn methods
+	// "telemetry", "session info", "subscribe", "channels" or "demux".
+	Op string
+
+	// Net is the network type of the operation, such as "pool" or
+	// "pool6".
+	Net string
+
+	// Source is the local address of the operation, if any.
+	Source net.Addr
+
+	// Addr is the remote address of the operation, or the local
+	// address for listen and accept. It may be nil.
+	Addr net.Addr
+
+	// Session is the index of the session, or -1 if the operation has
+	// none.
+	Session int
+
+	// Err is the error that occurred during the operation.
+	Err error
+}
+
+func (e *OpError) Error() string {
+	if e == nil {
+		return "<nil>"
+	}
+	s := e.Op + " " + e.Net
+	if e.Source != nil && e.Addr != nil {
+		s += " " + e.Source.String() + "->" + e.Addr.String()
+	} else if e.Addr != nil {
+		s += " " + e.Addr.String()
+	}
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return s
+}
+
+func (e *OpError) Unwrap() error { return e.Err }
+
+// Is reports whether target is the sentinel error for the cause.
+func (e *OpError) Is(target error) bool {
+	s := sentinel(e.Err)
+	return s != nil && s == target
+}
+
+// Timeout reports whether the operation timed out, at a deadline or in
+// the backend (ETIMEDOUT).
+func (e *OpError) Timeout() bool {
+	var t interface{ Timeout() bool }
+	return errors.As(e.Err, &t) && t.Timeout()
+}
+
+// Temporary reports whether the error is temporary.
+//
+// Deprecated: as for [net.Error], use Timeout or errors.Is against
+// the sentinel errors, such as [ErrOverload], instead.
+func (e *OpError) Temporary() bool {
+	var t interface{ Temporary() bool }
+	return errors.As(e.Err, &t) && t.Temporary()
+}
+
+// sentinel returns the sentinel error for a backend error, or nil if
+// there is none.
+func sentinel(err error) error {
+	var te *timeoutError
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &te) {
+		return ErrTimeout
+	}
+	if errors.Is(err, os.ErrClosed) {
+		return ErrClosed
+	}
+
+	var code poolioc.WireError
+	if errors.As(err, &code) {
+		if int(code) < len(wireErrors) {
+			return wireErrors[code]
+		}
 		return nil
 	}
 
 	var errno syscall.Errno
 	if !errors.As(err, &errno) {
-		return err
+		return nil
 	}
-
 	switch errno {
 	case syscall.ENOSPC:
 		return ErrSessionFull
 	case syscall.ECONNREFUSED:
+		return ErrConnRefused
+	case syscall.EACCES, syscall.EKEYREJECTED:
 		return ErrAuthFailed
 	case syscall.ETIMEDOUT:
 		return ErrTimeout
@@ -59,9 +238,51 @@ func mapErrno(err error) error {
 		return ErrNetUnreachable
 	case syscall.EBADF:
 		return ErrClosed
-	default:
-		return fmt.Errorf("pool: %w", errno)
+	case syscall.ETIME:
+		return ErrFragTimeout
+	case syscall.EPIPE:
+		return ErrWriteClosed
+	case syscall.ENOBUFS:
+		return ErrOverload
+	case syscall.EPROTONOSUPPORT:
+		return ErrVersionMismatch
+	}
+	return nil
+}
+
+// mapErrno converts a syscall.Errno to a typed POOL error.
+// An expired deadline becomes a [net.Error] timeout, and the orderly
+// end of a channel [io.EOF]. Operations that report an [OpError] keep
+// the errno as its cause instead; see [Conn.opError].
+func mapErrno(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &timeoutError{}
+	}
+	if errors.Is(err, os.ErrClosed) {
+		return ErrClosed
+	}
+	if endOfStream(err) {
+		return io.EOF
 	}
+
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return err
+	}
+	if s := sentinel(errno); s != nil {
+		return s
+	}
+	return fmt.Errorf("pool: %w", errno)
+}
+
+// endOfStream reports whether err is the orderly end of a channel: the
+// peer closed it for writing without a reason.
+func endOfStream(err error) bool {
+	var se *poolioc.ShutdownError
+	return errors.As(err, &se) && se.Reason == 0
 }
 
 // timeoutError implements net.Error for deadline exceeded.
@@ -3,6 +3,7 @@
 package pool
 
 import (
+	"context"
 	"net"
 	"sync"
 	"time"
@@ -14,95 +15,306 @@ import (
 //
 // Call [Listen] to create a Listener. Then call Accept to wait for
 // incoming POOL sessions.
+//
+// A Listener watches the device for newly established sessions and
+// queues them for Accept. At most [poolioc.ListenBacklog] sessions are
+// queued; further sessions stay in the device's session table until
+// Accept makes room. Sessions queued or left waiting when the Listener
+// is closed are closed; connections already accepted stay open. On a
+// Backend shared with a [Dialer], the sessions the Dialer establishes
+// are not taken for inbound ones.
 type Listener struct {
-	dev     *poolioc.Device
+	dev     poolioc.Backend
+	shared  *sharedDevice // nil for a caller-supplied Backend
+	release func()        // drops the Listener's reference to dev
 	addr    *Addr
 	mu      sync.Mutex
 	closed  bool
-	known   map[uint32]struct{}
-	pollInt time.Duration
+	done    chan struct{} // closed by Close
+	backlog chan *Conn    // established sessions not yet accepted
+	kick    chan struct{} // wakes the watcher when backlog space frees up
+	stopped chan struct{} // closed when the watcher exits
+	err     error         // why the watcher exited, set before stopped is closed
+	seen    map[sessionKey]struct{}
+	left    map[sessionKey]struct{} // established sessions the full backlog left waiting
+}
+
+// sessionKey identifies a session in a session table. Both ends of a
+// session share its ID, so a loopback connection through one device
+// shows the ID twice; a reused index with a new ID is a new session.
+type sessionKey struct {
+	idx uint32
+	id  [poolioc.SessionIDSize]byte
+}
+
+// keyOf returns the sessionKey of s.
+func keyOf(s *poolioc.SessionInfo) sessionKey {
+	return sessionKey{idx: s.Index, id: s.SessionID}
+}
+
+// pollInterval is how often a Listener re-reads the session table of a
+// backend that does not implement [poolioc.Notifier]. resyncInterval is
+// the same for backends that do, guarding against missed wakeups.
+const (
+	pollInterval   = 100 * time.Millisecond
+	resyncInterval = time.Second
+)
+
+// ListenConfig contains options for listening for POOL connections.
+type ListenConfig struct {
+	// Backend is the device implementation the listener runs on.
+	// If nil, a device of the listener's own is opened through
+	// Devices, and closed once the Listener and every connection it
+	// accepted are closed. A caller-supplied Backend is stopped but
+	// never closed by [Listener.Close].
+	Backend poolioc.Backend
+
+	// Devices opens the listener's device when Backend is nil. If nil,
+	// DefaultDeviceManager is used.
+	Devices *DeviceManager
 }
 
 // Listen starts listening for POOL connections on the given address.
 // The network must be "pool", "pool4", or "pool6". The address is
 // "host:port" or ":port".
 func Listen(network, address string) (*Listener, error) {
-	addr, err := ResolveAddr(network, address)
-	if err != nil {
-		// Allow ":port" shorthand with an unspecified host
-		if address[0] == ':' {
-			addr = &Addr{IP: net.IPv6unspecified, Port: 0}
-			var portErr error
-			addr.Port, portErr = net.LookupPort("tcp", address[1:])
-			if portErr != nil {
-				return nil, err
-			}
-		} else {
-			return nil, err
-		}
+	var lc ListenConfig
+	return lc.Listen(context.Background(), network, address)
+}
+
+// Listen announces on the given address using the ListenConfig's
+// options. See [Listen] for a description of the arguments. The context
+// only governs setting up the listener; it does not affect the returned
+// Listener.
+func (lc *ListenConfig) Listen(ctx context.Context, network, address string) (*Listener, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
-	dev, err := poolioc.Open()
+	addrs, err := resolveAddrs(ctx, nil, network, address)
 	if err != nil {
-		return nil, mapErrno(err)
+		return nil, &OpError{Op: "listen", Net: network, Session: -1, Err: err}
 	}
+	addr := addrs[0]
 
-	if err := dev.Listen(uint16(addr.Port)); err != nil {
-		dev.Close()
-		return nil, mapErrno(err)
+	dev, shared, err := lc.backend()
+	if err != nil {
+		return nil, &OpError{Op: "listen", Net: network, Addr: addr, Session: -1, Err: err}
 	}
+	release := shared.acquire()
 
-	return &Listener{
+	l := &Listener{
 		dev:     dev,
+		shared:  shared,
+		release: release,
 		addr:    addr,
-		known:   make(map[uint32]struct{}),
-		pollInt: 100 * time.Millisecond,
-	}, nil
+		done:    make(chan struct{}),
+		backlog: make(chan *Conn, poolioc.ListenBacklog),
+		kick:    make(chan struct{}, 1),
+		stopped: make(chan struct{}),
+		seen:    make(map[sessionKey]struct{}),
+		left:    make(map[sessionKey]struct{}),
+	}
+
+	// Sessions that exist before listening, such as outbound sessions
+	// on a shared Backend, are not inbound connections; later ones on
+	// a shared Backend are told apart through outbound.
+	if shared == nil {
+		listenStart(l)
+	}
+	sessions, err := dev.Sessions()
+	if err != nil {
+		l.unregister()
+		return nil, &OpError{Op: "listen", Net: network, Addr: addr, Session: -1, Err: err}
+	}
+	for i := range sessions {
+		l.seen[keyOf(&sessions[i])] = struct{}{}
+	}
+
+	if err := dev.Listen(uint16(addr.Port)); err != nil {
+		l.unregister()
+		return nil, &OpError{Op: "listen", Net: network, Addr: addr, Session: -1, Err: err}
+	}
+
+	go l.watch()
+	return l, nil
 }
 
-// Accept waits for and returns the next POOL connection.
-// It polls the kernel session list for newly established sessions.
-func (l *Listener) Accept() (net.Conn, error) {
+// backend returns the device to listen on: the caller-supplied Backend,
+// with a nil *sharedDevice, or a device of the listener's own.
+func (lc *ListenConfig) backend() (poolioc.Backend, *sharedDevice, error) {
+	if lc.Backend != nil {
+		return lc.Backend, nil, nil
+	}
+	m := lc.Devices
+	if m == nil {
+		m = DefaultDeviceManager
+	}
+	sd, err := m.listen()
+	if err != nil {
+		return nil, nil, err
+	}
+	return sd.dev, sd, nil
+}
+
+// watch queues newly established sessions until the Listener is closed
+// or the session table cannot be read. It re-reads the table whenever
+// the backend reports a state change, Accept frees backlog space, or
+// the poll interval elapses.
+func (l *Listener) watch() {
+	defer close(l.stopped)
+
+	notifier, _ := l.dev.(poolioc.Notifier)
+	interval := pollInterval
+	if notifier != nil {
+		interval = resyncInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
 	for {
-		l.mu.Lock()
-		if l.closed {
-			l.mu.Unlock()
-			return nil, ErrClosed
+		// Take the readiness channel before reading the table so that
+		// a change made during the read still wakes us.
+		var ready <-chan struct{}
+		if notifier != nil {
+			ready = notifier.Ready()
 		}
-		l.mu.Unlock()
-
-		sessions, err := l.dev.Sessions()
-		if err != nil {
-			return nil, mapErrno(err)
+		if err := l.scan(); err != nil {
+			l.err = l.opError("accept", err)
+			return
 		}
+		select {
+		case <-ready:
+		case <-ticker.C:
+		case <-l.kick:
+		case <-l.done:
+			return
+		}
+	}
+}
 
-		for i := range sessions {
-			s := &sessions[i]
-			if s.State != poolioc.StateEstablished {
+// scan diffs the session table against the sessions already seen,
+// keyed by index and SessionID so that a reused index is still a new
+// session. It queues each new established session while backlog space
+// remains, recording the rest in left, and forgets sessions that have
+// left the table. On a caller-supplied Backend, sessions dialed through
+// it are skipped, and new sessions wait for the next scan while a dial
+// is still connecting.
+func (l *Listener) scan() error {
+	sessions, err := l.dev.Sessions()
+	if err != nil {
+		return err
+	}
+
+	present := make(map[sessionKey]struct{}, len(sessions))
+	for i := range sessions {
+		s := &sessions[i]
+		k := keyOf(s)
+		present[k] = struct{}{}
+		if s.State != poolioc.StateEstablished {
+			continue
+		}
+		if _, ok := l.seen[k]; ok {
+			continue
+		}
+		if l.shared == nil {
+			ok, pending := dialed(l.dev, k)
+			if ok {
+				l.seen[k] = struct{}{}
 				continue
 			}
-			l.mu.Lock()
-			_, already := l.known[s.Index]
-			if !already {
-				l.known[s.Index] = struct{}{}
-			}
-			l.mu.Unlock()
-			if already {
+			if pending {
 				continue
 			}
+		}
+		if len(l.backlog) == cap(l.backlog) {
+			l.left[k] = struct{}{} // picked up once Accept makes room
+			continue
+		}
 
-			remote := &Addr{
-				IP:   net.IP(s.PeerAddr[:]).To16(),
-				Port: int(s.PeerPort),
-			}
-			return newConn(l.dev, s.Index, l.addr, remote, 0), nil
+		delete(l.left, k)
+		l.seen[k] = struct{}{}
+		remote := &Addr{
+			IP:   net.IP(s.PeerAddr[:]).To16(),
+			Port: int(s.PeerPort),
+		}
+		l.backlog <- newConn(l.dev, l.shared.acquire(), s.Index, l.addr, remote, 0)
+	}
+
+	for k := range l.seen {
+		if _, ok := present[k]; !ok {
+			delete(l.seen, k)
+		}
+	}
+	for k := range l.left {
+		if _, ok := present[k]; !ok {
+			delete(l.left, k)
+		}
+	}
+	return nil
+}
+
+// Accept waits for and returns the next POOL connection.
+func (l *Listener) Accept() (net.Conn, error) {
+	return l.AcceptContext(context.Background())
+}
+
+// AcceptContext is like [Listener.Accept] but returns ctx.Err() if ctx
+// is done before a connection arrives. The returned connection is a
+// [*Conn].
+func (l *Listener) AcceptContext(ctx context.Context) (net.Conn, error) {
+	select {
+	case <-l.done:
+		return nil, ErrClosed
+	default:
+	}
+
+	select {
+	case c := <-l.backlog:
+		return l.accepted(c), nil
+	case <-l.stopped:
+		// Hand out what was queued before the watcher failed.
+		select {
+		case c := <-l.backlog:
+			return l.accepted(c), nil
+		default:
 		}
+		if l.isClosed() {
+			return nil, ErrClosed
+		}
+		return nil, l.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-l.done:
+		return nil, ErrClosed
+	}
+}
+
+// accepted wakes the watcher, which may have left sessions behind while
+// the backlog was full, and returns c.
+func (l *Listener) accepted(c *Conn) *Conn {
+	l.wake()
+	return c
+}
 
-		time.Sleep(l.pollInt)
+// wake makes the watcher re-read the session table.
+func (l *Listener) wake() {
+	select {
+	case l.kick <- struct{}{}:
+	default:
 	}
 }
 
-// Close stops the POOL listener and releases the device.
+func (l *Listener) isClosed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closed
+}
+
+// Close stops the POOL listener, closes sessions that were never
+// accepted, whether queued or left waiting for backlog space, and
+// releases the Listener's reference to its device. Accepted connections
+// are not affected.
 func (l *Listener) Close() error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
@@ -111,10 +323,43 @@ func (l *Listener) Close() error {
 		return ErrClosed
 	}
 	l.closed = true
-
+	close(l.done)
+	<-l.stopped
 	err := l.dev.Stop()
-	_ = l.dev.Close()
-	return mapErrno(err)
+
+	// The watcher has exited, so nothing else sends on the backlog. A
+	// last scan picks up sessions established before the listener
+	// stopped.
+	_ = l.scan()
+	for len(l.backlog) > 0 {
+		(<-l.backlog).Close()
+	}
+	for k := range l.left {
+		_ = l.dev.CloseSession(k.idx)
+	}
+	l.unregister()
+	return l.opError("close", err)
+}
+
+// unregister drops the Listener from outbound, if it is there, and
+// releases its reference to its device.
+func (l *Listener) unregister() {
+	if l.shared == nil {
+		listenStop(l)
+	}
+	l.release()
+}
+
+// opError wraps an error from the operation op in an [OpError], like
+// [Conn.opError].
+func (l *Listener) opError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if sentinel(err) == ErrClosed {
+		return ErrClosed
+	}
+	return &OpError{Op: op, Net: "pool", Addr: l.addr, Session: -1, Err: err}
 }
 
 // Addr returns the listener's network address.
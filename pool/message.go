@@ -0,0 +1,213 @@
+//go:build linux
+
+package pool
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/amosdavis/pool-go/poolioc"
+)
+
+// DefaultMaxMessageSize is the largest message [Conn.ReadMessage] and
+// [Conn.WriteMessage] accept unless changed with SetMaxMessageSize.
+const DefaultMaxMessageSize = 16 << 20
+
+// A message is sent as one or more chunks of at most chunkSize bytes,
+// each a backend message on the same channel. The first chunk starts
+// with the message length as a big-endian uint64.
+const (
+	chunkSize     = poolioc.MaxPayload
+	msgHeaderSize = 8
+)
+
+// framer splits messages into chunks and joins them again. Its zero
+// value is ready to use.
+type framer struct {
+	max atomic.Int64 // zero means DefaultMaxMessageSize
+
+	wmu  sync.Mutex
+	werr error // set when a message was only partly sent
+
+	rmu  sync.Mutex
+	rbuf []byte
+	msg  []byte // message being read, nil between messages
+	want uint64 // length of msg when complete
+	skip uint64 // bytes left of a message being discarded
+}
+
+func (f *framer) maxSize() uint64 {
+	if n := f.max.Load(); n > 0 {
+		return uint64(n)
+	}
+	return DefaultMaxMessageSize
+}
+
+func (f *framer) setMaxSize(n int) {
+	f.max.Store(int64(max(n, 0)))
+}
+
+// write sends b as one message through send.
+func (f *framer) write(ctx context.Context, send func(context.Context, []byte) error, b []byte) error {
+	if uint64(len(b)) > f.maxSize() {
+		return ErrMessageTooLarge
+	}
+
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+	if f.werr != nil {
+		return f.werr
+	}
+
+	n := min(len(b), chunkSize-msgHeaderSize)
+	first := make([]byte, msgHeaderSize, msgHeaderSize+n)
+	binary.BigEndian.PutUint64(first, uint64(len(b)))
+	first = append(first, b[:n]...)
+	if err := send(ctx, first); err != nil {
+		return err
+	}
+	for b = b[n:]; len(b) > 0; b = b[n:] {
+		n = min(len(b), chunkSize)
+		if err := send(ctx, b[:n]); err != nil {
+			// The peer is left mid-message; nothing sent after
+			// this point could be framed correctly.
+			f.werr = err
+			return err
+		}
+	}
+	return nil
+}
+
+// read receives one message through recv. A message longer than the
+// limit is discarded and reported as [ErrMessageTooLarge]. If recv
+// fails mid-message, the next read resumes where it left off; if the
+// channel ends mid-message, read fails with [io.ErrUnexpectedEOF].
+func (f *framer) read(ctx context.Context, recv func(context.Context, []byte) (int, error)) ([]byte, error) {
+	f.rmu.Lock()
+	defer f.rmu.Unlock()
+	if f.rbuf == nil {
+		f.rbuf = make([]byte, chunkSize)
+	}
+
+	for {
+		n, err := recv(ctx, f.rbuf)
+		if err != nil && f.msg != nil && endOfStream(err) {
+			f.msg = nil
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		chunk := f.rbuf[:n]
+
+		switch {
+		case f.skip > 0:
+			f.skip -= min(f.skip, uint64(n))
+			continue
+		case f.msg == nil:
+			if n < msgHeaderSize {
+				return nil, ErrBadMessage
+			}
+			size := binary.BigEndian.Uint64(chunk)
+			chunk = chunk[msgHeaderSize:]
+			if uint64(len(chunk)) > size {
+				return nil, ErrBadMessage
+			}
+			if size > f.maxSize() {
+				f.skip = size - uint64(len(chunk))
+				return nil, ErrMessageTooLarge
+			}
+			f.msg = make([]byte, 0, size)
+			f.want = size
+		case uint64(len(f.msg)+n) > f.want:
+			f.msg = nil
+			return nil, ErrBadMessage
+		}
+
+		f.msg = append(f.msg, chunk...)
+		if uint64(len(f.msg)) == f.want {
+			msg := f.msg
+			f.msg = nil
+			return msg, nil
+		}
+	}
+}
+
+// WriteMessage sends b as a single message of any size up to the
+// maximum message size, split into as many backend messages as needed.
+// The peer must receive it with ReadMessage. Do not mix WriteMessage
+// with Write on the same channel.
+//
+// If WriteMessage fails after sending part of b, the peer is left
+// mid-message and every later WriteMessage returns the same error.
+func (c *Conn) WriteMessage(ctx context.Context, b []byte) error {
+	if c.isClosed() {
+		return ErrClosed
+	}
+	wctx, stop := c.writeDeadline.merge(ctx)
+	defer stop()
+	err := c.msgs.write(wctx, func(ctx context.Context, chunk []byte) error {
+		return c.send(ctx, c.channel, PriorityDefault, 0, chunk)
+	}, b)
+	return c.ioError("write", err, &c.writeDeadline)
+}
+
+// ReadMessage receives the next message sent with WriteMessage. A
+// message larger than the maximum message size is discarded and
+// reported as [ErrMessageTooLarge]; the following ReadMessage returns
+// the message after it. The read deadline applies to the whole call.
+func (c *Conn) ReadMessage(ctx context.Context) ([]byte, error) {
+	if c.isClosed() {
+		return nil, ErrClosed
+	}
+	rctx, stop := c.readDeadline.merge(ctx)
+	defer stop()
+	msg, err := c.msgs.read(rctx, func(ctx context.Context, b []byte) (int, error) {
+		info, err := c.recv(ctx, c.channel, b)
+		return info.Len, err
+	})
+	return msg, c.ioError("read", err, &c.readDeadline)
+}
+
+// SetMaxMessageSize sets the largest message WriteMessage sends and
+// ReadMessage accepts. Zero or a negative n restores
+// [DefaultMaxMessageSize]. Channels opened afterwards inherit the
+// limit.
+func (c *Conn) SetMaxMessageSize(n int) {
+	c.msgs.setMaxSize(n)
+}
+
+// WriteMessage is like [Conn.WriteMessage] on this channel.
+func (cc *ChannelConn) WriteMessage(ctx context.Context, b []byte) error {
+	if cc.isClosed() {
+		return ErrClosed
+	}
+	wctx, stop := cc.writeDeadline.merge(ctx)
+	defer stop()
+	err := cc.msgs.write(wctx, func(ctx context.Context, chunk []byte) error {
+		return cc.conn.send(ctx, cc.channel, PriorityDefault, 0, chunk)
+	}, b)
+	return cc.ioError("write", err, &cc.writeDeadline)
+}
+
+// ReadMessage is like [Conn.ReadMessage] on this channel.
+func (cc *ChannelConn) ReadMessage(ctx context.Context) ([]byte, error) {
+	if cc.isClosed() {
+		return nil, ErrClosed
+	}
+	rctx, stop := cc.readDeadline.merge(ctx)
+	defer stop()
+	msg, err := cc.msgs.read(rctx, func(ctx context.Context, b []byte) (int, error) {
+		info, err := cc.conn.recv(ctx, cc.channel, b)
+		return info.Len, err
+	})
+	return msg, cc.ioError("read", err, &cc.readDeadline)
+}
+
+// SetMaxMessageSize is like [Conn.SetMaxMessageSize] for this channel.
+func (cc *ChannelConn) SetMaxMessageSize(n int) {
+	cc.msgs.setMaxSize(n)
+}
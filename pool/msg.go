@@ -0,0 +1,147 @@
+//go:build linux
+
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/amosdavis/pool-go/poolioc"
+)
+
+// Message is one POOL message with its per-message metadata, as
+// returned by ReadMsg and sent by WriteMsg.
+type Message struct {
+	Data []byte
+
+	// Channel is the channel the message arrived on. WriteMsg ignores
+	// it and sends on the channel of its Conn or ChannelConn.
+	Channel uint8
+
+	// Flags holds poolioc.Flag* bits. WriteMsg passes them as
+	// SendReq.Flags, for example FlagPriority or FlagRequireAck, except
+	// FlagCompressed, which is set only by compression (see
+	// [Conn.SetCompression]); ReadMsg reports RecvReq.Flags, such as
+	// FlagEncrypted, FlagCompressed, FlagPriority and FlagTelemetry.
+	Flags uint8
+
+	// Priority is the class WriteMsg sends the message as. Zero
+	// (PriorityDefault) uses the channel's class, or PriorityHigh if
+	// Flags has FlagPriority. ReadMsg leaves it zero.
+	Priority Priority
+
+	// Seq and Time are the sender's sequence number and timestamp from
+	// the packet header, where the backend reports them (pooludp does,
+	// the kernel module does not); otherwise they are zero. WriteMsg
+	// ignores them.
+	Seq  uint64
+	Time time.Time
+}
+
+// priority returns the class m is sent as, PriorityDefault meaning
+// that of its channel.
+func (m *Message) priority() Priority {
+	if m.Priority == PriorityDefault && m.Flags&poolioc.FlagPriority != 0 {
+		return PriorityHigh
+	}
+	return m.Priority
+}
+
+// msgBufs holds receive buffers for ReadMsg.
+var msgBufs = sync.Pool{
+	New: func() any { return new([poolioc.MaxPayload]byte) },
+}
+
+// sendMsg sends data with flags. A backend that does not implement
+// [poolioc.MessageBackend] can only send without flags.
+func sendMsg(ctx context.Context, dev poolioc.Backend, idx uint32, ch uint8, flags uint8, data []byte) error {
+	if mb, ok := dev.(poolioc.MessageBackend); ok {
+		return mb.SendMsg(ctx, idx, ch, flags, data)
+	}
+	if flags != 0 {
+		return fmt.Errorf("pool: backend cannot send message flags: %w", errors.ErrUnsupported)
+	}
+	return sendBytes(ctx, dev, idx, ch, data)
+}
+
+// recvMsg receives one whole message on ch, growing its buffer as
+// needed.
+func (c *Conn) recvMsg(ctx context.Context, ch uint8) (*Message, error) {
+	pooled := msgBufs.Get().(*[poolioc.MaxPayload]byte)
+	defer msgBufs.Put(pooled)
+	buf := pooled[:]
+	for {
+		info, err := c.recv(ctx, ch, buf)
+		if errors.Is(err, syscall.EMSGSIZE) && len(buf) < DefaultMaxMessageSize {
+			buf = make([]byte, min(2*len(buf), DefaultMaxMessageSize))
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		m := &Message{
+			Data:    append([]byte(nil), buf[:info.Len]...),
+			Channel: ch,
+			Flags:   info.Flags,
+			Seq:     info.Seq,
+		}
+		if info.Timestamp != 0 {
+			m.Time = time.Unix(0, int64(info.Timestamp))
+		}
+		return m, nil
+	}
+}
+
+// WriteMsg sends m.Data as one message with m.Flags. The message must
+// fit in a single backend message (see [ErrMessageTooLarge]). If the
+// backend does not carry flags, a message with flags fails with an
+// error wrapping [errors.ErrUnsupported]. The write deadline applies.
+func (c *Conn) WriteMsg(ctx context.Context, m *Message) error {
+	if c.isClosed() {
+		return ErrClosed
+	}
+	wctx, stop := c.writeDeadline.merge(ctx)
+	defer stop()
+	err := c.send(wctx, c.channel, m.priority(), m.Flags, m.Data)
+	return c.ioError("write", err, &c.writeDeadline)
+}
+
+// ReadMsg receives the next message whole, with its metadata. Message
+// boundaries are preserved regardless of the read mode. Do not mix
+// ReadMsg with Read, which may hold part of a message. The read
+// deadline applies.
+func (c *Conn) ReadMsg(ctx context.Context) (*Message, error) {
+	if c.isClosed() {
+		return nil, ErrClosed
+	}
+	rctx, stop := c.readDeadline.merge(ctx)
+	defer stop()
+	m, err := c.recvMsg(rctx, c.channel)
+	return m, c.ioError("read", err, &c.readDeadline)
+}
+
+// WriteMsg is like [Conn.WriteMsg] on this channel.
+func (cc *ChannelConn) WriteMsg(ctx context.Context, m *Message) error {
+	if cc.isClosed() {
+		return ErrClosed
+	}
+	wctx, stop := cc.writeDeadline.merge(ctx)
+	defer stop()
+	err := cc.conn.send(wctx, cc.channel, m.priority(), m.Flags, m.Data)
+	return cc.ioError("write", err, &cc.writeDeadline)
+}
+
+// ReadMsg is like [Conn.ReadMsg] on this channel.
+func (cc *ChannelConn) ReadMsg(ctx context.Context) (*Message, error) {
+	if cc.isClosed() {
+		return nil, ErrClosed
+	}
+	rctx, stop := cc.readDeadline.merge(ctx)
+	defer stop()
+	m, err := cc.conn.recvMsg(rctx, cc.channel)
+	return m, cc.ioError("read", err, &cc.readDeadline)
+}
@@ -0,0 +1,125 @@
+//go:build linux
+
+package pool
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/amosdavis/pool-go/poolioc"
+)
+
+// outbound tracks the sessions dialed through caller-supplied Backends
+// while a Listener runs on one. The session table does not say which
+// side initiated a session, so without it a Listener sharing its
+// Backend with a Dialer would queue the Dialer's sessions as inbound.
+// Devices of a DeviceManager are never shared that way.
+var outbound struct {
+	mu        sync.Mutex
+	listeners map[*Listener]struct{} // Listeners on caller-supplied Backends
+	dialing   int                    // dials connecting on caller-supplied Backends
+	sessions  map[dialedKey]struct{} // sessions those dials established
+}
+
+// dialedKey identifies a dialed session by its Backend and its key in
+// the Backend's session table.
+type dialedKey struct {
+	dev poolioc.Backend
+	sessionKey
+}
+
+// trackable reports whether dev can be part of a dialedKey. A Backend
+// of a type that is not comparable, which no Listener could share
+// by identity, is not tracked.
+func trackable(dev poolioc.Backend) bool {
+	return reflect.TypeOf(dev).Comparable()
+}
+
+// listenStart registers a Listener on a caller-supplied Backend. It
+// must be called before the Listener first reads the session table.
+func listenStart(l *Listener) {
+	outbound.mu.Lock()
+	defer outbound.mu.Unlock()
+	if outbound.listeners == nil {
+		outbound.listeners = make(map[*Listener]struct{})
+	}
+	outbound.listeners[l] = struct{}{}
+}
+
+// listenStop unregisters a Listener registered with listenStart.
+func listenStop(l *Listener) {
+	outbound.mu.Lock()
+	defer outbound.mu.Unlock()
+	delete(outbound.listeners, l)
+}
+
+// dialStart records a dial connecting on a caller-supplied Backend.
+// Until dialDone, Listeners leave new sessions they cannot place yet
+// for a later scan.
+func dialStart() {
+	outbound.mu.Lock()
+	defer outbound.mu.Unlock()
+	outbound.dialing++
+}
+
+// dialDone records the end of a dial started with dialStart, which
+// established session idx on dev unless it failed. If a Listener runs,
+// the session's ID is recorded, and the returned function forgets it
+// once the session is closed.
+func dialDone(dev poolioc.Backend, idx int, failed bool) (forget func()) {
+	outbound.mu.Lock()
+	listening := len(outbound.listeners) > 0
+	outbound.mu.Unlock()
+
+	k := dialedKey{dev: dev}
+	found := false
+	if !failed && listening && trackable(dev) {
+		k.sessionKey, found = lookup(dev, uint32(idx))
+	}
+
+	outbound.mu.Lock()
+	defer outbound.mu.Unlock()
+	forget = func() {}
+	if found {
+		if outbound.sessions == nil {
+			outbound.sessions = make(map[dialedKey]struct{})
+		}
+		outbound.sessions[k] = struct{}{}
+		forget = func() {
+			outbound.mu.Lock()
+			defer outbound.mu.Unlock()
+			delete(outbound.sessions, k)
+		}
+	}
+	outbound.dialing--
+	for l := range outbound.listeners {
+		l.wake()
+	}
+	return forget
+}
+
+// dialed reports whether session k of dev was dialed through it, and
+// whether a dial on a caller-supplied Backend is still connecting, so
+// that the answer may change.
+func dialed(dev poolioc.Backend, k sessionKey) (ok, pending bool) {
+	outbound.mu.Lock()
+	defer outbound.mu.Unlock()
+	if trackable(dev) {
+		_, ok = outbound.sessions[dialedKey{dev, k}]
+	}
+	return ok, outbound.dialing > 0
+}
+
+// lookup returns the key of session idx on dev.
+func lookup(dev poolioc.Backend, idx uint32) (sessionKey, bool) {
+	sessions, err := dev.Sessions()
+	if err != nil {
+		return sessionKey{}, false
+	}
+	for i := range sessions {
+		if sessions[i].Index == idx {
+			return keyOf(&sessions[i]), true
+		}
+	}
+	return sessionKey{}, false
+}
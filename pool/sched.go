@@ -0,0 +1,347 @@
+//go:build linux
+
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/amosdavis/pool-go/poolioc"
+)
+
+// Priority is the traffic class of a channel or message. When writes
+// on several channels of a Conn are waiting to be sent, the Conn's
+// scheduler sends them in weighted round-robin order across classes,
+// so higher classes go first without starving lower ones.
+type Priority uint8
+
+const (
+	// PriorityDefault leaves the class of a [Message] to its channel.
+	// Set on a channel, it restores PriorityNormal.
+	PriorityDefault Priority = iota
+
+	// PriorityBulk is for transfers that may wait, such as files. It
+	// gets one turn for every two of PriorityNormal.
+	PriorityBulk
+
+	// PriorityNormal is the class of a channel unless set otherwise.
+	PriorityNormal
+
+	// PriorityHigh is for interactive and control traffic. It gets two
+	// turns for every one of PriorityNormal, and its messages are sent
+	// with [poolioc.FlagPriority] where the backend carries flags.
+	PriorityHigh
+)
+
+// priorityWeights are the turns each class gets per round.
+var priorityWeights = [...]int{
+	PriorityBulk:   1,
+	PriorityNormal: 2,
+	PriorityHigh:   4,
+}
+
+var priorityNames = [...]string{
+	PriorityDefault: "default",
+	PriorityBulk:    "bulk",
+	PriorityNormal:  "normal",
+	PriorityHigh:    "high",
+}
+
+func (p Priority) String() string {
+	if int(p) < len(priorityNames) {
+		return priorityNames[p]
+	}
+	return fmt.Sprintf("Priority(%d)", uint8(p))
+}
+
+// ChannelStats reports how the scheduler has treated the writes on one
+// channel. Waits, WaitTime and MaxWait grow when the channel's writes
+// queue behind others; Pending and Oldest show a channel being starved
+// right now.
+type ChannelStats struct {
+	Channel  uint8
+	Priority Priority
+
+	Sends    uint64        // writes let through to the backend
+	Waits    uint64        // writes that queued behind another
+	WaitTime time.Duration // total time writes spent queued
+	MaxWait  time.Duration // longest time a write spent queued
+
+	Pending int           // writes queued now
+	Oldest  time.Duration // how long the oldest queued write has waited
+}
+
+// turn is a write waiting for the scheduler.
+type turn struct {
+	ch    uint8
+	since time.Time
+	ready chan struct{} // closed when the write may proceed
+}
+
+// scheduler lets one write at a time through to the backend, choosing
+// among waiting writes by class. Its zero value is ready to use.
+type scheduler struct {
+	mu      sync.Mutex
+	busy    bool // a write holds the turn
+	queues  [PriorityHigh + 1][]*turn
+	current [PriorityHigh + 1]int // smooth weighted round-robin state
+	chans   map[uint8]*ChannelStats
+}
+
+// stats returns the stats of ch, which also hold its class. s.mu must
+// be held.
+func (s *scheduler) stats(ch uint8) *ChannelStats {
+	if s.chans == nil {
+		s.chans = make(map[uint8]*ChannelStats)
+	}
+	st, ok := s.chans[ch]
+	if !ok {
+		st = &ChannelStats{Channel: ch, Priority: PriorityNormal}
+		s.chans[ch] = st
+	}
+	return st
+}
+
+// setPriority sets the class of ch.
+func (s *scheduler) setPriority(ch uint8, p Priority) {
+	if p == PriorityDefault || p > PriorityHigh {
+		p = PriorityNormal
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats(ch).Priority = p
+}
+
+// class returns the class a write on ch is sent as: p unless it is
+// PriorityDefault, then that of the channel.
+func (s *scheduler) class(ch uint8, p Priority) Priority {
+	if p != PriorityDefault && p <= PriorityHigh {
+		return p
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats(ch).Priority
+}
+
+// acquire waits for the turn to send on ch as class p. The caller must
+// release it once the backend has taken the write.
+func (s *scheduler) acquire(ctx context.Context, ch uint8, p Priority) error {
+	s.mu.Lock()
+	st := s.stats(ch)
+	if !s.busy {
+		s.busy = true
+		st.Sends++
+		s.mu.Unlock()
+		return nil
+	}
+	t := &turn{ch: ch, since: time.Now(), ready: make(chan struct{})}
+	s.queues[p] = append(s.queues[p], t)
+	st.Pending++
+	s.mu.Unlock()
+
+	select {
+	case <-t.ready:
+		return nil
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	if i := slices.Index(s.queues[p], t); i >= 0 {
+		s.queues[p] = slices.Delete(s.queues[p], i, i+1)
+		st.Pending--
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+	s.mu.Unlock()
+	s.release() // granted as ctx finished: pass the turn on
+	return ctx.Err()
+}
+
+// release hands the turn to the next waiting write, if any. Classes
+// with writes waiting share turns by smooth weighted round-robin.
+func (s *scheduler) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next, total := PriorityDefault, 0
+	for p := PriorityHigh; p >= PriorityBulk; p-- {
+		if len(s.queues[p]) == 0 {
+			s.current[p] = 0
+			continue
+		}
+		s.current[p] += priorityWeights[p]
+		total += priorityWeights[p]
+		if next == PriorityDefault || s.current[p] > s.current[next] {
+			next = p
+		}
+	}
+	if next == PriorityDefault {
+		s.busy = false
+		return
+	}
+	s.current[next] -= total
+
+	t := s.queues[next][0]
+	s.queues[next] = s.queues[next][1:]
+	wait := time.Since(t.since)
+	st := s.stats(t.ch)
+	st.Pending--
+	st.Sends++
+	st.Waits++
+	st.WaitTime += wait
+	st.MaxWait = max(st.MaxWait, wait)
+	close(t.ready)
+}
+
+// channelStats returns a snapshot of the stats of ch.
+func (s *scheduler) channelStats(ch uint8, now time.Time) ChannelStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.snapshot(s.stats(ch), now)
+}
+
+// allStats returns a snapshot of the stats of every channel written to
+// or given a class, ordered by channel.
+func (s *scheduler) allStats(now time.Time) []ChannelStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]ChannelStats, 0, len(s.chans))
+	for _, st := range s.chans {
+		out = append(out, s.snapshot(st, now))
+	}
+	slices.SortFunc(out, func(a, b ChannelStats) int { return int(a.Channel) - int(b.Channel) })
+	return out
+}
+
+// snapshot copies st, filling in Oldest. s.mu must be held.
+func (s *scheduler) snapshot(st *ChannelStats, now time.Time) ChannelStats {
+	out := *st
+	for _, q := range s.queues {
+		for _, t := range q {
+			if t.ch == st.Channel {
+				out.Oldest = max(out.Oldest, now.Sub(t.since))
+			}
+		}
+	}
+	return out
+}
+
+// sendPoll is how often a write whose backend queue is full retries
+// when the backend cannot report readiness.
+const sendPoll = 10 * time.Millisecond
+
+// schedule runs send once the scheduler gives ch the turn, as class p
+// or the channel's class. send is passed flags with FlagPriority added
+// for PriorityHigh if the backend carries message flags.
+//
+// send runs under a [poolioc.NoWait] context. If the backend's queue
+// is full, send fails with EAGAIN and schedule gives up the turn while
+// it waits for room, so that a stalled channel does not hold up writes
+// on the others; send is then run again at the channel's next turn.
+// Backends that ignore NoWait wait for room holding the turn.
+func (c *Conn) schedule(ctx context.Context, ch uint8, p Priority, flags uint8, send func(ctx context.Context, flags uint8) error) error {
+	p = c.sched.class(ch, p)
+	if _, ok := c.dev.(poolioc.MessageBackend); ok && p == PriorityHigh {
+		flags |= poolioc.FlagPriority
+	}
+	for {
+		if err := c.sched.acquire(ctx, ch, p); err != nil {
+			return err
+		}
+		ready := c.ready()
+		err := send(poolioc.NoWait(ctx), flags)
+		c.sched.release()
+		if !errors.Is(err, syscall.EAGAIN) {
+			return err
+		}
+		if err := waitReady(ctx, ready); err != nil {
+			return err
+		}
+	}
+}
+
+// ready returns a channel closed at the backend's next change of state,
+// or nil if it cannot report one.
+func (c *Conn) ready() <-chan struct{} {
+	if n, ok := c.dev.(poolioc.Notifier); ok {
+		return n.Ready()
+	}
+	return nil
+}
+
+// waitReady waits until ready is closed, or for sendPoll if ready is
+// nil. It returns ctx.Err() if ctx is done first.
+func waitReady(ctx context.Context, ready <-chan struct{}) error {
+	if ready == nil {
+		t := time.NewTimer(sendPoll)
+		defer t.Stop()
+		select {
+		case <-t.C:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// send sends data on ch through the scheduler, compressed if ch has
+// compression on. FlagCompressed in flags is ignored.
+func (c *Conn) send(ctx context.Context, ch uint8, p Priority, flags uint8, data []byte) error {
+	return c.sendWith(ctx, ch, p, flags, data, func(ctx context.Context, flags uint8, b []byte) error {
+		return sendMsg(ctx, c.dev, c.sessionIdx, ch, flags, b)
+	})
+}
+
+// sendWith is send, handing the message, compressed or not, to the
+// backend with put in the scheduler's turn, after any negotiation
+// messages pending on ch.
+func (c *Conn) sendWith(ctx context.Context, ch uint8, p Priority, flags uint8, data []byte, put func(ctx context.Context, flags uint8, b []byte) error) error {
+	flags &^= poolioc.FlagCompressed
+	z, tried := c.comp.compress(ch, data)
+	err := c.schedule(ctx, ch, p, flags, func(ctx context.Context, flags uint8) error {
+		if err := c.negotiate(ctx, ch, flags); err != nil {
+			return err
+		}
+		if z != nil {
+			return put(ctx, flags|poolioc.FlagCompressed, z)
+		}
+		return put(ctx, flags, data)
+	})
+	if err == nil && tried {
+		c.comp.counted(ch, len(data), z)
+	}
+	return err
+}
+
+// SetPriority sets the class of writes on the Conn's channel. The
+// default is [PriorityNormal].
+func (c *Conn) SetPriority(p Priority) {
+	c.sched.setPriority(c.channel, p)
+}
+
+// ChannelStats reports the scheduler's treatment of each channel of
+// the Conn that has been written to or given a class.
+func (c *Conn) ChannelStats() []ChannelStats {
+	return c.sched.allStats(time.Now())
+}
+
+// SetPriority is like [Conn.SetPriority] for this channel. The class
+// belongs to the channel: ChannelConns on the same channel share it.
+func (cc *ChannelConn) SetPriority(p Priority) {
+	cc.conn.sched.setPriority(cc.channel, p)
+}
+
+// Stats reports the scheduler's treatment of this channel.
+func (cc *ChannelConn) Stats() ChannelStats {
+	return cc.conn.sched.channelStats(cc.channel, time.Now())
+}
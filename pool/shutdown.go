@@ -0,0 +1,91 @@
+//go:build linux
+
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/amosdavis/pool-go/poolioc"
+)
+
+// shutdown closes ch for writing through the scheduler, after the
+// writes already queued on it.
+func (c *Conn) shutdown(ctx context.Context, ch uint8, reason poolioc.WireError) error {
+	sb, ok := c.dev.(poolioc.ShutdownBackend)
+	if !ok {
+		return fmt.Errorf("pool: backend cannot close a channel for writing: %w", errors.ErrUnsupported)
+	}
+	return c.schedule(ctx, ch, PriorityDefault, 0, func(ctx context.Context, _ uint8) error {
+		return sb.Shutdown(ctx, c.sessionIdx, ch, reason)
+	})
+}
+
+// CloseWrite closes the Conn's channel for writing, as PktClose closes
+// a session: once the peer has read what was written before, its reads
+// return [io.EOF]. Reads on this side go on until the peer closes its
+// side in turn, and later writes fail with [ErrWriteClosed].
+//
+// CloseWrite needs a backend that implements [poolioc.ShutdownBackend],
+// such as the userspace stack of package pooludp. On /dev/pool it
+// fails with an error wrapping [errors.ErrUnsupported], since the
+// kernel module cannot close one channel of a session; close the Conn
+// instead.
+func (c *Conn) CloseWrite() error {
+	return c.CloseWriteReason(context.Background(), 0)
+}
+
+// CloseWriteReason is like [Conn.CloseWrite] but gives the peer a
+// reason, a POOL error code such as [poolioc.ErrOverload]: instead of
+// io.EOF, its reads then fail with an [*OpError] whose cause is a
+// [*poolioc.ShutdownError] carrying it, and which matches the sentinel
+// for the code, such as [ErrOverload]. A zero reason is an orderly
+// close. The write deadline applies.
+func (c *Conn) CloseWriteReason(ctx context.Context, reason poolioc.WireError) error {
+	if c.isClosed() {
+		return ErrClosed
+	}
+	wctx, stop := c.writeDeadline.merge(ctx)
+	defer stop()
+	err := c.shutdown(wctx, c.channel, reason)
+	return c.ioError("close", err, &c.writeDeadline)
+}
+
+// CloseRead stops reading: reads waiting return and later ones return
+// [io.EOF], apart from data already received. The peer is not told and
+// may go on writing; its messages are left unread.
+func (c *Conn) CloseRead() error {
+	if c.isClosed() {
+		return ErrClosed
+	}
+	c.readDeadline.shut(io.EOF)
+	return nil
+}
+
+// CloseWrite is like [Conn.CloseWrite] for this channel. The channel
+// stays subscribed until Close.
+func (cc *ChannelConn) CloseWrite() error {
+	return cc.CloseWriteReason(context.Background(), 0)
+}
+
+// CloseWriteReason is like [Conn.CloseWriteReason] for this channel.
+func (cc *ChannelConn) CloseWriteReason(ctx context.Context, reason poolioc.WireError) error {
+	if cc.isClosed() {
+		return ErrClosed
+	}
+	wctx, stop := cc.writeDeadline.merge(ctx)
+	defer stop()
+	err := cc.conn.shutdown(wctx, cc.channel, reason)
+	return cc.ioError("close", err, &cc.writeDeadline)
+}
+
+// CloseRead is like [Conn.CloseRead] for this channel.
+func (cc *ChannelConn) CloseRead() error {
+	if cc.isClosed() {
+		return ErrClosed
+	}
+	cc.readDeadline.shut(io.EOF)
+	return nil
+}
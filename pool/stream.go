@@ -0,0 +1,110 @@
+//go:build linux
+
+package pool
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/amosdavis/pool-go/poolioc"
+)
+
+// ReadMode selects how Read treats POOL message boundaries.
+type ReadMode int32
+
+const (
+	// StreamMode gives Read byte-stream semantics, as for a TCP
+	// connection: a message larger than the buffer is returned over
+	// several reads and message boundaries are not preserved. It is
+	// the default.
+	StreamMode ReadMode = iota
+
+	// MessageMode makes each Read return exactly one message. A buffer
+	// too small for the next message fails with [ErrBufferTooSmall],
+	// leaving the message queued.
+	MessageMode
+)
+
+// streamReader buffers the unread part of a message for stream-mode
+// reads. It must be created with newStreamReader.
+type streamReader struct {
+	mode atomic.Int32
+	sem  chan struct{} // held by the reader, so waiting honors ctx
+	buf  []byte        // receive buffer for messages b cannot hold
+	rest []byte        // unread bytes of the last message, within buf
+}
+
+func newStreamReader(mode ReadMode) *streamReader {
+	r := &streamReader{sem: make(chan struct{}, 1)}
+	r.mode.Store(int32(mode))
+	return r
+}
+
+// read fills b through recv. Bytes left over from an earlier message
+// are returned first, in either mode, even once ctx is done.
+func (r *streamReader) read(ctx context.Context, recv func(context.Context, []byte) (int, error), b []byte) (int, error) {
+	select {
+	case r.sem <- struct{}{}:
+	default:
+		select {
+		case r.sem <- struct{}{}:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+	defer func() { <-r.sem }()
+
+	if len(r.rest) > 0 {
+		n := copy(b, r.rest)
+		r.rest = r.rest[n:]
+		if len(r.rest) == 0 && len(r.buf) > poolioc.MaxPayload {
+			r.buf = nil // do not keep an oversized buffer around
+		}
+		return n, nil
+	}
+
+	if ReadMode(r.mode.Load()) == MessageMode || len(b) >= poolioc.MaxPayload {
+		n, err := recv(ctx, b)
+		if !errors.Is(err, syscall.EMSGSIZE) {
+			return n, err
+		}
+		if ReadMode(r.mode.Load()) == MessageMode {
+			return 0, ErrBufferTooSmall
+		}
+	}
+
+	// The message may be larger than b: receive it whole, growing the
+	// buffer while the backend reports it too small, and keep the rest.
+	for {
+		if r.buf == nil {
+			r.buf = make([]byte, max(poolioc.MaxPayload, len(b)))
+		}
+		n, err := recv(ctx, r.buf)
+		if errors.Is(err, syscall.EMSGSIZE) && len(r.buf) < DefaultMaxMessageSize {
+			r.buf = make([]byte, min(2*len(r.buf), DefaultMaxMessageSize))
+			continue
+		}
+		if errors.Is(err, syscall.EMSGSIZE) {
+			return 0, ErrBufferTooSmall
+		}
+		if err != nil {
+			return 0, err
+		}
+		m := copy(b, r.buf[:n])
+		r.rest = r.buf[m:n]
+		return m, nil
+	}
+}
+
+// SetReadMode sets how Read treats message boundaries. The default is
+// [StreamMode]. Channels opened afterwards inherit the mode.
+func (c *Conn) SetReadMode(mode ReadMode) {
+	c.in.mode.Store(int32(mode))
+}
+
+// SetReadMode is like [Conn.SetReadMode] for this channel.
+func (cc *ChannelConn) SetReadMode(mode ReadMode) {
+	cc.in.mode.Store(int32(mode))
+}
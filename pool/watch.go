@@ -0,0 +1,43 @@
+//go:build linux
+
+package pool
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/amosdavis/pool-go/poolioc"
+)
+
+// Watch streams lifecycle events for the sessions visible on b: a
+// session becoming established, starting a rekey, changing config
+// version, closing, or leaving the session table. Each event carries
+// the session before and after the change. The sessions present when
+// Watch is called produce no events.
+//
+// b is the backend whose sessions to watch, such as the device given to
+// [Dialer] or [ListenConfig]; Watch fails with an error wrapping
+// [os.ErrInvalid] if it is nil. Backends implementing
+// [poolioc.EventBackend] supply their own events; others are watched
+// with [poolioc.PollEvents].
+//
+// The channel is closed when ctx is done or the session table can no
+// longer be read.
+func Watch(ctx context.Context, b poolioc.Backend) (<-chan poolioc.Event, error) {
+	if b == nil {
+		return nil, fmt.Errorf("pool: watch: no backend: %w", os.ErrInvalid)
+	}
+
+	var ch <-chan poolioc.Event
+	var err error
+	if eb, ok := b.(poolioc.EventBackend); ok {
+		ch, err = eb.Events(ctx)
+	} else {
+		ch, err = poolioc.PollEvents(ctx, b)
+	}
+	if err != nil {
+		return nil, mapErrno(err)
+	}
+	return ch, nil
+}
@@ -0,0 +1,22 @@
+// Package poolfrag splits POOL messages into fragments that fit the path
+// MTU and reassembles them on receipt.
+//
+// Each fragment travels in its own packet with poolioc.FlagFragment set
+// (and poolioc.FlagLastFrag on the final one), its payload prefixed by a
+// [poolwire.FragHeader], as pool.ko sends them. A fragmented message
+// holds at most poolioc.MaxPayload bytes in up to poolioc.MaxFrags
+// fragments; larger ones are framed over several messages by
+// pool.Conn.WriteMessage:
+//
+//	frags, err := poolfrag.Split(id, msg, poolfrag.PayloadSize(mtu))
+//	for _, f := range frags {
+//		payload, _ := f.MarshalBinary()
+//		// send payload
+//	}
+//
+// A [Reassembler] collects fragments in any order and returns each
+// message once all of its fragments have arrived. Incomplete messages
+// expire after poolioc.FragTimeoutMS and the memory they may hold is
+// bounded, so one Reassembler per session keeps a misbehaving peer from
+// exhausting the receiver.
+package poolfrag
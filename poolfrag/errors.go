@@ -0,0 +1,24 @@
+//go:build linux
+
+package poolfrag
+
+import "errors"
+
+// Sentinel errors returned by the fragmenter and reassembler.
+var (
+	// ErrTooLarge indicates a message longer than poolioc.MaxPayload
+	// bytes or that needs more than poolioc.MaxFrags fragments.
+	ErrTooLarge = errors.New("poolfrag: message too large")
+
+	// ErrInvalid indicates a fragment whose header is out of range or
+	// disagrees with earlier fragments of the same message.
+	ErrInvalid = errors.New("poolfrag: invalid fragment")
+
+	// ErrTimeout indicates a message whose fragments did not all arrive
+	// within the reassembly timeout.
+	ErrTimeout = errors.New("poolfrag: reassembly timed out")
+
+	// ErrBufferFull indicates that buffering a fragment would exceed
+	// the reassembler's memory limit. The message is dropped.
+	ErrBufferFull = errors.New("poolfrag: reassembly buffer full")
+)
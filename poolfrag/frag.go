@@ -0,0 +1,116 @@
+//go:build linux
+
+package poolfrag
+
+import (
+	"encoding"
+	"fmt"
+
+	"github.com/amosdavis/pool-go/poolioc"
+	"github.com/amosdavis/pool-go/poolwire"
+)
+
+// PayloadSize returns how many message bytes fit in one fragment
+// carried in an encrypted packet of mtu bytes.
+func PayloadSize(mtu int) int {
+	return mtu - poolwire.HeaderSize - poolioc.TagSize - poolwire.FragHeaderSize
+}
+
+// Fragment is one piece of a fragmented message.
+type Fragment struct {
+	poolwire.FragHeader
+	Data []byte
+}
+
+// Last reports whether f is the final fragment of its message: the one
+// whose data ends where the message does.
+func (f *Fragment) Last() bool {
+	return int(f.FragOffset)+len(f.Data) == int(f.TotalLen)
+}
+
+// Validate reports whether f's header is in range: f's data must lie
+// within the message, and only an empty message may have an empty
+// fragment.
+func (f *Fragment) Validate() error {
+	if end := int(f.FragOffset) + len(f.Data); end > int(f.TotalLen) {
+		return fmt.Errorf("%w: bytes %d-%d of a %d-byte message", ErrInvalid, f.FragOffset, end, f.TotalLen)
+	}
+	if len(f.Data) == 0 && f.TotalLen != 0 {
+		return fmt.Errorf("%w: empty fragment of a %d-byte message", ErrInvalid, f.TotalLen)
+	}
+	return nil
+}
+
+// MarshalBinary encodes f as a packet payload: the fragment header
+// followed by the data.
+func (f *Fragment) MarshalBinary() ([]byte, error) {
+	return f.AppendBinary(make([]byte, 0, poolwire.FragHeaderSize+len(f.Data)))
+}
+
+// AppendBinary appends the encoding of f to b.
+func (f *Fragment) AppendBinary(b []byte) ([]byte, error) {
+	if err := f.Validate(); err != nil {
+		return b, err
+	}
+	b, err := f.FragHeader.AppendBinary(b)
+	if err != nil {
+		return b, err
+	}
+	return append(b, f.Data...), nil
+}
+
+// UnmarshalBinary decodes a packet payload into f. Data is copied.
+func (f *Fragment) UnmarshalBinary(data []byte) error {
+	if len(data) < poolwire.FragHeaderSize {
+		return fmt.Errorf("%w: fragment is %d bytes", poolwire.ErrLength, len(data))
+	}
+	var v Fragment
+	if err := v.FragHeader.UnmarshalBinary(data[:poolwire.FragHeaderSize]); err != nil {
+		return err
+	}
+	v.Data = append([]byte(nil), data[poolwire.FragHeaderSize:]...)
+	if err := v.Validate(); err != nil {
+		return err
+	}
+	*f = v
+	return nil
+}
+
+// Split cuts msg into fragments of at most size bytes, all tagged with
+// msgID. Every fragment but the last is exactly size bytes; an empty
+// message yields one empty fragment. The fragments share msg's memory.
+// Split fails with [ErrTooLarge] if msg is longer than
+// poolioc.MaxPayload bytes or needs more than poolioc.MaxFrags
+// fragments.
+func Split(msgID uint32, msg []byte, size int) ([]Fragment, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("poolfrag: invalid fragment size %d", size)
+	}
+	if len(msg) > poolioc.MaxPayload {
+		return nil, fmt.Errorf("%w: %d bytes, more than %d", ErrTooLarge, len(msg), poolioc.MaxPayload)
+	}
+	n := max(1, (len(msg)+size-1)/size)
+	if n > poolioc.MaxFrags {
+		return nil, fmt.Errorf("%w: %d bytes need %d fragments of %d", ErrTooLarge, len(msg), n, size)
+	}
+
+	frags := make([]Fragment, n)
+	for i := range frags {
+		end := min(len(msg), (i+1)*size)
+		frags[i] = Fragment{
+			FragHeader: poolwire.FragHeader{
+				MsgID:      msgID,
+				FragOffset: uint16(i * size),
+				TotalLen:   uint16(len(msg)),
+			},
+			Data: msg[i*size : end : end],
+		}
+	}
+	return frags, nil
+}
+
+// Verify interface compliance at compile time.
+var (
+	_ encoding.BinaryMarshaler   = (*Fragment)(nil)
+	_ encoding.BinaryUnmarshaler = (*Fragment)(nil)
+)
@@ -0,0 +1,180 @@
+//go:build linux
+
+package poolfrag
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/amosdavis/pool-go/poolioc"
+	"github.com/amosdavis/pool-go/poolwire"
+)
+
+// DefaultTimeout is how long a Reassembler waits for the rest of a
+// message after its first fragment arrives.
+const DefaultTimeout = poolioc.FragTimeoutMS * time.Millisecond
+
+// DefaultMaxBytes is the default memory limit of a Reassembler: enough
+// for several maximum-size messages at the default MTU.
+const DefaultMaxBytes = 4 << 20
+
+// Reassembler collects the fragments of messages, in any order, until
+// each message is complete.
+//
+// The zero value is ready to use with the default limits. A
+// Reassembler is not safe for concurrent use.
+type Reassembler struct {
+	// Timeout is how long an incomplete message is kept, counted from
+	// its first fragment. Zero means DefaultTimeout.
+	Timeout time.Duration
+
+	// MaxBytes bounds the memory held by incomplete messages. Each
+	// buffered fragment counts its data plus its header. Zero means
+	// DefaultMaxBytes.
+	MaxBytes int
+
+	pending map[uint32]*partial
+	bytes   int
+}
+
+// partial is a message with some of its fragments: the data of each,
+// by byte offset.
+type partial struct {
+	total    int
+	frags    map[uint16][]byte
+	have     int // message bytes received
+	bytes    int
+	deadline time.Time
+}
+
+// Add buffers f, received at now. When f completes its message, Add
+// returns the message, which is never nil, and forgets it; otherwise it
+// returns nil. Duplicate fragments are ignored. The data of f is copied.
+//
+// If f disagrees with earlier fragments of its message, by its length
+// or by overlapping one of them, or would make the message span more
+// than poolioc.MaxFrags fragments, Add drops the message and fails with
+// [ErrInvalid]. If buffering f would exceed MaxBytes, it drops the
+// message and fails with [ErrBufferFull].
+func (r *Reassembler) Add(f Fragment, now time.Time) ([]byte, error) {
+	if err := f.Validate(); err != nil {
+		return nil, err
+	}
+	if f.FragOffset == 0 && f.Last() {
+		return append([]byte{}, f.Data...), nil
+	}
+
+	p := r.pending[f.MsgID]
+	if p == nil {
+		p = &partial{
+			total:    int(f.TotalLen),
+			frags:    make(map[uint16][]byte),
+			deadline: now.Add(r.timeout()),
+		}
+		if r.pending == nil {
+			r.pending = make(map[uint32]*partial)
+		}
+		r.pending[f.MsgID] = p
+	} else if p.total != int(f.TotalLen) {
+		r.drop(f.MsgID)
+		return nil, fmt.Errorf("%w: message %d is %d bytes, not %d", ErrInvalid, f.MsgID, p.total, f.TotalLen)
+	}
+	if b, ok := p.frags[f.FragOffset]; ok && len(b) == len(f.Data) {
+		return nil, nil
+	}
+	if err := p.fits(f); err != nil {
+		r.drop(f.MsgID)
+		return nil, err
+	}
+
+	cost := poolwire.FragHeaderSize + len(f.Data)
+	if r.bytes+cost > r.maxBytes() {
+		r.drop(f.MsgID)
+		return nil, fmt.Errorf("%w: message %d", ErrBufferFull, f.MsgID)
+	}
+	p.frags[f.FragOffset] = append([]byte{}, f.Data...)
+	p.have += len(f.Data)
+	p.bytes += cost
+	r.bytes += cost
+	if p.have < p.total {
+		return nil, nil
+	}
+
+	r.drop(f.MsgID)
+	msg := make([]byte, p.total)
+	for off, b := range p.frags {
+		copy(msg[off:], b)
+	}
+	return msg, nil
+}
+
+// fits reports whether f can join the fragments of p: it must not
+// overlap any of them or take the message past poolioc.MaxFrags
+// fragments.
+func (p *partial) fits(f Fragment) error {
+	if len(p.frags) >= poolioc.MaxFrags {
+		return fmt.Errorf("%w: message %d has more than %d fragments", ErrInvalid, f.MsgID, poolioc.MaxFrags)
+	}
+	start, end := int(f.FragOffset), int(f.FragOffset)+len(f.Data)
+	for off, b := range p.frags {
+		if int(off) < end && start < int(off)+len(b) {
+			return fmt.Errorf("%w: message %d has overlapping fragments at bytes %d and %d", ErrInvalid, f.MsgID, off, start)
+		}
+	}
+	return nil
+}
+
+// Expire drops the incomplete messages whose timeout has passed at now
+// and returns their IDs in ascending order. The caller reports each as
+// [ErrTimeout].
+func (r *Reassembler) Expire(now time.Time) []uint32 {
+	var ids []uint32
+	for id, p := range r.pending {
+		if !now.Before(p.deadline) {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		r.drop(id)
+	}
+	return ids
+}
+
+// Discard drops the incomplete message with the given ID, if any.
+func (r *Reassembler) Discard(msgID uint32) {
+	r.drop(msgID)
+}
+
+// Pending returns the number of incomplete messages.
+func (r *Reassembler) Pending() int {
+	return len(r.pending)
+}
+
+// Buffered returns the memory held by incomplete messages, as counted
+// against MaxBytes.
+func (r *Reassembler) Buffered() int {
+	return r.bytes
+}
+
+func (r *Reassembler) drop(msgID uint32) {
+	if p, ok := r.pending[msgID]; ok {
+		r.bytes -= p.bytes
+		delete(r.pending, msgID)
+	}
+}
+
+func (r *Reassembler) timeout() time.Duration {
+	if r.Timeout > 0 {
+		return r.Timeout
+	}
+	return DefaultTimeout
+}
+
+func (r *Reassembler) maxBytes() int {
+	if r.MaxBytes > 0 {
+		return r.MaxBytes
+	}
+	return DefaultMaxBytes
+}
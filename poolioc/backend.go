@@ -0,0 +1,174 @@
+//go:build linux
+
+package poolioc
+
+import "context"
+
+// Backend is the set of POOL device operations that the pool package
+// builds on. [*Device] implements it for both the kernel module and the
+// fake backend; other implementations (mocks, userspace stacks, remote
+// brokers, or wrappers that instrument a Device) can be passed to the
+// pool package in its place.
+//
+// Implementations must be safe for concurrent use. RecvBytes blocks
+// until a message is available on the channel, copying it into buf and
+// returning its length.
+type Backend interface {
+	// Listen starts accepting inbound sessions on port.
+	Listen(port uint16) error
+
+	// Stop shuts down the listener started by Listen.
+	Stop() error
+
+	// Connect performs a handshake with a remote peer and returns the
+	// session index.
+	Connect(req ConnectReq) (int, error)
+
+	// SendBytes sends one message on a session and channel.
+	SendBytes(sessionIdx uint32, channel uint8, data []byte) error
+
+	// RecvBytes receives one message from a session and channel.
+	RecvBytes(sessionIdx uint32, channel uint8, buf []byte) (int, error)
+
+	// Sessions returns the sessions visible to this backend.
+	Sessions() ([]SessionInfo, error)
+
+	// CloseSession closes the session at the given index.
+	CloseSession(idx uint32) error
+
+	// ChannelSubscribe subscribes to a channel on a session.
+	ChannelSubscribe(sessionIdx uint32, channel uint8) error
+
+	// ChannelUnsubscribe unsubscribes from a channel on a session.
+	ChannelUnsubscribe(sessionIdx uint32, channel uint8) error
+
+	// ChannelList returns the bitmap of subscribed channels.
+	ChannelList(sessionIdx uint32) ([MaxChannels / 8]byte, error)
+}
+
+// ContextBackend is implemented by backends whose blocking operations
+// can be abandoned. The pool package uses it so that deadlines and
+// contexts cancel in-flight reads and writes; calls on a plain Backend
+// are run on a helper goroutine instead.
+//
+// After a context-aware call returns, the backend must no longer access
+// the caller's buffer.
+type ContextBackend interface {
+	Backend
+
+	// ConnectContext is Connect, returning ctx.Err() if ctx is done
+	// before the handshake completes. A late handshake must not leave
+	// a session behind.
+	ConnectContext(ctx context.Context, req ConnectReq) (int, error)
+
+	// SendBytesContext is SendBytes, returning ctx.Err() if ctx is done
+	// before the message is queued.
+	SendBytesContext(ctx context.Context, sessionIdx uint32, channel uint8, data []byte) error
+
+	// RecvBytesContext is RecvBytes, returning ctx.Err() if ctx is done
+	// before a message arrives.
+	RecvBytesContext(ctx context.Context, sessionIdx uint32, channel uint8, buf []byte) (int, error)
+}
+
+// Notifier is implemented by backends that can report state changes
+// instead of being polled. The pool package uses it to wake listeners
+// when sessions are established; backends without it have their
+// session table re-read periodically.
+type Notifier interface {
+	// Ready returns a channel that is closed at the next change in
+	// backend state: a session established or closed, a message
+	// queued or drained, or the delivery of a message sent with
+	// [AckBackend.SendAcked] reported. Spurious wakeups are allowed.
+	Ready() <-chan struct{}
+}
+
+// EventBackend is implemented by backends that report session
+// lifecycle events themselves. Backends without it are watched by
+// polling Sessions and comparing snapshots with [Diff].
+type EventBackend interface {
+	Backend
+
+	// Events streams lifecycle events for the sessions visible to the
+	// backend until ctx is done. See [Device.Events].
+	Events(ctx context.Context) (<-chan Event, error)
+}
+
+// MessageBackend is implemented by backends that carry per-message
+// flags and report metadata about received messages. The pool package
+// uses it for Conn.WriteMsg and Conn.ReadMsg; a plain Backend can send
+// messages only without flags.
+type MessageBackend interface {
+	Backend
+
+	// SendMsg sends one message on a session and channel with the
+	// given SendReq.Flags, returning ctx.Err() if ctx is done before
+	// the message is queued.
+	SendMsg(ctx context.Context, sessionIdx uint32, channel uint8, flags uint8, data []byte) error
+
+	// RecvMsg receives one message from a session and channel into
+	// buf, returning ctx.Err() if ctx is done before a message arrives.
+	RecvMsg(ctx context.Context, sessionIdx uint32, channel uint8, buf []byte) (MsgInfo, error)
+}
+
+// AckBackend is implemented by backends that report when the peer has
+// acknowledged delivery of a message. The pool package uses it for
+// Conn.WriteAcked and Conn.WriteAsync.
+type AckBackend interface {
+	Backend
+
+	// SendAcked sends one message with FlagRequireAck added to flags,
+	// returning ctx.Err() if ctx is done before the message is queued.
+	// The returned channel then receives nil once the peer acknowledges
+	// delivery, or the error that prevented it — a [WireError] if the
+	// peer answered with a POOL error code — and is closed.
+	SendAcked(ctx context.Context, sessionIdx uint32, channel uint8, flags uint8, data []byte) (<-chan error, error)
+}
+
+// DemuxBackend is implemented by backends that can receive the next
+// message of a session whatever its channel. The pool package uses it
+// for Conn.StartDemux and Conn.AcceptChannel, which need to see
+// messages on channels that nobody is reading yet.
+type DemuxBackend interface {
+	Backend
+
+	// RecvAny receives the next message of a session into buf, in the
+	// order the messages arrived across channels, and reports its
+	// channel in MsgInfo.Channel. It returns ctx.Err() if ctx is done
+	// before a message arrives. A message that was lost rather than
+	// received is reported as its error, with MsgInfo.Channel set, and
+	// so, once, is the [*ShutdownError] of a channel the peer closed.
+	// If buf is too small, RecvAny fails with EMSGSIZE, leaving the
+	// message queued, and reports its channel and length in MsgInfo.
+	// With an empty buf RecvAny returns at once without receiving;
+	// a backend that cannot receive from any channel fails it with
+	// EOPNOTSUPP.
+	RecvAny(ctx context.Context, sessionIdx uint32, buf []byte) (MsgInfo, error)
+}
+
+// ShutdownBackend is implemented by backends that can close one
+// direction of a channel, as PktClose closes a session. The pool
+// package uses it for Conn.CloseWrite and ChannelConn.CloseWrite.
+type ShutdownBackend interface {
+	Backend
+
+	// Shutdown closes a session channel for writing, returning
+	// ctx.Err() if ctx is done before the close is queued. The close
+	// reaches the peer after the messages already sent on the channel;
+	// once it has received them, its receives on the channel fail with
+	// a [*ShutdownError] carrying reason, zero for an orderly close.
+	// Later sends on the channel fail with EPIPE. Shutting down a
+	// channel again does nothing.
+	Shutdown(ctx context.Context, sessionIdx uint32, channel uint8, reason WireError) error
+}
+
+// Verify interface compliance at compile time.
+var (
+	_ Backend         = (*Device)(nil)
+	_ ContextBackend  = (*Device)(nil)
+	_ Notifier        = (*Device)(nil)
+	_ EventBackend    = (*Device)(nil)
+	_ MessageBackend  = (*Device)(nil)
+	_ AckBackend      = (*Device)(nil)
+	_ DemuxBackend    = (*Device)(nil)
+	_ ShutdownBackend = (*Device)(nil)
+)
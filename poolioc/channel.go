@@ -2,7 +2,12 @@
 
 package poolioc
 
-import "unsafe"
+import (
+	"math/bits"
+	"strconv"
+	"strings"
+	"unsafe"
+)
 
 // ChannelSubscribe subscribes to receive data on the given channel
 // for the specified session.
@@ -34,8 +39,83 @@ func (d *Device) ChannelList(sessionIdx uint32) ([MaxChannels / 8]byte, error) {
 		Operation:  ChanList,
 		DataPtr:    uint64(uintptr(unsafe.Pointer(&bitmap[0]))),
 	}
-	if err := d.ioctl(iocChannel, unsafe.Pointer(&req)); err != nil {
+	if _, err := d.ioctlUser(iocChannel, unsafe.Pointer(&req), bitmap[:]); err != nil {
 		return bitmap, err
 	}
 	return bitmap, nil
 }
+
+// ChannelSet is a set of channels in the layout of the bitmap returned
+// by ChannelList: channel i is bit i%8 of byte i/8. A bitmap converts
+// directly, as in ChannelSet(bitmap). The zero value is the empty set.
+type ChannelSet [MaxChannels / 8]byte
+
+// Has reports whether ch is in the set.
+func (s ChannelSet) Has(ch uint8) bool {
+	return s[ch/8]&(1<<(ch%8)) != 0
+}
+
+// Add adds ch to the set.
+func (s *ChannelSet) Add(ch uint8) {
+	s[ch/8] |= 1 << (ch % 8)
+}
+
+// Remove removes ch from the set.
+func (s *ChannelSet) Remove(ch uint8) {
+	s[ch/8] &^= 1 << (ch % 8)
+}
+
+// Count returns the number of channels in the set.
+func (s ChannelSet) Count() int {
+	n := 0
+	for _, b := range s {
+		n += bits.OnesCount8(b)
+	}
+	return n
+}
+
+// Iterate calls fn for each channel in the set in ascending order,
+// stopping early if fn returns false.
+func (s ChannelSet) Iterate(fn func(ch uint8) bool) {
+	for i, b := range s {
+		for b != 0 {
+			bit := bits.TrailingZeros8(b)
+			if !fn(uint8(i*8 + bit)) {
+				return
+			}
+			b &^= 1 << bit
+		}
+	}
+}
+
+// String returns the set as ascending channels and ranges, such as
+// "{1-3,7,200}".
+func (s ChannelSet) String() string {
+	var sb strings.Builder
+	sb.WriteByte('{')
+	first, last := -1, -1
+	flush := func() {
+		if first < 0 {
+			return
+		}
+		if sb.Len() > 1 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(strconv.Itoa(first))
+		if last > first {
+			sb.WriteByte('-')
+			sb.WriteString(strconv.Itoa(last))
+		}
+	}
+	s.Iterate(func(ch uint8) bool {
+		if int(ch) != last+1 || first < 0 {
+			flush()
+			first = int(ch)
+		}
+		last = int(ch)
+		return true
+	})
+	flush()
+	sb.WriteByte('}')
+	return sb.String()
+}
@@ -2,7 +2,11 @@
 
 package poolioc
 
-import "unsafe"
+import (
+	"context"
+	"syscall"
+	"unsafe"
+)
 
 // Listen starts the POOL listener on the given port.
 func (d *Device) Listen(port uint16) error {
@@ -10,9 +14,48 @@ func (d *Device) Listen(port uint16) error {
 }
 
 // Connect initiates a POOL handshake to a remote peer.
-// Returns the session index on success.
+// Returns the session index on success. The kernel module cannot be
+// given a transport, protocol version or heartbeat interval yet, so
+// Connect fails with EOPNOTSUPP if req asks for other than the defaults
+// (see [ConnectReq]), on /dev/pool and the fake backend alike. A
+// concurrent [Device.Close] does not
+// wait for the handshake; Connect then fails with [os.ErrClosed].
 func (d *Device) Connect(req ConnectReq) (int, error) {
-	return d.ioctlRet(iocConnect, unsafe.Pointer(&req))
+	if !req.defaults() {
+		return -1, syscall.EOPNOTSUPP
+	}
+	return d.ioctlBlocking(iocConnect, unsafe.Pointer(&req))
+}
+
+// ConnectContext is like [Device.Connect] but returns ctx.Err() if ctx
+// is done before the handshake completes. A handshake that completes
+// after that is torn down, so an abandoned connect never leaks a session.
+func (d *Device) ConnectContext(ctx context.Context, req ConnectReq) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+
+	type result struct {
+		idx int
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		idx, err := d.Connect(req)
+		ch <- result{idx, err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.idx, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-ch; r.err == nil {
+				_ = d.CloseSession(uint32(r.idx))
+			}
+		}()
+		return -1, ctx.Err()
+	}
 }
 
 // Stop shuts down the POOL listener.
@@ -2,18 +2,45 @@
 
 package poolioc
 
-import "unsafe"
+import (
+	"context"
+	"errors"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
 
 // Send transmits data on a POOL session.
 // The caller must set req.DataPtr to the address of the data buffer
-// and req.Len to the number of bytes to send.
+// and req.Len to the number of bytes to send. The fake backend does not
+// follow raw addresses, so with it Send fails with EFAULT; use
+// [Device.SendBytes] or [Device.SendMsg] instead.
 func (d *Device) Send(req SendReq) error {
-	return d.ioctl(iocSend, unsafe.Pointer(&req))
+	return d.SendContext(context.Background(), req)
+}
+
+// SendContext is like [Device.Send] but gives up waiting for queue
+// space when ctx is done, returning ctx.Err().
+func (d *Device) SendContext(ctx context.Context, req SendReq) error {
+	return d.send(ctx, req, nil)
+}
+
+// send is SendContext for a request whose DataPtr refers to data.
+func (d *Device) send(ctx context.Context, req SendReq, data []byte) error {
+	return d.wait(ctx, func() error {
+		_, err := d.ioctlUser(iocSend, unsafe.Pointer(&req), data)
+		return err
+	})
 }
 
 // SendBytes is a convenience wrapper that sends a byte slice on a
 // session and channel.
 func (d *Device) SendBytes(sessionIdx uint32, channel uint8, data []byte) error {
+	return d.SendBytesContext(context.Background(), sessionIdx, channel, data)
+}
+
+// SendBytesContext is like [Device.SendBytes] but honors ctx.
+func (d *Device) SendBytesContext(ctx context.Context, sessionIdx uint32, channel uint8, data []byte) error {
 	if len(data) == 0 {
 		return nil
 	}
@@ -23,19 +50,43 @@ func (d *Device) SendBytes(sessionIdx uint32, channel uint8, data []byte) error
 		Len:        uint32(len(data)),
 		DataPtr:    uint64(uintptr(unsafe.Pointer(&data[0]))),
 	}
-	return d.Send(req)
+	err := d.send(ctx, req, data)
+	runtime.KeepAlive(data)
+	return err
 }
 
 // Recv receives data from a POOL session.
 // On entry, req.Len is the buffer capacity and req.DataPtr points to
 // the buffer. On return, req.Len contains the number of bytes received.
+// As with [Device.Send], the fake backend fails a raw address with
+// EFAULT; use [Device.RecvBytes] or [Device.RecvMsg] instead.
 func (d *Device) Recv(req *RecvReq) error {
-	return d.ioctl(iocRecv, unsafe.Pointer(req))
+	return d.RecvContext(context.Background(), req)
+}
+
+// RecvContext is like [Device.Recv] but gives up waiting for data when
+// ctx is done, returning ctx.Err(). The buffer is not written after
+// RecvContext returns.
+func (d *Device) RecvContext(ctx context.Context, req *RecvReq) error {
+	return d.recv(ctx, req, nil)
+}
+
+// recv is RecvContext for a request whose DataPtr refers to buf.
+func (d *Device) recv(ctx context.Context, req *RecvReq, buf []byte) error {
+	return d.wait(ctx, func() error {
+		_, err := d.ioctlUser(iocRecv, unsafe.Pointer(req), buf)
+		return err
+	})
 }
 
 // RecvBytes is a convenience wrapper that receives into a byte slice.
 // Returns the number of bytes received.
 func (d *Device) RecvBytes(sessionIdx uint32, channel uint8, buf []byte) (int, error) {
+	return d.RecvBytesContext(context.Background(), sessionIdx, channel, buf)
+}
+
+// RecvBytesContext is like [Device.RecvBytes] but honors ctx.
+func (d *Device) RecvBytesContext(ctx context.Context, sessionIdx uint32, channel uint8, buf []byte) (int, error) {
 	if len(buf) == 0 {
 		return 0, nil
 	}
@@ -45,8 +96,140 @@ func (d *Device) RecvBytes(sessionIdx uint32, channel uint8, buf []byte) (int, e
 		Len:        uint32(len(buf)),
 		DataPtr:    uint64(uintptr(unsafe.Pointer(&buf[0]))),
 	}
-	if err := d.Recv(&req); err != nil {
+	err := d.recv(ctx, &req, buf)
+	runtime.KeepAlive(buf)
+	if err != nil {
 		return 0, err
 	}
 	return int(req.Len), nil
 }
+
+// MsgInfo describes a message received with RecvMsg.
+type MsgInfo struct {
+	Len     int   // bytes copied into the buffer
+	Flags   uint8 // RecvReq.Flags: FlagEncrypted, FlagCompressed, ...
+	Channel uint8 // channel the message arrived on
+
+	// Seq and Timestamp are the sequence number and sender timestamp
+	// (nanoseconds since the Unix epoch) from the packet header, or
+	// zero if the backend does not report them. The kernel module
+	// does not.
+	Seq       uint64
+	Timestamp uint64
+}
+
+// SendMsg is like [Device.SendBytesContext] but sends with the given
+// SendReq.Flags, such as FlagPriority or FlagRequireAck.
+func (d *Device) SendMsg(ctx context.Context, sessionIdx uint32, channel uint8, flags uint8, data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	req := SendReq{
+		SessionIdx: sessionIdx,
+		Channel:    channel,
+		Flags:      flags,
+		Len:        uint32(len(data)),
+		DataPtr:    uint64(uintptr(unsafe.Pointer(&data[0]))),
+	}
+	err := d.send(ctx, req, data)
+	runtime.KeepAlive(data)
+	return err
+}
+
+// RecvMsg is like [Device.RecvBytesContext] but also returns the
+// message flags.
+func (d *Device) RecvMsg(ctx context.Context, sessionIdx uint32, channel uint8, buf []byte) (MsgInfo, error) {
+	if len(buf) == 0 {
+		return MsgInfo{}, nil
+	}
+	req := RecvReq{
+		SessionIdx: sessionIdx,
+		Channel:    channel,
+		Len:        uint32(len(buf)),
+		DataPtr:    uint64(uintptr(unsafe.Pointer(&buf[0]))),
+	}
+	err := d.recv(ctx, &req, buf)
+	runtime.KeepAlive(buf)
+	if err != nil {
+		return MsgInfo{}, err
+	}
+	return MsgInfo{Len: int(req.Len), Flags: req.Flags, Channel: channel}, nil
+}
+
+// RecvAny is like [Device.RecvMsg] but receives the oldest message of
+// the session on any channel, reporting its channel in the MsgInfo. The
+// kernel module only receives per channel, so on /dev/pool RecvAny
+// fails with EOPNOTSUPP, even with an empty buf.
+func (d *Device) RecvAny(ctx context.Context, sessionIdx uint32, buf []byte) (MsgInfo, error) {
+	if d.emu == nil {
+		return MsgInfo{}, syscall.EOPNOTSUPP
+	}
+	if len(buf) == 0 {
+		return MsgInfo{}, nil
+	}
+	req := RecvReq{
+		SessionIdx: sessionIdx,
+		Len:        uint32(len(buf)),
+		DataPtr:    uint64(uintptr(unsafe.Pointer(&buf[0]))),
+	}
+	err := d.wait(ctx, func() error {
+		return d.control(func(uintptr) error { return d.emu.recvAny(&req, buf) })
+	})
+	runtime.KeepAlive(buf)
+	if errors.Is(err, syscall.EMSGSIZE) {
+		return MsgInfo{Len: int(req.Len), Channel: req.Channel}, err
+	}
+	if err != nil {
+		return MsgInfo{Channel: req.Channel}, err
+	}
+	return MsgInfo{Len: int(req.Len), Flags: req.Flags, Channel: req.Channel}, nil
+}
+
+// SendAcked sends data with FlagRequireAck. The kernel module does not
+// report acknowledgements to userspace, so on /dev/pool it fails with
+// EOPNOTSUPP. The fake backend acknowledges a message once the peer's
+// reader takes it, and fails it with ECONNRESET if the peer session is
+// torn down first.
+func (d *Device) SendAcked(ctx context.Context, sessionIdx uint32, channel uint8, flags uint8, data []byte) (<-chan error, error) {
+	if d.emu == nil {
+		return nil, syscall.EOPNOTSUPP
+	}
+	if len(data) == 0 {
+		done := make(chan error, 1)
+		done <- nil
+		close(done)
+		return done, nil
+	}
+	req := SendReq{
+		SessionIdx: sessionIdx,
+		Channel:    channel,
+		Flags:      flags | FlagRequireAck,
+		Len:        uint32(len(data)),
+		DataPtr:    uint64(uintptr(unsafe.Pointer(&data[0]))),
+	}
+	var done <-chan error
+	err := d.wait(ctx, func() error {
+		return d.control(func(uintptr) error {
+			var err error
+			done, err = d.emu.sendAcked(&req, data)
+			return err
+		})
+	})
+	runtime.KeepAlive(data)
+	if err != nil {
+		return nil, err
+	}
+	return done, nil
+}
+
+// Shutdown closes a session channel for writing, as described by
+// [ShutdownBackend]. The kernel module closes whole sessions only, so on
+// /dev/pool Shutdown fails with EOPNOTSUPP.
+func (d *Device) Shutdown(ctx context.Context, sessionIdx uint32, channel uint8, reason WireError) error {
+	if d.emu == nil {
+		return syscall.EOPNOTSUPP
+	}
+	return d.wait(ctx, func() error {
+		return d.control(func(uintptr) error { return d.emu.shutdown(sessionIdx, channel, reason) })
+	})
+}
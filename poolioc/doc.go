@@ -7,4 +7,7 @@
 // which implements net.Conn and net.Listener on top of poolioc.
 //
 // This package requires Linux with the pool.ko kernel module loaded.
+// For testing without the module, [OpenBackend] with [BackendFake] (or
+// POOL_BACKEND=fake in the environment) selects an in-memory emulation
+// of the device that supports loopback sessions within one process.
 package poolioc
@@ -0,0 +1,195 @@
+//go:build linux
+
+package poolioc
+
+import (
+	"context"
+	"time"
+)
+
+// eventResync is how often Events re-reads the session table when the
+// device has not reported readiness, guarding against missed wakeups.
+// eventPoll is how often PollEvents re-reads it for a backend that
+// cannot report readiness at all.
+const (
+	eventResync = time.Second
+	eventPoll   = 100 * time.Millisecond
+)
+
+// EventType identifies a session lifecycle transition.
+type EventType uint8
+
+const (
+	EventEstablished   EventType = iota + 1 // session reached StateEstablished
+	EventRekeying                           // session entered StateRekeying or RekeyCount increased
+	EventConfigChanged                      // Telem.ConfigVersion changed
+	EventClosing                            // session entered StateClosing
+	EventClosed                             // session left the session table
+)
+
+var eventNames = [...]string{
+	EventEstablished:   "ESTABLISHED",
+	EventRekeying:      "REKEYING",
+	EventConfigChanged: "CONFIG_CHANGED",
+	EventClosing:       "CLOSING",
+	EventClosed:        "CLOSED",
+}
+
+func (t EventType) String() string {
+	if int(t) < len(eventNames) && eventNames[t] != "" {
+		return eventNames[t]
+	}
+	return "UNKNOWN"
+}
+
+// Event is one session lifecycle transition. Before is the session as
+// last seen and is the zero value if the session is new; After is the
+// session as now seen and is the zero value for EventClosed.
+type Event struct {
+	Type   EventType
+	Before SessionInfo
+	After  SessionInfo
+}
+
+// Diff returns the events that take the session table from before to
+// after. Sessions are matched by SessionID, so a new session on a
+// reused index is reported as new. Sessions without a SessionID are
+// still handshaking and are ignored. A session that changes in several
+// ways yields one event per change, in EventType order.
+func Diff(before, after []SessionInfo) []Event {
+	var zero [SessionIDSize]byte
+	prev := make(map[[SessionIDSize]byte]*SessionInfo, len(before))
+	for i := range before {
+		if before[i].SessionID != zero {
+			prev[before[i].SessionID] = &before[i]
+		}
+	}
+
+	var events []Event
+	seen := make(map[[SessionIDSize]byte]struct{}, len(after))
+	for i := range after {
+		a := &after[i]
+		if a.SessionID == zero {
+			continue
+		}
+		seen[a.SessionID] = struct{}{}
+
+		var b SessionInfo
+		p, existed := prev[a.SessionID]
+		if existed {
+			b = *p
+		}
+		emit := func(t EventType) {
+			events = append(events, Event{Type: t, Before: b, After: *a})
+		}
+
+		if up(a.State) && (!existed || !up(b.State)) {
+			emit(EventEstablished)
+		}
+		// A rekey is reported once: on entering StateRekeying, or from
+		// the count alone if it started and finished between snapshots.
+		if a.State == StateRekeying && (!existed || b.State != StateRekeying) ||
+			existed && b.State != StateRekeying && a.RekeyCount > b.RekeyCount {
+			emit(EventRekeying)
+		}
+		if existed && a.Telem.ConfigVersion != b.Telem.ConfigVersion {
+			emit(EventConfigChanged)
+		}
+		if a.State == StateClosing && (!existed || b.State != StateClosing) {
+			emit(EventClosing)
+		}
+	}
+
+	for i := range before {
+		b := &before[i]
+		if b.SessionID == zero {
+			continue
+		}
+		if _, ok := seen[b.SessionID]; !ok {
+			events = append(events, Event{Type: EventClosed, Before: *b})
+		}
+	}
+	return events
+}
+
+// up reports whether a session in state s has completed its handshake
+// and can carry data.
+func up(s uint8) bool {
+	return s == StateEstablished || s == StateRekeying
+}
+
+// Events streams lifecycle events for the sessions visible on this
+// device, as [PollEvents] does for any backend. The channel is also
+// closed when the device is closed.
+func (d *Device) Events(ctx context.Context) (<-chan Event, error) {
+	return pollEvents(ctx, d, d.done)
+}
+
+// PollEvents streams lifecycle events for the sessions visible on b.
+// The sessions present when PollEvents is called form the baseline and
+// produce no events. The session table is re-read whenever b reports
+// readiness through [Notifier], or every 100ms if it cannot, and Diff
+// turns consecutive snapshots into events. It serves backends that do
+// not implement [EventBackend].
+//
+// The channel is closed when ctx is done or the session table can no
+// longer be read. Events are delivered in order; a slow receiver delays
+// later events but does not lose them, since each snapshot is compared
+// with the last one delivered.
+func PollEvents(ctx context.Context, b Backend) (<-chan Event, error) {
+	return pollEvents(ctx, b, nil)
+}
+
+// pollEvents implements PollEvents, also stopping once done is closed.
+func pollEvents(ctx context.Context, b Backend, done <-chan struct{}) (<-chan Event, error) {
+	notifier, _ := b.(Notifier)
+	var ready <-chan struct{}
+	if notifier != nil {
+		ready = notifier.Ready()
+	}
+	prev, err := b.Sessions()
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan Event)
+	go func() {
+		defer close(ch)
+		interval := eventPoll
+		if notifier != nil {
+			interval = eventResync
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ready:
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			case <-done:
+				return
+			}
+
+			if notifier != nil {
+				ready = notifier.Ready()
+			}
+			cur, err := b.Sessions()
+			if err != nil {
+				return
+			}
+			for _, ev := range Diff(prev, cur) {
+				select {
+				case ch <- ev:
+				case <-ctx.Done():
+					return
+				case <-done:
+					return
+				}
+			}
+			prev = cur
+		}
+	}()
+	return ch, nil
+}
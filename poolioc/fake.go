@@ -0,0 +1,607 @@
+//go:build linux
+
+package poolioc
+
+import (
+	"crypto/rand"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// The fake backend emulates pool.ko entirely in userspace. It decodes
+// the same ioctl requests the kernel module receives, so the Device
+// methods run unchanged on top of it. The one difference is that the
+// Device hands the emulator the memory a request points to as a slice;
+// Send and Recv, which take a raw address only, fail with EFAULT.
+//
+// Like the kernel module, the emulation is process-wide: all Devices
+// opened with the fake backend share one session table of MaxSessions
+// slots and one listener namespace. A session is owned by the handle
+// that created it — the connecting handle for outbound sessions, the
+// listening handle for inbound ones — and only its owner sees it in
+// Sessions or may use it. Peers are reachable only over loopback.
+//
+// Each handle is backed by an eventfd that the emulation signals on
+// every state change, so the handle goes through the same runtime
+// poller path as /dev/pool. Send and Recv fail with EAGAIN instead of
+// blocking, as the kernel does for a non-blocking descriptor.
+
+// fakeQueueLen is the number of messages a channel queue holds before
+// Send fails with EAGAIN.
+const fakeQueueLen = 256
+
+// fakeRTT is the round-trip time reported for loopback sessions.
+const fakeRTT = 20 * time.Microsecond
+
+// fakeKernel is the emulated module state shared by all fake handles.
+var fakeKernel = newEmulator()
+
+// emulator holds the emulated session table and listener ports.
+type emulator struct {
+	mu        sync.Mutex
+	devices   map[*emuDevice]struct{}
+	sessions  [MaxSessions]*emuSession
+	listeners map[uint16]*emuDevice
+	nextPort  uint16
+}
+
+// emuDevice is one open handle on the emulated device.
+type emuDevice struct {
+	emu    *emulator
+	fd     int
+	port   uint16 // listening port, 0 if not listening
+	closed bool
+}
+
+// emuSession is one slot in the emulated session table.
+type emuSession struct {
+	info     SessionInfo
+	owner    *emuDevice
+	peer     *emuSession
+	channels [MaxChannels / 8]byte
+	queues   map[uint8][]emuMsg
+	arrivals uint64              // messages queued so far, to order them across channels
+	shut     ChannelSet          // channels closed for writing
+	ended    map[uint8]WireError // channels the peer closed, with its reason
+	created  time.Time
+}
+
+// emuMsg is a queued message with the flags it was sent with, or the
+// end of its channel.
+type emuMsg struct {
+	data    []byte
+	flags   uint8
+	arrival uint64
+	end     bool // queued by Shutdown: no message follows
+	reason  WireError
+	ack     chan error // for SendAcked: receives the delivery result, or nil
+}
+
+func newEmulator() *emulator {
+	return &emulator{
+		devices:   make(map[*emuDevice]struct{}),
+		listeners: make(map[uint16]*emuDevice),
+		nextPort:  49152,
+	}
+}
+
+// openFake opens a handle on the emulated device.
+func openFake() (*Device, error) {
+	fd, _, errno := syscall.Syscall(syscall.SYS_EVENTFD2, 0,
+		syscall.O_CLOEXEC|syscall.O_NONBLOCK, 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	ed := &emuDevice{emu: fakeKernel, fd: int(fd)}
+	dev, err := newDevice(int(fd), ed)
+	if err != nil {
+		return nil, err
+	}
+	fakeKernel.mu.Lock()
+	fakeKernel.devices[ed] = struct{}{}
+	fakeKernel.mu.Unlock()
+	return dev, nil
+}
+
+// close releases the handle: its listener is stopped and every session
+// it owns is torn down, as the kernel does when the last fd reference
+// goes away. The eventfd itself is closed by the Device.
+func (ed *emuDevice) close() error {
+	e := ed.emu
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if ed.closed {
+		return syscall.EBADF
+	}
+	ed.closed = true
+	delete(e.devices, ed)
+	if ed.port != 0 {
+		delete(e.listeners, ed.port)
+		ed.port = 0
+	}
+	for _, s := range e.sessions {
+		if s != nil && s.owner == ed {
+			e.remove(s)
+		}
+	}
+	e.signal()
+	return nil
+}
+
+// ioctl dispatches an ioctl request to the emulation, with user the
+// memory the request's pointer field refers to, if any. The return
+// value mirrors the positive return of the real syscall.
+func (ed *emuDevice) ioctl(req uintptr, arg unsafe.Pointer, user []byte) (int, error) {
+	e := ed.emu
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if ed.closed {
+		return -1, syscall.EBADF
+	}
+
+	switch req {
+	case iocListen:
+		return 0, e.listen(ed, *(*uint16)(arg))
+	case iocStop:
+		return 0, e.stop(ed)
+	case iocConnect:
+		return e.connect(ed, (*ConnectReq)(arg))
+	case iocSend:
+		return 0, e.send(ed, (*SendReq)(arg), user, nil)
+	case iocRecv:
+		return 0, e.recv(ed, (*RecvReq)(arg), user)
+	case iocSessions:
+		return 0, e.list(ed, (*SessionList)(arg), user)
+	case iocCloseSess:
+		return 0, e.closeSession(ed, *(*uint32)(arg))
+	case iocChannel:
+		return 0, e.channel(ed, (*ChannelReq)(arg), user)
+	default:
+		return -1, syscall.ENOTTY
+	}
+}
+
+func (e *emulator) listen(ed *emuDevice, port uint16) error {
+	if port == 0 {
+		return syscall.EINVAL
+	}
+	if ed.port != 0 {
+		return syscall.EBUSY
+	}
+	if _, ok := e.listeners[port]; ok {
+		return syscall.EADDRINUSE
+	}
+	e.listeners[port] = ed
+	ed.port = port
+	return nil
+}
+
+func (e *emulator) stop(ed *emuDevice) error {
+	if ed.port != 0 {
+		delete(e.listeners, ed.port)
+		ed.port = 0
+	}
+	return nil
+}
+
+func (e *emulator) connect(ed *emuDevice, req *ConnectReq) (int, error) {
+	if req.Transport > TransportAuto {
+		return -1, syscall.EINVAL
+	}
+	if req.Version > VersionPQC {
+		return -1, syscall.EPROTONOSUPPORT
+	}
+	ip := net.IP(req.PeerAddr[:])
+	if !ip.IsLoopback() && !ip.IsUnspecified() {
+		return -1, syscall.ENETUNREACH
+	}
+	srv, ok := e.listeners[req.PeerPort]
+	if !ok {
+		return -1, syscall.ECONNREFUSED
+	}
+
+	ci, si := e.freeSlot(-1), -1
+	if ci >= 0 {
+		si = e.freeSlot(ci)
+	}
+	if si < 0 {
+		return -1, syscall.ENOSPC
+	}
+
+	var id [SessionIDSize]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return -1, syscall.EIO
+	}
+
+	localPort := e.nextPort
+	e.nextPort++
+	if e.nextPort == 0 {
+		e.nextPort = 49152
+	}
+
+	now := time.Now()
+	client := &emuSession{owner: ed, created: now, queues: make(map[uint8][]emuMsg)}
+	client.info = SessionInfo{
+		Index:      uint32(ci),
+		PeerAddr:   req.PeerAddr,
+		PeerPort:   req.PeerPort,
+		AddrFamily: req.AddrFamily,
+		State:      StateInitSent,
+		SessionID:  id,
+	}
+	// The dialing end of a loopback session has the loopback address of
+	// its family, whatever address it dialed.
+	var local [16]byte
+	if req.AddrFamily == syscall.AF_INET6 {
+		copy(local[:], net.IPv6loopback)
+	} else {
+		copy(local[:], net.IPv4(127, 0, 0, 1).To16())
+	}
+	server := &emuSession{owner: srv, created: now, queues: make(map[uint8][]emuMsg)}
+	server.info = SessionInfo{
+		Index:      uint32(si),
+		PeerAddr:   local,
+		PeerPort:   localPort,
+		AddrFamily: req.AddrFamily,
+		State:      StateChallenged,
+		SessionID:  id,
+	}
+	client.peer, server.peer = server, client
+	e.sessions[ci], e.sessions[si] = client, server
+
+	// Loopback handshakes complete immediately.
+	client.info.State = StateEstablished
+	server.info.State = StateEstablished
+	e.signal()
+	return ci, nil
+}
+
+// sendAcked is send for SendAcked. The returned channel receives nil
+// once the peer's reader takes the message, or ECONNRESET if the peer
+// session is torn down first, and is then closed. Like recvAny, it is
+// not an ioctl of the kernel module.
+func (ed *emuDevice) sendAcked(req *SendReq, user []byte) (<-chan error, error) {
+	e := ed.emu
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if ed.closed {
+		return nil, syscall.EBADF
+	}
+	ack := make(chan error, 1)
+	if err := e.send(ed, req, user, ack); err != nil {
+		return nil, err
+	}
+	return ack, nil
+}
+
+// send queues the message of req, held in user, for the peer of the
+// session, with ack to report its delivery if not nil.
+func (e *emulator) send(ed *emuDevice, req *SendReq, user []byte, ack chan error) error {
+	if req.Len > MaxPayload {
+		return syscall.EMSGSIZE
+	}
+	s, err := e.owned(ed, req.SessionIdx)
+	if err != nil {
+		return err
+	}
+	if s.info.State != StateEstablished || s.peer == nil {
+		return syscall.ENOTCONN
+	}
+	if s.shut.Has(req.Channel) {
+		return syscall.EPIPE
+	}
+	p := s.peer
+	if len(p.queues[req.Channel]) >= fakeQueueLen {
+		return syscall.EAGAIN
+	}
+	data, err := userBytes(user, req.Len)
+	if err != nil {
+		return err
+	}
+	p.arrivals++
+	p.queues[req.Channel] = append(p.queues[req.Channel], emuMsg{
+		data:    append([]byte(nil), data...),
+		flags:   req.Flags,
+		arrival: p.arrivals,
+		ack:     ack,
+	})
+	s.info.BytesSent += uint64(len(data))
+	s.info.PacketsSent++
+	e.signal()
+	return nil
+}
+
+func (e *emulator) recv(ed *emuDevice, req *RecvReq, user []byte) error {
+	s, err := e.owned(ed, req.SessionIdx)
+	if err != nil {
+		return err
+	}
+	return e.take(s, req, user)
+}
+
+// recvAny is recv from whichever channel of the session holds the
+// oldest message, which it stores in req.Channel. If the message does
+// not fit, it stores its length in req.Len. It is not an ioctl of the
+// kernel module, which receives per channel only.
+func (ed *emuDevice) recvAny(req *RecvReq, user []byte) error {
+	e := ed.emu
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	s, err := e.owned(ed, req.SessionIdx)
+	if err != nil {
+		return err
+	}
+	var oldest uint64
+	for ch, q := range s.queues {
+		if len(q) > 0 && (oldest == 0 || q[0].arrival < oldest) {
+			oldest, req.Channel = q[0].arrival, ch
+		}
+	}
+	if oldest == 0 {
+		return s.idle()
+	}
+	err = e.take(s, req, user)
+	if errors.Is(err, syscall.EMSGSIZE) {
+		req.Len = uint32(len(s.queues[req.Channel][0].data))
+	}
+	return err
+}
+
+// shutdown queues the end of a channel for the peer of the session,
+// after the messages already queued, and fails later sends on it with
+// EPIPE. Like recvAny, it is not an ioctl of the kernel module.
+func (ed *emuDevice) shutdown(idx uint32, channel uint8, reason WireError) error {
+	e := ed.emu
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	s, err := e.owned(ed, idx)
+	if err != nil {
+		return err
+	}
+	if s.shut.Has(channel) {
+		return nil
+	}
+	if s.info.State != StateEstablished || s.peer == nil {
+		return syscall.ENOTCONN
+	}
+	p := s.peer
+	if len(p.queues[channel]) >= fakeQueueLen {
+		return syscall.EAGAIN
+	}
+	s.shut.Add(channel)
+	p.arrivals++
+	p.queues[channel] = append(p.queues[channel], emuMsg{
+		arrival: p.arrivals,
+		end:     true,
+		reason:  reason,
+	})
+	e.signal()
+	return nil
+}
+
+// idle returns the error for a receive that finds nothing queued. The
+// peer of a session is only ever gone because it was closed.
+func (s *emuSession) idle() error {
+	if s.peer == nil {
+		return &ShutdownError{Session: true}
+	}
+	return syscall.EAGAIN
+}
+
+// take moves the first message queued on req.Channel into the request
+// and its buffer, user. Once the peer has closed the channel, take fails
+// with a [*ShutdownError] instead.
+func (e *emulator) take(s *emuSession, req *RecvReq, user []byte) error {
+	q := s.queues[req.Channel]
+	if len(q) == 0 {
+		if reason, ok := s.ended[req.Channel]; ok {
+			return &ShutdownError{Reason: reason}
+		}
+		return s.idle()
+	}
+	msg := q[0]
+	if msg.end {
+		s.queues[req.Channel] = q[1:]
+		if s.ended == nil {
+			s.ended = make(map[uint8]WireError)
+		}
+		s.ended[req.Channel] = msg.reason
+		e.signal()
+		return &ShutdownError{Reason: msg.reason}
+	}
+	if uint32(len(msg.data)) > req.Len {
+		return syscall.EMSGSIZE
+	}
+	buf, err := userBytes(user, req.Len)
+	if err != nil {
+		return err
+	}
+	copy(buf, msg.data)
+	s.queues[req.Channel] = q[1:]
+	req.Len = uint32(len(msg.data))
+	req.Flags = FlagEncrypted | msg.flags
+	s.info.BytesRecv += uint64(len(msg.data))
+	s.info.PacketsRecv++
+	msg.acked(nil)
+	e.signal()
+	return nil
+}
+
+// acked reports the delivery result of a message sent with SendAcked.
+func (m emuMsg) acked(err error) {
+	if m.ack != nil {
+		m.ack <- err
+		close(m.ack)
+	}
+}
+
+func (e *emulator) list(ed *emuDevice, list *SessionList, user []byte) error {
+	infos, err := userInfos(user, list.MaxSessions)
+	if err != nil {
+		return err
+	}
+	n := uint32(0)
+	now := time.Now()
+	for _, s := range e.sessions {
+		if s == nil || s.owner != ed {
+			continue
+		}
+		if n >= list.MaxSessions {
+			break
+		}
+		infos[n] = s.snapshot(now)
+		n++
+	}
+	list.Count = n
+	return nil
+}
+
+func (e *emulator) closeSession(ed *emuDevice, idx uint32) error {
+	s, err := e.owned(ed, idx)
+	if err != nil {
+		return err
+	}
+	e.remove(s)
+	e.signal()
+	return nil
+}
+
+func (e *emulator) channel(ed *emuDevice, req *ChannelReq, user []byte) error {
+	s, err := e.owned(ed, req.SessionIdx)
+	if err != nil {
+		return err
+	}
+	byteIdx, bit := req.Channel/8, byte(1)<<(req.Channel%8)
+	switch req.Operation {
+	case ChanSubscribe:
+		s.channels[byteIdx] |= bit
+	case ChanUnsubscribe:
+		s.channels[byteIdx] &^= bit
+	case ChanList:
+		bitmap, err := userBytes(user, MaxChannels/8)
+		if err != nil {
+			return err
+		}
+		copy(bitmap, s.channels[:])
+	default:
+		return syscall.EINVAL
+	}
+	req.Result = 0
+	return nil
+}
+
+// owned returns the session at idx if it exists and belongs to ed.
+func (e *emulator) owned(ed *emuDevice, idx uint32) (*emuSession, error) {
+	if ed.closed {
+		return nil, syscall.EBADF
+	}
+	if idx >= MaxSessions || e.sessions[idx] == nil || e.sessions[idx].owner != ed {
+		return nil, syscall.EINVAL
+	}
+	return e.sessions[idx], nil
+}
+
+// remove frees the slot of s and moves its peer to StateClosing. The
+// peer keeps its queued data until its owner closes it; the messages
+// queued for s are dropped, failing their acknowledgements.
+func (e *emulator) remove(s *emuSession) {
+	for _, q := range s.queues {
+		for _, msg := range q {
+			msg.acked(syscall.ECONNRESET)
+		}
+	}
+	s.queues = nil
+	if p := s.peer; p != nil {
+		p.peer = nil
+		p.info.State = StateClosing
+	}
+	s.peer = nil
+	s.info.State = StateClosing
+	e.sessions[s.info.Index] = nil
+}
+
+// signal makes every open handle's eventfd readable, waking operations
+// waiting on the handle for readiness.
+func (e *emulator) signal() {
+	one := [8]byte{1}
+	for ed := range e.devices {
+		_, _ = syscall.Write(ed.fd, one[:])
+	}
+}
+
+// freeSlot returns the lowest free session index other than skip,
+// or -1 if the table is full.
+func (e *emulator) freeSlot(skip int) int {
+	for i, s := range e.sessions {
+		if s == nil && i != skip {
+			return i
+		}
+	}
+	return -1
+}
+
+// snapshot returns the session info with telemetry filled in.
+func (s *emuSession) snapshot(now time.Time) SessionInfo {
+	info := s.info
+	uptime := now.Sub(s.created)
+	depth := 0
+	for _, q := range s.queues {
+		depth += len(q)
+	}
+	info.Telem = Telemetry{
+		RTTNs:         uint64(fakeRTT),
+		MTUCurrent:    DefaultMTU,
+		QueueDepth:    uint16(depth),
+		UptimeNs:      uint64(uptime),
+		RekeyCount:    info.RekeyCount,
+		ThroughputBps: throughput(info.BytesSent+info.BytesRecv, uptime),
+	}
+	return info
+}
+
+func throughput(bytes uint64, d time.Duration) uint32 {
+	if d <= 0 {
+		return 0
+	}
+	bps := float64(bytes) / d.Seconds()
+	if bps > float64(^uint32(0)) {
+		return ^uint32(0)
+	}
+	return uint32(bps)
+}
+
+// userBytes returns the first n bytes of user, the memory a request's
+// pointer field refers to: the emulated equivalent of
+// copy_{from,to}_user. The Device hands that memory to the emulator as
+// a slice, which the garbage collector tracks, rather than leaving it to
+// follow the address in the request. A request that comes with a raw
+// address alone fails with EFAULT, as a bad address does in the kernel.
+func userBytes(user []byte, n uint32) ([]byte, error) {
+	if uint32(len(user)) < n {
+		return nil, syscall.EFAULT
+	}
+	return user[:n], nil
+}
+
+// userInfos is userBytes for the array of n SessionInfo a SessionList
+// points to. A list longer than the session table is refused with
+// EINVAL before its size is computed, so that the size cannot wrap.
+func userInfos(user []byte, n uint32) ([]SessionInfo, error) {
+	if n > MaxSessions {
+		return nil, syscall.EINVAL
+	}
+	b, err := userBytes(user, uint32(uint64(n)*uint64(unsafe.Sizeof(SessionInfo{}))))
+	if err != nil || n == 0 {
+		return nil, err
+	}
+	return unsafe.Slice((*SessionInfo)(unsafe.Pointer(&b[0])), n), nil
+}
@@ -0,0 +1,105 @@
+//go:build linux
+
+package poolioc
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"time"
+)
+
+// fallbackPoll is how often waiters retry when the descriptor cannot be
+// registered with the runtime poller.
+const fallbackPoll = 10 * time.Millisecond
+
+// watch wakes waiters every time the runtime poller reports the device
+// ready. wait is the Read or Write method of the file's RawConn. If the
+// descriptor does not support poll, watch falls back to waking waiters
+// periodically.
+func (d *Device) watch(wait func(func(uintptr) bool) error) {
+	err := wait(func(uintptr) bool {
+		d.signal()
+		return false
+	})
+	if err == nil {
+		return
+	}
+
+	ticker := time.NewTicker(fallbackPoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.signal()
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// signal wakes every operation currently waiting for readiness.
+func (d *Device) signal() {
+	d.readyMu.Lock()
+	close(d.ready)
+	d.ready = make(chan struct{})
+	d.readyMu.Unlock()
+}
+
+// readyChan returns a channel that is closed at the next readiness event.
+func (d *Device) readyChan() <-chan struct{} {
+	d.readyMu.Lock()
+	defer d.readyMu.Unlock()
+	return d.ready
+}
+
+// Ready returns a channel that is closed the next time the device
+// descriptor becomes readable or writable. Callers re-read the state
+// they care about, such as [Device.Sessions], after each wakeup.
+func (d *Device) Ready() <-chan struct{} {
+	return d.readyChan()
+}
+
+// noWaitKey marks a context made by NoWait.
+type noWaitKey struct{}
+
+// NoWait returns a copy of ctx under which a send on a [Device], or on
+// another backend that honours it, fails with EAGAIN instead of waiting
+// for room in a full queue. The caller can then wait for [Notifier]
+// readiness without holding up others, and retry.
+func NoWait(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noWaitKey{}, true)
+}
+
+// IsNoWait reports whether ctx, or a context it derives from, was made
+// by [NoWait].
+func IsNoWait(ctx context.Context) bool {
+	v, _ := ctx.Value(noWaitKey{}).(bool)
+	return v
+}
+
+// wait runs op until it stops failing with EAGAIN, sleeping on device
+// readiness between attempts. op runs on the calling goroutine, so once
+// wait returns no ioctl is still using the caller's buffers. wait
+// returns ctx.Err() if ctx is done first and [os.ErrClosed] if the
+// device is closed. Under a [NoWait] context it returns EAGAIN instead
+// of sleeping.
+func (d *Device) wait(ctx context.Context, op func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for {
+		ready := d.readyChan()
+		err := op()
+		if err != syscall.EAGAIN || IsNoWait(ctx) {
+			return err
+		}
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-d.done:
+			return os.ErrClosed
+		}
+	}
+}
@@ -4,6 +4,7 @@ package poolioc
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"sync"
 	"syscall"
@@ -12,81 +13,258 @@ import (
 
 const devicePath = "/dev/pool"
 
+// Backend names accepted by [OpenBackend] and the POOL_BACKEND
+// environment variable, besides those added with [RegisterBackend].
+const (
+	// BackendKernel talks to pool.ko through /dev/pool.
+	BackendKernel = "kernel"
+
+	// BackendFake emulates pool.ko in memory. Sessions can only be
+	// established over loopback, between handles in the same process.
+	BackendFake = "fake"
+)
+
+// BackendEnv is the environment variable consulted by [Open] to select
+// a backend. An empty value selects [BackendKernel].
+const BackendEnv = "POOL_BACKEND"
+
 // Device represents an open handle to the POOL kernel module.
 // All methods are safe for concurrent use.
+//
+// The descriptor is opened non-blocking and registered with the Go
+// runtime poller, so operations that would block wait for device
+// readiness instead of occupying a thread, and can be abandoned through
+// a context.
+//
+// Every ioctl holds a reference to the descriptor, as [os.File] I/O
+// does, so Close waits for ioctls in flight before the descriptor is
+// released, and no ioctl runs against a descriptor number the kernel
+// has reused. Operations waiting for readiness are woken by Close.
 type Device struct {
-	mu sync.Mutex
-	fd int
+	mu   sync.Mutex
+	fd   int
+	file *os.File
+	rc   syscall.RawConn // runs each ioctl with a reference to fd
+	emu  *emuDevice      // non-nil for the fake backend
+
+	readyMu sync.Mutex
+	ready   chan struct{} // closed and replaced on every readiness event
+	done    chan struct{} // closed by Close
+}
+
+// registered holds the backends added with RegisterBackend, by name.
+var registered struct {
+	mu   sync.Mutex
+	open map[string]func() (Backend, error)
 }
 
-// Open opens /dev/pool and returns a Device handle.
+// RegisterBackend makes a backend implemented outside this package
+// available to [OpenBackend] under name, as package pooludp does for
+// its userspace stack. The Backend open returns must implement
+// [io.Closer], which releases it. RegisterBackend is meant to be
+// called from an init function; it panics if name is empty, is
+// [BackendKernel] or [BackendFake], or is already registered.
+func RegisterBackend(name string, open func() (Backend, error)) {
+	registered.mu.Lock()
+	defer registered.mu.Unlock()
+	if _, dup := registered.open[name]; dup || name == "" || name == BackendKernel || name == BackendFake {
+		panic(fmt.Sprintf("poolioc: RegisterBackend called twice or with a reserved name %q", name))
+	}
+	if registered.open == nil {
+		registered.open = make(map[string]func() (Backend, error))
+	}
+	registered.open[name] = open
+}
+
+// OpenBackend opens the named backend: a Device for [BackendKernel],
+// the default for an empty name, and [BackendFake], or a backend added
+// with [RegisterBackend]. The returned Backend implements [io.Closer].
+// The pool package opens its devices with it, passing the value of
+// POOL_BACKEND.
+func OpenBackend(name string) (Backend, error) {
+	registered.mu.Lock()
+	open := registered.open[name]
+	registered.mu.Unlock()
+	if open == nil {
+		return openDevice(name)
+	}
+	b, err := open()
+	if err != nil {
+		return nil, fmt.Errorf("poolioc: open %s backend: %w", name, err)
+	}
+	if _, ok := b.(io.Closer); !ok {
+		return nil, fmt.Errorf("poolioc: %s backend cannot be closed", name)
+	}
+	return b, nil
+}
+
+// Open opens the backend named by the POOL_BACKEND environment variable,
+// /dev/pool by default, and returns a Device handle. It fails for a
+// backend added with [RegisterBackend], which is not a Device; use
+// [OpenBackend] for those.
 func Open() (*Device, error) {
-	fd, err := syscall.Open(devicePath, syscall.O_RDWR, 0)
+	return openDevice(os.Getenv(BackendEnv))
+}
+
+// openDevice opens a Device on the named built-in backend.
+func openDevice(name string) (*Device, error) {
+	switch name {
+	case "", BackendKernel:
+		fd, err := syscall.Open(devicePath, syscall.O_RDWR|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			return nil, fmt.Errorf("poolioc: open %s: %w", devicePath, err)
+		}
+		return newDevice(fd, nil)
+	case BackendFake:
+		dev, err := openFake()
+		if err != nil {
+			return nil, fmt.Errorf("poolioc: open fake backend: %w", err)
+		}
+		return dev, nil
+	default:
+		return nil, fmt.Errorf("poolioc: unknown backend %q", name)
+	}
+}
+
+// newDevice wraps a non-blocking descriptor in a Device and starts
+// watching it for readiness.
+func newDevice(fd int, emu *emuDevice) (*Device, error) {
+	f := os.NewFile(uintptr(fd), devicePath)
+	rc, err := f.SyscallConn()
 	if err != nil {
-		return nil, fmt.Errorf("poolioc: open %s: %w", devicePath, err)
+		f.Close()
+		return nil, fmt.Errorf("poolioc: %w", err)
 	}
-	return &Device{fd: fd}, nil
+	d := &Device{
+		fd:    fd,
+		file:  f,
+		rc:    rc,
+		emu:   emu,
+		ready: make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go d.watch(rc.Read)
+	go d.watch(rc.Write)
+	return d, nil
 }
 
-// Close closes the device handle.
+// Close closes the device handle. Operations waiting on the device
+// return [os.ErrClosed]; Close waits for ioctls already in flight before
+// it releases the descriptor. Those return promptly, except a Connect
+// waiting out a handshake, which Close does not wait for: it fails with
+// [os.ErrClosed] once the handshake ends, and the session is torn down.
 func (d *Device) Close() error {
 	d.mu.Lock()
-	defer d.mu.Unlock()
-
 	if d.fd < 0 {
+		d.mu.Unlock()
 		return os.ErrClosed
 	}
-	err := syscall.Close(d.fd)
 	d.fd = -1
+	close(d.done)
+	d.mu.Unlock()
+	d.signal()
+
+	// The emulator stops signalling the eventfd before it is closed.
+	var err error
+	if d.emu != nil {
+		err = d.emu.close()
+	}
+	if cerr := d.file.Close(); err == nil {
+		err = cerr
+	}
 	return err
 }
 
 // Fd returns the underlying file descriptor. Returns -1 if closed.
+// The descriptor is only valid until Close, which may run concurrently.
 func (d *Device) Fd() int {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 	return d.fd
 }
 
-// ioctl performs a raw ioctl syscall on the device fd.
-func (d *Device) ioctl(req uintptr, arg unsafe.Pointer) error {
-	d.mu.Lock()
-	fd := d.fd
-	d.mu.Unlock()
-
-	if fd < 0 {
+// control runs op with a reference to the descriptor held, so that a
+// concurrent Close waits for op to return before the descriptor is
+// released. It returns [os.ErrClosed] once Close has been called,
+// including for an op that the closing emulator failed with EBADF.
+func (d *Device) control(op func(fd uintptr) error) error {
+	if d.Fd() < 0 {
 		return os.ErrClosed
 	}
-
-	_, _, errno := syscall.Syscall(
-		syscall.SYS_IOCTL,
-		uintptr(fd),
-		req,
-		uintptr(arg),
-	)
-	if errno != 0 {
-		return errno
+	var err error
+	if cerr := d.rc.Control(func(fd uintptr) { err = op(fd) }); cerr != nil {
+		return os.ErrClosed
+	}
+	if err == syscall.EBADF && d.Fd() < 0 {
+		return os.ErrClosed
 	}
-	return nil
+	return err
+}
+
+// ioctl performs a raw ioctl syscall on the device fd.
+func (d *Device) ioctl(req uintptr, arg unsafe.Pointer) error {
+	_, err := d.ioctlRet(req, arg)
+	return err
 }
 
 // ioctlRet performs an ioctl and returns the positive return value
 // (used by CONNECT which returns the session index).
 func (d *Device) ioctlRet(req uintptr, arg unsafe.Pointer) (int, error) {
-	d.mu.Lock()
-	fd := d.fd
-	d.mu.Unlock()
+	return d.ioctlUser(req, arg, nil)
+}
 
-	if fd < 0 {
-		return -1, os.ErrClosed
+// ioctlUser is ioctlRet for a request whose pointer field refers to
+// user. The kernel follows the address in the request; the emulator is
+// handed user itself.
+func (d *Device) ioctlUser(req uintptr, arg unsafe.Pointer, user []byte) (int, error) {
+	ret := -1
+	err := d.control(func(fd uintptr) error {
+		if d.emu != nil {
+			var err error
+			ret, err = d.emu.ioctl(req, arg, user)
+			return err
+		}
+		r1, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg))
+		if errno != 0 {
+			return errno
+		}
+		ret = int(r1)
+		return nil
+	})
+	if err != nil {
+		return -1, err
 	}
+	return ret, nil
+}
 
-	r1, _, errno := syscall.Syscall(
-		syscall.SYS_IOCTL,
-		uintptr(fd),
-		req,
-		uintptr(arg),
-	)
+// ioctlBlocking is ioctlRet for an ioctl that may block, such as
+// CONNECT waiting out a handshake. On /dev/pool it runs on a duplicate
+// of the descriptor, so that a concurrent Close need not wait for it;
+// the duplicate keeps the open file alive until the ioctl returns, and
+// closing it after a Close releases whatever the ioctl set up. It
+// returns [os.ErrClosed] if Close was called meanwhile.
+func (d *Device) ioctlBlocking(req uintptr, arg unsafe.Pointer) (int, error) {
+	if d.emu != nil {
+		return d.ioctlRet(req, arg)
+	}
+	var dup uintptr
+	err := d.control(func(fd uintptr) error {
+		r1, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_DUPFD_CLOEXEC, 0)
+		if errno != 0 {
+			return errno
+		}
+		dup = r1
+		return nil
+	})
+	if err != nil {
+		return -1, err
+	}
+	defer syscall.Close(int(dup))
+
+	r1, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dup, req, uintptr(arg))
+	if d.Fd() < 0 {
+		return -1, os.ErrClosed
+	}
 	if errno != 0 {
 		return -1, errno
 	}
@@ -2,7 +2,10 @@
 
 package poolioc
 
-import "unsafe"
+import (
+	"runtime"
+	"unsafe"
+)
 
 // Sessions retrieves the list of active POOL sessions.
 func (d *Device) Sessions() ([]SessionInfo, error) {
@@ -12,7 +15,10 @@ func (d *Device) Sessions() ([]SessionInfo, error) {
 		InfoPtr:     uint64(uintptr(unsafe.Pointer(&infos[0]))),
 	}
 
-	if err := d.ioctl(iocSessions, unsafe.Pointer(&list)); err != nil {
+	user := unsafe.Slice((*byte)(unsafe.Pointer(&infos[0])), len(infos)*int(unsafe.Sizeof(infos[0])))
+	_, err := d.ioctlUser(iocSessions, unsafe.Pointer(&list), user)
+	runtime.KeepAlive(infos)
+	if err != nil {
 		return nil, err
 	}
 
@@ -169,12 +169,30 @@ var (
 // Ioctl request/response structs — must match pool.h byte layout
 // --------------------------------------------------------------------
 
-// ConnectReq matches struct pool_connect_req.
+// ConnectReq has the size and layout of struct pool_connect_req, but
+// only PeerAddr, PeerPort and AddrFamily are fields of it: Transport,
+// Version and HeartbeatSec sit in bytes the kernel module treats as
+// reserved. The pooludp stack honours them; [Device.Connect], on
+// /dev/pool or the fake backend that emulates it, fails with EOPNOTSUPP
+// unless they select the defaults (TCP transport, protocol Version, a
+// HeartbeatSec interval), which their zero values do, until the module
+// has an ABI for them.
 type ConnectReq struct {
-	PeerAddr   [16]byte // IPv4-mapped (::ffff:x.x.x.x) or native IPv6
-	PeerPort   uint16
-	AddrFamily uint8 // syscall.AF_INET or syscall.AF_INET6
-	_reserved  [5]byte
+	PeerAddr     [16]byte // IPv4-mapped (::ffff:x.x.x.x) or native IPv6
+	PeerPort     uint16
+	AddrFamily   uint8 // syscall.AF_INET or syscall.AF_INET6
+	Transport    uint8 // TransportTCP, TransportRaw or TransportAuto
+	Version      uint8 // 0, Version or VersionPQC
+	_reserved    uint8
+	HeartbeatSec uint16 // heartbeat interval in seconds, 0 for default
+}
+
+// defaults reports whether req leaves Transport, Version and
+// HeartbeatSec at what the kernel module does anyway.
+func (req *ConnectReq) defaults() bool {
+	return req.Transport == TransportTCP &&
+		(req.Version == 0 || req.Version == Version) &&
+		(req.HeartbeatSec == 0 || req.HeartbeatSec == HeartbeatSec)
 }
 
 // SendReq matches struct pool_send_req.
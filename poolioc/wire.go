@@ -0,0 +1,67 @@
+//go:build linux
+
+package poolioc
+
+import "fmt"
+
+// WireError is a POOL error code from the wire protocol (ErrAuthFail
+// through ErrVersionMismatch) reported by the peer.
+type WireError uint8
+
+var wireErrorNames = [...]string{
+	ErrAuthFail:        "AUTH_FAIL",
+	ErrDecryptFail:     "DECRYPT_FAIL",
+	ErrSeqInvalid:      "SEQ_INVALID",
+	ErrFragTimeout:     "FRAG_TIMEOUT",
+	ErrMTUExceeded:     "MTU_EXCEEDED",
+	ErrConfigReject:    "CONFIG_REJECT",
+	ErrRekeyFail:       "REKEY_FAIL",
+	ErrJournalFull:     "JOURNAL_FULL",
+	ErrOverload:        "OVERLOAD",
+	ErrVersionMismatch: "VERSION_MISMATCH",
+}
+
+func (e WireError) Error() string {
+	return "poolioc: peer error " + e.name()
+}
+
+// name returns the name of the code, or its value if it has none.
+func (e WireError) name() string {
+	if int(e) < len(wireErrorNames) && wireErrorNames[e] != "" {
+		return wireErrorNames[e]
+	}
+	return fmt.Sprintf("%#02x", uint8(e))
+}
+
+// ShutdownError is the error receives on a channel fail with once the
+// peer has closed the channel for writing (see [ShutdownBackend]) and
+// every message it sent before has been received. Reason is the POOL
+// error code the peer gave, or zero for an orderly close; a non-zero
+// Reason is what Unwrap returns.
+//
+// The userspace backends also fail receives with a ShutdownError whose
+// Session field is set once the peer has closed the whole session and
+// everything queued has been read. The kernel module does not tell a
+// session the peer closed from one that is gone for another reason;
+// both fail with ENOTCONN.
+type ShutdownError struct {
+	Reason  WireError
+	Session bool // the peer closed the session rather than the channel
+}
+
+func (e *ShutdownError) Error() string {
+	if e.Session {
+		return "poolioc: session closed by peer"
+	}
+	if e.Reason == 0 {
+		return "poolioc: channel closed by peer"
+	}
+	return "poolioc: channel closed by peer with " + e.Reason.name()
+}
+
+func (e *ShutdownError) Unwrap() error {
+	if e.Reason == 0 {
+		return nil
+	}
+	return e.Reason
+}
@@ -0,0 +1,65 @@
+//go:build linux
+
+package poolmux
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// deadline is a stream deadline, modeled on the deadline type behind
+// net.Pipe. Changing the deadline affects operations that are already
+// waiting on it.
+type deadline struct {
+	mu     sync.Mutex // Guards timer, ctx and cancel
+	timer  *time.Timer
+	ctx    context.Context // Must be non-nil; done when the deadline passes
+	cancel context.CancelFunc
+}
+
+func makeDeadline() deadline {
+	ctx, cancel := context.WithCancel(context.Background())
+	return deadline{ctx: ctx, cancel: cancel}
+}
+
+// set sets the point in time when the deadline will time out. A zero
+// value for t prevents timeout; a t in the future refreshes a deadline
+// that has passed.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.ctx.Done() // Wait for the timer callback to finish and cancel
+	}
+	d.timer = nil
+
+	expired := d.ctx.Err() != nil
+	if t.IsZero() {
+		if expired {
+			d.renew()
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if expired {
+			d.renew()
+		}
+		d.timer = time.AfterFunc(dur, d.cancel)
+		return
+	}
+	d.cancel()
+}
+
+// renew replaces an expired context. d.mu must be held.
+func (d *deadline) renew() {
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+}
+
+// context returns a context that is done when the deadline is exceeded.
+func (d *deadline) context() context.Context {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.ctx
+}
@@ -0,0 +1,33 @@
+// Package poolmux multiplexes any number of logical streams over one
+// POOL channel, for applications that need more concurrent streams
+// than the 256 channels of a session.
+//
+// A [Session] runs over a message transport: a [pool.Conn] or a
+// [pool.ChannelConn], which carry frames whole. One side is the
+// [Client] and the other the [Server]; either may open streams:
+//
+//	// Dialing side
+//	conn, _ := pool.Dial("pool", "10.0.0.1:9253")
+//	sess, _ := poolmux.Client(conn, nil)
+//	st, _ := sess.OpenStream(ctx)
+//	st.Write([]byte("hello"))
+//
+//	// Accepting side
+//	sess, _ := poolmux.Server(conn, nil)
+//	st, _ := sess.AcceptStream(ctx)
+//	io.Copy(st, st)
+//
+// Each [Stream] implements [net.Conn], with deadlines. Close half-closes
+// a stream like yamux: the peer reads io.EOF once it has read what was
+// written before. Reset aborts a stream on both sides.
+//
+// The framing follows yamux. Every frame is one POOL message: a 12-byte
+// header (version, type, flags, stream ID, length) followed, for DATA
+// frames, by the payload. Stream IDs are odd for streams the client
+// opens and even for the server's. WINDOW_UPDATE frames carry flow
+// control: each stream starts with a receive window of [InitialWindow]
+// bytes, the peer may send no more than the window allows, and the
+// reader grants more as it consumes data, so a slow stream cannot hold
+// up the others. The SYN, ACK, FIN and RST flags open, accept,
+// half-close and reset streams; GO_AWAY ends a session.
+package poolmux
@@ -0,0 +1,41 @@
+//go:build linux
+
+package poolmux
+
+import "errors"
+
+// Sentinel errors returned by sessions and streams.
+var (
+	// ErrSessionClosed indicates the session has ended, closed by
+	// either side or by a failure of its transport.
+	ErrSessionClosed = errors.New("poolmux: session closed")
+
+	// ErrStreamClosed indicates a read or write on a stream that was
+	// closed on this side.
+	ErrStreamClosed = errors.New("poolmux: stream closed")
+
+	// ErrStreamReset indicates the stream was reset by either side.
+	ErrStreamReset = errors.New("poolmux: stream reset")
+
+	// ErrRemoteGoAway indicates the peer accepts no new streams.
+	ErrRemoteGoAway = errors.New("poolmux: remote going away")
+
+	// ErrStreamsExhausted indicates the session has used up its stream
+	// IDs.
+	ErrStreamsExhausted = errors.New("poolmux: stream IDs exhausted")
+
+	// ErrProtocol indicates a frame that violates the protocol. The
+	// session ends with it.
+	ErrProtocol = errors.New("poolmux: protocol error")
+
+	// ErrTimeout indicates a stream deadline was exceeded.
+	ErrTimeout = errors.New("poolmux: i/o timeout")
+)
+
+// timeoutError implements net.Error for an exceeded deadline.
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string   { return ErrTimeout.Error() }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+func (e *timeoutError) Unwrap() error   { return ErrTimeout }
@@ -0,0 +1,92 @@
+//go:build linux
+
+package poolmux
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// protoVersion is the framing version carried by every header.
+	protoVersion = 0
+
+	// headerSize is the encoded size of a frame header.
+	headerSize = 12
+)
+
+// frameType is the type of a frame.
+type frameType uint8
+
+const (
+	typeData         frameType = iota // payload for a stream
+	typeWindowUpdate                  // Length more bytes may be sent
+	typePing                          // reserved, answered by nothing yet
+	typeGoAway                        // Length is a goAway code
+)
+
+// Frame flags.
+const (
+	flagSYN uint16 = 1 << iota // opens a stream
+	flagACK                    // accepts a stream
+	flagFIN                    // the sender has finished writing
+	flagRST                    // the stream is aborted
+)
+
+// GO_AWAY codes.
+const (
+	goAwayNormal uint32 = iota
+	goAwayProtocol
+)
+
+// header is a decoded frame header. For DATA frames Length is the size
+// of the payload, for WINDOW_UPDATE the window increment and for
+// GO_AWAY the code.
+type header struct {
+	typ      frameType
+	flags    uint16
+	streamID uint32
+	length   uint32
+}
+
+// encode returns the frame made of h and payload.
+func (h header) encode(payload []byte) []byte {
+	b := make([]byte, headerSize+len(payload))
+	b[0] = protoVersion
+	b[1] = byte(h.typ)
+	binary.BigEndian.PutUint16(b[2:], h.flags)
+	binary.BigEndian.PutUint32(b[4:], h.streamID)
+	binary.BigEndian.PutUint32(b[8:], h.length)
+	copy(b[headerSize:], payload)
+	return b
+}
+
+// decode splits a frame into its header and payload.
+func decode(b []byte) (header, []byte, error) {
+	if len(b) < headerSize {
+		return header{}, nil, fmt.Errorf("%w: %d-byte frame", ErrProtocol, len(b))
+	}
+	if b[0] != protoVersion {
+		return header{}, nil, fmt.Errorf("%w: version %d", ErrProtocol, b[0])
+	}
+	h := header{
+		typ:      frameType(b[1]),
+		flags:    binary.BigEndian.Uint16(b[2:]),
+		streamID: binary.BigEndian.Uint32(b[4:]),
+		length:   binary.BigEndian.Uint32(b[8:]),
+	}
+	payload := b[headerSize:]
+	switch h.typ {
+	case typeData:
+		if int(h.length) != len(payload) {
+			return header{}, nil, fmt.Errorf("%w: DATA length %d with %d bytes", ErrProtocol, h.length, len(payload))
+		}
+	case typeWindowUpdate, typePing, typeGoAway:
+		if len(payload) != 0 {
+			return header{}, nil, fmt.Errorf("%w: payload on frame type %d", ErrProtocol, h.typ)
+		}
+	default:
+		return header{}, nil, fmt.Errorf("%w: frame type %d", ErrProtocol, h.typ)
+	}
+	return h, payload, nil
+}
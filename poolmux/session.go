@@ -0,0 +1,344 @@
+//go:build linux
+
+package poolmux
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/amosdavis/pool-go/pool"
+)
+
+// InitialWindow is the receive window every stream starts with, in
+// bytes. A larger [Config.MaxStreamWindow] is granted when the stream
+// is opened.
+const InitialWindow = 256 << 10
+
+// Transport is the message connection a Session runs over. Each frame
+// is written and read as one message. [*pool.Conn] and
+// [*pool.ChannelConn] implement it.
+type Transport interface {
+	ReadMsg(ctx context.Context) (*pool.Message, error)
+	WriteMsg(ctx context.Context, m *pool.Message) error
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+// Config configures a Session. A nil *Config is the default
+// configuration.
+type Config struct {
+	// AcceptBacklog is the number of streams opened by the peer that
+	// may wait for AcceptStream; further ones are reset. Zero means
+	// 256.
+	AcceptBacklog int
+
+	// MaxStreamWindow is the receive window of each stream, in bytes:
+	// how much the peer may send before the stream is read. It must be
+	// at least InitialWindow, which zero means.
+	MaxStreamWindow uint32
+
+	// MaxFrameSize is the largest DATA payload sent in one frame. It
+	// must fit a single message of the transport with the frame
+	// header. Zero means 16 KiB.
+	MaxFrameSize int
+}
+
+// withDefaults returns the configuration with zero fields filled in.
+func (cfg *Config) withDefaults() (Config, error) {
+	var c Config
+	if cfg != nil {
+		c = *cfg
+	}
+	if c.AcceptBacklog <= 0 {
+		c.AcceptBacklog = 256
+	}
+	if c.MaxStreamWindow == 0 {
+		c.MaxStreamWindow = InitialWindow
+	}
+	if c.MaxStreamWindow < InitialWindow {
+		return c, fmt.Errorf("poolmux: stream window %d below InitialWindow", c.MaxStreamWindow)
+	}
+	if c.MaxFrameSize <= 0 {
+		c.MaxFrameSize = 16 << 10
+	}
+	return c, nil
+}
+
+// Session is a multiplexed connection: any number of [Stream]s over one
+// [Transport]. It implements [net.Listener], accepting streams opened
+// by the peer. All methods are safe for concurrent use.
+type Session struct {
+	t   Transport
+	cfg Config
+
+	ctx    context.Context // done once the session has ended
+	cancel context.CancelFunc
+	accept chan *Stream
+
+	mu       sync.Mutex
+	streams  map[uint32]*Stream
+	nextID   uint32
+	goAway   bool  // the peer accepts no new streams
+	err      error // why the session ended
+	closeErr error // result of closing the transport
+}
+
+// Client starts a session on t as the side that opens odd-numbered
+// streams. cfg may be nil.
+func Client(t Transport, cfg *Config) (*Session, error) {
+	return newSession(t, cfg, 1)
+}
+
+// Server starts a session on t as the side that opens even-numbered
+// streams. cfg may be nil.
+func Server(t Transport, cfg *Config) (*Session, error) {
+	return newSession(t, cfg, 2)
+}
+
+func newSession(t Transport, cfg *Config, firstID uint32) (*Session, error) {
+	c, err := cfg.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Session{
+		t:       t,
+		cfg:     c,
+		ctx:     ctx,
+		cancel:  cancel,
+		accept:  make(chan *Stream, c.AcceptBacklog),
+		streams: make(map[uint32]*Stream),
+		nextID:  firstID,
+	}
+	go s.recvLoop()
+	return s, nil
+}
+
+// OpenStream opens a new stream. It returns without waiting for the
+// peer; writes may start at once. It fails with [ErrRemoteGoAway] if
+// the peer has asked for no more streams.
+func (s *Session) OpenStream(ctx context.Context) (*Stream, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, ErrSessionClosed
+	}
+	if s.goAway {
+		s.mu.Unlock()
+		return nil, ErrRemoteGoAway
+	}
+	id := s.nextID
+	if id == 0 || id+2 < id {
+		s.mu.Unlock()
+		return nil, ErrStreamsExhausted
+	}
+	s.nextID += 2
+	st := newStream(s, id)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	if err := s.sendWindow(ctx, id, flagSYN, s.cfg.MaxStreamWindow-InitialWindow); err != nil {
+		s.remove(id)
+		return nil, s.ioError(err)
+	}
+	return st, nil
+}
+
+// AcceptStream waits for the peer to open a stream and returns it.
+func (s *Session) AcceptStream(ctx context.Context) (*Stream, error) {
+	select {
+	case st := <-s.accept:
+		err := s.sendWindow(ctx, st.id, flagACK, s.cfg.MaxStreamWindow-InitialWindow)
+		if err != nil {
+			st.Reset()
+			return nil, s.ioError(err)
+		}
+		return st, nil
+	case <-s.ctx.Done():
+		return nil, ErrSessionClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Accept is like AcceptStream without a context. It implements
+// [net.Listener].
+func (s *Session) Accept() (net.Conn, error) {
+	return s.AcceptStream(context.Background())
+}
+
+// Addr returns the local address of the transport.
+func (s *Session) Addr() net.Addr {
+	return s.t.LocalAddr()
+}
+
+// NumStreams returns the number of streams that are open.
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// Close tells the peer the session is going away, ends every stream
+// with [ErrSessionClosed] and closes the transport.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	ended := s.err != nil
+	s.mu.Unlock()
+	if ended {
+		return ErrSessionClosed
+	}
+	_ = s.send(s.ctx, header{typ: typeGoAway, length: goAwayNormal}, nil)
+	s.fail(ErrSessionClosed)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeErr
+}
+
+// fail ends the session with err, if it has not ended already.
+func (s *Session) fail(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.err = err
+	streams := s.streams
+	s.streams = make(map[uint32]*Stream)
+	s.mu.Unlock()
+
+	s.cancel()
+	for _, st := range streams {
+		st.abort(ErrSessionClosed)
+	}
+	cerr := s.t.Close()
+	s.mu.Lock()
+	s.closeErr = cerr
+	s.mu.Unlock()
+}
+
+// ioError maps an error from the transport: once the session has ended
+// it is reported as ErrSessionClosed.
+func (s *Session) ioError(err error) error {
+	if s.ctx.Err() != nil {
+		return ErrSessionClosed
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() || errors.Is(err, context.DeadlineExceeded) {
+		return &timeoutError{}
+	}
+	return err
+}
+
+// send writes one frame.
+func (s *Session) send(ctx context.Context, h header, payload []byte) error {
+	return s.t.WriteMsg(ctx, &pool.Message{Data: h.encode(payload)})
+}
+
+// sendWindow writes a WINDOW_UPDATE frame granting delta bytes.
+func (s *Session) sendWindow(ctx context.Context, id uint32, flags uint16, delta uint32) error {
+	return s.send(ctx, header{typ: typeWindowUpdate, flags: flags, streamID: id, length: delta}, nil)
+}
+
+// remove forgets the stream with id.
+func (s *Session) remove(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.streams, id)
+}
+
+// recvLoop reads and dispatches frames until the session ends.
+func (s *Session) recvLoop() {
+	for {
+		m, err := s.t.ReadMsg(s.ctx)
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		h, payload, err := decode(m.Data)
+		if err == nil {
+			err = s.handle(h, payload)
+		}
+		if errors.Is(err, ErrProtocol) {
+			_ = s.send(s.ctx, header{typ: typeGoAway, length: goAwayProtocol}, nil)
+			s.fail(err)
+			return
+		}
+	}
+}
+
+// handle dispatches one frame.
+func (s *Session) handle(h header, payload []byte) error {
+	switch h.typ {
+	case typeGoAway:
+		s.mu.Lock()
+		s.goAway = true
+		s.mu.Unlock()
+		return nil
+	case typePing:
+		return nil
+	}
+
+	st, refused, err := s.stream(h)
+	if refused {
+		// Reset here rather than under s.mu, as a GOAWAY is sent.
+		_ = s.send(s.ctx, header{typ: typeWindowUpdate, flags: flagRST, streamID: h.streamID}, nil)
+		return nil
+	}
+	if st == nil || err != nil {
+		return err
+	}
+	if h.typ == typeData {
+		if err := st.receive(payload); err != nil {
+			return err
+		}
+	} else {
+		st.grow(h.length)
+	}
+	if h.flags&flagFIN != 0 {
+		st.remoteClose()
+	}
+	if h.flags&flagRST != 0 {
+		st.abort(ErrStreamReset)
+		s.remove(st.id)
+	}
+	return nil
+}
+
+// stream returns the stream a DATA or WINDOW_UPDATE frame is for,
+// creating it on SYN. It returns nil for frames on streams that have
+// gone away, and reports a SYN refused because the accept backlog is
+// full, which the caller must reset.
+func (s *Session) stream(h header) (st *Stream, refused bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.streams[h.streamID]
+	if h.flags&flagSYN == 0 {
+		return st, false, nil
+	}
+	if ok || h.streamID == 0 || h.streamID%2 == s.nextID%2 {
+		return nil, false, fmt.Errorf("%w: SYN for stream %d", ErrProtocol, h.streamID)
+	}
+	if s.err != nil {
+		return nil, false, nil
+	}
+	st = newStream(s, h.streamID)
+	select {
+	case s.accept <- st:
+	default:
+		return nil, true, nil
+	}
+	s.streams[h.streamID] = st
+	return st, false, nil
+}
+
+// Verify interface compliance at compile time.
+var (
+	_ net.Listener = (*Session)(nil)
+	_ Transport    = (*pool.Conn)(nil)
+	_ Transport    = (*pool.ChannelConn)(nil)
+)
@@ -0,0 +1,346 @@
+//go:build linux
+
+package poolmux
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Stream is one logical stream of a [Session]. It implements
+// [net.Conn]; its deadlines are its own.
+type Stream struct {
+	id   uint32
+	sess *Session
+
+	wmu sync.Mutex // keeps the frames of concurrent writes apart
+
+	mu          sync.Mutex
+	buf         []byte // received and not yet read
+	recvWindow  uint32 // bytes the peer may still send
+	unacked     uint32 // bytes consumed and not yet granted back
+	sendWindow  uint32 // bytes we may still send
+	closed      bool   // Close was called: data that arrives is dropped
+	writeClosed bool   // FIN sent
+	remoteDone  bool   // FIN received
+	err         error  // why the stream ended: reset or session end
+	changed     chan struct{}
+
+	readDeadline  deadline
+	writeDeadline deadline
+}
+
+func newStream(s *Session, id uint32) *Stream {
+	return &Stream{
+		id:            id,
+		sess:          s,
+		recvWindow:    s.cfg.MaxStreamWindow,
+		sendWindow:    InitialWindow,
+		readDeadline:  makeDeadline(),
+		writeDeadline: makeDeadline(),
+	}
+}
+
+// StreamID returns the ID of the stream, odd if the client opened it.
+func (st *Stream) StreamID() uint32 { return st.id }
+
+// watch returns a channel that is closed at the next change. st.mu
+// must be held.
+func (st *Stream) watch() <-chan struct{} {
+	if st.changed == nil {
+		st.changed = make(chan struct{})
+	}
+	return st.changed
+}
+
+// signal wakes everything waiting for a change. st.mu must be held.
+func (st *Stream) signal() {
+	if st.changed != nil {
+		close(st.changed)
+		st.changed = nil
+	}
+}
+
+// wait releases st.mu until the next change or until ctx is done.
+func (st *Stream) wait(ctx context.Context) {
+	changed := st.watch()
+	st.mu.Unlock()
+	select {
+	case <-changed:
+	case <-ctx.Done():
+	}
+	st.mu.Lock()
+}
+
+// consume records n bytes taken off the stream and returns the window
+// to grant the peer, once at least half the window is owed. st.mu must
+// be held.
+func (st *Stream) consume(n int) uint32 {
+	st.unacked += uint32(n)
+	if st.unacked < st.sess.cfg.MaxStreamWindow/2 {
+		return 0
+	}
+	grant := st.unacked
+	st.unacked = 0
+	st.recvWindow += grant
+	return grant
+}
+
+// receive buffers the payload of a DATA frame.
+func (st *Stream) receive(payload []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	n := len(payload)
+	if uint64(n) > uint64(st.recvWindow) {
+		return fmt.Errorf("%w: stream %d sent %d bytes over a %d-byte window", ErrProtocol, st.id, n, st.recvWindow)
+	}
+	st.recvWindow -= uint32(n)
+	if st.closed || st.err != nil {
+		// Nobody will read it: give the window straight back.
+		if grant := st.consume(n); grant > 0 {
+			go st.sess.sendWindow(st.sess.ctx, st.id, 0, grant)
+		}
+		return nil
+	}
+	st.buf = append(st.buf, payload...)
+	st.signal()
+	return nil
+}
+
+// grow adds delta to the send window.
+func (st *Stream) grow(delta uint32) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.sendWindow += delta
+	st.signal()
+}
+
+// remoteClose records the peer's FIN.
+func (st *Stream) remoteClose() {
+	st.mu.Lock()
+	st.remoteDone = true
+	done := st.writeClosed
+	st.signal()
+	st.mu.Unlock()
+	if done {
+		st.sess.remove(st.id)
+	}
+}
+
+// abort ends the stream with err.
+func (st *Stream) abort(err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.signal()
+}
+
+// Read reads data from the stream. It returns io.EOF once the peer has
+// closed its side and everything it wrote has been read.
+func (st *Stream) Read(b []byte) (int, error) {
+	ctx := st.readDeadline.context()
+	st.mu.Lock()
+	for {
+		switch {
+		case st.closed:
+			st.mu.Unlock()
+			return 0, ErrStreamClosed
+		case errors.Is(st.err, ErrStreamReset):
+			st.mu.Unlock()
+			return 0, ErrStreamReset
+		case ctx.Err() != nil:
+			st.mu.Unlock()
+			return 0, &timeoutError{}
+		case len(st.buf) > 0:
+			n := copy(b, st.buf)
+			st.buf = st.buf[n:]
+			if len(st.buf) == 0 {
+				st.buf = nil
+			}
+			grant := st.consume(n)
+			st.mu.Unlock()
+			if grant > 0 {
+				_ = st.sess.sendWindow(st.sess.ctx, st.id, 0, grant)
+			}
+			return n, nil
+		case st.err != nil:
+			st.mu.Unlock()
+			return 0, st.err
+		case st.remoteDone:
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		st.wait(ctx)
+	}
+}
+
+// reserve takes up to want bytes of send window, waiting for the peer
+// to grant some if there is none.
+func (st *Stream) reserve(ctx context.Context, want int) (int, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for {
+		switch {
+		case st.err != nil:
+			return 0, st.err
+		case st.writeClosed:
+			return 0, ErrStreamClosed
+		case ctx.Err() != nil:
+			return 0, &timeoutError{}
+		case st.sendWindow > 0:
+			n := min(want, int(st.sendWindow), st.sess.cfg.MaxFrameSize)
+			st.sendWindow -= uint32(n)
+			return n, nil
+		}
+		st.wait(ctx)
+	}
+}
+
+// Write writes data to the stream, in frames of at most MaxFrameSize.
+// It blocks while the peer's window is exhausted; if the write
+// deadline passes meanwhile, it returns how much was sent and a
+// timeout.
+func (st *Stream) Write(b []byte) (int, error) {
+	st.wmu.Lock()
+	defer st.wmu.Unlock()
+
+	ctx := st.writeDeadline.context()
+	total := 0
+	for total < len(b) {
+		n, err := st.reserve(ctx, len(b)-total)
+		if err != nil {
+			return total, err
+		}
+		h := header{typ: typeData, streamID: st.id, length: uint32(n)}
+		if err := st.sess.send(ctx, h, b[total:total+n]); err != nil {
+			return total, st.ioError(ctx, err)
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// ioError maps an error from the transport for this stream.
+func (st *Stream) ioError(ctx context.Context, err error) error {
+	if st.sess.ctx.Err() == nil && ctx.Err() != nil {
+		return &timeoutError{}
+	}
+	return st.sess.ioError(err)
+}
+
+// CloseWrite half-closes the stream: the peer reads io.EOF after the
+// data already written. Reads go on until the peer closes its side.
+func (st *Stream) CloseWrite() error {
+	st.wmu.Lock()
+	defer st.wmu.Unlock()
+
+	st.mu.Lock()
+	if st.err != nil {
+		err := st.err
+		st.mu.Unlock()
+		return err
+	}
+	if st.writeClosed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.writeClosed = true
+	done := st.remoteDone
+	st.signal()
+	st.mu.Unlock()
+
+	if done {
+		st.sess.remove(st.id)
+	}
+	err := st.sess.sendWindow(st.sess.ctx, st.id, flagFIN, 0)
+	return st.sess.ioError(err)
+}
+
+// Close closes the stream on this side: it sends FIN like CloseWrite
+// and makes reads fail, discarding data that has not been read. The
+// peer can still read what was written before. Use Reset to abort the
+// stream instead.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return ErrStreamClosed
+	}
+	st.closed = true
+	if grant := st.consume(len(st.buf)); grant > 0 {
+		go st.sess.sendWindow(st.sess.ctx, st.id, 0, grant)
+	}
+	st.buf = nil
+	st.signal()
+	ended := st.err != nil
+	st.mu.Unlock()
+
+	if ended {
+		return nil
+	}
+	return st.CloseWrite()
+}
+
+// Reset aborts the stream on both sides: reads and writes fail with
+// [ErrStreamReset], and data in flight is discarded.
+func (st *Stream) Reset() error {
+	st.mu.Lock()
+	if st.err != nil {
+		st.mu.Unlock()
+		return nil
+	}
+	st.err = ErrStreamReset
+	st.signal()
+	st.mu.Unlock()
+
+	st.sess.remove(st.id)
+	err := st.sess.send(st.sess.ctx, header{typ: typeWindowUpdate, flags: flagRST, streamID: st.id}, nil)
+	return st.sess.ioError(err)
+}
+
+// LocalAddr returns the local address of the session's transport.
+func (st *Stream) LocalAddr() net.Addr { return st.sess.t.LocalAddr() }
+
+// RemoteAddr returns the remote address of the session's transport.
+func (st *Stream) RemoteAddr() net.Addr { return st.sess.t.RemoteAddr() }
+
+// SetDeadline sets both read and write deadlines. Like [net.Conn], the
+// deadline also applies to pending calls.
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.readDeadline.set(t)
+	st.writeDeadline.set(t)
+	st.wake()
+	return nil
+}
+
+// SetReadDeadline sets the deadline for reads.
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.readDeadline.set(t)
+	st.wake()
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for writes, including waits for
+// the peer's window.
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.writeDeadline.set(t)
+	st.wake()
+	return nil
+}
+
+// wake makes waiting calls look at their deadline again.
+func (st *Stream) wake() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.signal()
+}
+
+// Verify interface compliance at compile time.
+var _ net.Conn = (*Stream)(nil)
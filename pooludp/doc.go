@@ -0,0 +1,70 @@
+// Package pooludp is a userspace implementation of the POOL protocol
+// over UDP, for hosts that cannot load the pool.ko kernel module.
+//
+// A [Stack] implements the same backend surface as a [poolioc.Device]
+// — it satisfies [poolioc.Backend], [poolioc.ContextBackend],
+// [poolioc.Notifier], [poolioc.MessageBackend], [poolioc.AckBackend],
+// [poolioc.DemuxBackend] and [poolioc.ShutdownBackend] — so the pool
+// package runs on it unchanged:
+//
+//	st := pooludp.New()
+//	defer st.Close()
+//	lc := pool.ListenConfig{Backend: st}
+//	ln, err := lc.Listen(ctx, "pool", ":9253")
+//
+// Importing this package registers it as the "udp" backend of
+// [poolioc.OpenBackend]: setting POOL_BACKEND=udp in the environment
+// then makes pool.Dial and pool.Listen open a new Stack wherever they
+// would otherwise open /dev/pool. No privileges are needed.
+//
+// Like a device handle, a Stack owns one socket and every session made
+// through it. The socket is bound by the first Listen (to the listening
+// port) or Connect (to an ephemeral port). Sessions use the wire format
+// of package poolwire, one packet per datagram:
+//
+//   - INIT carries the initiator's X25519 public key and heartbeat
+//     interval. CHALLENGE returns the responder's public key and a
+//     random challenge. RESPONSE returns the challenge sealed under the
+//     derived keys, and the responder confirms with an ACK. Keys are
+//     derived from the X25519 shared secret with HKDF-SHA256, salted
+//     with the session ID; each direction has its own keys. A
+//     listening Stack holds a few sessions awaiting RESPONSE per source
+//     address, and a few more overall, dropping INITs beyond them.
+//   - DATA payloads are sealed with ChaCha20-Poly1305 using the packet
+//     sequence number as nonce and the header as additional data. Every
+//     DATA packet is acknowledged, retransmitted until it is, and
+//     delivered in order.
+//   - Each channel is flow-controlled on its own, so that a reader
+//     that falls behind on one channel holds up neither the others nor
+//     the session. A sender may have 256 sequenced packets on a
+//     channel that the receiver's reader has not yet taken; the
+//     receiver raises that limit as it reads, in the Seq field of its
+//     ACKs, which is otherwise zero, and in ACKs that acknowledge
+//     nothing. A sender that reaches the limit probes the receiver for
+//     it with a HEARTBEAT flagged FlagRequireAck rather than treating
+//     the wait as loss.
+//   - Messages too long for one packet at the default MTU are split by
+//     package poolfrag into DATA packets flagged FlagFragment, the last
+//     also FlagLastFrag, and reassembled before delivery.
+//   - A message sent with FlagRequireAck is answered, once it is queued
+//     for the reader, with a delivery ACK: an ACK flagged
+//     FlagRequireAck whose Ack field is the message's last sequence
+//     number and whose Seq field is zero, or the POOL error code if the
+//     message was lost in reassembly.
+//   - HEARTBEAT keeps idle sessions alive; a session whose peer falls
+//     silent for several heartbeat intervals moves to StateClosing.
+//     If data was still unacknowledged, later sends fail with the
+//     cause, ETIMEDOUT or ECONNRESET, rather than ENOTCONN.
+//   - CLOSE ends a session once its outstanding data is acknowledged.
+//     A CLOSE with a sequence number closes only its channel for
+//     writing: it is sealed, acknowledged and delivered in order like
+//     DATA, and its one-byte payload is the reason, a POOL error code
+//     or zero.
+//
+// Every packet after INIT carries a header HMAC-SHA256. The packets
+// that have no sequence number, ACK, HEARTBEAT and the CLOSE of a
+// session, are also sequenced by their header timestamp, which each
+// side keeps increasing: one that is not later than the last accepted
+// is dropped as a replay. Version 2 (post-quantum) handshakes are not
+// supported. Messages are limited to [MaxMessage] bytes.
+package pooludp
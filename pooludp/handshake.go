@@ -0,0 +1,293 @@
+//go:build linux
+
+package pooludp
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/amosdavis/pool-go/poolioc"
+	"github.com/amosdavis/pool-go/poolwire"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Handshake payload sizes.
+const (
+	keyLen       = 32 // X25519 public key
+	initLen      = keyLen + 2
+	challengeLen = keyLen + 16
+)
+
+// Connect performs a handshake with the peer in req and returns the
+// session index. It fails with ETIMEDOUT if the peer does not answer.
+func (st *Stack) Connect(req poolioc.ConnectReq) (int, error) {
+	return st.ConnectContext(context.Background(), req)
+}
+
+// ConnectContext is like [Stack.Connect] but returns ctx.Err() if ctx
+// is done before the handshake completes. The half-open session is
+// discarded.
+func (st *Stack) ConnectContext(ctx context.Context, req poolioc.ConnectReq) (int, error) {
+	if req.Transport > poolioc.TransportAuto {
+		return -1, syscall.EINVAL
+	}
+	version := req.Version
+	if version == 0 {
+		version = poolioc.Version
+	}
+	if version != poolioc.Version {
+		return -1, syscall.EPROTONOSUPPORT
+	}
+
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return -1, err
+	}
+	peer := &net.UDPAddr{IP: net.IP(req.PeerAddr[:]).To16(), Port: int(req.PeerPort)}
+	if ip4 := peer.IP.To4(); ip4 != nil {
+		peer.IP = ip4
+	}
+
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return -1, syscall.EBADF
+	}
+	if err := st.bind(0); err != nil {
+		st.mu.Unlock()
+		return -1, err
+	}
+	idx := st.freeSlot()
+	if idx < 0 {
+		st.mu.Unlock()
+		return -1, syscall.ENOSPC
+	}
+
+	now := time.Now()
+	s := newSession(idx, peer, now)
+	s.initiator = true
+	s.state = poolioc.StateInitSent
+	s.version = version
+	s.priv = priv
+	if req.HeartbeatSec != 0 {
+		s.heartbeat = time.Duration(req.HeartbeatSec) * time.Second
+	}
+	for {
+		if _, err := rand.Read(s.id[:]); err != nil {
+			st.mu.Unlock()
+			return -1, err
+		}
+		if _, taken := st.byID[s.id]; !taken {
+			break
+		}
+	}
+
+	payload := binary.BigEndian.AppendUint16(priv.PublicKey().Bytes(), uint16(s.heartbeat/time.Second))
+	s.hsPacket, err = s.packet(poolioc.PktInit, 0, 0, 0, 0, payload)
+	if err == nil {
+		s.hsSent = now
+		err = st.write(s, s.hsPacket)
+	}
+	if err != nil {
+		st.mu.Unlock()
+		return -1, err
+	}
+	st.sessions[idx] = s
+	st.byID[s.id] = s
+	st.signal()
+	st.mu.Unlock()
+
+	err = st.wait(ctx, func() error {
+		switch {
+		case s.state == poolioc.StateEstablished:
+			return nil
+		case s.err != nil:
+			return s.err
+		case s.state == poolioc.StateClosing:
+			return syscall.ECONNRESET
+		}
+		return syscall.EAGAIN
+	})
+	if err != nil {
+		st.mu.Lock()
+		if s.sendMAC != nil && !s.peerGone && !st.closed {
+			st.sendClose(s) // the responder may already be established
+		}
+		st.free(s)
+		st.signal()
+		st.mu.Unlock()
+		return -1, err
+	}
+	return idx, nil
+}
+
+// onInit answers an INIT from a new peer with a CHALLENGE, or resends
+// the CHALLENGE if the INIT is a retransmission. INITs beyond the
+// half-open limits are dropped before any key is generated.
+func (st *Stack) onInit(h *poolwire.Header, payload []byte, from *net.UDPAddr, now time.Time) {
+	if s := st.byID[h.SessionID]; s != nil {
+		if !s.initiator && s.state == poolioc.StateChallenged && sameAddr(s.peer, from) {
+			_ = st.write(s, s.hsPacket)
+		}
+		return
+	}
+	if !st.listening || h.Version != poolioc.Version || len(payload) != initLen {
+		return
+	}
+	if !st.admit(from) {
+		return
+	}
+	peerPub, err := ecdh.X25519().NewPublicKey(payload[:keyLen])
+	if err != nil {
+		return
+	}
+	idx := st.freeSlot()
+	if idx < 0 {
+		return
+	}
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return
+	}
+
+	s := newSession(idx, from, now)
+	s.id = h.SessionID
+	s.state = poolioc.StateChallenged
+	s.version = h.Version
+	if hb := binary.BigEndian.Uint16(payload[keyLen:]); hb != 0 {
+		s.heartbeat = time.Duration(hb) * time.Second
+	}
+	if _, err := rand.Read(s.challenge[:]); err != nil {
+		return
+	}
+	if err := s.deriveKeys(priv, peerPub); err != nil {
+		return
+	}
+	s.hsPacket, err = s.packet(poolioc.PktChallenge, 0, 0, 0, 0, append(priv.PublicKey().Bytes(), s.challenge[:]...))
+	if err != nil {
+		return
+	}
+	st.sessions[idx] = s
+	st.byID[s.id] = s
+	_ = st.write(s, s.hsPacket)
+	st.signal()
+}
+
+// admit reports whether another half-open session from addr stays
+// within maxHalfOpen and maxHalfOpenPerHost. st.mu must be held.
+func (st *Stack) admit(addr *net.UDPAddr) bool {
+	total, host := 0, 0
+	for _, s := range st.sessions {
+		if s == nil || s.initiator || s.state != poolioc.StateChallenged {
+			continue
+		}
+		total++
+		if s.peer.IP.Equal(addr.IP) {
+			host++
+		}
+	}
+	return total < maxHalfOpen && host < maxHalfOpenPerHost
+}
+
+// onChallenge derives the session keys from a CHALLENGE and answers
+// with a RESPONSE proving that it holds them.
+func (st *Stack) onChallenge(s *session, h *poolwire.Header, payload []byte) {
+	if !s.initiator {
+		return
+	}
+	if s.state == poolioc.StateChallenged {
+		// Our RESPONSE was lost and the responder saw our INIT again.
+		if h.Verify(s.recvMAC) == nil {
+			_ = st.write(s, s.hsPacket)
+		}
+		return
+	}
+	if s.state != poolioc.StateInitSent || len(payload) != challengeLen {
+		return
+	}
+	peerPub, err := ecdh.X25519().NewPublicKey(payload[:keyLen])
+	if err != nil {
+		return
+	}
+	if err := s.deriveKeys(s.priv, peerPub); err != nil {
+		return
+	}
+	if h.Verify(s.recvMAC) != nil {
+		// Not from the peer we sent INIT to; wait for the real one.
+		s.sendAEAD, s.recvAEAD, s.sendMAC, s.recvMAC = nil, nil, nil, nil
+		return
+	}
+
+	pkt, err := s.packet(poolioc.PktResponse, 0, 0, 0, 0, payload[keyLen:])
+	if err != nil {
+		return
+	}
+	s.state = poolioc.StateChallenged
+	s.hsPacket = pkt
+	s.hsSent = time.Now()
+	_ = st.write(s, pkt)
+	st.signal()
+}
+
+// onResponse completes the handshake on the responder if the initiator
+// sealed the challenge correctly, and acknowledges it.
+func (st *Stack) onResponse(s *session, h *poolwire.Header, payload, ad []byte, now time.Time) {
+	if s.initiator {
+		return
+	}
+	if s.state == poolioc.StateChallenged {
+		got, err := s.recvAEAD.Open(nil, nonce(h.Seq), payload, ad)
+		if err != nil || h.Seq != 0 || subtle.ConstantTimeCompare(got, s.challenge[:]) != 1 {
+			return
+		}
+		s.establish(now)
+	}
+	if s.state == poolioc.StateEstablished {
+		if pkt, err := s.packet(poolioc.PktAck, 0, 0, 0, 0, nil); err == nil {
+			_ = st.write(s, pkt)
+		}
+	}
+}
+
+// deriveKeys sets the per-direction AEAD and MAC keys from the X25519
+// exchange between priv and peer.
+func (s *session) deriveKeys(priv *ecdh.PrivateKey, peer *ecdh.PublicKey) error {
+	shared, err := priv.ECDH(peer)
+	if err != nil {
+		return err
+	}
+
+	// Bind the keys to both public keys, initiator first.
+	info := append(priv.PublicKey().Bytes(), peer.Bytes()...)
+	if !s.initiator {
+		info = append(peer.Bytes(), priv.PublicKey().Bytes()...)
+	}
+	var k [4 * poolioc.KeySize]byte
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, s.id[:], info), k[:]); err != nil {
+		return err
+	}
+	sendKey, recvKey := k[0:32], k[32:64]
+	sendMAC, recvMAC := k[64:96], k[96:128]
+	if !s.initiator {
+		sendKey, recvKey = recvKey, sendKey
+		sendMAC, recvMAC = recvMAC, sendMAC
+	}
+
+	if s.sendAEAD, err = chacha20poly1305.New(sendKey); err != nil {
+		return err
+	}
+	if s.recvAEAD, err = chacha20poly1305.New(recvKey); err != nil {
+		return err
+	}
+	s.sendMAC, s.recvMAC = sendMAC, recvMAC
+	return nil
+}
@@ -0,0 +1,863 @@
+//go:build linux
+
+package pooludp
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/amosdavis/pool-go/poolfrag"
+	"github.com/amosdavis/pool-go/poolioc"
+	"github.com/amosdavis/pool-go/poolwire"
+)
+
+// adLen is the length of the header prefix that is authenticated as
+// additional data when sealing a payload: everything but the HMAC.
+const adLen = poolwire.HeaderSize - poolioc.HMACSize
+
+// session is one slot in a Stack's session table.
+type session struct {
+	idx       uint32
+	id        [poolioc.SessionIDSize]byte
+	peer      *net.UDPAddr
+	initiator bool
+	state     uint8
+	version   uint8
+	err       error // why the handshake failed
+	created   time.Time
+
+	// Handshake state, dropped once established.
+	priv       *ecdh.PrivateKey
+	challenge  [16]byte
+	hsPacket   []byte // last handshake packet, resent until answered
+	hsSent     time.Time
+	hsDeadline time.Time
+
+	// Keys for each direction, set once the peer's public key is known.
+	sendAEAD, recvAEAD cipher.AEAD
+	sendMAC, recvMAC   []byte
+
+	heartbeat          time.Duration
+	lastSend, lastRecv time.Time
+
+	// Header timestamps, which sequence the packets that have no
+	// sequence number: the last one sent, and the last one of such a
+	// packet accepted from the peer.
+	sentStamp, peerStamp uint64
+
+	sendSeq     uint64
+	unacked     map[uint64]*outPacket
+	waiters     map[uint64]chan error // delivery ACKs awaited, by last seq
+	dropped     error                 // why unacknowledged data was discarded
+	srtt        time.Duration
+	rttvar      time.Duration
+	retransmits uint64
+
+	// Per-channel flow control. The sender of each side may have
+	// queueLen sequenced packets on a channel that the receiver's
+	// reader has not freed, or as many more as the receiver grants.
+	chanSent  map[uint8]uint64    // sequenced packets sent per channel
+	chanLimit map[uint8]uint64    // the peer's grants above queueLen
+	stalled   map[uint8]time.Time // channels out of grant, with when last probed
+	freed     map[uint8]uint64    // packets per channel our reader has freed
+	granted   map[uint8]uint64    // the grants last sent per channel
+
+	recvNext uint64
+	reorder  map[uint64]message
+	queues   map[uint8][]message
+	channels [poolioc.MaxChannels / 8]byte
+	shut     poolioc.ChannelSet          // channels closed for writing
+	ended    map[uint8]poolioc.WireError // channels the peer closed, with its reason
+
+	// Fragmentation state: the next message ID to send, and messages
+	// being reassembled with where each is delivered.
+	msgID    uint32
+	frags    poolfrag.Reassembler
+	fragMsgs map[uint32]fragMsg
+
+	peerGone   bool // the peer closed the session or stopped answering
+	peerClosed bool // the peer closed the session with CLOSE
+	lingering  bool // closed locally, flushing unacknowledged data
+	lingerEnd  time.Time
+
+	bytesSent, bytesRecv     uint64
+	packetsSent, packetsRecv uint64
+}
+
+// outPacket is a DATA packet awaiting acknowledgement.
+type outPacket struct {
+	pkt   []byte
+	first time.Time // when first sent
+	sent  time.Time // when last sent
+	tries int       // retransmissions so far
+}
+
+// fragMsg records where a message being reassembled is delivered.
+type fragMsg struct {
+	channel uint8
+	last    uint64 // sequence number of its last fragment
+	ack     bool   // the sender asked for a delivery ACK
+}
+
+// message is a received DATA payload, or an error to report in its
+// place, or the end of its channel.
+type message struct {
+	data    []byte
+	channel uint8
+	flags   uint16
+	seq     uint64
+	sentAt  uint64 // sender timestamp, nanoseconds since the Unix epoch
+	err     error
+	end     bool // a sequenced CLOSE: data holds the reason
+	credit  bool // holds a packet of its channel's grant until taken
+}
+
+func newSession(idx int, peer *net.UDPAddr, now time.Time) *session {
+	return &session{
+		idx:        uint32(idx),
+		peer:       peer,
+		created:    now,
+		hsDeadline: now.Add(handshakeTimeout),
+		heartbeat:  poolioc.HeartbeatSec * time.Second,
+		lastRecv:   now,
+		unacked:    make(map[uint64]*outPacket),
+		waiters:    make(map[uint64]chan error),
+		chanSent:   make(map[uint8]uint64),
+		chanLimit:  make(map[uint8]uint64),
+		stalled:    make(map[uint8]time.Time),
+		freed:      make(map[uint8]uint64),
+		granted:    make(map[uint8]uint64),
+		recvNext:   1,
+		reorder:    make(map[uint64]message),
+		queues:     make(map[uint8][]message),
+		fragMsgs:   make(map[uint32]fragMsg),
+	}
+}
+
+// nonce returns the AEAD nonce for sequence number seq. Each direction
+// has its own key and sequence space, so nonces never repeat.
+func nonce(seq uint64) []byte {
+	n := make([]byte, poolioc.NonceSize)
+	binary.BigEndian.PutUint64(n[poolioc.NonceSize-8:], seq)
+	return n
+}
+
+// packet builds a packet of type typ, timestamped later than any
+// packet built before it. The header is signed once keys are known. A
+// non-nil payload is sealed under the send key unless the packet is
+// part of the key exchange.
+func (s *session) packet(typ uint8, seq, ack uint64, channel uint8, flags uint16, payload []byte) ([]byte, error) {
+	s.sentStamp = max(uint64(time.Now().UnixNano()), s.sentStamp+1)
+	h := poolwire.Header{
+		Version:   s.version,
+		Type:      typ,
+		Flags:     flags,
+		Seq:       seq,
+		Ack:       ack,
+		SessionID: s.id,
+		Timestamp: s.sentStamp,
+		Channel:   channel,
+	}
+	seal := payload != nil && typ != poolioc.PktInit && typ != poolioc.PktChallenge
+	n := len(payload)
+	if seal {
+		h.Flags |= poolioc.FlagEncrypted
+		n += poolioc.TagSize
+	}
+	h.PayloadLen = uint16(n)
+	if s.sendMAC != nil {
+		if err := h.Sign(s.sendMAC); err != nil {
+			return nil, err
+		}
+	}
+
+	b, err := h.AppendBinary(make([]byte, 0, poolwire.HeaderSize+n))
+	if err != nil {
+		return nil, err
+	}
+	if seal {
+		return s.sendAEAD.Seal(b, nonce(seq), payload, b[:adLen]), nil
+	}
+	return append(b, payload...), nil
+}
+
+// fresh reports whether an authenticated packet is not a replay. The
+// packets without a sequence number, ACK, HEARTBEAT and the CLOSE of
+// the session, must carry a later timestamp than the last of them
+// accepted; a reordered one is dropped like a lost one. Sequenced
+// packets are deduplicated by sequence number instead.
+func (s *session) fresh(h *poolwire.Header) bool {
+	switch {
+	case h.Type == poolioc.PktAck, h.Type == poolioc.PktHeartbeat:
+	case h.Type == poolioc.PktClose && h.Seq == 0:
+	default:
+		return true
+	}
+	if h.Timestamp <= s.peerStamp {
+		return false
+	}
+	s.peerStamp = h.Timestamp
+	return true
+}
+
+// establish completes the handshake.
+func (s *session) establish(now time.Time) {
+	s.state = poolioc.StateEstablished
+	s.priv = nil
+	s.hsPacket = nil
+	s.lastRecv = now
+}
+
+// lost marks the peer as gone, failing awaited delivery ACKs with err.
+// If data was still unacknowledged, later sends fail with err rather
+// than ENOTCONN, so that the writer learns it was lost. Queued data
+// stays readable.
+func (s *session) lost(err error) {
+	s.state = poolioc.StateClosing
+	s.peerGone = true
+	if len(s.unacked) > 0 {
+		s.dropped = err
+	}
+	clear(s.unacked)
+	s.failWaiters(err)
+}
+
+// notConnected returns the error for a send once the session is not
+// established.
+func (s *session) notConnected() error {
+	if s.dropped != nil {
+		return s.dropped
+	}
+	return syscall.ENOTCONN
+}
+
+// room reports whether n more sequenced packets may be sent on
+// channel: the send window must have room for them, and the peer's
+// grant for the channel must cover them. A channel short of grant is
+// marked stalled, to be probed. st.mu must be held.
+func (s *session) room(channel uint8, n int) bool {
+	if len(s.unacked)+n > window {
+		return false
+	}
+	if s.chanSent[channel]+uint64(n) > s.peerLimit(channel) {
+		if _, ok := s.stalled[channel]; !ok {
+			s.stalled[channel] = time.Now()
+		}
+		return false
+	}
+	return true
+}
+
+// peerLimit returns how many sequenced packets the peer lets us send
+// on channel.
+func (s *session) peerLimit(channel uint8) uint64 {
+	if l, ok := s.chanLimit[channel]; ok {
+		return l
+	}
+	return queueLen
+}
+
+// onGrant raises the peer's grant for channel to limit. ACKs that
+// carry no grant have a zero limit.
+func (s *session) onGrant(channel uint8, limit uint64) {
+	if limit <= s.peerLimit(channel) {
+		return
+	}
+	s.chanLimit[channel] = limit
+	delete(s.stalled, channel)
+}
+
+// limit returns how many sequenced packets the peer may send on
+// channel: those our reader has freed and a queue's worth more.
+func (s *session) limit(channel uint8) uint64 {
+	return s.freed[channel] + queueLen
+}
+
+// failWaiters completes every awaited delivery ACK with err.
+func (s *session) failWaiters(err error) {
+	for seq, w := range s.waiters {
+		w <- err
+		close(w)
+		delete(s.waiters, seq)
+	}
+}
+
+// rto returns the retransmission timeout (RFC 6298) before backoff.
+func (s *session) rto() time.Duration {
+	if s.srtt == 0 {
+		return initialRTO
+	}
+	return min(max(s.srtt+4*s.rttvar, minRTO), maxRTO)
+}
+
+func (s *session) onAck(h *poolwire.Header, now time.Time) {
+	if h.Flags&poolioc.FlagRequireAck != 0 {
+		s.onDeliveryAck(h)
+		return
+	}
+	s.onGrant(h.Channel, h.Seq)
+	p, ok := s.unacked[h.Ack]
+	if !ok {
+		return
+	}
+	delete(s.unacked, h.Ack)
+	if p.tries > 0 {
+		return // ambiguous sample (Karn's algorithm)
+	}
+	rtt := now.Sub(p.first)
+	if s.srtt == 0 {
+		s.srtt, s.rttvar = rtt, rtt/2
+		return
+	}
+	s.rttvar = (3*s.rttvar + (s.srtt - rtt).Abs()) / 4
+	s.srtt = (7*s.srtt + rtt) / 8
+}
+
+// onDeliveryAck completes the waiter for the message whose last
+// packet h acknowledges. A delivery ACK carries the receiver's POOL
+// error code, if any, in its sequence number.
+func (s *session) onDeliveryAck(h *poolwire.Header) {
+	w, ok := s.waiters[h.Ack]
+	if !ok {
+		return
+	}
+	delete(s.waiters, h.Ack)
+	if h.Seq != 0 {
+		w <- poolioc.WireError(h.Seq)
+	} else {
+		w <- nil
+	}
+	close(w)
+}
+
+// deliver moves buffered messages that are next in sequence to their
+// channel queues, stopping at a gap. Fragments go to the reassembler,
+// freeing their packet of the channel's grant, and their message is
+// queued once complete. Messages sent with FlagRequireAck are
+// acknowledged as they are queued.
+//
+// A sender that keeps to its grants never fills a queue, so a reader
+// that falls behind on one channel does not hold up the others; for
+// one that does not, deliver also stops at a full queue, and the
+// packets behind it go unacknowledged. st.mu must be held.
+func (st *Stack) deliver(s *session) {
+	for {
+		m, ok := s.reorder[s.recvNext]
+		if !ok || len(s.queues[m.channel]) >= queueLen {
+			return
+		}
+		delete(s.reorder, s.recvNext)
+		s.recvNext++
+		if m.flags&poolioc.FlagFragment != 0 {
+			ch := m.channel
+			if m, ok = s.reassemble(m); !ok {
+				st.release(s, ch)
+				continue
+			}
+		}
+		st.queue(s, m)
+	}
+}
+
+// release frees a packet of the peer's grant for channel, and grants
+// the peer more once half a queue's worth has been freed since the
+// last grant. st.mu must be held.
+func (st *Stack) release(s *session, channel uint8) {
+	s.freed[channel]++
+	if s.limit(channel)-max(s.granted[channel], queueLen) >= queueLen/2 {
+		st.grant(s, channel)
+	}
+}
+
+// grant tells the peer how many sequenced packets it may send on
+// channel, in an ACK that acknowledges nothing and whose Seq field is
+// the limit. st.mu must be held.
+func (st *Stack) grant(s *session, channel uint8) {
+	limit := s.limit(channel)
+	s.granted[channel] = limit
+	if pkt, err := s.packet(poolioc.PktAck, limit, 0, channel, 0, nil); err == nil {
+		_ = st.write(s, pkt)
+	}
+}
+
+// probe asks the peer to repeat its grant for channel, in a HEARTBEAT
+// flagged FlagRequireAck, in case a grant was lost while the channel
+// was stalled. st.mu must be held.
+func (st *Stack) probe(s *session, channel uint8) {
+	if pkt, err := s.packet(poolioc.PktHeartbeat, 0, 0, channel, poolioc.FlagRequireAck, nil); err == nil {
+		_ = st.write(s, pkt)
+	}
+}
+
+// queue appends m to its channel queue and sends the delivery ACK the
+// sender asked for. st.mu must be held.
+func (st *Stack) queue(s *session, m message) {
+	s.queues[m.channel] = append(s.queues[m.channel], m)
+	if m.flags&poolioc.FlagRequireAck == 0 {
+		return
+	}
+	var code poolioc.WireError
+	switch {
+	case m.err == nil:
+	case errors.Is(m.err, syscall.ETIME):
+		code = poolioc.ErrFragTimeout
+	case errors.Is(m.err, syscall.ENOBUFS):
+		code = poolioc.ErrOverload
+	default:
+		code = poolioc.ErrSeqInvalid
+	}
+	pkt, err := s.packet(poolioc.PktAck, uint64(code), m.seq, m.channel, poolioc.FlagRequireAck, nil)
+	if err == nil {
+		_ = st.write(s, pkt)
+	}
+}
+
+// reassemble adds the fragment in m to its message. It returns the
+// message, or an error in its place, once there is one to queue. Either
+// carries the sequence number of the message's last fragment and its
+// FlagRequireAck, so the sender can be told.
+func (s *session) reassemble(m message) (message, bool) {
+	fail := message{channel: m.channel, flags: m.flags & poolioc.FlagRequireAck, seq: m.seq, credit: true}
+	var f poolfrag.Fragment
+	if err := f.UnmarshalBinary(m.data); err != nil || f.FragOffset%fragSize != 0 {
+		fail.err = syscall.EPROTO
+		return fail, true
+	}
+	fm, ok := s.fragMsgs[f.MsgID]
+	if !ok {
+		// The sender splits at fragSize, one fragment per sequence
+		// number, so the offsets locate the last fragment's.
+		index, count := int(f.FragOffset)/fragSize, (int(f.TotalLen)+fragSize-1)/fragSize
+		fm = fragMsg{
+			channel: m.channel,
+			last:    m.seq - uint64(index) + uint64(count) - 1,
+			ack:     m.flags&poolioc.FlagRequireAck != 0,
+		}
+	}
+	data, err := s.frags.Add(f, time.Now())
+	if err != nil {
+		delete(s.fragMsgs, f.MsgID)
+		fail.seq, fail.err = fm.last, fragErrno(err)
+		return fail, true
+	}
+	if data == nil {
+		s.fragMsgs[f.MsgID] = fm
+		return message{}, false
+	}
+	delete(s.fragMsgs, f.MsgID)
+	m.data = data
+	m.flags &^= poolioc.FlagFragment | poolioc.FlagLastFrag
+	return m, true
+}
+
+// expire reports messages whose reassembly timed out to the reader of
+// their channel, and to their sender if it asked. It reports whether
+// any did. st.mu must be held.
+func (st *Stack) expire(s *session, now time.Time) bool {
+	ids := s.frags.Expire(now)
+	for _, id := range ids {
+		fm := s.fragMsgs[id]
+		delete(s.fragMsgs, id)
+		m := message{channel: fm.channel, seq: fm.last, err: syscall.ETIME}
+		if fm.ack {
+			m.flags = poolioc.FlagRequireAck
+		}
+		st.queue(s, m)
+	}
+	return len(ids) > 0
+}
+
+// fragErrno maps a reassembly error to the errno a device would return.
+func fragErrno(err error) error {
+	switch {
+	case errors.Is(err, poolfrag.ErrTimeout):
+		return syscall.ETIME
+	case errors.Is(err, poolfrag.ErrBufferFull):
+		return syscall.ENOBUFS
+	default:
+		return syscall.EPROTO
+	}
+}
+
+// SendBytes sends one message on a session and channel, blocking while
+// the session's send window is full. Messages that do not fit in one
+// packet at the default MTU are sent as fragments.
+func (st *Stack) SendBytes(idx uint32, channel uint8, data []byte) error {
+	return st.SendBytesContext(context.Background(), idx, channel, data)
+}
+
+// SendBytesContext is like [Stack.SendBytes] but returns ctx.Err() if
+// ctx is done before the message is sent.
+func (st *Stack) SendBytesContext(ctx context.Context, idx uint32, channel uint8, data []byte) error {
+	return st.SendMsg(ctx, idx, channel, 0, data)
+}
+
+// SendMsg is like [Stack.SendBytesContext] but sets flags in the
+// header of the message's packets. The fragment flags are reserved
+// for the stack. Every packet is acknowledged whether or not
+// FlagRequireAck is set; see [Stack.SendAcked] to learn when the whole
+// message was delivered.
+func (st *Stack) SendMsg(ctx context.Context, idx uint32, channel uint8, flags uint8, data []byte) error {
+	_, err := st.send(ctx, idx, channel, flags, data, false)
+	return err
+}
+
+// SendAcked is like [Stack.SendMsg] with FlagRequireAck set. The peer
+// answers with a delivery ACK once the message is queued for its
+// reader, or with a POOL error code if it was lost in reassembly. The
+// returned channel receives nil or the code as a [poolioc.WireError];
+// ETIMEDOUT or ECONNRESET if the session is lost first; or EBADF if it
+// is closed.
+func (st *Stack) SendAcked(ctx context.Context, idx uint32, channel uint8, flags uint8, data []byte) (<-chan error, error) {
+	done, err := st.send(ctx, idx, channel, flags|poolioc.FlagRequireAck, data, true)
+	if err != nil {
+		return nil, err
+	}
+	return done, nil
+}
+
+// send sends one message, returning a channel for its delivery ACK if
+// ack is set.
+func (st *Stack) send(ctx context.Context, idx uint32, channel uint8, flags uint8, data []byte, ack bool) (chan error, error) {
+	if len(data) > MaxMessage {
+		return nil, syscall.EMSGSIZE
+	}
+	if flags&(poolioc.FlagFragment|poolioc.FlagLastFrag) != 0 {
+		return nil, syscall.EINVAL
+	}
+	var done chan error
+	err := st.wait(ctx, func() error {
+		s, err := st.session(idx)
+		if err != nil {
+			return err
+		}
+		if s.state != poolioc.StateEstablished || s.peerGone {
+			return s.notConnected()
+		}
+		if s.shut.Has(channel) {
+			return syscall.EPIPE
+		}
+		if err := st.sendMsg(s, channel, flags, data); err != nil {
+			return err
+		}
+		if ack {
+			done = make(chan error, 1)
+			s.waiters[s.sendSeq] = done
+		}
+		return nil
+	})
+	return done, err
+}
+
+// sendMsg sends data in one DATA packet, or as fragments if it is too
+// long, unless the send window or the channel's grant is short.
+// st.mu must be held.
+func (st *Stack) sendMsg(s *session, channel uint8, flags uint8, data []byte) error {
+	if len(data) <= maxUnfragmented {
+		if !s.room(channel, 1) {
+			return syscall.EAGAIN
+		}
+		if err := st.sendData(s, channel, uint16(flags), data); err != nil {
+			return err
+		}
+		s.bytesSent += uint64(len(data))
+		return nil
+	}
+
+	frags, err := poolfrag.Split(s.msgID, data, fragSize)
+	if err != nil {
+		return syscall.EMSGSIZE
+	}
+	if !s.room(channel, len(frags)) {
+		return syscall.EAGAIN
+	}
+	for _, f := range frags {
+		payload, err := f.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		fflags := uint16(flags) | poolioc.FlagFragment
+		if f.Last() {
+			fflags |= poolioc.FlagLastFrag
+		}
+		if err := st.sendData(s, channel, fflags, payload); err != nil {
+			return err
+		}
+	}
+	s.msgID++
+	s.bytesSent += uint64(len(data))
+	return nil
+}
+
+// sendData sends payload in the session's next DATA packet and keeps it
+// for retransmission until acknowledged. st.mu must be held.
+func (st *Stack) sendData(s *session, channel uint8, flags uint16, payload []byte) error {
+	return st.sendSequenced(s, poolioc.PktData, channel, flags, payload)
+}
+
+// sendSequenced sends a packet of type typ with the session's next
+// sequence number, and keeps it for retransmission until acknowledged.
+// st.mu must be held.
+func (st *Stack) sendSequenced(s *session, typ uint8, channel uint8, flags uint16, payload []byte) error {
+	seq := s.sendSeq + 1
+	pkt, err := s.packet(typ, seq, 0, channel, flags, payload)
+	if err != nil {
+		return err
+	}
+	s.sendSeq = seq
+	s.chanSent[channel]++
+	now := time.Now()
+	s.unacked[seq] = &outPacket{pkt: pkt, first: now, sent: now}
+	s.packetsSent++
+	// A failed write is retried by retransmission.
+	_ = st.write(s, pkt)
+	return nil
+}
+
+// RecvBytes receives one message from a session and channel, blocking
+// until one arrives. It fails with EMSGSIZE, leaving the message
+// queued, if buf is too small. Once the queue is empty, it fails with a
+// [*poolioc.ShutdownError] if the peer has closed the channel (see
+// [Stack.Shutdown]) or, with Session set, the session, and with
+// ENOTCONN if the peer stopped answering. A message lost in reassembly
+// is reported in its place, as ETIME if its fragments did not arrive
+// in time.
+func (st *Stack) RecvBytes(idx uint32, channel uint8, buf []byte) (int, error) {
+	return st.RecvBytesContext(context.Background(), idx, channel, buf)
+}
+
+// RecvBytesContext is like [Stack.RecvBytes] but returns ctx.Err() if
+// ctx is done before a message arrives.
+func (st *Stack) RecvBytesContext(ctx context.Context, idx uint32, channel uint8, buf []byte) (int, error) {
+	info, err := st.RecvMsg(ctx, idx, channel, buf)
+	return info.Len, err
+}
+
+// RecvMsg is like [Stack.RecvBytesContext] but also returns the
+// message's flags, sequence number and sender timestamp. For a
+// fragmented message they are those of its last fragment.
+func (st *Stack) RecvMsg(ctx context.Context, idx uint32, channel uint8, buf []byte) (poolioc.MsgInfo, error) {
+	var info poolioc.MsgInfo
+	err := st.wait(ctx, func() error {
+		s, err := st.session(idx)
+		if err != nil {
+			return err
+		}
+		info, err = st.take(s, channel, buf)
+		return err
+	})
+	return info, err
+}
+
+// RecvAny is like [Stack.RecvMsg] but receives the next message of the
+// session on any channel, in sequence order, and reports its channel.
+func (st *Stack) RecvAny(ctx context.Context, idx uint32, buf []byte) (poolioc.MsgInfo, error) {
+	var info poolioc.MsgInfo
+	if len(buf) == 0 {
+		return info, nil
+	}
+	err := st.wait(ctx, func() error {
+		s, err := st.session(idx)
+		if err != nil {
+			return err
+		}
+		var next *message
+		for _, q := range s.queues {
+			if len(q) > 0 && (next == nil || q[0].seq < next.seq) {
+				next = &q[0]
+			}
+		}
+		if next == nil {
+			return s.idle()
+		}
+		info, err = st.take(s, next.channel, buf)
+		return err
+	})
+	return info, err
+}
+
+// Shutdown closes a session channel for writing: it sends the peer a
+// CLOSE for the channel, sequenced and retransmitted like DATA so that
+// it arrives after the messages sent before it. The peer's receives on
+// the channel then fail with a [*poolioc.ShutdownError] carrying
+// reason, and sends on it here fail with EPIPE.
+func (st *Stack) Shutdown(ctx context.Context, idx uint32, channel uint8, reason poolioc.WireError) error {
+	return st.wait(ctx, func() error {
+		s, err := st.session(idx)
+		if err != nil {
+			return err
+		}
+		if s.shut.Has(channel) {
+			return nil
+		}
+		if s.state != poolioc.StateEstablished || s.peerGone {
+			return s.notConnected()
+		}
+		if !s.room(channel, 1) {
+			return syscall.EAGAIN
+		}
+		if err := st.sendSequenced(s, poolioc.PktClose, channel, 0, []byte{byte(reason)}); err != nil {
+			return err
+		}
+		s.shut.Add(channel)
+		return nil
+	})
+}
+
+// idle returns the error for a receive that finds nothing queued.
+func (s *session) idle() error {
+	switch {
+	case s.peerClosed:
+		return &poolioc.ShutdownError{Session: true}
+	case s.peerGone:
+		return syscall.ENOTCONN
+	}
+	return syscall.EAGAIN
+}
+
+// take moves the first message queued on channel into buf. Once the
+// peer has closed the channel, it fails with a [*poolioc.ShutdownError]
+// instead. st.mu must be held.
+func (st *Stack) take(s *session, channel uint8, buf []byte) (poolioc.MsgInfo, error) {
+	q := s.queues[channel]
+	if len(q) == 0 {
+		if reason, ok := s.ended[channel]; ok {
+			return poolioc.MsgInfo{Channel: channel}, &poolioc.ShutdownError{Reason: reason}
+		}
+		return poolioc.MsgInfo{}, s.idle()
+	}
+	m := q[0]
+	if m.end {
+		var reason poolioc.WireError
+		if len(m.data) > 0 {
+			reason = poolioc.WireError(m.data[0])
+		}
+		s.queues[channel] = q[1:]
+		if s.ended == nil {
+			s.ended = make(map[uint8]poolioc.WireError)
+		}
+		s.ended[channel] = reason
+		st.taken(s, m)
+		st.signal()
+		return poolioc.MsgInfo{Channel: channel}, &poolioc.ShutdownError{Reason: reason}
+	}
+	if m.err != nil {
+		s.queues[channel] = q[1:]
+		st.taken(s, m)
+		st.signal()
+		return poolioc.MsgInfo{Channel: channel}, m.err
+	}
+	if len(m.data) > len(buf) {
+		return poolioc.MsgInfo{Len: len(m.data), Channel: channel}, syscall.EMSGSIZE
+	}
+	n := copy(buf, m.data)
+	s.queues[channel] = q[1:]
+	s.bytesRecv += uint64(n)
+	s.packetsRecv++
+	st.taken(s, m)
+	st.signal()
+	return poolioc.MsgInfo{
+		Len:       n,
+		Flags:     uint8(m.flags),
+		Channel:   channel,
+		Seq:       m.seq,
+		Timestamp: m.sentAt,
+	}, nil
+}
+
+// taken frees the grant held by m, which the reader has just taken,
+// and delivers what was waiting for room. st.mu must be held.
+func (st *Stack) taken(s *session, m message) {
+	if m.credit {
+		st.release(s, m.channel)
+	}
+	st.deliver(s)
+}
+
+// onData buffers an inbound DATA packet, or a CLOSE for one channel,
+// and acknowledges it with the channel's grant. Packets beyond the
+// receive window are dropped unacknowledged, so the sender retransmits
+// them once the gap before them is filled.
+func (st *Stack) onData(s *session, h *poolwire.Header, payload, ad []byte) {
+	if s.state != poolioc.StateEstablished || h.Seq == 0 {
+		return
+	}
+	if h.Seq >= s.recvNext+window {
+		return
+	}
+	if _, dup := s.reorder[h.Seq]; !dup && h.Seq >= s.recvNext {
+		data, err := s.recvAEAD.Open(nil, nonce(h.Seq), payload, ad)
+		if err != nil {
+			return
+		}
+		s.reorder[h.Seq] = message{
+			data:    data,
+			channel: h.Channel,
+			flags:   h.Flags,
+			seq:     h.Seq,
+			sentAt:  h.Timestamp,
+			end:     h.Type == poolioc.PktClose,
+			credit:  true,
+		}
+		st.deliver(s)
+	}
+	limit := s.limit(h.Channel)
+	s.granted[h.Channel] = limit
+	if pkt, err := s.packet(poolioc.PktAck, limit, h.Seq, h.Channel, 0, nil); err == nil {
+		_ = st.write(s, pkt)
+	}
+}
+
+// snapshot returns the session info with telemetry filled in.
+func (s *session) snapshot(now time.Time) poolioc.SessionInfo {
+	info := poolioc.SessionInfo{
+		Index:       s.idx,
+		PeerPort:    uint16(s.peer.Port),
+		AddrFamily:  syscall.AF_INET6,
+		State:       s.state,
+		SessionID:   s.id,
+		BytesSent:   s.bytesSent,
+		BytesRecv:   s.bytesRecv,
+		PacketsSent: s.packetsSent,
+		PacketsRecv: s.packetsRecv,
+	}
+	copy(info.PeerAddr[:], s.peer.IP.To16())
+	if s.peer.IP.To4() != nil {
+		info.AddrFamily = syscall.AF_INET
+	}
+
+	depth := len(s.reorder) + s.frags.Pending()
+	for _, q := range s.queues {
+		depth += len(q)
+	}
+	uptime := now.Sub(s.created)
+	info.Telem = poolioc.Telemetry{
+		RTTNs:         uint64(s.srtt),
+		JitterNs:      uint64(s.rttvar),
+		MTUCurrent:    poolioc.DefaultMTU,
+		QueueDepth:    uint16(min(depth, 0xFFFF)),
+		UptimeNs:      uint64(uptime),
+		ThroughputBps: throughput(s.bytesSent+s.bytesRecv, uptime),
+	}
+	if s.packetsSent > 0 {
+		info.Telem.LossRatePPM = uint32(min(s.retransmits*1e6/s.packetsSent, 1e6))
+	}
+	return info
+}
+
+func throughput(bytes uint64, d time.Duration) uint32 {
+	if d <= 0 {
+		return 0
+	}
+	bps := float64(bytes) / d.Seconds()
+	if bps > float64(^uint32(0)) {
+		return ^uint32(0)
+	}
+	return uint32(bps)
+}
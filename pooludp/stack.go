@@ -0,0 +1,576 @@
+//go:build linux
+
+package pooludp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/amosdavis/pool-go/poolioc"
+	"github.com/amosdavis/pool-go/poolwire"
+)
+
+// BackendName is the POOL_BACKEND value that selects a Stack in the
+// pool package. It is registered with [poolioc.RegisterBackend], so
+// that [poolioc.OpenBackend] opens a new Stack for it.
+const BackendName = "udp"
+
+func init() {
+	poolioc.RegisterBackend(BackendName, func() (poolioc.Backend, error) {
+		return New(), nil
+	})
+}
+
+// maxDatagram is the largest UDP payload that can be sent over IPv4.
+const maxDatagram = 65507
+
+// maxUnfragmented is the largest message sent in a single DATA packet;
+// longer ones are split into fragments of fragSize bytes so that no
+// packet exceeds the default MTU.
+const (
+	maxUnfragmented = poolioc.DefaultMTU - poolioc.HeaderSize - poolioc.TagSize
+	fragSize        = poolioc.DefaultMTU - poolioc.HeaderSize - poolioc.TagSize - poolwire.FragHeaderSize
+)
+
+// MaxMessage is the largest message a Stack can send: fragments carry
+// the length of their message in 16 bits, as pool.ko's do.
+const MaxMessage = poolioc.MaxPayload
+
+const (
+	// queueLen is the number of messages a channel queue holds, and
+	// the number of sequenced packets on a channel a sender may have
+	// that the receiver's reader has not freed, beyond what the
+	// receiver grants as it reads.
+	queueLen = 256
+
+	// window is the number of unacknowledged DATA packets a session
+	// may have in flight, and how far ahead of the next expected
+	// sequence number the receiver buffers.
+	window = 256
+
+	// tick is how often timers are serviced.
+	tick = 20 * time.Millisecond
+
+	// Retransmission timeouts, before exponential backoff.
+	initialRTO = 200 * time.Millisecond
+	minRTO     = 100 * time.Millisecond
+	maxRTO     = time.Second
+
+	// maxRetries is how often a DATA packet is retransmitted before
+	// the peer is considered gone.
+	maxRetries = 8
+
+	// handshakeRetry is how often an unanswered handshake packet is
+	// resent, and handshakeTimeout how long a handshake may take.
+	handshakeRetry   = 250 * time.Millisecond
+	handshakeTimeout = 5 * time.Second
+
+	// maxHalfOpen and maxHalfOpenPerHost bound the sessions a
+	// listening Stack holds for INITs not yet answered by a RESPONSE,
+	// overall and per source address, so that a flood of INITs, from
+	// one host or from spoofed ones, cannot take the whole session
+	// table. Further INITs are dropped until handshakes complete or
+	// time out.
+	maxHalfOpen        = poolioc.MaxSessions / 4
+	maxHalfOpenPerHost = 4
+
+	// deadHeartbeats is how many heartbeat intervals may pass without
+	// hearing from the peer.
+	deadHeartbeats = 3
+
+	// lingerTimeout bounds how long a closed session keeps
+	// retransmitting unacknowledged data.
+	lingerTimeout = 2 * time.Second
+)
+
+// Stack is a userspace POOL endpoint on one UDP socket. It plays the
+// role of one open handle on /dev/pool. Create it with [New]; it is
+// safe for concurrent use.
+type Stack struct {
+	mu        sync.Mutex
+	conn      *net.UDPConn // nil until the first Listen or Connect
+	listening bool
+	closed    bool
+	sessions  [poolioc.MaxSessions]*session
+	byID      map[[poolioc.SessionIDSize]byte]*session
+	ready     chan struct{} // closed and replaced on every state change
+	done      chan struct{} // closed by Close
+	wg        sync.WaitGroup
+}
+
+// New returns a Stack with no socket. The socket is opened by the first
+// Listen or Connect.
+func New() *Stack {
+	return &Stack{
+		byID:  make(map[[poolioc.SessionIDSize]byte]*session),
+		ready: make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+// Close tears down every session, telling connected peers, and closes
+// the socket. Blocked operations fail with [os.ErrClosed].
+func (st *Stack) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return syscall.EBADF
+	}
+	st.closed = true
+	for _, s := range st.sessions {
+		if s == nil {
+			continue
+		}
+		if s.state == poolioc.StateEstablished && !s.peerGone {
+			st.sendClose(s)
+		}
+		st.free(s)
+	}
+	close(st.done)
+	st.signal()
+	conn := st.conn
+	st.mu.Unlock()
+
+	var err error
+	if conn != nil {
+		err = conn.Close()
+	}
+	st.wg.Wait()
+	return err
+}
+
+// LocalAddr returns the address of the Stack's socket, or nil if it has
+// not been opened yet.
+func (st *Stack) LocalAddr() *net.UDPAddr {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.conn == nil {
+		return nil
+	}
+	return st.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Listen accepts inbound sessions on port. The Stack's socket is bound
+// to port, so Listen fails with EBUSY once the Stack has connected
+// from an ephemeral port.
+func (st *Stack) Listen(port uint16) error {
+	if port == 0 {
+		return syscall.EINVAL
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.closed {
+		return syscall.EBADF
+	}
+	if st.listening {
+		return syscall.EBUSY
+	}
+	if st.conn != nil && st.conn.LocalAddr().(*net.UDPAddr).Port != int(port) {
+		return syscall.EBUSY
+	}
+	if err := st.bind(port); err != nil {
+		return err
+	}
+	st.listening = true
+	return nil
+}
+
+// Stop stops accepting inbound sessions. Established sessions and the
+// socket stay open.
+func (st *Stack) Stop() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.closed {
+		return syscall.EBADF
+	}
+	st.listening = false
+	return nil
+}
+
+// Sessions returns the sessions of this Stack.
+func (st *Stack) Sessions() ([]poolioc.SessionInfo, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.closed {
+		return nil, syscall.EBADF
+	}
+	now := time.Now()
+	var infos []poolioc.SessionInfo
+	for _, s := range st.sessions {
+		if s != nil && !s.lingering {
+			infos = append(infos, s.snapshot(now))
+		}
+	}
+	return infos, nil
+}
+
+// CloseSession closes the session at idx. Data still unacknowledged is
+// retransmitted for a while before the peer is sent CLOSE, but the
+// session leaves Sessions at once.
+func (st *Stack) CloseSession(idx uint32) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	s, err := st.session(idx)
+	if err != nil {
+		return err
+	}
+	if s.state == poolioc.StateEstablished && !s.peerGone {
+		if len(s.unacked) > 0 {
+			s.lingering = true
+			s.lingerEnd = time.Now().Add(lingerTimeout)
+			st.signal()
+			return nil
+		}
+		st.sendClose(s)
+	}
+	st.free(s)
+	st.signal()
+	return nil
+}
+
+// ChannelSubscribe subscribes to a channel on a session.
+func (st *Stack) ChannelSubscribe(idx uint32, channel uint8) error {
+	return st.channel(idx, func(s *session) {
+		s.channels[channel/8] |= 1 << (channel % 8)
+	})
+}
+
+// ChannelUnsubscribe unsubscribes from a channel on a session.
+func (st *Stack) ChannelUnsubscribe(idx uint32, channel uint8) error {
+	return st.channel(idx, func(s *session) {
+		s.channels[channel/8] &^= 1 << (channel % 8)
+	})
+}
+
+// ChannelList returns the bitmap of subscribed channels.
+func (st *Stack) ChannelList(idx uint32) ([poolioc.MaxChannels / 8]byte, error) {
+	var bitmap [poolioc.MaxChannels / 8]byte
+	err := st.channel(idx, func(s *session) { bitmap = s.channels })
+	return bitmap, err
+}
+
+func (st *Stack) channel(idx uint32, op func(*session)) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	s, err := st.session(idx)
+	if err != nil {
+		return err
+	}
+	op(s)
+	return nil
+}
+
+// Ready returns a channel that is closed at the next change in the
+// Stack's state.
+func (st *Stack) Ready() <-chan struct{} {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.ready
+}
+
+// signal wakes every operation waiting for a state change. st.mu must
+// be held.
+func (st *Stack) signal() {
+	close(st.ready)
+	st.ready = make(chan struct{})
+}
+
+// wait runs op with st.mu held until it stops failing with EAGAIN,
+// sleeping on state changes between attempts. It returns ctx.Err() if
+// ctx is done first and [os.ErrClosed] if the Stack is closed. Under a
+// [poolioc.NoWait] context it returns EAGAIN instead of sleeping.
+func (st *Stack) wait(ctx context.Context, op func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for {
+		st.mu.Lock()
+		ready := st.ready
+		err := op()
+		st.mu.Unlock()
+		if err != syscall.EAGAIN || poolioc.IsNoWait(ctx) {
+			return err
+		}
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-st.done:
+			return os.ErrClosed
+		}
+	}
+}
+
+// session returns the session at idx. st.mu must be held.
+func (st *Stack) session(idx uint32) (*session, error) {
+	if st.closed {
+		return nil, syscall.EBADF
+	}
+	if idx >= poolioc.MaxSessions || st.sessions[idx] == nil || st.sessions[idx].lingering {
+		return nil, syscall.EINVAL
+	}
+	return st.sessions[idx], nil
+}
+
+// freeSlot returns the lowest free session index, or -1 if the table
+// is full. st.mu must be held.
+func (st *Stack) freeSlot() int {
+	for i, s := range st.sessions {
+		if s == nil {
+			return i
+		}
+	}
+	return -1
+}
+
+// free removes s from the session table. st.mu must be held.
+func (st *Stack) free(s *session) {
+	s.failWaiters(syscall.EBADF)
+	if st.sessions[s.idx] == s {
+		st.sessions[s.idx] = nil
+	}
+	if st.byID[s.id] == s {
+		delete(st.byID, s.id)
+	}
+}
+
+// bind opens the socket on port, or an ephemeral port if port is 0,
+// unless it is already open. st.mu must be held.
+func (st *Stack) bind(port uint16) error {
+	if st.conn != nil {
+		return nil
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: int(port)})
+	if err != nil {
+		return errno(err)
+	}
+	st.conn = conn
+	st.wg.Add(2)
+	go st.readLoop(conn)
+	go st.run()
+	return nil
+}
+
+// write sends one packet to the peer of s. st.mu must be held.
+func (st *Stack) write(s *session, pkt []byte) error {
+	s.lastSend = time.Now()
+	_, err := st.conn.WriteToUDP(pkt, s.peer)
+	return errno(err)
+}
+
+// readLoop handles inbound datagrams until the socket is closed.
+func (st *Stack) readLoop(conn *net.UDPConn) {
+	defer st.wg.Done()
+	buf := make([]byte, maxDatagram+1)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		st.handle(buf[:n], from, time.Now())
+	}
+}
+
+// run services timers until the Stack is closed.
+func (st *Stack) run() {
+	defer st.wg.Done()
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			st.mu.Lock()
+			changed := false
+			for _, s := range st.sessions {
+				if s != nil && st.service(s, now) {
+					changed = true
+				}
+			}
+			if changed {
+				st.signal()
+			}
+			st.mu.Unlock()
+		case <-st.done:
+			return
+		}
+	}
+}
+
+// handle processes one inbound datagram.
+func (st *Stack) handle(b []byte, from *net.UDPAddr, now time.Time) {
+	var h poolwire.Header
+	if len(b) < poolwire.HeaderSize || h.UnmarshalBinary(b[:poolwire.HeaderSize]) != nil {
+		return
+	}
+	payload := b[poolwire.HeaderSize:]
+	if int(h.PayloadLen) != len(payload) {
+		return
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.closed {
+		return
+	}
+
+	if h.Type == poolioc.PktInit {
+		st.onInit(&h, payload, from, now)
+		return
+	}
+	s := st.byID[h.SessionID]
+	if s == nil || !sameAddr(s.peer, from) {
+		return
+	}
+	if h.Type == poolioc.PktChallenge {
+		st.onChallenge(s, &h, payload)
+		return
+	}
+	if s.recvMAC == nil || h.Verify(s.recvMAC) != nil || !s.fresh(&h) {
+		return
+	}
+	s.lastRecv = now
+
+	// The responder's ACK of our RESPONSE may be lost; any later
+	// authenticated packet from it confirms the handshake as well.
+	if s.initiator && s.state == poolioc.StateChallenged {
+		s.establish(now)
+	}
+
+	switch h.Type {
+	case poolioc.PktResponse:
+		st.onResponse(s, &h, payload, b[:adLen], now)
+	case poolioc.PktData:
+		st.onData(s, &h, payload, b[:adLen])
+	case poolioc.PktAck:
+		s.onAck(&h, now)
+	case poolioc.PktHeartbeat:
+		if h.Flags&poolioc.FlagRequireAck != 0 {
+			st.grant(s, h.Channel) // a stalled sender's probe
+		}
+	case poolioc.PktClose:
+		if h.Seq != 0 {
+			st.onData(s, &h, payload, b[:adLen]) // closes one channel
+			break
+		}
+		st.onClose(s)
+	}
+	st.signal()
+}
+
+// service runs the timers of s: handshake retries and expiry,
+// retransmission, probes of stalled channels, heartbeats, peer
+// liveness and lingering closes. It
+// reports whether the state of s changed. st.mu must be held.
+func (st *Stack) service(s *session, now time.Time) bool {
+	switch s.state {
+	case poolioc.StateInitSent, poolioc.StateChallenged:
+		if now.After(s.hsDeadline) {
+			s.err = syscall.ETIMEDOUT
+			st.free(s)
+			return true
+		}
+		if s.initiator && now.Sub(s.hsSent) >= handshakeRetry {
+			s.hsSent = now
+			_ = st.write(s, s.hsPacket)
+		}
+		return false
+	}
+
+	if s.lingering && (len(s.unacked) == 0 || s.peerGone || now.After(s.lingerEnd)) {
+		if !s.peerGone {
+			st.sendClose(s)
+		}
+		st.free(s)
+		return true
+	}
+	changed := st.expire(s, now)
+	if s.peerGone {
+		return changed
+	}
+
+	rto := s.rto()
+	for _, p := range s.unacked {
+		if now.Sub(p.sent) < min(rto<<p.tries, maxRTO) {
+			continue
+		}
+		if p.tries >= maxRetries {
+			s.lost(syscall.ETIMEDOUT)
+			return true
+		}
+		p.tries++
+		p.sent = now
+		s.retransmits++
+		_ = st.write(s, p.pkt)
+	}
+	// A channel waiting for a grant is not losing packets: probe it
+	// for as long as the peer is alive.
+	for ch, probed := range s.stalled {
+		if now.Sub(probed) >= rto {
+			s.stalled[ch] = now
+			st.probe(s, ch)
+		}
+	}
+
+	if now.Sub(s.lastRecv) > deadHeartbeats*s.heartbeat {
+		s.lost(syscall.ETIMEDOUT)
+		return true
+	}
+	if now.Sub(s.lastSend) >= s.heartbeat {
+		if pkt, err := s.packet(poolioc.PktHeartbeat, 0, 0, 0, 0, nil); err == nil {
+			_ = st.write(s, pkt)
+		}
+	}
+	return changed
+}
+
+// sendClose tells the peer of s that the session is over. st.mu must
+// be held.
+func (st *Stack) sendClose(s *session) {
+	if pkt, err := s.packet(poolioc.PktClose, 0, 0, 0, 0, nil); err == nil {
+		_ = st.write(s, pkt)
+	}
+}
+
+func (st *Stack) onClose(s *session) {
+	if s.lingering {
+		st.free(s)
+		return
+	}
+	s.peerClosed = true
+	s.lost(syscall.ECONNRESET)
+}
+
+// sameAddr reports whether a and b are the same UDP endpoint, treating
+// IPv4 and IPv4-mapped IPv6 addresses as equal.
+func sameAddr(a, b *net.UDPAddr) bool {
+	return a.Port == b.Port && a.IP.Equal(b.IP)
+}
+
+// errno returns the syscall.Errno underlying err, if any, so that the
+// pool package maps it as it would a device error.
+func errno(err error) error {
+	var e syscall.Errno
+	if errors.As(err, &e) {
+		return e
+	}
+	return err
+}
+
+// Verify interface compliance at compile time.
+var (
+	_ poolioc.Backend         = (*Stack)(nil)
+	_ poolioc.ContextBackend  = (*Stack)(nil)
+	_ poolioc.Notifier        = (*Stack)(nil)
+	_ poolioc.MessageBackend  = (*Stack)(nil)
+	_ poolioc.AckBackend      = (*Stack)(nil)
+	_ poolioc.DemuxBackend    = (*Stack)(nil)
+	_ poolioc.ShutdownBackend = (*Stack)(nil)
+)
@@ -0,0 +1,58 @@
+//go:build linux
+
+package poolwire
+
+import (
+	"encoding"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/amosdavis/pool-go/poolioc"
+)
+
+// AddressSize is the encoded size of an [Address].
+const AddressSize = poolioc.AddrSize
+
+// Address is a 256-bit POOL address. It corresponds to
+// [poolioc.Address].
+type Address struct {
+	TypeVersion uint32
+	OrgID       uint64
+	SegmentID   uint64
+	NodeID      uint64
+	Checksum    uint32
+}
+
+// MarshalBinary encodes a.
+func (a *Address) MarshalBinary() ([]byte, error) {
+	return a.AppendBinary(make([]byte, 0, AddressSize))
+}
+
+// AppendBinary appends the encoding of a to b.
+func (a *Address) AppendBinary(b []byte) ([]byte, error) {
+	b = binary.BigEndian.AppendUint32(b, a.TypeVersion)
+	b = binary.BigEndian.AppendUint64(b, a.OrgID)
+	b = binary.BigEndian.AppendUint64(b, a.SegmentID)
+	b = binary.BigEndian.AppendUint64(b, a.NodeID)
+	b = binary.BigEndian.AppendUint32(b, a.Checksum)
+	return b, nil
+}
+
+// UnmarshalBinary decodes exactly one address from data.
+func (a *Address) UnmarshalBinary(data []byte) error {
+	if len(data) != AddressSize {
+		return fmt.Errorf("%w: address is %d bytes, got %d", ErrLength, AddressSize, len(data))
+	}
+	a.TypeVersion = binary.BigEndian.Uint32(data[0:])
+	a.OrgID = binary.BigEndian.Uint64(data[4:])
+	a.SegmentID = binary.BigEndian.Uint64(data[12:])
+	a.NodeID = binary.BigEndian.Uint64(data[20:])
+	a.Checksum = binary.BigEndian.Uint32(data[28:])
+	return nil
+}
+
+// Verify interface compliance at compile time.
+var (
+	_ encoding.BinaryMarshaler   = (*Address)(nil)
+	_ encoding.BinaryUnmarshaler = (*Address)(nil)
+)
@@ -0,0 +1,14 @@
+// Package poolwire encodes and decodes the on-wire structures of the
+// POOL protocol: the packet [Header], the [FragHeader] that prefixes
+// fragment payloads, the 256-bit [Address], and [JournalEntry] records.
+//
+// All multi-byte fields are in network byte order. The types mirror the
+// C structures in pool.h, as poolioc does, but split packed fields into
+// their parts and carry variable-length data inline, so that a decoded
+// value can be inspected and re-encoded without further bookkeeping.
+// Encodings round-trip exactly: reserved bytes must be zero, and
+// anything that would not survive a round trip is rejected.
+//
+// The package does not use the kernel module and is intended for
+// capture analysis, tests, and userspace tooling that speaks POOL.
+package poolwire
@@ -0,0 +1,27 @@
+//go:build linux
+
+package poolwire
+
+import "errors"
+
+// Sentinel errors returned by the codecs. They are wrapped with detail
+// about the offending value; test for them with [errors.Is].
+var (
+	// ErrLength indicates an encoding of the wrong size.
+	ErrLength = errors.New("poolwire: invalid length")
+
+	// ErrVersion indicates an unsupported protocol version.
+	ErrVersion = errors.New("poolwire: unsupported version")
+
+	// ErrPacketType indicates an unknown packet type.
+	ErrPacketType = errors.New("poolwire: unknown packet type")
+
+	// ErrFlags indicates unknown or inconsistent header flags.
+	ErrFlags = errors.New("poolwire: invalid flags")
+
+	// ErrReserved indicates a non-zero reserved field.
+	ErrReserved = errors.New("poolwire: reserved field not zero")
+
+	// ErrHMAC indicates a header whose HMAC does not verify.
+	ErrHMAC = errors.New("poolwire: HMAC mismatch")
+)
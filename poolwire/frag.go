@@ -0,0 +1,50 @@
+//go:build linux
+
+package poolwire
+
+import (
+	"encoding"
+	"encoding/binary"
+	"fmt"
+)
+
+// FragHeaderSize is the encoded size of a [FragHeader].
+const FragHeaderSize = 8
+
+// FragHeader prefixes the payload of every packet sent with
+// poolioc.FlagFragment. It corresponds to [poolioc.FragHeader].
+type FragHeader struct {
+	MsgID      uint32 // identifies the message the fragment belongs to
+	FragOffset uint16 // byte offset of the fragment's data within the message
+	TotalLen   uint16 // length of the whole message in bytes
+}
+
+// MarshalBinary encodes f.
+func (f *FragHeader) MarshalBinary() ([]byte, error) {
+	return f.AppendBinary(make([]byte, 0, FragHeaderSize))
+}
+
+// AppendBinary appends the encoding of f to b.
+func (f *FragHeader) AppendBinary(b []byte) ([]byte, error) {
+	b = binary.BigEndian.AppendUint32(b, f.MsgID)
+	b = binary.BigEndian.AppendUint16(b, f.FragOffset)
+	b = binary.BigEndian.AppendUint16(b, f.TotalLen)
+	return b, nil
+}
+
+// UnmarshalBinary decodes exactly one fragment header from data.
+func (f *FragHeader) UnmarshalBinary(data []byte) error {
+	if len(data) != FragHeaderSize {
+		return fmt.Errorf("%w: fragment header is %d bytes, got %d", ErrLength, FragHeaderSize, len(data))
+	}
+	f.MsgID = binary.BigEndian.Uint32(data[0:])
+	f.FragOffset = binary.BigEndian.Uint16(data[4:])
+	f.TotalLen = binary.BigEndian.Uint16(data[6:])
+	return nil
+}
+
+// Verify interface compliance at compile time.
+var (
+	_ encoding.BinaryMarshaler   = (*FragHeader)(nil)
+	_ encoding.BinaryUnmarshaler = (*FragHeader)(nil)
+)
@@ -0,0 +1,168 @@
+//go:build linux
+
+package poolwire
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/amosdavis/pool-go/poolioc"
+)
+
+// HeaderSize is the encoded size of a [Header].
+const HeaderSize = poolioc.HeaderSize
+
+// hmacOffset is where the HMAC starts in an encoded header; the HMAC
+// covers every byte before it.
+const hmacOffset = HeaderSize - poolioc.HMACSize
+
+// validFlags is the set of flags defined by the protocol.
+const validFlags = poolioc.FlagEncrypted | poolioc.FlagCompressed |
+	poolioc.FlagPriority | poolioc.FlagFragment | poolioc.FlagLastFrag |
+	poolioc.FlagRequireAck | poolioc.FlagTelemetry | poolioc.FlagRollbackRdy |
+	poolioc.FlagConfigLock | poolioc.FlagJournalSync
+
+// Header is the 80-byte header that starts every POOL packet. It
+// corresponds to [poolioc.Header] with the VerType byte split into
+// Version and Type.
+//
+// Encoded layout, in network byte order:
+//
+//	 0  version (high nibble) | type (low nibble)
+//	 1  reserved
+//	 2  flags
+//	 4  seq
+//	12  ack
+//	20  session ID
+//	36  timestamp
+//	44  payload length
+//	46  channel
+//	47  reserved
+//	48  HMAC-SHA256 of bytes 0-47
+type Header struct {
+	Version    uint8 // poolioc.Version or poolioc.VersionPQC
+	Type       uint8 // one of the poolioc.Pkt* constants
+	Flags      uint16
+	Seq        uint64
+	Ack        uint64
+	SessionID  [poolioc.SessionIDSize]byte
+	Timestamp  uint64
+	PayloadLen uint16
+	Channel    uint8
+	HMAC       [poolioc.HMACSize]byte
+}
+
+// Validate reports whether h can be encoded: the version and packet
+// type must be known, and the flags must be defined and consistent.
+func (h *Header) Validate() error {
+	if h.Version < poolioc.Version || h.Version > poolioc.VersionPQC {
+		return fmt.Errorf("%w: %d", ErrVersion, h.Version)
+	}
+	if h.Type > poolioc.PktJournal {
+		return fmt.Errorf("%w: %#x", ErrPacketType, h.Type)
+	}
+	if h.Flags&^validFlags != 0 {
+		return fmt.Errorf("%w: unknown bits %#04x", ErrFlags, h.Flags&^validFlags)
+	}
+	if h.Flags&poolioc.FlagLastFrag != 0 && h.Flags&poolioc.FlagFragment == 0 {
+		return fmt.Errorf("%w: last-fragment without fragment", ErrFlags)
+	}
+	return nil
+}
+
+// MarshalBinary encodes h. It fails if h does not pass Validate.
+func (h *Header) MarshalBinary() ([]byte, error) {
+	return h.AppendBinary(make([]byte, 0, HeaderSize))
+}
+
+// AppendBinary appends the encoding of h to b.
+func (h *Header) AppendBinary(b []byte) ([]byte, error) {
+	if err := h.Validate(); err != nil {
+		return b, err
+	}
+	b = append(b, h.Version<<4|h.Type, 0)
+	b = binary.BigEndian.AppendUint16(b, h.Flags)
+	b = binary.BigEndian.AppendUint64(b, h.Seq)
+	b = binary.BigEndian.AppendUint64(b, h.Ack)
+	b = append(b, h.SessionID[:]...)
+	b = binary.BigEndian.AppendUint64(b, h.Timestamp)
+	b = binary.BigEndian.AppendUint16(b, h.PayloadLen)
+	b = append(b, h.Channel, 0)
+	b = append(b, h.HMAC[:]...)
+	return b, nil
+}
+
+// UnmarshalBinary decodes exactly one header from data. To decode the
+// header of a packet, pass data[:HeaderSize].
+func (h *Header) UnmarshalBinary(data []byte) error {
+	if len(data) != HeaderSize {
+		return fmt.Errorf("%w: header is %d bytes, got %d", ErrLength, HeaderSize, len(data))
+	}
+	if data[1] != 0 || data[47] != 0 {
+		return fmt.Errorf("%w: header", ErrReserved)
+	}
+
+	var v Header
+	v.Version = data[0] >> 4
+	v.Type = data[0] & 0x0F
+	v.Flags = binary.BigEndian.Uint16(data[2:])
+	v.Seq = binary.BigEndian.Uint64(data[4:])
+	v.Ack = binary.BigEndian.Uint64(data[12:])
+	copy(v.SessionID[:], data[20:36])
+	v.Timestamp = binary.BigEndian.Uint64(data[36:])
+	v.PayloadLen = binary.BigEndian.Uint16(data[44:])
+	v.Channel = data[46]
+	copy(v.HMAC[:], data[hmacOffset:])
+	if err := v.Validate(); err != nil {
+		return err
+	}
+	*h = v
+	return nil
+}
+
+// ComputeHMAC returns the HMAC-SHA256 under key of the encoded header
+// bytes that precede the HMAC field. The current HMAC field is ignored.
+func (h *Header) ComputeHMAC(key []byte) ([poolioc.HMACSize]byte, error) {
+	var sum [poolioc.HMACSize]byte
+	var buf [HeaderSize]byte
+	b, err := h.AppendBinary(buf[:0])
+	if err != nil {
+		return sum, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b[:hmacOffset])
+	copy(sum[:], mac.Sum(nil))
+	return sum, nil
+}
+
+// Sign sets h.HMAC to the header's HMAC under key.
+func (h *Header) Sign(key []byte) error {
+	sum, err := h.ComputeHMAC(key)
+	if err != nil {
+		return err
+	}
+	h.HMAC = sum
+	return nil
+}
+
+// Verify checks h.HMAC against the header's HMAC under key in constant
+// time. It returns [ErrHMAC] on mismatch.
+func (h *Header) Verify(key []byte) error {
+	sum, err := h.ComputeHMAC(key)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(sum[:], h.HMAC[:]) {
+		return ErrHMAC
+	}
+	return nil
+}
+
+// Verify interface compliance at compile time.
+var (
+	_ encoding.BinaryMarshaler   = (*Header)(nil)
+	_ encoding.BinaryUnmarshaler = (*Header)(nil)
+)
@@ -0,0 +1,94 @@
+//go:build linux
+
+package poolwire
+
+import (
+	"encoding"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// JournalEntryHeaderSize is the encoded size of a [JournalEntry]
+// without its detail.
+const JournalEntryHeaderSize = 52
+
+// JournalEntry is one record of the POOL change journal. It
+// corresponds to [poolioc.JournalEntry] followed by DetailLength bytes
+// of detail, which are carried in Detail; the length field is derived
+// from len(Detail) when encoding.
+type JournalEntry struct {
+	Timestamp       uint64
+	ConfigVerBefore uint32
+	ConfigVerAfter  uint32
+	ChangeHash      [32]byte
+	ChangeType      uint16 // one of the poolioc.Journal* constants
+	Detail          []byte
+}
+
+// Len returns the encoded size of e.
+func (e *JournalEntry) Len() int {
+	return JournalEntryHeaderSize + len(e.Detail)
+}
+
+// MarshalBinary encodes e. It fails if Detail is longer than 65535
+// bytes.
+func (e *JournalEntry) MarshalBinary() ([]byte, error) {
+	return e.AppendBinary(make([]byte, 0, e.Len()))
+}
+
+// AppendBinary appends the encoding of e to b.
+func (e *JournalEntry) AppendBinary(b []byte) ([]byte, error) {
+	if len(e.Detail) > math.MaxUint16 {
+		return b, fmt.Errorf("%w: journal detail is %d bytes, at most %d allowed", ErrLength, len(e.Detail), math.MaxUint16)
+	}
+	b = binary.BigEndian.AppendUint64(b, e.Timestamp)
+	b = binary.BigEndian.AppendUint32(b, e.ConfigVerBefore)
+	b = binary.BigEndian.AppendUint32(b, e.ConfigVerAfter)
+	b = append(b, e.ChangeHash[:]...)
+	b = binary.BigEndian.AppendUint16(b, e.ChangeType)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(e.Detail)))
+	b = append(b, e.Detail...)
+	return b, nil
+}
+
+// UnmarshalBinary decodes exactly one journal entry from data. Detail
+// is copied, so data may be reused afterwards. To decode a sequence of
+// entries, split it with [JournalEntryLen].
+func (e *JournalEntry) UnmarshalBinary(data []byte) error {
+	n, err := JournalEntryLen(data)
+	if err != nil {
+		return err
+	}
+	if n != len(data) {
+		return fmt.Errorf("%w: journal entry is %d bytes, got %d", ErrLength, n, len(data))
+	}
+
+	e.Timestamp = binary.BigEndian.Uint64(data[0:])
+	e.ConfigVerBefore = binary.BigEndian.Uint32(data[8:])
+	e.ConfigVerAfter = binary.BigEndian.Uint32(data[12:])
+	copy(e.ChangeHash[:], data[16:48])
+	e.ChangeType = binary.BigEndian.Uint16(data[48:])
+	e.Detail = append([]byte(nil), data[JournalEntryHeaderSize:]...)
+	return nil
+}
+
+// JournalEntryLen returns the encoded size of the journal entry at the
+// start of data, which may be followed by further entries. It fails if
+// data is too short to hold the entry's fixed part and detail.
+func JournalEntryLen(data []byte) (int, error) {
+	if len(data) < JournalEntryHeaderSize {
+		return 0, fmt.Errorf("%w: journal entry needs %d bytes, got %d", ErrLength, JournalEntryHeaderSize, len(data))
+	}
+	n := JournalEntryHeaderSize + int(binary.BigEndian.Uint16(data[50:]))
+	if len(data) < n {
+		return 0, fmt.Errorf("%w: journal entry needs %d bytes, got %d", ErrLength, n, len(data))
+	}
+	return n, nil
+}
+
+// Verify interface compliance at compile time.
+var (
+	_ encoding.BinaryMarshaler   = (*JournalEntry)(nil)
+	_ encoding.BinaryUnmarshaler = (*JournalEntry)(nil)
+)
@@ -22,12 +22,219 @@ Feature: High-level pool networking API
     When I dial "pool" "192.0.2.1:9999" with a 1 second timeout
     Then the dial should fail with a timeout error
 
+  Scenario: Dial through a caller-supplied backend
+    Given I listen on "pool" ":9257"
+    When I dial "127.0.0.1:9257" through an instrumented backend
+    And I write "wrapped"
+    Then the instrumented backend should have counted 1 send
+
+  Scenario: Dialer options reach the backend
+    Given I listen on "pool" ":9260"
+    When I dial "127.0.0.1:9260" through an instrumented backend with PQC, raw transport and a 3s keepalive
+    Then the backend should have seen version 2, transport 1 and heartbeat 3
+    And the Control hook should have run
+    And the dial should be unsupported
+
+  Scenario: Dialer rejects a mismatched local address
+    When I dial "127.0.0.1:9261" with local address "::1"
+    Then the error should be a dial OpError for "127.0.0.1:9261" caused by "pool: local address [::1]:0 does not match family of 127.0.0.1:9261"
+
+  Scenario: An OpError without a cause formats like net.OpError
+    Then an OpError for "read" on "pool" without a cause should say "read pool"
+    And a nil OpError should say "<nil>"
+
+  Scenario: A failing Control hook aborts the dial with an OpError
+    Given I listen on "pool" ":9329"
+    When I dial "127.0.0.1:9329" with a Control hook that fails with "denied by policy"
+    Then the error should be a dial OpError for "127.0.0.1:9329" caused by "denied by policy"
+
+  Scenario: Dialer cannot bind a local address
+    Given I listen on "pool" ":9323"
+    When I dial "127.0.0.1:9323" with local address "127.0.0.1"
+    Then the dial should be unsupported
+    When I dial "127.0.0.1:9323" with local address "0.0.0.0"
+    Then the dial should have succeeded
+
+  Scenario: Dial falls back to a reachable address family
+    Given I listen on "pool" ":9262"
+    And a resolver that maps "dual.test" to "2001:db8::1" and "127.0.0.1"
+    When I dial "pool" "dual.test:9262" with that resolver
+    Then the remote address should be "127.0.0.1"
+
+  Scenario: pool4 dials only IPv4 addresses
+    Given I listen on "pool" ":9263"
+    And a resolver that maps "dual.test" to "::1" and "127.0.0.1"
+    When I dial "pool4" "dual.test:9263" with that resolver
+    Then the remote address should be "127.0.0.1"
+
+  Scenario: pool4 rejects an IPv6 literal
+    When I resolve "pool4" "[::1]:9253" expecting an error
+    Then the operation should fail with an error containing "no suitable address found"
+
   Scenario: Listen and accept
     Given I listen on "pool" ":9254"
     When a client connects to "127.0.0.1:9254"
     Then Accept should return a connection
     And the remote address should be "127.0.0.1"
 
+  Scenario: Accepted connections report the dialer's address
+    Given I listen on "pool" ":9324"
+    When a client connects to "0.0.0.0:9324"
+    Then Accept should return a connection
+    And the remote address should be "127.0.0.1"
+
+  Scenario: Accept a new session on a reused index
+    Given I listen on "pool" ":9264"
+    And a client connects to "127.0.0.1:9264"
+    When both sides close the connection
+    And a client connects to "127.0.0.1:9264" and is accepted within 50ms
+    Then the accepted session should reuse the previous index
+
+  Scenario: Accept drains sessions established before it is called
+    Given I listen on "pool" ":9265"
+    When 3 clients connect to "127.0.0.1:9265"
+    Then Accept should return 3 connections
+
+  Scenario: A Listener does not accept sessions dialed through its own Backend
+    Given I listen on "pool" ":9328" through my own device
+    When a client connects to "127.0.0.1:9328" through my own device
+    Then the accepted connection should be the client's peer
+    And no further connection should be accepted within 300ms
+
+  Scenario: Watch session lifecycle on any backend
+    Given I listen on "pool" ":9267"
+    And I watch sessions on an instrumented backend
+    When I dial "127.0.0.1:9267" through the watched backend
+    Then Watch should report an "ESTABLISHED" event
+    When I close the connection
+    Then Watch should report a "CLOSED" event
+
+  Scenario: Watch needs a backend to watch
+    Then watching sessions without a backend should be invalid
+
+  Scenario: Conn methods report session errors as OpErrors
+    Given I listen on "pool" ":9321"
+    When I dial "127.0.0.1:9321" through an instrumented backend
+    And the backend closes the session behind the connection's back
+    Then Telemetry, SessionInfo, OpenChannel and Channels should fail with an OpError
+
+  Scenario: Messages carry per-message flags
+    Given I listen on "pool" ":9268"
+    And a client connects to "127.0.0.1:9268"
+    When the client writes the message "urgent" with flags 0x24
+    Then I should read the message "urgent" on channel 0 with flags 0x24 set
+
+  Scenario: Flags need a backend that carries them
+    Given I listen on "pool" ":9269"
+    When I dial "127.0.0.1:9269" through an instrumented backend
+    Then writing a message with flags 0x04 should be unsupported
+
+  Scenario: Acknowledged writes wait for delivery
+    Given I listen on "pool" ":9279"
+    And a client connects to "127.0.0.1:9279"
+    When the client pipelines 50 acknowledged writes
+    Then no acknowledged write should complete before I read it
+    When I read back the 50 pipelined writes
+    Then every acknowledged write should complete
+    And an acknowledged write of "ping" should complete once I read it with flags 0x20 set
+
+  Scenario: Acknowledged writes need a backend that reports delivery
+    Given I listen on "pool" ":9280"
+    When I dial "127.0.0.1:9280" through an instrumented backend
+    Then an acknowledged write should be unsupported
+
+  Scenario: High-priority channels overtake bulk transfers
+    Given I listen on "pool" ":9283"
+    When I dial "127.0.0.1:9283" through a backend that holds sends
+    And channel 1 is set to "bulk" priority and channel 2 to "high"
+    And 6 writes on channel 1 and then 2 writes on channel 2 are waiting
+    And the backend releases the sends
+    Then the sends should go to channels 1, 2, 2, 1, 1, 1, 1, 1
+    And only the channel 2 sends should carry FlagPriority
+    And channel 1 should report 5 waits and channel 2 should report 2 waits
+
+  Scenario: A stalled channel does not hold up writes on the others
+    Given I listen on "pool" ":9318"
+    And a client connects to "127.0.0.1:9318"
+    When channel 1 is set to "bulk" priority and channel 2 to "high"
+    And channel 1 fills the client's queue and a further write on it stalls
+    Then a write on channel 2 should succeed within 500ms
+    And the stalled write should complete once the client reads channel 1
+
+  Scenario: Messages can override their channel's priority
+    Given I listen on "pool" ":9284"
+    And a client connects to "127.0.0.1:9284"
+    When the client's channel is set to "bulk" priority
+    And the client writes the message "now" with priority "high"
+    Then I should read the message "now" on channel 0 with flags 0x04 set
+
+  Scenario Outline: Compressible messages are sent compressed
+    Given I listen on "pool" ":<port>"
+    And a client connects to "127.0.0.1:<port>"
+    When the client demultiplexes its channels
+    And the client enables "<codec>" compression
+    And the client writes "hello"
+    Then the client should have compressed 0 messages and skipped 0
+    And I should read back what the client wrote
+    And the client should agree on "<codec>" compression
+    When the client writes a 20000-byte log message
+    And the client writes 200 random bytes
+    Then I should read back what the client wrote
+    And the client should have compressed 1 message and skipped 1 with a ratio below 0.25
+    And I should have decompressed 1 message
+
+    Examples:
+      | codec | port |
+      | flate | 9285 |
+      | gzip  | 9286 |
+      | zlib  | 9287 |
+      | lzw   | 9288 |
+
+  Scenario: Writes that fail do not count as compressed
+    Given I listen on "pool" ":9333"
+    And a client connects to "127.0.0.1:9333"
+    When the client demultiplexes its channels
+    And the client enables "zlib" compression
+    And the client writes "hello"
+    Then I should read back what the client wrote
+    And the client should agree on "zlib" compression
+    And a 20000-byte log message written by the client after its write deadline should time out
+    And the client should have compressed 0 messages and skipped 0
+
+  Scenario: The peer chooses among the offered codecs
+    Given I listen on "pool" ":9289"
+    And a client connects to "127.0.0.1:9289"
+    And I enable "zlib" compression
+    When the client enables "lzw, zlib" compression
+    And the client writes a 10000-byte log message
+    Then I should read back what the client wrote
+    And the client should have compressed 0 messages and skipped 0
+    When I write "ok"
+    Then the client should read "ok" and then use "zlib" compression
+    When the client writes a 10000-byte log message
+    Then I should read back what the client wrote
+    And the client should have compressed 1 message and skipped 0 with a ratio below 0.25
+
+  Scenario: Compression needs a backend that carries flags
+    Given I listen on "pool" ":9290"
+    When I dial "127.0.0.1:9290" through an instrumented backend
+    Then enabling compression should be unsupported
+
+  Scenario: Accept honors context cancellation
+    Given I listen on "pool" ":9258"
+    When I accept with a 50ms context timeout
+    Then the operation should fail with "context deadline exceeded"
+
+  Scenario: DialContext with a canceled context
+    Given I listen on "pool" ":9259"
+    When I dial "127.0.0.1:9259" with a canceled context
+    Then the operation should fail with "context canceled"
+
+  Scenario: ReadContext honors cancellation
+    Given I have a connected pool.Conn
+    When I read with a context canceled after 50ms
+    Then the operation should fail with "context canceled"
+
   Scenario: Conn implements net.Conn
     Given I have a connected pool.Conn
     Then it should implement net.Conn
@@ -44,6 +251,14 @@ Feature: High-level pool networking API
     When I set a write deadline 100ms in the past
     Then Write should return a timeout error
 
+  Scenario: Read deadline abandons a pending read
+    Given I have a connected pool.Conn
+    When I read with a 50ms read deadline
+    Then the read should time out without writing to the buffer
+    When I clear the read deadline
+    And I write "after deadline"
+    Then I should read "after deadline"
+
   Scenario: Close connection
     Given I have a connected pool.Conn
     When I close the connection
@@ -67,6 +282,249 @@ Feature: High-level pool networking API
     And the peer echoes on channel 5
     Then I should read "channel5 data" on channel 5
 
+  Scenario: Small reads see a byte stream
+    Given I have a connected pool.Conn
+    When I write "hello, stream world"
+    Then reading 5 bytes at a time should give "hello, stream world"
+    When I write "head"
+    And I write "er+body"
+    Then io.ReadFull of 6 bytes should give "header"
+    And I should read "+body"
+    When I write the lines "alpha" and "beta"
+    Then a 16-byte bufio.Reader should read the lines "alpha" and "beta"
+
+  Scenario: Message mode reports small buffers
+    Given I have a connected pool.Conn
+    And the connection is in message mode
+    When I write "too long for the buffer"
+    Then a 4-byte read should fail with ErrBufferTooSmall
+    And I should read "too long for the buffer"
+
+  Scenario: Messages larger than 64 KiB keep their boundaries
+    Given I have a connected pool.Conn
+    When I write messages of 200000, 0 and 70000 bytes
+    Then I should read back messages of 200000, 0 and 70000 bytes
+
+  Scenario: Receivers discard messages over their limit
+    Given I have a connected pool.Conn
+    When I write messages of 200000, 0 and 70000 bytes
+    And I limit messages to 100000 bytes
+    Then reading a message should fail with ErrMessageTooLarge
+    And I should read back messages of 0 and 70000 bytes
+    And writing a 100001-byte message should fail with ErrMessageTooLarge
+
+  Scenario: Large messages on a channel
+    Given I have a connected pool.Conn
+    When I open channel 7
+    And the peer relays a message on channel 7
+    And I write a 150000-byte message on channel 7
+    Then I should read back the 150000-byte message on channel 7
+
+  Scenario: Channel deadlines are independent
+    Given I listen on "pool" ":9291"
+    And a client connects to "127.0.0.1:9291"
+    When I open channels 1 and 2
+    And channel 1 has a read deadline 50ms from now
+    And the client writes "on time" on channel 2 after 100ms
+    Then reading on channel 1 should time out
+    And channel 2 should read "on time"
+
+  Scenario: Expired channel deadlines fail writes until cleared
+    Given I listen on "pool" ":9292"
+    And a client connects to "127.0.0.1:9292"
+    When I open channels 1 and 2
+    And channel 1 has a write deadline in the past
+    Then writing on channel 1 should time out
+    And writing on channel 2 should succeed
+    When channel 1 clears its deadlines
+    Then writing on channel 1 should succeed
+
+  Scenario: Accept a channel the peer starts sending on
+    Given I listen on "pool" ":9293" through my own device
+    And a client connects to "127.0.0.1:9293"
+    When the client writes "hello,world" on channel 7
+    Then I should accept channel 7
+    And channel 7 should read "hello"
+    And channel 7 should read "world"
+    And channel 7 should not be subscribed
+
+  Scenario: A full channel queue overflows without holding back other channels
+    Given I listen on "pool" ":9294"
+    And a client connects to "127.0.0.1:9294"
+    And I demultiplex channels with a queue of 2 messages
+    When the client writes "one,two,three,four" on channel 3
+    And the client writes "last" on channel 0
+    Then I should read "last"
+    And I should accept channel 3
+    And channel 3 should read "one"
+    And channel 3 should read "two"
+    And reading on channel 3 should fail with ErrChannelOverflow
+    When the client writes "five" on channel 3
+    Then channel 3 should read "five"
+
+  Scenario: A message too large for the demultiplexer fails only its channel
+    Given I listen on "pool" ":9325" through a backend that receives an oversized message on channel 7
+    And a client connects to "127.0.0.1:9325"
+    When the client writes "after" on channel 0
+    Then I should accept channel 7
+    And reading on channel 7 should fail with ErrMessageTooLarge
+    And I should read "after"
+
+  Scenario: Auto-subscribe channels as they are seen
+    Given I listen on "pool" ":9295" through my own device
+    And a client connects to "127.0.0.1:9295"
+    And I demultiplex channels with auto-subscribe
+    When the client writes "ping" on channel 9
+    Then I should accept channel 9
+    And channel 9 should be subscribed
+    When channel 9 is closed
+    Then channel 9 should not be subscribed
+    When the client writes "again" on channel 9
+    Then I should accept channel 9
+    And channel 9 should read "again"
+
+  Scenario: Accepting channels needs a backend that receives from any channel
+    Given I listen on "pool" ":9296"
+    When I dial "127.0.0.1:9296" through an instrumented backend
+    Then demultiplexing should be unsupported
+
+  Scenario: Allocate free channels
+    Given I have a connected pool.Conn
+    And I open channels 1 and 3
+    When I allocate 3 channels
+    Then the allocated channels should be 2, 4 and 5
+    When 50 goroutines allocate a channel each
+    Then the allocated channels should all differ
+
+  Scenario: Reserved channel ranges
+    Given I have a connected pool.Conn
+    When I reserve channels 1 to 10
+    Then reserving channels 5 to 20 should fail with ErrChannelsReserved
+    When I allocate 2 channels
+    Then the allocated channels should be 11 and 12
+    When I allocate 2 channels from the reserved range
+    Then the allocated channels should be 1 and 2
+    When I reserve channels 13 to 255
+    Then allocating a channel should fail with ErrNoFreeChannel
+
+  Scenario: Half-close ends the peer's reads with io.EOF
+    Given I listen on "pool" ":9305"
+    And a client connects to "127.0.0.1:9305"
+    When the client writes "one,two" and closes its side for writing
+    Then io.Copy should read "onetwo" until io.EOF
+    And reads should keep returning io.EOF
+    And the client's writes should fail with ErrWriteClosed
+    When I write "still open"
+    Then the client should read "still open"
+
+  Scenario: The peer's close reason reaches the reader
+    Given I listen on "pool" ":9306"
+    And a client connects to "127.0.0.1:9306"
+    When the client writes "partial" and closes its side for writing with reason 0x09
+    Then I should read "partial"
+    And reading should fail with the peer's reason 0x09
+
+  Scenario: Reads end with io.EOF once the peer closes the session
+    Given I listen on "pool" ":9307"
+    And a client connects to "127.0.0.1:9307"
+    When the client writes "bye" on channel 0
+    And the client closes the connection
+    Then I should read "bye"
+    And reads should keep returning io.EOF
+
+  Scenario: Half-close an accepted channel
+    Given I listen on "pool" ":9308" through my own device
+    And a client connects to "127.0.0.1:9308"
+    When the client writes "a,b" on channel 4 and closes it for writing
+    Then I should accept channel 4
+    And channel 4 should read "a"
+    And channel 4 should read "b"
+    And channel 4 should read io.EOF
+    And channel 4 should read io.EOF
+
+  Scenario: CloseRead still returns the rest of a message already received
+    Given I listen on "pool" ":9326"
+    And a client connects to "127.0.0.1:9326"
+    When the client writes "abcdefghijklmnopqrstuvwxyz"
+    And reading 1 bytes at a time should give "a"
+    And I close my side for reading
+    Then reading 1 bytes at a time should give "bcdefghijklmnopqrstuvwxyz"
+    And reads should keep returning io.EOF
+
+  Scenario: A session that ends without the peer closing it is not io.EOF
+    Given I listen on "pool" ":9327" through a backend whose sessions are gone
+    And a client connects to "127.0.0.1:9327"
+    Then reading should fail with a read OpError wrapping ENOTCONN
+
+  Scenario: CloseRead wakes a waiting read
+    Given I listen on "pool" ":9309"
+    And a client connects to "127.0.0.1:9309"
+    When a read is waiting
+    And I close my side for reading
+    Then the waiting read should return io.EOF
+    And reads should keep returning io.EOF
+
+  Scenario: Half-close needs a backend that can close a channel
+    Given I listen on "pool" ":9310"
+    When I dial "127.0.0.1:9310" through an instrumented backend
+    Then closing for writing should be unsupported
+
+  Scenario: A refused dial is not an authentication failure
+    When I dial "127.0.0.1:9312" with nothing listening
+    Then the error should be a dial OpError for "127.0.0.1:9312" caused by ECONNREFUSED
+    And the error should match ErrConnRefused and not ErrAuthFailed
+
+  Scenario: A peer's POOL error code matches its sentinel
+    Given I listen on "pool" ":9313"
+    And a client connects to "127.0.0.1:9313"
+    When the client writes "partial" and closes its side for writing with reason 0x09
+    Then I should read "partial"
+    And reading should fail with a read OpError on my session
+    And the error should match ErrOverload and not ErrAuthFailed
+
+  Scenario: An expired deadline is a timeout OpError
+    Given I have a connected pool.Conn
+    When I set a read deadline 10ms in the past
+    Then reading should fail with a read OpError on my session
+    And the error should be a timeout matching ErrTimeout
+
+  Scenario: Closing the device wakes a blocked Read with ErrClosed
+    Given I listen on "pool" ":9314" through my own device
+    And a client connects to "127.0.0.1:9314"
+    When a read is waiting
+    And I close my device
+    Then the waiting read should return ErrClosed
+
+  Scenario: Closing a listener closes sessions its full backlog left waiting
+    Given I listen on "pool" ":9322" through a backend with 130 inbound sessions
+    When I close the listener
+    Then the backend should have closed all 130 inbound sessions
+
+  Scenario: Dialed connections share a device that closes with the last one
+    Given I listen on "pool" ":9315"
+    When 3 clients connect to "127.0.0.1:9315" through the device manager
+    Then the device manager should have 1 open device
+    When the clients close their connections
+    Then the device manager should have 0 open devices
+
+  Scenario: Dials spread over device shards
+    Given I listen on "pool" ":9316"
+    And a device manager with 2 shards
+    When 4 clients connect to "127.0.0.1:9316" through the device manager
+    Then the device manager should have 2 open devices
+    When the clients close their connections
+    Then the device manager should have 0 open devices
+
+  Scenario: Accepted connections outlive their listener
+    Given I listen on "pool" ":9317" through a device manager
+    And a client connects to "127.0.0.1:9317"
+    When I close the listener
+    And I write "still here"
+    Then the client should read "still here"
+    And the device manager should have 1 open device
+    When I close the connection
+    Then the device manager should have 0 open devices
+
   Scenario: Close channel
     Given I have a connected pool.Conn
     And I have an open channel 5
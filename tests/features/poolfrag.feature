@@ -0,0 +1,48 @@
+Feature: Message fragmentation and reassembly
+  As a developer sending large telemetry blobs
+  I want messages split into MTU-sized fragments and reassembled
+  So that messages larger than one packet cross the network intact
+
+  Scenario: A large message reassembles from shuffled fragments
+    Given a 60000-byte message split for a 1400-byte MTU
+    Then there should be 47 fragments of at most 1296 bytes
+    And the fragments should carry byte offsets and the message length
+    When the fragments arrive in random order with duplicates
+    Then the message should be reassembled exactly once
+    And the reassembler should hold no memory
+
+  Scenario: Messages longer than MaxPayload are rejected
+    When I split a 65536-byte message for a 1400-byte MTU
+    Then fragmentation should fail with "poolfrag: message too large"
+
+  Scenario: Messages needing more than MaxFrags fragments are rejected
+    When I split a 30000-byte message for a 200-byte MTU
+    Then fragmentation should fail with "poolfrag: message too large"
+
+  Scenario: Incomplete messages expire after FragTimeoutMS
+    Given a 5000-byte message split for a 1400-byte MTU
+    When all but the last fragment arrive
+    Then nothing should expire after 4999ms
+    And the message should expire after 5000ms
+    And the reassembler should hold no memory
+
+  Scenario: Reassembly memory is bounded
+    Given a reassembler limited to 4096 bytes
+    And a 5000-byte message split for a 1400-byte MTU
+    When all the fragments arrive
+    Then fragmentation should fail with "poolfrag: reassembly buffer full"
+    And the reassembler should hold no memory
+
+  Scenario: Fragments that disagree are rejected
+    Given a 5000-byte message split for a 1400-byte MTU
+    When the first fragment arrives
+    And a fragment claiming the message is 6000 bytes arrives
+    Then fragmentation should fail with "poolfrag: invalid fragment"
+    And the reassembler should hold no memory
+
+  Scenario: Overlapping fragments are rejected
+    Given a 5000-byte message split for a 1400-byte MTU
+    When the first fragment arrives
+    And a fragment overlapping it by 100 bytes arrives
+    Then fragmentation should fail with "poolfrag: invalid fragment"
+    And the reassembler should hold no memory
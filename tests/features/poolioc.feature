@@ -37,6 +37,10 @@ Feature: Low-level poolioc device operations
     And the peer echoes the data back
     Then I should receive "hello pool" on channel 0
 
+  Scenario: The fake backend does not follow raw buffer addresses
+    Given I have an established session
+    Then a send from a raw address should fail with EFAULT on the fake backend
+
   Scenario: List sessions
     Given I have an established session
     When I list sessions
@@ -48,6 +52,17 @@ Feature: Low-level poolioc device operations
     When I close the session
     Then the session should be removed from the list
 
+  Scenario: Close wakes a blocked receive
+    Given I have an established session
+    When a receive is waiting on channel 0
+    And I close the device
+    Then the waiting receive should fail with os.ErrClosed
+
+  Scenario: Close races ioctls in flight
+    Given I have an established session
+    When 8 goroutines list sessions while I close the device
+    Then every call should have succeeded or failed with os.ErrClosed
+
   Scenario: Subscribe to a channel
     Given I have an established session
     When I subscribe to channel 5
@@ -61,17 +76,57 @@ Feature: Low-level poolioc device operations
     When I list channels
     Then the bitmap should show channels 1, 3, and 7 as active
 
+  Scenario: Channel sets
+    Given I have an established session
+    And I subscribe to channels 1, 3, and 7
+    When I list channels
+    Then the channel set should be "{1,3,7}" with 3 channels
+    When I add channels 2 and 255 to the set and remove 7
+    Then the channel set should be "{1-3,255}" with 4 channels
+
   Scenario: Send large payload
     Given I have an established session
     When I send a 4000-byte payload
     And the peer echoes the data back
     Then I should receive a 4000-byte payload
 
+  Scenario: Session lifecycle events
+    Given I have an open POOL device
+    And a remote POOL peer is listening on "127.0.0.1:9266"
+    And I am watching device events
+    When I connect to "127.0.0.1:9266"
+    Then I should see an "ESTABLISHED" event
+    When the peer closes its session
+    Then I should see a "CLOSING" event
+    When I close the session
+    Then I should see a "CLOSED" event
+
+  Scenario Outline: Diff classifies session changes
+    Given a session in state "<from>" with rekey count <r1> and config version <c1>
+    When it changes to state "<to>" with rekey count <r2> and config version <c2>
+    Then Diff should report "<events>"
+
+    Examples:
+      | from        | r1 | c1 | to          | r2 | c2 | events                   |
+      | NONE        | 0  | 1  | ESTABLISHED | 0  | 1  | ESTABLISHED              |
+      | ESTABLISHED | 0  | 1  | REKEYING    | 0  | 1  | REKEYING                 |
+      | REKEYING    | 0  | 1  | ESTABLISHED | 1  | 1  | nothing                  |
+      | ESTABLISHED | 0  | 1  | ESTABLISHED | 1  | 1  | REKEYING                 |
+      | ESTABLISHED | 0  | 1  | ESTABLISHED | 0  | 2  | CONFIG_CHANGED           |
+      | ESTABLISHED | 0  | 1  | REKEYING    | 1  | 2  | REKEYING, CONFIG_CHANGED |
+      | ESTABLISHED | 0  | 1  | CLOSING     | 0  | 1  | CLOSING                  |
+      | CLOSING     | 0  | 1  | NONE        | 0  | 1  | CLOSED                   |
+
   Scenario: Connection refused
     Given I have an open POOL device
     When I connect to "192.0.2.1:9999"
     Then the connection should fail with a timeout or unreachable error
 
+  Scenario: The device is not given connect options the kernel module would ignore
+    Given I have an open POOL device
+    When I connect to "192.0.2.1:9999" with a 30-second heartbeat
+    Then the device should refuse the options with EOPNOTSUPP
+
   Scenario: IPv4-mapped helper functions
     When I convert "10.0.0.1" to an IPv4-mapped IPv6 address
     Then the result should be "::ffff:10.0.0.1"
@@ -0,0 +1,59 @@
+Feature: Stream multiplexing over a POOL session
+  As a developer writing a proxy
+  I want thousands of logical streams over one POOL channel
+  So that I am not limited to 256 channels per session
+
+  Scenario: Thousands of streams over one session
+    Given a multiplexed session on ":9298"
+    And the server echoes every stream
+    Then 2000 streams should each echo their own message
+    And no streams should remain open
+
+  Scenario: Streams over a channel
+    Given a multiplexed session on ":9299" over channel 9
+    And the server echoes every stream
+    Then 10 streams should each echo their own message
+
+  Scenario: A slow reader holds back only its own stream
+    Given a multiplexed session on ":9300"
+    When the client opens 2 streams
+    Then writing 1048576 bytes on client stream 1 with a 200ms deadline should stop after 262144 bytes
+    And client stream 2 should reach the server with "unblocked"
+    When server stream 1 reads 262144 bytes
+    Then writing 100000 bytes on client stream 1 should succeed
+
+  Scenario: Half-close ends the request but not the reply
+    Given a multiplexed session on ":9301"
+    When the client opens 1 stream
+    And client stream 1 sends "request" and closes its side
+    Then server stream 1 should read "request" and then EOF
+    When server stream 1 sends "response" and closes its side
+    Then client stream 1 should read "response" and then EOF
+    And no streams should remain open
+
+  Scenario: Reset aborts a stream on both sides
+    Given a multiplexed session on ":9302"
+    When the client opens 1 stream
+    And client stream 1 is reset
+    Then reading server stream 1 should fail with "poolmux: stream reset"
+    And writing client stream 1 should fail with "poolmux: stream reset"
+
+  Scenario: Stream deadlines
+    Given a multiplexed session on ":9303"
+    When the client opens 1 stream
+    Then a read on client stream 1 with a 50ms deadline should time out
+    When server stream 1 sends "late"
+    And client stream 1 clears its deadlines
+    Then client stream 1 should read "late"
+
+  Scenario: Closing a session ends its streams
+    Given a multiplexed session on ":9304"
+    When the client opens 1 stream
+    And the server closes the session
+    Then reading client stream 1 should fail with "poolmux: session closed"
+    And opening a stream should fail with "poolmux: session closed"
+
+  Scenario: A stream beyond the accept backlog is reset
+    Given a multiplexed session on ":9334" with an accept backlog of 1
+    When the client opens 2 streams the server does not accept
+    Then reading client stream 2 should fail with "poolmux: stream reset"
@@ -0,0 +1,127 @@
+Feature: Userspace POOL stack over UDP
+  As a developer without the POOL kernel module
+  I want to run POOL over a userspace UDP stack
+  So that pool.Dial and pool.Listen work unprivileged
+
+  Scenario: Dial and listen over the userspace stack
+    Given a userspace echo server on ":9270"
+    When I dial "127.0.0.1:9270" over the userspace stack
+    And I write "hello udp" over the userspace stack
+    Then I should read "hello udp" over the userspace stack
+    And the userspace session should be "ESTABLISHED" with a measured RTT
+
+  Scenario: Dial an IPv6 loopback peer
+    Given a userspace echo server on ":9271"
+    When I dial "[::1]:9271" over the userspace stack
+    And I write "hello v6" over the userspace stack
+    Then I should read "hello v6" over the userspace stack
+
+  Scenario: Messages arrive in order and intact
+    Given a userspace echo server on ":9272"
+    When I dial "127.0.0.1:9272" over the userspace stack
+    Then 500 numbered messages should echo back in order
+    And a 60000-byte message should echo back intact
+
+  Scenario: Messages larger than a packet are fragmented
+    Given a userspace echo server on ":9277"
+    When I dial "127.0.0.1:9277" over the userspace stack
+    Then a 65535-byte message should echo back intact
+    And the session should have sent at least 51 packets
+    And a 1304-byte message should echo back intact
+    And 20 numbered messages should echo back in order
+
+  Scenario: Messages report their sequence number and send time
+    Given a userspace echo server on ":9278"
+    When I dial "127.0.0.1:9278" over the userspace stack
+    And I write "first" over the userspace stack
+    And I write "second" over the userspace stack
+    Then reading messages should give "first" and "second" with increasing sequence numbers and send times
+
+  Scenario: Acknowledged writes are confirmed by the peer
+    Given a userspace echo server on ":9281"
+    When I dial "127.0.0.1:9281" over the userspace stack
+    And I pipeline 20 acknowledged writes over the userspace stack, the last 60000 bytes
+    Then every acknowledged write over the userspace stack should complete
+
+  Scenario: Acknowledged writes fail once the peer is gone
+    Given a userspace echo server on ":9282"
+    When I dial "127.0.0.1:9282" over the userspace stack
+    And the userspace server shuts down
+    Then an acknowledged write over the userspace stack should fail
+
+  Scenario: Channels a client opens are accepted by the server
+    Given a userspace server that echoes every channel on ":9297"
+    When I dial "127.0.0.1:9297" over the userspace stack
+    Then channels 2, 5 and 200 should echo "over udp" over the userspace stack
+
+  Scenario: Half-close over the userspace stack
+    Given a userspace server that counts bytes until io.EOF on ":9311"
+    When I dial "127.0.0.1:9311" over the userspace stack
+    And I write "a" over the userspace stack
+    And I write "bb" over the userspace stack
+    And I write "ccc" over the userspace stack
+    And I close the userspace connection for writing
+    Then I should read "6 bytes" over the userspace stack
+    And the userspace connection should read io.EOF
+
+  Scenario: A reader that falls behind on one channel holds up neither the others nor the session
+    Given a userspace server that accepts without reading on ":9319"
+    When I dial "127.0.0.1:9319" over the userspace stack
+    And I write 600 numbered messages on channel 1 over the userspace stack in the background
+    Then the writes on channel 1 should stall after 256 packets
+    And "still moving" written on channel 2 should reach the userspace server
+    And the userspace session should have lost no packets
+    And the userspace server should read the 600 messages on channel 1 in order
+
+  Scenario: Forged packets are ignored
+    Given a userspace echo server on ":9273"
+    When I dial "127.0.0.1:9273" over the userspace stack
+    And someone sends the server a DATA packet with a forged HMAC
+    And I write "still fine" over the userspace stack
+    Then I should read "still fine" over the userspace stack
+
+  Scenario: A flood of INITs cannot fill the session table
+    Given a userspace echo server on ":9320"
+    When someone sends the server 50 INITs
+    Then the server should hold at most 4 half-open sessions
+    When I dial "[::1]:9320" over the userspace stack
+    And I write "made it" over the userspace stack
+    Then I should read "made it" over the userspace stack
+
+  Scenario: Peer close reaches the other side
+    Given a userspace echo server on ":9274"
+    When I dial "127.0.0.1:9274" over the userspace stack
+    And I write "last words" over the userspace stack
+    And I close the userspace connection
+    Then the server should see the session closing
+
+  Scenario: Replayed heartbeats do not keep a silent peer's session open
+    Given a userspace echo server on ":9330"
+    When I dial the server through a relay on ":9331" with a 1s keepalive
+    And the relay cuts me off and replays my last heartbeat to the server
+    Then the server should see the session closing within 5s
+
+  Scenario: Dial times out when nobody answers
+    When I dial "127.0.0.1:9275" over the userspace stack with a 300ms timeout
+    Then the userspace dial should fail with a timeout error
+
+  Scenario: Acknowledged writes are compressed like any other
+    Given a userspace echo server on ":9332"
+    When I dial "127.0.0.1:9332" over the userspace stack
+    And I enable "zlib" compression over the userspace stack
+    And I write "hello" over the userspace stack
+    Then I should read "hello" over the userspace stack
+    And an acknowledged 20000-byte log message over the userspace stack should be sent compressed and echo back
+
+  Scenario: The userspace stack registers itself with poolioc
+    When I open the "udp" backend through poolioc
+    Then it should be a userspace stack
+    Given POOL_BACKEND is "udp"
+    Then opening a POOL device should fail for a backend that is not a device
+
+  Scenario: POOL_BACKEND=udp selects the userspace stack
+    Given POOL_BACKEND is "udp"
+    And a POOL echo server on ":9276"
+    When I dial "pool" "127.0.0.1:9276"
+    And I write "via env"
+    Then I should read "via env"
@@ -0,0 +1,47 @@
+Feature: POOL wire codec
+  As a developer writing POOL tooling
+  I want to encode and decode on-wire POOL structures
+  So that I can analyse captures and speak POOL from userspace
+
+  Scenario: Header round-trips through 80 bytes
+    Given a version 1 DATA header with seq 7, channel 3 and flags 0x0009
+    When I marshal the header
+    Then the encoding should be 80 bytes starting with 0x13
+    And unmarshalling it should give back the same header
+
+  Scenario: Header HMAC
+    Given a version 2 DATA header with seq 1, channel 0 and flags 0x0001
+    When I sign the header with key "secret"
+    Then the header should verify with key "secret"
+    And the header should not verify with key "other"
+    When I change the header sequence number to 2
+    Then the header should not verify with key "secret"
+
+  Scenario Outline: Invalid headers are rejected
+    Given a version <version> DATA header with seq 1, channel 0 and flags <flags>
+    When I marshal the header
+    Then marshalling should fail with "<error>"
+
+    Examples:
+      | version | flags  | error                         |
+      | 3       | 0x0000 | poolwire: unsupported version |
+      | 1       | 0x0400 | poolwire: invalid flags       |
+      | 1       | 0x0010 | poolwire: invalid flags       |
+
+  Scenario: Non-zero reserved bytes are rejected
+    Given a version 1 DATA header with seq 1, channel 0 and flags 0x0000
+    When I marshal the header
+    And I set encoded byte 47 to 0xff
+    Then unmarshalling it should fail with "poolwire: reserved field not zero"
+
+  Scenario: Fragment header and address use network byte order
+    When I marshal a fragment header with message 0x01020304, offset 1 and total 256
+    Then the encoding should be "01020304 0001 0100"
+    When I marshal an address with org 0x0a0b and node 1
+    Then the address should round-trip in 32 bytes
+
+  Scenario: Journal entries carry variable-length detail
+    Given journal entries with details "rekeyed" and ""
+    When I marshal them back to back
+    Then splitting the stream should give back both entries
+    And a stream cut short by 1 byte should fail with "poolwire: invalid length"
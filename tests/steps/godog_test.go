@@ -22,6 +22,10 @@ func TestFeatures(t *testing.T) {
 		ScenarioInitializer: func(ctx *godog.ScenarioContext) {
 			InitializePooliocScenario(ctx)
 			InitializePoolScenario(ctx)
+			InitializePoolwireScenario(ctx)
+			InitializePooludpScenario(ctx)
+			InitializePoolfragScenario(ctx)
+			InitializePoolmuxScenario(ctx)
 		},
 		Options: &opts,
 	}
@@ -3,19 +3,41 @@
 package steps
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"math/rand"
 	"net"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/amosdavis/pool-go/pool"
+	"github.com/amosdavis/pool-go/poolioc"
+	"github.com/amosdavis/pool-go/pooludp"
 	"github.com/cucumber/godog"
 )
 
+// fakeBackend reports whether the suite runs on the in-memory emulation
+// or the userspace UDP stack, where in-process peers stand in for a
+// remote POOL node.
+func fakeBackend() bool {
+	switch os.Getenv(poolioc.BackendEnv) {
+	case poolioc.BackendFake, pooludp.BackendName:
+		return true
+	}
+	return false
+}
+
 // deviceUnavailable returns true when /dev/pool is not present.
 func deviceUnavailable(err error) bool {
 	return errors.Is(err, syscall.ENOENT) || errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrPermission)
@@ -24,10 +46,153 @@ func deviceUnavailable(err error) bool {
 type poolContext struct {
 	listener *pool.Listener
 	conn     *pool.Conn
+	client   *pool.Conn // dialing side when conn was accepted
+	peer     *pool.Conn // accepting side when conn was dialed
 	addr     *pool.Addr
 	readBuf  []byte
 	err      error
 	chanConn net.Conn
+	backend  *countingBackend
+	resolver *stubResolver
+	lastIdx  uint32 // session index of the previously accepted conn
+	pending  []*pool.Conn
+	acks     []*pool.Ack
+	holding  *holdingBackend
+	device   *poolioc.Device // backend of the listener, when the scenario inspects it
+	reserved *pool.ChannelRange
+	alloced  []uint8 // channels allocated by the last step, in order
+	chans    map[uint8]*pool.ChannelConn
+	writes   chan error // results of writes started in the background
+	reads    chan error // result of a read started in the background
+	sent     [][]byte   // messages the client wrote, in order
+	events   <-chan poolioc.Event
+	unwatch  context.CancelFunc
+	devices  *pool.DeviceManager
+	crowded  *crowdedBackend
+}
+
+// countingBackend wraps a poolioc.Backend and counts sends, standing in
+// for an application that instruments the device layer.
+type countingBackend struct {
+	poolioc.Backend
+	sends   atomic.Int64
+	connect poolioc.ConnectReq
+	control bool
+}
+
+func (b *countingBackend) Connect(req poolioc.ConnectReq) (int, error) {
+	b.connect = req
+	return b.Backend.Connect(req)
+}
+
+func (b *countingBackend) SendBytes(idx uint32, ch uint8, data []byte) error {
+	b.sends.Add(1)
+	return b.Backend.SendBytes(idx, ch, data)
+}
+
+// holdingBackend wraps a poolioc.MessageBackend and holds every send
+// until released, recording the channel and flags of each in the order
+// they reach the backend.
+type holdingBackend struct {
+	poolioc.MessageBackend
+	release chan struct{}
+
+	mu   sync.Mutex
+	sent []heldSend
+}
+
+type heldSend struct {
+	channel, flags uint8
+}
+
+func (b *holdingBackend) SendMsg(ctx context.Context, idx uint32, ch uint8, flags uint8, data []byte) error {
+	select {
+	case <-b.release:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	b.mu.Lock()
+	b.sent = append(b.sent, heldSend{ch, flags})
+	b.mu.Unlock()
+	return b.MessageBackend.SendMsg(ctx, idx, ch, flags, data)
+}
+
+// crowdedBackend is a Backend whose session table fills with more
+// established inbound sessions than a Listener queues once it listens,
+// and records the sessions closed. Its other methods are not used.
+type crowdedBackend struct {
+	poolioc.Backend
+	inbound int
+
+	mu        sync.Mutex
+	listening bool
+	closed    map[uint32]bool
+}
+
+func (b *crowdedBackend) Listen(uint16) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.listening = true
+	return nil
+}
+
+func (b *crowdedBackend) Stop() error { return nil }
+
+func (b *crowdedBackend) Sessions() ([]poolioc.SessionInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.listening {
+		return nil, nil
+	}
+	var sessions []poolioc.SessionInfo
+	for i := 0; i < b.inbound; i++ {
+		if b.closed[uint32(i)] {
+			continue
+		}
+		s := poolioc.SessionInfo{Index: uint32(i), State: poolioc.StateEstablished}
+		binary.BigEndian.PutUint32(s.SessionID[:], uint32(i)+1)
+		sessions = append(sessions, s)
+	}
+	return sessions, nil
+}
+
+func (b *crowdedBackend) CloseSession(idx uint32) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed[idx] = true
+	return nil
+}
+
+// oversizedBackend is a Device that receives one message of size
+// bytes on channel ch before anything the peer sends, as a backend
+// with a larger maximum message size than the demultiplexer would.
+type oversizedBackend struct {
+	*poolioc.Device
+	ch   uint8
+	size int
+	done atomic.Bool
+}
+
+func (b *oversizedBackend) RecvAny(ctx context.Context, idx uint32, buf []byte) (poolioc.MsgInfo, error) {
+	if len(buf) == 0 || b.done.Load() {
+		return b.Device.RecvAny(ctx, idx, buf)
+	}
+	info := poolioc.MsgInfo{Len: b.size, Channel: b.ch}
+	if len(buf) < b.size {
+		return info, syscall.EMSGSIZE
+	}
+	b.done.Store(true)
+	return info, nil
+}
+
+// goneBackend is a Device on which receives fail with ENOTCONN, as they
+// do on the kernel module once a session has ended.
+type goneBackend struct {
+	*poolioc.Device
+}
+
+func (b goneBackend) RecvMsg(context.Context, uint32, uint8, []byte) (poolioc.MsgInfo, error) {
+	return poolioc.MsgInfo{}, syscall.ENOTCONN
 }
 
 func InitializePoolScenario(ctx *godog.ScenarioContext) {
@@ -40,9 +205,36 @@ func InitializePoolScenario(ctx *godog.ScenarioContext) {
 		if pc.conn != nil {
 			_ = pc.conn.Close()
 		}
+		if pc.client != nil {
+			_ = pc.client.Close()
+		}
+		if pc.peer != nil {
+			_ = pc.peer.Close()
+		}
+		if pc.unwatch != nil {
+			pc.unwatch()
+		}
+		for _, c := range pc.pending {
+			_ = c.Close()
+		}
 		if pc.listener != nil {
 			_ = pc.listener.Close()
 		}
+		if pc.resolver != nil {
+			_ = pc.resolver.Close()
+		}
+		if pc.backend != nil {
+			_ = pc.backend.Backend.(*poolioc.Device).Close()
+		}
+		for _, cc := range pc.chans {
+			_ = cc.Close()
+		}
+		if pc.holding != nil {
+			_ = pc.holding.MessageBackend.(*poolioc.Device).Close()
+		}
+		if pc.device != nil {
+			_ = pc.device.Close()
+		}
 		return scenarioCtx, nil
 	})
 
@@ -52,9 +244,39 @@ func InitializePoolScenario(ctx *godog.ScenarioContext) {
 	ctx.Step(`^I should read "([^"]*)"$`, pc.shouldRead)
 	ctx.Step(`^I dial "([^"]*)" "([^"]*)" with a (\d+) second timeout$`, pc.dialTimeout)
 	ctx.Step(`^the dial should fail with a timeout error$`, pc.dialTimedOut)
+	ctx.Step(`^I dial "([^"]*)" through an instrumented backend$`, pc.dialBackend)
+	ctx.Step(`^I dial "([^"]*)" through an instrumented backend with PQC, raw transport and a (\d+)s keepalive$`, pc.dialOptions)
+	ctx.Step(`^the backend should have seen version (\d+), transport (\d+) and heartbeat (\d+)$`, pc.backendOptions)
+	ctx.Step(`^the Control hook should have run$`, pc.controlRan)
+	ctx.Step(`^a resolver that maps "([^"]*)" to "([^"]*)" and "([^"]*)"$`, pc.stubResolver)
+	ctx.Step(`^I dial "([^"]*)" "([^"]*)" with that resolver$`, pc.dialResolver)
+	ctx.Step(`^I resolve "([^"]*)" "([^"]*)" expecting an error$`, pc.resolveErr)
+	ctx.Step(`^I dial "([^"]*)" with local address "([^"]*)"$`, pc.dialLocal)
+	ctx.Step(`^the dial should be unsupported$`, pc.dialUnsupported)
+	ctx.Step(`^the dial should have succeeded$`, pc.dialSucceeded)
+	ctx.Step(`^the instrumented backend should have counted (\d+) sends?$`, pc.backendSends)
 	ctx.Step(`^I listen on "([^"]*)" "([^"]*)"$`, pc.listenOn)
+	ctx.Step(`^I watch sessions on an instrumented backend$`, pc.watchBackend)
+	ctx.Step(`^watching sessions without a backend should be invalid$`, pc.watchNilInvalid)
+	ctx.Step(`^the backend closes the session behind the connection's back$`, pc.backendClosesSession)
+	ctx.Step(`^Telemetry, SessionInfo, OpenChannel and Channels should fail with an OpError$`, pc.sessionOpErrors)
+	ctx.Step(`^I dial "([^"]*)" through the watched backend$`, pc.dialWatched)
+	ctx.Step(`^Watch should report an? "([^"]*)" event$`, pc.watchReports)
+	ctx.Step(`^I accept with a (\d+)ms context timeout$`, pc.acceptContext)
+	ctx.Step(`^I dial "([^"]*)" with a canceled context$`, pc.dialCanceled)
+	ctx.Step(`^I read with a context canceled after (\d+)ms$`, pc.readCanceled)
+	ctx.Step(`^the operation should fail with "([^"]*)"$`, pc.failedWith)
+	ctx.Step(`^the operation should fail with an error containing "([^"]*)"$`, pc.failedContaining)
 	ctx.Step(`^a client connects to "([^"]*)"$`, pc.clientConnects)
 	ctx.Step(`^Accept should return a connection$`, pc.acceptReturns)
+	ctx.Step(`^both sides close the connection$`, pc.closeBoth)
+	ctx.Step(`^a client connects to "([^"]*)" and is accepted within (\d+)ms$`, pc.acceptedWithin)
+	ctx.Step(`^a client connects to "([^"]*)" through my own device$`, pc.clientConnectsOwnDevice)
+	ctx.Step(`^the accepted connection should be the client's peer$`, pc.acceptedPeer)
+	ctx.Step(`^no further connection should be accepted within (\d+)ms$`, pc.noFurtherAccept)
+	ctx.Step(`^the accepted session should reuse the previous index$`, pc.reusedIndex)
+	ctx.Step(`^(\d+) clients connect to "([^"]*)"$`, pc.clientsConnect)
+	ctx.Step(`^Accept should return (\d+) connections$`, pc.acceptN)
 	ctx.Step(`^the remote address should be "([^"]*)"$`, pc.remoteIs)
 	ctx.Step(`^I have a connected pool\.Conn$`, pc.haveConn)
 	ctx.Step(`^it should implement net\.Conn$`, pc.implNetConn)
@@ -64,6 +286,9 @@ func InitializePoolScenario(ctx *godog.ScenarioContext) {
 	ctx.Step(`^Read should return a timeout error$`, pc.readTimeout)
 	ctx.Step(`^I set a write deadline (\d+)ms in the past$`, pc.pastWriteDeadline)
 	ctx.Step(`^Write should return a timeout error$`, pc.writeTimeout)
+	ctx.Step(`^I read with a (\d+)ms read deadline$`, pc.readWithDeadline)
+	ctx.Step(`^the read should time out without writing to the buffer$`, pc.readTimedOutCleanly)
+	ctx.Step(`^I clear the read deadline$`, pc.clearReadDeadline)
 	ctx.Step(`^I close the connection$`, pc.closeConn)
 	ctx.Step(`^subsequent writes should return ErrClosed$`, pc.writeAfterClose)
 	ctx.Step(`^subsequent reads should return ErrClosed$`, pc.readAfterClose)
@@ -72,6 +297,116 @@ func InitializePoolScenario(ctx *godog.ScenarioContext) {
 	ctx.Step(`^I query the session state$`, pc.queryState)
 	ctx.Step(`^it should be "([^"]*)"$`, pc.stateIs)
 	ctx.Step(`^I open channel (\d+)$`, pc.openChannel)
+	ctx.Step(`^reading (\d+) bytes at a time should give "([^"]*)"$`, pc.smallReads)
+	ctx.Step(`^io\.ReadFull of (\d+) bytes should give "([^"]*)"$`, pc.readFull)
+	ctx.Step(`^I write the lines "([^"]*)" and "([^"]*)"$`, pc.writeLines)
+	ctx.Step(`^a (\d+)-byte bufio\.Reader should read the lines "([^"]*)" and "([^"]*)"$`, pc.bufioLines)
+	ctx.Step(`^the connection is in message mode$`, pc.messageMode)
+	ctx.Step(`^a (\d+)-byte read should fail with ErrBufferTooSmall$`, pc.readTooSmall)
+	ctx.Step(`^the client writes the message "([^"]*)" with flags (0x[0-9a-fA-F]+)$`, pc.clientWritesMsg)
+	ctx.Step(`^I should read the message "([^"]*)" on channel (\d+) with flags (0x[0-9a-fA-F]+) set$`, pc.readMsgFlags)
+	ctx.Step(`^writing a message with flags (0x[0-9a-fA-F]+) should be unsupported$`, pc.flagsUnsupported)
+	ctx.Step(`^no acknowledged write should complete before I read it$`, pc.acksPending)
+	ctx.Step(`^I read back the (\d+) pipelined writes$`, pc.readPipelined)
+	ctx.Step(`^an acknowledged write of "([^"]*)" should complete once I read it with flags (0x[0-9a-fA-F]+) set$`, pc.ackedOnRead)
+	ctx.Step(`^the client pipelines (\d+) acknowledged writes$`, pc.clientPipelines)
+	ctx.Step(`^every acknowledged write should complete$`, pc.acksComplete)
+	ctx.Step(`^an acknowledged write should be unsupported$`, pc.ackUnsupported)
+	ctx.Step(`^I dial "([^"]*)" through a backend that holds sends$`, pc.dialHolding)
+	ctx.Step(`^channel (\d+) is set to "([^"]*)" priority and channel (\d+) to "([^"]*)"$`, pc.channelPriorities)
+	ctx.Step(`^(\d+) writes on channel (\d+) and then (\d+) writes on channel (\d+) are waiting$`, pc.writesWaiting)
+	ctx.Step(`^the backend releases the sends$`, pc.releaseSends)
+	ctx.Step(`^the sends should go to channels ([\d, ]+)$`, pc.sendOrder)
+	ctx.Step(`^only the channel (\d+) sends should carry FlagPriority$`, pc.onlyPriority)
+	ctx.Step(`^channel (\d+) should report (\d+) waits and channel (\d+) should report (\d+) waits$`, pc.channelWaits)
+	ctx.Step(`^channel (\d+) fills the client's queue and a further write on it stalls$`, pc.stallChannel)
+	ctx.Step(`^a write on channel (\d+) should succeed within (\d+)ms$`, pc.channelWriteWithin)
+	ctx.Step(`^the stalled write should complete once the client reads channel (\d+)$`, pc.stalledWriteCompletes)
+	ctx.Step(`^the client's channel is set to "([^"]*)" priority$`, pc.clientPriority)
+	ctx.Step(`^the client enables "([^"]*)" compression$`, pc.clientCompression)
+	ctx.Step(`^I enable "([^"]*)" compression$`, pc.enableCompression)
+	ctx.Step(`^the client writes "([^"]*)"$`, pc.clientWrites)
+	ctx.Step(`^the client writes a (\d+)-byte log message$`, pc.clientWritesLog)
+	ctx.Step(`^a (\d+)-byte log message written by the client after its write deadline should time out$`, pc.clientLogTimesOut)
+	ctx.Step(`^the client writes (\d+) random bytes$`, pc.clientWritesRandom)
+	ctx.Step(`^I should read back what the client wrote$`, pc.readBackSent)
+	ctx.Step(`^the client should have compressed (\d+) messages? and skipped (\d+) with a ratio below ([\d.]+)$`, pc.clientCompressed)
+	ctx.Step(`^I should have decompressed (\d+) messages?$`, pc.decompressed)
+	ctx.Step(`^the client should read "([^"]*)" and then use "([^"]*)" compression$`, pc.clientAdopts)
+	ctx.Step(`^the client should have compressed (\d+) messages? and skipped (\d+)$`, pc.clientCompressedNone)
+	ctx.Step(`^the client demultiplexes its channels$`, pc.clientDemux)
+	ctx.Step(`^the client should agree on "([^"]*)" compression$`, pc.clientAgrees)
+	ctx.Step(`^enabling compression should be unsupported$`, pc.compressionUnsupported)
+	ctx.Step(`^I open channels (\d+) and (\d+)$`, pc.openChannels)
+	ctx.Step(`^channel (\d+) has a read deadline (\d+)ms from now$`, pc.channelReadDeadline)
+	ctx.Step(`^channel (\d+) has a write deadline in the past$`, pc.channelPastWriteDeadline)
+	ctx.Step(`^channel (\d+) clears its deadlines$`, pc.channelClearsDeadlines)
+	ctx.Step(`^the client writes "([^"]*)" on channel (\d+) after (\d+)ms$`, pc.clientWritesChannelLater)
+	ctx.Step(`^reading on channel (\d+) should time out$`, pc.channelReadTimesOut)
+	ctx.Step(`^channel (\d+) should read "([^"]*)"$`, pc.channelReads)
+	ctx.Step(`^writing on channel (\d+) should time out$`, pc.channelWriteTimesOut)
+	ctx.Step(`^writing on channel (\d+) should succeed$`, pc.channelWriteSucceeds)
+	ctx.Step(`^I listen on "([^"]*)" "([^"]*)" through my own device$`, pc.listenOwnDevice)
+	ctx.Step(`^I listen on "([^"]*)" "([^"]*)" through a backend that receives an oversized message on channel (\d+)$`, pc.listenOversized)
+	ctx.Step(`^I listen on "([^"]*)" "([^"]*)" through a backend whose sessions are gone$`, pc.listenGone)
+	ctx.Step(`^reading should fail with a read OpError wrapping ENOTCONN$`, pc.readNotConn)
+	ctx.Step(`^reading on channel (\d+) should fail with (ErrChannelOverflow|ErrMessageTooLarge)$`, pc.channelReadFails)
+	ctx.Step(`^I demultiplex channels with a queue of (\d+) messages$`, pc.demuxQueue)
+	ctx.Step(`^I demultiplex channels with auto-subscribe$`, pc.demuxAutoSubscribe)
+	ctx.Step(`^the client writes "([^"]*)" on channel (\d+)$`, pc.clientWritesChannel)
+	ctx.Step(`^I should accept channel (\d+)$`, pc.acceptChannel)
+	ctx.Step(`^channel (\d+) should( not)? be subscribed$`, pc.channelSubscribed)
+	ctx.Step(`^demultiplexing should be unsupported$`, pc.demuxUnsupported)
+	ctx.Step(`^channel (\d+) is closed$`, pc.channelClosed)
+	ctx.Step(`^the client writes "([^"]*)" and closes its side for writing$`, pc.clientWritesAndCloses)
+	ctx.Step(`^the client writes "([^"]*)" and closes its side for writing with reason (0x[0-9a-fA-F]+)$`, pc.clientWritesAndClosesReason)
+	ctx.Step(`^io\.Copy should read "([^"]*)" until io\.EOF$`, pc.copyUntilEOF)
+	ctx.Step(`^reads should keep returning io\.EOF$`, pc.readsEOF)
+	ctx.Step(`^the client's writes should fail with ErrWriteClosed$`, pc.clientWriteClosed)
+	ctx.Step(`^the client should read "([^"]*)"$`, pc.clientReads)
+	ctx.Step(`^reading should fail with the peer's reason (0x[0-9a-fA-F]+)$`, pc.readFailsReason)
+	ctx.Step(`^the client closes the connection$`, pc.clientCloses)
+	ctx.Step(`^the client writes "([^"]*)" on channel (\d+) and closes it for writing$`, pc.clientWritesChannelAndCloses)
+	ctx.Step(`^channel (\d+) should read io\.EOF$`, pc.channelReadsEOF)
+	ctx.Step(`^a read is waiting$`, pc.readWaiting)
+	ctx.Step(`^I close my side for reading$`, pc.closeRead)
+	ctx.Step(`^the waiting read should return io\.EOF$`, pc.waitingReadEOF)
+	ctx.Step(`^I close my device$`, pc.closeDevice)
+	ctx.Step(`^I listen on "([^"]*)" "([^"]*)" through a device manager$`, pc.listenManaged)
+	ctx.Step(`^a device manager with (\d+) shards$`, pc.managerShards)
+	ctx.Step(`^(\d+) clients connect to "([^"]*)" through the device manager$`, pc.clientsConnectManaged)
+	ctx.Step(`^the device manager should have (\d+) open devices?$`, pc.managerDevices)
+	ctx.Step(`^the clients close their connections$`, pc.closePending)
+	ctx.Step(`^I close the listener$`, pc.closeListener)
+	ctx.Step(`^I listen on "([^"]*)" "([^"]*)" through a backend with (\d+) inbound sessions$`, pc.listenCrowded)
+	ctx.Step(`^the backend should have closed all (\d+) inbound sessions$`, pc.crowdedClosed)
+	ctx.Step(`^the waiting read should return ErrClosed$`, pc.waitingReadClosed)
+	ctx.Step(`^closing for writing should be unsupported$`, pc.closeWriteUnsupported)
+	ctx.Step(`^I dial "([^"]*)" with nothing listening$`, pc.dialRefused)
+	ctx.Step(`^the error should be a dial OpError for "([^"]*)" caused by ECONNREFUSED$`, pc.dialOpError)
+	ctx.Step(`^the error should be a dial OpError for "([^"]*)" caused by "([^"]*)"$`, pc.dialOpErrorCause)
+	ctx.Step(`^I dial "([^"]*)" with a Control hook that fails with "([^"]*)"$`, pc.dialControlFails)
+	ctx.Step(`^an OpError for "([^"]*)" on "([^"]*)" without a cause should say "([^"]*)"$`, opErrorWithoutCause)
+	ctx.Step(`^a nil OpError should say "([^"]*)"$`, nilOpError)
+	ctx.Step(`^the error should match (Err\w+) and not (Err\w+)$`, pc.errorMatches)
+	ctx.Step(`^reading should fail with a read OpError on my session$`, pc.readOpError)
+	ctx.Step(`^the error should be a timeout matching ErrTimeout$`, pc.opErrorTimeout)
+	ctx.Step(`^I allocate (\d+) channels?( from the reserved range)?$`, pc.allocateChannels)
+	ctx.Step(`^(\d+) goroutines allocate a channel each$`, pc.allocateConcurrently)
+	ctx.Step(`^the allocated channels should be ([\d, and]+)$`, pc.allocatedAre)
+	ctx.Step(`^the allocated channels should all differ$`, pc.allocatedDiffer)
+	ctx.Step(`^I reserve channels (\d+) to (\d+)$`, pc.reserveChannels)
+	ctx.Step(`^reserving channels (\d+) to (\d+) should fail with ErrChannelsReserved$`, pc.reserveFails)
+	ctx.Step(`^allocating a channel should fail with ErrNoFreeChannel$`, pc.allocateFails)
+	ctx.Step(`^the client writes the message "([^"]*)" with priority "([^"]*)"$`, pc.clientWritesPriority)
+	ctx.Step(`^I write messages of ([\d, and]+) bytes$`, pc.writeMessages)
+	ctx.Step(`^I should read back messages of ([\d, and]+) bytes$`, pc.readMessages)
+	ctx.Step(`^I limit messages to (\d+) bytes$`, pc.limitMessages)
+	ctx.Step(`^reading a message should fail with ErrMessageTooLarge$`, pc.readMessageTooLarge)
+	ctx.Step(`^writing a (\d+)-byte message should fail with ErrMessageTooLarge$`, pc.writeMessageTooLarge)
+	ctx.Step(`^the peer relays a message on channel (\d+)$`, pc.peerRelaysChannel)
+	ctx.Step(`^I write a (\d+)-byte message on channel (\d+)$`, pc.writeChannelMessage)
+	ctx.Step(`^I should read back the (\d+)-byte message on channel (\d+)$`, pc.readChannelMessage)
 	ctx.Step(`^I write "([^"]*)" on channel (\d+)$`, pc.writeChannel)
 	ctx.Step(`^the peer echoes on channel (\d+)$`, pc.peerEchoesChannel)
 	ctx.Step(`^I should read "([^"]*)" on channel (\d+)$`, pc.readChannel)
@@ -89,7 +424,44 @@ func InitializePoolScenario(ctx *godog.ScenarioContext) {
 }
 
 func (pc *poolContext) echoServer(addr string) error {
-	return godog.ErrPending
+	if !fakeBackend() {
+		return godog.ErrPending
+	}
+	ln, err := pool.Listen("pool", addr)
+	if err != nil {
+		return err
+	}
+	pc.listener = ln
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go echo(conn)
+		}
+	}()
+	return nil
+}
+
+// echo writes every message read from conn back to it until an error.
+func echo(conn net.Conn) {
+	echoUpTo(conn, poolioc.MaxPayload)
+}
+
+// echoUpTo echoes messages of up to size bytes until conn fails.
+func echoUpTo(conn net.Conn, size int) {
+	defer conn.Close()
+	buf := make([]byte, size)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write(buf[:n]); err != nil {
+			return
+		}
+	}
 }
 
 func (pc *poolContext) dial(network, address string) error {
@@ -136,173 +508,1886 @@ func (pc *poolContext) dialTimedOut() error {
 	return nil
 }
 
-func (pc *poolContext) listenOn(network, address string) error {
-	ln, err := pool.Listen(network, address)
+func (pc *poolContext) dialBackend(address string) error {
+	dev, err := poolioc.Open()
 	if err != nil {
 		if deviceUnavailable(err) {
 			return godog.ErrPending
 		}
 		return err
 	}
-	pc.listener = ln
+	pc.backend = &countingBackend{Backend: dev}
+	d := pool.Dialer{Backend: pc.backend}
+	conn, err := d.Dial("pool", address)
+	if err != nil {
+		return err
+	}
+	pc.conn = conn.(*pool.Conn)
 	return nil
 }
 
-func (pc *poolContext) clientConnects(_ string) error {
-	return godog.ErrPending
+func (pc *poolContext) watchBackend() error {
+	dev, err := poolioc.Open()
+	if err != nil {
+		if deviceUnavailable(err) {
+			return godog.ErrPending
+		}
+		return err
+	}
+	// countingBackend hides the Device's own event stream, so Watch
+	// falls back to polling the session table.
+	pc.backend = &countingBackend{Backend: dev}
+	ctx, cancel := context.WithCancel(context.Background())
+	pc.events, err = pool.Watch(ctx, pc.backend)
+	if err != nil {
+		cancel()
+		return err
+	}
+	pc.unwatch = cancel
+	return nil
 }
 
-func (pc *poolContext) acceptReturns() error {
-	if pc.conn == nil {
-		return fmt.Errorf("no connection accepted")
+func (pc *poolContext) watchNilInvalid() error {
+	_, err := pool.Watch(context.Background(), nil)
+	if !errors.Is(err, os.ErrInvalid) {
+		return fmt.Errorf("expected os.ErrInvalid, got %v", err)
 	}
 	return nil
 }
 
-func (pc *poolContext) remoteIs(expected string) error {
-	if pc.conn == nil {
-		return fmt.Errorf("no connection")
+func (pc *poolContext) backendClosesSession() error {
+	return pc.backend.CloseSession(pc.conn.SessionIndex())
+}
+
+func (pc *poolContext) sessionOpErrors() error {
+	_, telemErr := pc.conn.Telemetry()
+	_, infoErr := pc.conn.SessionInfo()
+	_, openErr := pc.conn.OpenChannel(5)
+	_, listErr := pc.conn.Channels()
+	for _, c := range []struct {
+		method string
+		err    error
+	}{
+		{"Telemetry", telemErr},
+		{"SessionInfo", infoErr},
+		{"OpenChannel", openErr},
+		{"Channels", listErr},
+	} {
+		var op *pool.OpError
+		if !errors.As(c.err, &op) {
+			return fmt.Errorf("%s: expected an *OpError, got %v", c.method, c.err)
+		}
+		if op.Session != int(pc.conn.SessionIndex()) {
+			return fmt.Errorf("%s: OpError for session %d, want %d", c.method, op.Session, pc.conn.SessionIndex())
+		}
 	}
-	addr := pc.conn.RemoteAddr().String()
-	host, _, _ := net.SplitHostPort(addr)
-	if host != expected {
-		return fmt.Errorf("expected remote %s, got %s", expected, host)
+	return nil
+}
+
+func (pc *poolContext) dialWatched(address string) error {
+	d := pool.Dialer{Backend: pc.backend}
+	conn, err := d.Dial("pool", address)
+	if err != nil {
+		return err
 	}
+	pc.conn = conn.(*pool.Conn)
 	return nil
 }
 
-func (pc *poolContext) haveConn() error {
-	return godog.ErrPending
+func (pc *poolContext) watchReports(want string) error {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case ev, ok := <-pc.events:
+			if !ok {
+				return fmt.Errorf("event stream ended before %s", want)
+			}
+			if ev.Type.String() == want {
+				return nil
+			}
+		case <-timeout:
+			return fmt.Errorf("no %s event", want)
+		}
+	}
 }
 
-func (pc *poolContext) implNetConn() error {
-	var _ net.Conn = pc.conn
+func (pc *poolContext) dialOptions(address string, keepAlive int) error {
+	dev, err := poolioc.Open()
+	if err != nil {
+		if deviceUnavailable(err) {
+			return godog.ErrPending
+		}
+		return err
+	}
+	pc.backend = &countingBackend{Backend: dev}
+	d := pool.Dialer{
+		Backend:   pc.backend,
+		Version:   poolioc.VersionPQC,
+		Transport: poolioc.TransportRaw,
+		KeepAlive: time.Duration(keepAlive) * time.Second,
+		Control: func(_, _ string, dev poolioc.Backend) error {
+			dev.(*countingBackend).control = true
+			return nil
+		},
+	}
+	// A Device cannot be given the options, so the dial fails once
+	// they reach it.
+	_, pc.err = d.Dial("pool", address)
 	return nil
 }
 
-func (pc *poolContext) localAddrPool() error {
-	addr := pc.conn.LocalAddr()
-	if addr.Network() != "pool" {
-		return fmt.Errorf("expected network pool, got %s", addr.Network())
+func (pc *poolContext) backendOptions(version, transport, heartbeat int) error {
+	req := pc.backend.connect
+	if int(req.Version) != version || int(req.Transport) != transport || int(req.HeartbeatSec) != heartbeat {
+		return fmt.Errorf("unexpected connect request: version %d, transport %d, heartbeat %d",
+			req.Version, req.Transport, req.HeartbeatSec)
 	}
 	return nil
 }
 
-func (pc *poolContext) remoteAddrPool() error {
-	addr := pc.conn.RemoteAddr()
-	if addr.Network() != "pool" {
-		return fmt.Errorf("expected network pool, got %s", addr.Network())
+func (pc *poolContext) controlRan() error {
+	if !pc.backend.control {
+		return fmt.Errorf("Control hook was not called")
 	}
 	return nil
 }
 
-func (pc *poolContext) pastReadDeadline(ms int) error {
-	return pc.conn.SetReadDeadline(time.Now().Add(-time.Duration(ms) * time.Millisecond))
+func (pc *poolContext) stubResolver(host, a, b string) error {
+	r, err := newStubResolver(map[string][]net.IP{
+		host: {net.ParseIP(a), net.ParseIP(b)},
+	})
+	if err != nil {
+		return err
+	}
+	pc.resolver = r
+	return nil
 }
 
-func (pc *poolContext) readTimeout() error {
-	buf := make([]byte, 1)
-	_, err := pc.conn.Read(buf)
-	if err == nil {
-		return fmt.Errorf("expected timeout error, got nil")
+func (pc *poolContext) dialResolver(network, address string) error {
+	d := pool.Dialer{Resolver: pc.resolver.Resolver(), Timeout: 5 * time.Second}
+	conn, err := d.Dial(network, address)
+	if err != nil {
+		return err
 	}
-	if ne, ok := err.(net.Error); ok && ne.Timeout() {
-		return nil
+	pc.conn = conn.(*pool.Conn)
+	return nil
+}
+
+func (pc *poolContext) resolveErr(network, address string) error {
+	_, pc.err = pool.Resolve(network, address)
+	return nil
+}
+
+func (pc *poolContext) dialLocal(address, local string) error {
+	d := pool.Dialer{LocalAddr: &pool.Addr{IP: net.ParseIP(local)}}
+	var conn net.Conn
+	conn, pc.err = d.Dial("pool", address)
+	if pc.err == nil {
+		pc.conn = conn.(*pool.Conn)
 	}
-	return nil // Any error is acceptable for past deadlines
+	return nil
 }
 
-func (pc *poolContext) pastWriteDeadline(ms int) error {
-	return pc.conn.SetWriteDeadline(time.Now().Add(-time.Duration(ms) * time.Millisecond))
+func (pc *poolContext) dialUnsupported() error {
+	if !errors.Is(pc.err, errors.ErrUnsupported) {
+		return fmt.Errorf("expected errors.ErrUnsupported, got %v", pc.err)
+	}
+	return nil
 }
 
-func (pc *poolContext) writeTimeout() error {
-	_, err := pc.conn.Write([]byte("test"))
-	if err == nil {
-		return fmt.Errorf("expected timeout error, got nil")
+func (pc *poolContext) dialSucceeded() error {
+	return pc.err
+}
+
+func (pc *poolContext) backendSends(want int) error {
+	if got := pc.backend.sends.Load(); got != int64(want) {
+		return fmt.Errorf("expected %d sends, got %d", want, got)
 	}
 	return nil
 }
 
-func (pc *poolContext) closeConn() error {
-	err := pc.conn.Close()
-	return err
+func (pc *poolContext) listenOn(network, address string) error {
+	ln, err := pool.Listen(network, address)
+	if err != nil {
+		if deviceUnavailable(err) {
+			return godog.ErrPending
+		}
+		return err
+	}
+	pc.listener = ln
+	return nil
 }
 
-func (pc *poolContext) writeAfterClose() error {
-	_, err := pc.conn.Write([]byte("test"))
-	if err != pool.ErrClosed {
-		return fmt.Errorf("expected ErrClosed, got %v", err)
+func (pc *poolContext) acceptContext(ms int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(ms)*time.Millisecond)
+	defer cancel()
+	_, pc.err = pc.listener.AcceptContext(ctx)
+	return nil
+}
+
+func (pc *poolContext) dialCanceled(address string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var d pool.Dialer
+	_, pc.err = d.DialContext(ctx, "pool", address)
+	return nil
+}
+
+func (pc *poolContext) readCanceled(ms int) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Duration(ms)*time.Millisecond, cancel)
+	_, pc.err = pc.conn.ReadContext(ctx, make([]byte, 64))
+	return nil
+}
+
+func (pc *poolContext) failedWith(msg string) error {
+	if pc.err == nil || pc.err.Error() != msg {
+		return fmt.Errorf("expected error %q, got %v", msg, pc.err)
 	}
 	return nil
 }
 
-func (pc *poolContext) readAfterClose() error {
-	buf := make([]byte, 1)
-	_, err := pc.conn.Read(buf)
-	if err != pool.ErrClosed {
-		return fmt.Errorf("expected ErrClosed, got %v", err)
+func (pc *poolContext) failedContaining(msg string) error {
+	if pc.err == nil || !strings.Contains(pc.err.Error(), msg) {
+		return fmt.Errorf("expected error containing %q, got %v", msg, pc.err)
 	}
 	return nil
 }
 
-func (pc *poolContext) requestTelemetry() error {
-	_, err := pc.conn.Telemetry()
-	return err
+func (pc *poolContext) clientConnects(address string) error {
+	if !fakeBackend() {
+		return godog.ErrPending
+	}
+	client, err := pool.Dial("pool", address)
+	if err != nil {
+		return err
+	}
+	pc.client = client
+	conn, err := pc.listener.Accept()
+	if err != nil {
+		return err
+	}
+	pc.conn = conn.(*pool.Conn)
+	return nil
 }
 
-func (pc *poolContext) telemetryValues() error {
-	t, err := pc.conn.Telemetry()
+func (pc *poolContext) clientConnectsOwnDevice(address string) error {
+	d := pool.Dialer{Backend: pc.device}
+	client, err := d.Dial("pool", address)
 	if err != nil {
 		return err
 	}
-	if t == nil {
-		return fmt.Errorf("telemetry is nil")
+	pc.client = client.(*pool.Conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	conn, err := pc.listener.AcceptContext(ctx)
+	if err != nil {
+		return err
 	}
+	pc.conn = conn.(*pool.Conn)
 	return nil
 }
 
-var sessionState string
+func (pc *poolContext) acceptedPeer() error {
+	if pc.conn.SessionIndex() == pc.client.SessionIndex() {
+		return fmt.Errorf("accepted the client's own session %d", pc.client.SessionIndex())
+	}
+	if _, err := pc.client.Write([]byte("ping")); err != nil {
+		return err
+	}
+	return pc.shouldRead("ping")
+}
 
-func (pc *poolContext) queryState() error {
-	var err error
-	sessionState, err = pc.conn.SessionState()
-	return err
+func (pc *poolContext) noFurtherAccept(ms int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(ms)*time.Millisecond)
+	defer cancel()
+	conn, err := pc.listener.AcceptContext(ctx)
+	if err == nil {
+		pc.pending = append(pc.pending, conn.(*pool.Conn))
+		return fmt.Errorf("accepted another connection, session %d", conn.(*pool.Conn).SessionIndex())
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	return nil
 }
 
-func (pc *poolContext) stateIs(expected string) error {
-	if sessionState != expected {
-		return fmt.Errorf("expected %s, got %s", expected, sessionState)
+func (pc *poolContext) acceptReturns() error {
+	if pc.conn == nil {
+		return fmt.Errorf("no connection accepted")
 	}
 	return nil
 }
 
-func (pc *poolContext) openChannel(ch int) error {
-	cc, err := pc.conn.OpenChannel(uint8(ch))
-	if err != nil {
+func (pc *poolContext) closeBoth() error {
+	pc.lastIdx = pc.conn.SessionIndex()
+	if err := pc.conn.Close(); err != nil {
 		return err
 	}
-	pc.chanConn = cc
+	if err := pc.client.Close(); err != nil {
+		return err
+	}
+	pc.conn, pc.client = nil, nil
 	return nil
 }
 
-func (pc *poolContext) writeChannel(msg string, _ int) error {
-	_, err := pc.chanConn.Write([]byte(msg))
-	return err
+func (pc *poolContext) acceptedWithin(address string, ms int) error {
+	if !fakeBackend() {
+		return godog.ErrPending
+	}
+	client, err := pool.Dial("pool", address)
+	if err != nil {
+		return err
+	}
+	pc.client = client
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := pc.listener.AcceptContext(ctx)
+	if err != nil {
+		return err
+	}
+	pc.conn = conn.(*pool.Conn)
+	if d := time.Since(start); d > time.Duration(ms)*time.Millisecond {
+		return fmt.Errorf("accept took %v", d)
+	}
+	return nil
 }
 
-func (pc *poolContext) peerEchoesChannel(_ int) error {
-	return godog.ErrPending
+func (pc *poolContext) reusedIndex() error {
+	if got := pc.conn.SessionIndex(); got != pc.lastIdx {
+		return fmt.Errorf("expected session index %d to be reused, got %d", pc.lastIdx, got)
+	}
+	return nil
 }
 
-func (pc *poolContext) readChannel(expected string, _ int) error {
-	buf := make([]byte, 4096)
-	n, err := pc.chanConn.Read(buf)
-	if err != nil {
-		return err
+func (pc *poolContext) clientsConnect(n int, address string) error {
+	if !fakeBackend() {
+		return godog.ErrPending
 	}
-	if string(buf[:n]) != expected {
-		return fmt.Errorf("expected %q, got %q", expected, string(buf[:n]))
+	for i := 0; i < n; i++ {
+		c, err := pool.Dial("pool", address)
+		if err != nil {
+			return err
+		}
+		pc.pending = append(pc.pending, c)
+	}
+	return nil
+}
+
+func (pc *poolContext) acceptN(n int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for i := 0; i < n; i++ {
+		conn, err := pc.listener.AcceptContext(ctx)
+		if err != nil {
+			return fmt.Errorf("accept %d: %w", i+1, err)
+		}
+		pc.pending = append(pc.pending, conn.(*pool.Conn))
+	}
+	return nil
+}
+
+func (pc *poolContext) remoteIs(expected string) error {
+	if pc.conn == nil {
+		return fmt.Errorf("no connection")
+	}
+	addr := pc.conn.RemoteAddr().String()
+	host, _, _ := net.SplitHostPort(addr)
+	if host != expected {
+		return fmt.Errorf("expected remote %s, got %s", expected, host)
+	}
+	return nil
+}
+
+func (pc *poolContext) haveConn() error {
+	if !fakeBackend() {
+		return godog.ErrPending
+	}
+	ln, err := pool.Listen("pool", ":9256")
+	if err != nil {
+		return err
+	}
+	pc.listener = ln
+	conn, err := pool.Dial("pool", "127.0.0.1:9256")
+	if err != nil {
+		return err
+	}
+	pc.conn = conn
+	peer, err := ln.Accept()
+	if err != nil {
+		return err
+	}
+	pc.peer = peer.(*pool.Conn)
+	go func() {
+		buf := make([]byte, poolioc.MaxPayload)
+		for {
+			n, err := pc.peer.Read(buf)
+			if err != nil {
+				return
+			}
+			if _, err := pc.peer.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (pc *poolContext) implNetConn() error {
+	var _ net.Conn = pc.conn
+	return nil
+}
+
+func (pc *poolContext) localAddrPool() error {
+	addr := pc.conn.LocalAddr()
+	if addr.Network() != "pool" {
+		return fmt.Errorf("expected network pool, got %s", addr.Network())
+	}
+	return nil
+}
+
+func (pc *poolContext) remoteAddrPool() error {
+	addr := pc.conn.RemoteAddr()
+	if addr.Network() != "pool" {
+		return fmt.Errorf("expected network pool, got %s", addr.Network())
+	}
+	return nil
+}
+
+func (pc *poolContext) pastReadDeadline(ms int) error {
+	return pc.conn.SetReadDeadline(time.Now().Add(-time.Duration(ms) * time.Millisecond))
+}
+
+func (pc *poolContext) readTimeout() error {
+	buf := make([]byte, 1)
+	_, err := pc.conn.Read(buf)
+	if err == nil {
+		return fmt.Errorf("expected timeout error, got nil")
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return nil
+	}
+	return nil // Any error is acceptable for past deadlines
+}
+
+func (pc *poolContext) pastWriteDeadline(ms int) error {
+	return pc.conn.SetWriteDeadline(time.Now().Add(-time.Duration(ms) * time.Millisecond))
+}
+
+func (pc *poolContext) writeTimeout() error {
+	_, err := pc.conn.Write([]byte("test"))
+	if err == nil {
+		return fmt.Errorf("expected timeout error, got nil")
+	}
+	return nil
+}
+
+func (pc *poolContext) readWithDeadline(ms int) error {
+	if err := pc.conn.SetReadDeadline(time.Now().Add(time.Duration(ms) * time.Millisecond)); err != nil {
+		return err
+	}
+	pc.readBuf = make([]byte, 64)
+	_, pc.err = pc.conn.Read(pc.readBuf)
+	return nil
+}
+
+func (pc *poolContext) readTimedOutCleanly() error {
+	ne, ok := pc.err.(net.Error)
+	if !ok || !ne.Timeout() {
+		return fmt.Errorf("expected timeout error, got %v", pc.err)
+	}
+	// Give an abandoned receive a chance to misbehave before checking.
+	time.Sleep(20 * time.Millisecond)
+	for _, b := range pc.readBuf {
+		if b != 0 {
+			return fmt.Errorf("buffer written after Read returned")
+		}
+	}
+	return nil
+}
+
+func (pc *poolContext) clearReadDeadline() error {
+	return pc.conn.SetReadDeadline(time.Time{})
+}
+
+func (pc *poolContext) closeConn() error {
+	err := pc.conn.Close()
+	return err
+}
+
+func (pc *poolContext) writeAfterClose() error {
+	_, err := pc.conn.Write([]byte("test"))
+	if err != pool.ErrClosed {
+		return fmt.Errorf("expected ErrClosed, got %v", err)
+	}
+	return nil
+}
+
+func (pc *poolContext) readAfterClose() error {
+	buf := make([]byte, 1)
+	_, err := pc.conn.Read(buf)
+	if err != pool.ErrClosed {
+		return fmt.Errorf("expected ErrClosed, got %v", err)
+	}
+	return nil
+}
+
+func (pc *poolContext) requestTelemetry() error {
+	_, err := pc.conn.Telemetry()
+	return err
+}
+
+func (pc *poolContext) telemetryValues() error {
+	t, err := pc.conn.Telemetry()
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		return fmt.Errorf("telemetry is nil")
+	}
+	return nil
+}
+
+var sessionState string
+
+func (pc *poolContext) queryState() error {
+	var err error
+	sessionState, err = pc.conn.SessionState()
+	return err
+}
+
+func (pc *poolContext) stateIs(expected string) error {
+	if sessionState != expected {
+		return fmt.Errorf("expected %s, got %s", expected, sessionState)
+	}
+	return nil
+}
+
+func (pc *poolContext) openChannel(ch int) error {
+	cc, err := pc.conn.OpenChannel(uint8(ch))
+	if err != nil {
+		return err
+	}
+	pc.chanConn = cc
+	return nil
+}
+
+func (pc *poolContext) writeChannel(msg string, _ int) error {
+	_, err := pc.chanConn.Write([]byte(msg))
+	return err
+}
+
+func (pc *poolContext) peerEchoesChannel(ch int) error {
+	if pc.peer == nil {
+		return godog.ErrPending
+	}
+	cc, err := pc.peer.OpenChannel(uint8(ch))
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+	buf := make([]byte, poolioc.MaxPayload)
+	n, err := cc.Read(buf)
+	if err != nil {
+		return err
+	}
+	_, err = cc.Write(buf[:n])
+	return err
+}
+
+func (pc *poolContext) readChannel(expected string, _ int) error {
+	buf := make([]byte, 4096)
+	n, err := pc.chanConn.Read(buf)
+	if err != nil {
+		return err
+	}
+	if string(buf[:n]) != expected {
+		return fmt.Errorf("expected %q, got %q", expected, string(buf[:n]))
+	}
+	return nil
+}
+
+func (pc *poolContext) smallReads(size int, expected string) error {
+	var got []byte
+	buf := make([]byte, size)
+	for len(got) < len(expected) {
+		n, err := pc.conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		if n > size {
+			return fmt.Errorf("read returned %d bytes into a %d-byte buffer", n, size)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if string(got) != expected {
+		return fmt.Errorf("expected %q, got %q", expected, got)
+	}
+	return nil
+}
+
+func (pc *poolContext) readFull(size int, expected string) error {
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(pc.conn, buf); err != nil {
+		return err
+	}
+	if string(buf) != expected {
+		return fmt.Errorf("expected %q, got %q", expected, buf)
+	}
+	return nil
+}
+
+func (pc *poolContext) writeLines(a, b string) error {
+	_, err := pc.conn.Write([]byte(a + "\n" + b + "\n"))
+	return err
+}
+
+func (pc *poolContext) bufioLines(size int, a, b string) error {
+	r := bufio.NewReaderSize(pc.conn, size)
+	for _, want := range []string{a, b} {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if line != want+"\n" {
+			return fmt.Errorf("expected line %q, got %q", want, line)
+		}
+	}
+	return nil
+}
+
+func (pc *poolContext) messageMode() error {
+	pc.conn.SetReadMode(pool.MessageMode)
+	return nil
+}
+
+func (pc *poolContext) readTooSmall(size int) error {
+	if _, err := pc.conn.Read(make([]byte, size)); !errors.Is(err, pool.ErrBufferTooSmall) {
+		return fmt.Errorf("expected ErrBufferTooSmall, got %v", err)
+	}
+	return nil
+}
+
+func (pc *poolContext) clientWritesMsg(data, flags string) error {
+	return pc.client.WriteMsg(context.Background(), &pool.Message{
+		Data:  []byte(data),
+		Flags: uint8(parseHex(flags)),
+	})
+}
+
+func (pc *poolContext) readMsgFlags(data string, ch int, flags string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	m, err := pc.conn.ReadMsg(ctx)
+	if err != nil {
+		return err
+	}
+	want := uint8(parseHex(flags))
+	if string(m.Data) != data || int(m.Channel) != ch || m.Flags&want != want {
+		return fmt.Errorf("expected %q on channel %d with flags %#x, got %q on channel %d with flags %#x",
+			data, ch, want, m.Data, m.Channel, m.Flags)
+	}
+	return nil
+}
+
+func (pc *poolContext) flagsUnsupported(flags string) error {
+	err := pc.conn.WriteMsg(context.Background(), &pool.Message{
+		Data:  []byte("flagged"),
+		Flags: uint8(parseHex(flags)),
+	})
+	if !errors.Is(err, errors.ErrUnsupported) {
+		return fmt.Errorf("expected errors.ErrUnsupported, got %v", err)
+	}
+	return nil
+}
+
+func (pc *poolContext) clientPipelines(n int) error {
+	for i := 0; i < n; i++ {
+		a, err := pc.client.WriteAsync(context.Background(), []byte(strconv.Itoa(i)))
+		if err != nil {
+			return fmt.Errorf("write %d: %w", i, err)
+		}
+		pc.acks = append(pc.acks, a)
+	}
+	return nil
+}
+
+func (pc *poolContext) acksPending() error {
+	time.Sleep(50 * time.Millisecond)
+	for i, a := range pc.acks {
+		select {
+		case <-a.Done():
+			return fmt.Errorf("write %d acknowledged before it was read: %v", i, a.Err())
+		default:
+		}
+	}
+	return nil
+}
+
+func (pc *poolContext) readPipelined(n int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	for i := 0; i < n; i++ {
+		m, err := pc.conn.ReadMsg(ctx)
+		if err != nil {
+			return fmt.Errorf("read %d: %w", i, err)
+		}
+		if want := strconv.Itoa(i); string(m.Data) != want {
+			return fmt.Errorf("read %d: expected %q, got %q", i, want, m.Data)
+		}
+	}
+	return nil
+}
+
+func (pc *poolContext) ackedOnRead(data, flags string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- pc.client.WriteAcked(ctx, []byte(data)) }()
+
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case err := <-done:
+		return fmt.Errorf("write returned before it was read: %v", err)
+	default:
+	}
+	if err := pc.readMsgFlags(data, 0, flags); err != nil {
+		return err
+	}
+	return <-done
+}
+
+func (pc *poolContext) acksComplete() error {
+	return waitAcks(pc.acks)
+}
+
+// waitAcks waits for every write in acks to be acknowledged.
+func waitAcks(acks []*pool.Ack) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i, a := range acks {
+		if err := a.Wait(ctx); err != nil {
+			return fmt.Errorf("write %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (pc *poolContext) ackUnsupported() error {
+	err := pc.conn.WriteAcked(context.Background(), []byte("acked"))
+	if !errors.Is(err, errors.ErrUnsupported) {
+		return fmt.Errorf("expected errors.ErrUnsupported, got %v", err)
+	}
+	return nil
+}
+
+// parsePriority parses a priority class by name.
+func parsePriority(name string) (pool.Priority, error) {
+	for p := pool.PriorityBulk; p <= pool.PriorityHigh; p++ {
+		if p.String() == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown priority %q", name)
+}
+
+func (pc *poolContext) dialHolding(address string) error {
+	dev, err := poolioc.Open()
+	if err != nil {
+		if deviceUnavailable(err) {
+			return godog.ErrPending
+		}
+		return err
+	}
+	pc.holding = &holdingBackend{MessageBackend: dev, release: make(chan struct{})}
+	d := pool.Dialer{Backend: pc.holding}
+	conn, err := d.Dial("pool", address)
+	if err != nil {
+		return err
+	}
+	pc.conn = conn.(*pool.Conn)
+	return nil
+}
+
+func (pc *poolContext) channelPriorities(ch1 int, name1 string, ch2 int, name2 string) error {
+	pc.chans = make(map[uint8]*pool.ChannelConn)
+	for _, c := range []struct {
+		ch   int
+		name string
+	}{{ch1, name1}, {ch2, name2}} {
+		p, err := parsePriority(c.name)
+		if err != nil {
+			return err
+		}
+		cc, err := pc.conn.OpenChannel(uint8(c.ch))
+		if err != nil {
+			return err
+		}
+		cc.SetPriority(p)
+		pc.chans[uint8(c.ch)] = cc
+	}
+	return nil
+}
+
+// queueWrites starts n writes on cc and waits until want of them are
+// queued in the scheduler.
+func (pc *poolContext) queueWrites(cc *pool.ChannelConn, n, want int) error {
+	for i := 0; i < n; i++ {
+		go func() {
+			_, err := cc.Write([]byte("x"))
+			pc.writes <- err
+		}()
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for cc.Stats().Pending != want {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("channel %d: %d writes queued, want %d", cc.Channel(), cc.Stats().Pending, want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return nil
+}
+
+func (pc *poolContext) writesWaiting(n1, ch1, n2, ch2 int) error {
+	pc.writes = make(chan error, n1+n2)
+	// The first write takes the turn and is held by the backend.
+	if err := pc.queueWrites(pc.chans[uint8(ch1)], n1, n1-1); err != nil {
+		return err
+	}
+	return pc.queueWrites(pc.chans[uint8(ch2)], n2, n2)
+}
+
+func (pc *poolContext) releaseSends() error {
+	close(pc.holding.release)
+	for i := 0; i < cap(pc.writes); i++ {
+		if err := <-pc.writes; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (pc *poolContext) sendOrder(list string) error {
+	var got []int
+	for _, s := range pc.holding.sent {
+		got = append(got, int(s.channel))
+	}
+	want := sizes(list)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		return fmt.Errorf("expected sends on channels %v, got %v", want, got)
+	}
+	return nil
+}
+
+func (pc *poolContext) onlyPriority(ch int) error {
+	for i, s := range pc.holding.sent {
+		if (s.flags&poolioc.FlagPriority != 0) != (int(s.channel) == ch) {
+			return fmt.Errorf("send %d on channel %d has flags %#x", i, s.channel, s.flags)
+		}
+	}
+	return nil
+}
+
+func (pc *poolContext) channelWaits(ch1, n1, ch2, n2 int) error {
+	for _, c := range [][2]int{{ch1, n1}, {ch2, n2}} {
+		st := pc.chans[uint8(c[0])].Stats()
+		if int(st.Waits) != c[1] || st.Pending != 0 || st.MaxWait <= 0 {
+			return fmt.Errorf("channel %d: %d waits (max %v), %d pending; want %d waits",
+				c[0], st.Waits, st.MaxWait, st.Pending, c[1])
+		}
+	}
+	return nil
+}
+
+// stallChannel writes on ch until the client's queue for it is full,
+// then starts one more write, which must wait for the client to read.
+func (pc *poolContext) stallChannel(ch int) error {
+	cc := pc.chans[uint8(ch)]
+	for i := 0; ; i++ {
+		if i == 10000 {
+			return fmt.Errorf("channel %d: the queue never filled", ch)
+		}
+		cc.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+		_, err := cc.Write([]byte("x"))
+		if isTimeout(err) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	cc.SetWriteDeadline(time.Time{})
+
+	pc.writes = make(chan error, 1)
+	go func() {
+		_, err := cc.Write([]byte("x"))
+		pc.writes <- err
+	}()
+	select {
+	case err := <-pc.writes:
+		return fmt.Errorf("write on a full queue returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+		return nil
+	}
+}
+
+func (pc *poolContext) channelWriteWithin(ch, ms int) error {
+	cc := pc.chans[uint8(ch)]
+	cc.SetWriteDeadline(time.Now().Add(time.Duration(ms) * time.Millisecond))
+	defer cc.SetWriteDeadline(time.Time{})
+	_, err := cc.Write([]byte("x"))
+	return err
+}
+
+func (pc *poolContext) stalledWriteCompletes(ch int) error {
+	cc, err := pc.client.OpenChannel(uint8(ch))
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+	if _, err := cc.Read(make([]byte, 16)); err != nil {
+		return err
+	}
+	select {
+	case err := <-pc.writes:
+		return err
+	case <-time.After(2 * time.Second):
+		return fmt.Errorf("the stalled write did not complete")
+	}
+}
+
+func (pc *poolContext) clientPriority(name string) error {
+	p, err := parsePriority(name)
+	if err != nil {
+		return err
+	}
+	pc.client.SetPriority(p)
+	return nil
+}
+
+func (pc *poolContext) clientWritesPriority(data, name string) error {
+	p, err := parsePriority(name)
+	if err != nil {
+		return err
+	}
+	return pc.client.WriteMsg(context.Background(), &pool.Message{Data: []byte(data), Priority: p})
+}
+
+// parseCodecs parses a list of codec names such as "lzw and zlib".
+func parseCodecs(list string) ([]pool.Compression, error) {
+	var out []pool.Compression
+	for _, name := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if name == "and" {
+			continue
+		}
+		found := false
+		for z := pool.CompressNone; z <= pool.CompressLZW; z++ {
+			if z.String() == name {
+				out, found = append(out, z), true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown codec %q", name)
+		}
+	}
+	return out, nil
+}
+
+func (pc *poolContext) clientCompression(list string) error {
+	codecs, err := parseCodecs(list)
+	if err != nil {
+		return err
+	}
+	return pc.client.SetCompression(codecs...)
+}
+
+func (pc *poolContext) enableCompression(list string) error {
+	codecs, err := parseCodecs(list)
+	if err != nil {
+		return err
+	}
+	return pc.conn.SetCompression(codecs...)
+}
+
+func (pc *poolContext) clientWrite(b []byte) error {
+	if _, err := pc.client.Write(b); err != nil {
+		return err
+	}
+	pc.sent = append(pc.sent, b)
+	return nil
+}
+
+func (pc *poolContext) clientWrites(data string) error {
+	return pc.clientWrite([]byte(data))
+}
+
+func (pc *poolContext) clientWritesLog(size int) error {
+	return pc.clientWrite(logMessage(size))
+}
+
+// logMessage returns size bytes of log lines, which compress well.
+func logMessage(size int) []byte {
+	var b bytes.Buffer
+	for i := 0; b.Len() < size; i++ {
+		fmt.Fprintf(&b, "2026-10-16T12:00:%02dZ INFO request served path=/api/v1/items/%d status=200\n", i%60, i)
+	}
+	return b.Bytes()[:size]
+}
+
+func (pc *poolContext) clientLogTimesOut(size int) error {
+	if err := pc.client.SetWriteDeadline(time.Now().Add(-time.Millisecond)); err != nil {
+		return err
+	}
+	_, err := pc.client.Write(logMessage(size))
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		return fmt.Errorf("expected the write to time out, got %v", err)
+	}
+	return nil
+}
+
+func (pc *poolContext) clientWritesRandom(size int) error {
+	b := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(b)
+	return pc.clientWrite(b)
+}
+
+func (pc *poolContext) readBackSent() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	for i, want := range pc.sent {
+		m, err := pc.conn.ReadMsg(ctx)
+		if err != nil {
+			return fmt.Errorf("message %d: %w", i, err)
+		}
+		if !bytes.Equal(m.Data, want) {
+			return fmt.Errorf("message %d: got %d bytes, want %d", i, len(m.Data), len(want))
+		}
+	}
+	pc.sent = nil
+	return nil
+}
+
+func (pc *poolContext) clientCompressed(n, skipped int, ratio float64) error {
+	st := pc.client.CompressionStats()
+	if int(st.Compressed) != n || int(st.Skipped) != skipped || st.Ratio() >= ratio {
+		return fmt.Errorf("expected %d compressed and %d skipped below ratio %v, got %+v (ratio %.3f)",
+			n, skipped, ratio, st, st.Ratio())
+	}
+	return nil
+}
+
+func (pc *poolContext) clientCompressedNone(n, skipped int) error {
+	return pc.clientCompressed(n, skipped, 1.1)
+}
+
+func (pc *poolContext) clientDemux() error {
+	return pc.client.StartDemux(pool.DemuxConfig{})
+}
+
+// clientAgrees waits for the client's demultiplexer to take in the
+// answer to its codec offer.
+func (pc *poolContext) clientAgrees(codec string) error {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		got := pc.client.CompressionStats().Codec
+		if got.String() == codec {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("expected the client to agree on %s, got %v", codec, got)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (pc *poolContext) decompressed(n int) error {
+	if st := pc.conn.CompressionStats(); int(st.Decompressed) != n || st.BytesDecoded <= st.BytesRecv {
+		return fmt.Errorf("expected %d messages decompressed, got %+v", n, st)
+	}
+	return nil
+}
+
+func (pc *poolContext) clientAdopts(data, codec string) error {
+	buf := make([]byte, 64)
+	n, err := pc.client.Read(buf)
+	if err != nil {
+		return err
+	}
+	if string(buf[:n]) != data {
+		return fmt.Errorf("expected %q, got %q", data, buf[:n])
+	}
+	if got := pc.client.CompressionStats().Codec; got.String() != codec {
+		return fmt.Errorf("expected the client to use %s, got %v", codec, got)
+	}
+	return nil
+}
+
+func (pc *poolContext) compressionUnsupported() error {
+	if err := pc.conn.SetCompression(pool.CompressGzip); !errors.Is(err, errors.ErrUnsupported) {
+		return fmt.Errorf("expected errors.ErrUnsupported, got %v", err)
+	}
+	return nil
+}
+
+func (pc *poolContext) openChannels(ch1, ch2 int) error {
+	pc.chans = make(map[uint8]*pool.ChannelConn)
+	for _, ch := range []int{ch1, ch2} {
+		cc, err := pc.conn.OpenChannel(uint8(ch))
+		if err != nil {
+			return err
+		}
+		pc.chans[uint8(ch)] = cc
+	}
+	return nil
+}
+
+func (pc *poolContext) channelReadDeadline(ch, ms int) error {
+	return pc.chans[uint8(ch)].SetReadDeadline(time.Now().Add(time.Duration(ms) * time.Millisecond))
+}
+
+func (pc *poolContext) channelPastWriteDeadline(ch int) error {
+	return pc.chans[uint8(ch)].SetWriteDeadline(time.Now().Add(-time.Second))
+}
+
+func (pc *poolContext) channelClearsDeadlines(ch int) error {
+	return pc.chans[uint8(ch)].SetDeadline(time.Time{})
+}
+
+func (pc *poolContext) clientWritesChannelLater(data string, ch, ms int) error {
+	cc, err := pc.client.OpenChannel(uint8(ch))
+	if err != nil {
+		return err
+	}
+	time.AfterFunc(time.Duration(ms)*time.Millisecond, func() {
+		defer cc.Close()
+		_, _ = cc.Write([]byte(data))
+	})
+	return nil
+}
+
+// isTimeout reports whether err is a net.Error timeout.
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+func (pc *poolContext) channelReadTimesOut(ch int) error {
+	start := time.Now()
+	_, err := pc.chans[uint8(ch)].Read(make([]byte, 64))
+	if !isTimeout(err) {
+		return fmt.Errorf("expected a timeout, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		return fmt.Errorf("read timed out after %v", d)
+	}
+	return nil
+}
+
+func (pc *poolContext) channelReads(ch int, want string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	buf := make([]byte, 64)
+	n, err := pc.chans[uint8(ch)].ReadContext(ctx, buf)
+	if err != nil {
+		return err
+	}
+	if string(buf[:n]) != want {
+		return fmt.Errorf("expected %q, got %q", want, buf[:n])
+	}
+	return nil
+}
+
+func (pc *poolContext) channelWriteTimesOut(ch int) error {
+	if _, err := pc.chans[uint8(ch)].Write([]byte("x")); !isTimeout(err) {
+		return fmt.Errorf("expected a timeout, got %v", err)
+	}
+	return nil
+}
+
+func (pc *poolContext) channelWriteSucceeds(ch int) error {
+	_, err := pc.chans[uint8(ch)].Write([]byte("x"))
+	return err
+}
+
+func (pc *poolContext) listenOwnDevice(network, address string) error {
+	dev, err := poolioc.Open()
+	if err != nil {
+		if deviceUnavailable(err) {
+			return godog.ErrPending
+		}
+		return err
+	}
+	pc.device = dev
+	lc := pool.ListenConfig{Backend: dev}
+	pc.listener, err = lc.Listen(context.Background(), network, address)
+	return err
+}
+
+func (pc *poolContext) listenOversized(network, address string, ch int) error {
+	dev, err := poolioc.Open()
+	if err != nil {
+		if deviceUnavailable(err) {
+			return godog.ErrPending
+		}
+		return err
+	}
+	pc.device = dev
+	lc := pool.ListenConfig{Backend: &oversizedBackend{Device: dev, ch: uint8(ch), size: pool.DefaultMaxMessageSize + 1}}
+	pc.listener, err = lc.Listen(context.Background(), network, address)
+	return err
+}
+
+func (pc *poolContext) listenGone(network, address string) error {
+	dev, err := poolioc.Open()
+	if err != nil {
+		if deviceUnavailable(err) {
+			return godog.ErrPending
+		}
+		return err
+	}
+	pc.device = dev
+	lc := pool.ListenConfig{Backend: goneBackend{dev}}
+	pc.listener, err = lc.Listen(context.Background(), network, address)
+	return err
+}
+
+func (pc *poolContext) readNotConn() error {
+	if err := pc.readOpError(); err != nil {
+		return err
+	}
+	if !errors.Is(pc.err, syscall.ENOTCONN) {
+		return fmt.Errorf("expected ENOTCONN, got %v", pc.err)
+	}
+	return nil
+}
+
+func (pc *poolContext) channelReadFails(ch int, name string) error {
+	want := map[string]error{
+		"ErrChannelOverflow": pool.ErrChannelOverflow,
+		"ErrMessageTooLarge": pool.ErrMessageTooLarge,
+	}[name]
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := pc.chans[uint8(ch)].ReadContext(ctx, make([]byte, 64)); !errors.Is(err, want) {
+		return fmt.Errorf("expected %s, got %v", name, err)
+	}
+	return nil
+}
+
+func (pc *poolContext) demuxQueue(n int) error {
+	return pc.conn.StartDemux(pool.DemuxConfig{QueueLen: n})
+}
+
+func (pc *poolContext) demuxAutoSubscribe() error {
+	return pc.conn.StartDemux(pool.DemuxConfig{AutoSubscribe: true})
+}
+
+func (pc *poolContext) clientWritesChannel(data string, ch int) error {
+	cc, err := pc.client.OpenChannel(uint8(ch))
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+	for _, msg := range strings.Split(data, ",") {
+		if _, err := cc.Write([]byte(msg)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (pc *poolContext) acceptChannel(ch int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	cc, err := pc.conn.AcceptChannel(ctx)
+	if err != nil {
+		return err
+	}
+	if pc.chans == nil {
+		pc.chans = make(map[uint8]*pool.ChannelConn)
+	}
+	pc.chans[cc.Channel()] = cc
+	if int(cc.Channel()) != ch {
+		return fmt.Errorf("accepted channel %d, want %d", cc.Channel(), ch)
+	}
+	return nil
+}
+
+func (pc *poolContext) channelSubscribed(ch int, not string) error {
+	bitmap, err := pc.device.ChannelList(pc.conn.SessionIndex())
+	if err != nil {
+		return err
+	}
+	subscribed := bitmap[ch/8]&(1<<(ch%8)) != 0
+	if subscribed != (not == "") {
+		return fmt.Errorf("channel %d subscribed: %v", ch, subscribed)
+	}
+	return nil
+}
+
+func (pc *poolContext) channelClosed(ch int) error {
+	return pc.chans[uint8(ch)].Close()
+}
+
+func (pc *poolContext) clientWritesAndCloses(data string) error {
+	return pc.clientWritesAndClosesReason(data, "0x00")
+}
+
+func (pc *poolContext) clientWritesAndClosesReason(data, reason string) error {
+	code, err := strconv.ParseUint(reason, 0, 8)
+	if err != nil {
+		return err
+	}
+	for _, msg := range strings.Split(data, ",") {
+		if _, err := pc.client.Write([]byte(msg)); err != nil {
+			return err
+		}
+	}
+	return pc.client.CloseWriteReason(context.Background(), poolioc.WireError(code))
+}
+
+func (pc *poolContext) copyUntilEOF(want string) error {
+	if err := pc.conn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		return err
+	}
+	var got bytes.Buffer
+	if _, err := io.Copy(&got, pc.conn); err != nil {
+		return fmt.Errorf("io.Copy: %w", err)
+	}
+	if got.String() != want {
+		return fmt.Errorf("expected %q, got %q", want, got.String())
+	}
+	return nil
+}
+
+func (pc *poolContext) readsEOF() error {
+	if err := pc.conn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		return err
+	}
+	for i := 0; i < 2; i++ {
+		if n, err := pc.conn.Read(make([]byte, 64)); n != 0 || err != io.EOF {
+			return fmt.Errorf("expected io.EOF, got %d bytes and %v", n, err)
+		}
+	}
+	return nil
+}
+
+func (pc *poolContext) clientWriteClosed() error {
+	if _, err := pc.client.Write([]byte("late")); !errors.Is(err, pool.ErrWriteClosed) {
+		return fmt.Errorf("expected ErrWriteClosed, got %v", err)
+	}
+	return nil
+}
+
+func (pc *poolContext) clientReads(want string) error {
+	if err := pc.client.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		return err
+	}
+	buf := make([]byte, 64)
+	n, err := pc.client.Read(buf)
+	if err != nil {
+		return err
+	}
+	if string(buf[:n]) != want {
+		return fmt.Errorf("expected %q, got %q", want, buf[:n])
+	}
+	return nil
+}
+
+func (pc *poolContext) readFailsReason(reason string) error {
+	code, err := strconv.ParseUint(reason, 0, 8)
+	if err != nil {
+		return err
+	}
+	if err := pc.conn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		return err
+	}
+	_, err = pc.conn.Read(make([]byte, 64))
+	var se *poolioc.ShutdownError
+	if !errors.As(err, &se) || se.Reason != poolioc.WireError(code) {
+		return fmt.Errorf("expected the peer's reason %s, got %v", reason, err)
+	}
+	if !errors.Is(err, poolioc.WireError(code)) {
+		return fmt.Errorf("%v does not match its wire error", err)
+	}
+	return nil
+}
+
+func (pc *poolContext) clientCloses() error {
+	err := pc.client.Close()
+	pc.client = nil
+	return err
+}
+
+func (pc *poolContext) clientWritesChannelAndCloses(data string, ch int) error {
+	cc, err := pc.client.OpenChannel(uint8(ch))
+	if err != nil {
+		return err
+	}
+	for _, msg := range strings.Split(data, ",") {
+		if _, err := cc.Write([]byte(msg)); err != nil {
+			return err
+		}
+	}
+	return cc.CloseWrite()
+}
+
+func (pc *poolContext) channelReadsEOF(ch int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if n, err := pc.chans[uint8(ch)].ReadContext(ctx, make([]byte, 64)); n != 0 || err != io.EOF {
+		return fmt.Errorf("expected io.EOF, got %d bytes and %v", n, err)
+	}
+	return nil
+}
+
+func (pc *poolContext) readWaiting() error {
+	pc.reads = make(chan error, 1)
+	go func() {
+		_, err := pc.conn.Read(make([]byte, 64))
+		pc.reads <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case err := <-pc.reads:
+		return fmt.Errorf("read returned early: %v", err)
+	default:
+		return nil
+	}
+}
+
+func (pc *poolContext) closeRead() error {
+	return pc.conn.CloseRead()
+}
+
+func (pc *poolContext) waitingReadEOF() error {
+	select {
+	case err := <-pc.reads:
+		if err != io.EOF {
+			return fmt.Errorf("expected io.EOF, got %v", err)
+		}
+		return nil
+	case <-time.After(2 * time.Second):
+		return fmt.Errorf("the read is still waiting")
+	}
+}
+
+func (pc *poolContext) closeDevice() error {
+	return pc.device.Close()
+}
+
+func (pc *poolContext) waitingReadClosed() error {
+	select {
+	case err := <-pc.reads:
+		if err != pool.ErrClosed {
+			return fmt.Errorf("expected ErrClosed, got %v", err)
+		}
+		return nil
+	case <-time.After(2 * time.Second):
+		return fmt.Errorf("the read is still waiting")
+	}
+}
+
+// manager returns the scenario's device manager, creating it if needed.
+func (pc *poolContext) manager() *pool.DeviceManager {
+	if pc.devices == nil {
+		pc.devices = &pool.DeviceManager{}
+	}
+	return pc.devices
+}
+
+func (pc *poolContext) listenManaged(network, address string) error {
+	lc := pool.ListenConfig{Devices: pc.manager()}
+	ln, err := lc.Listen(context.Background(), network, address)
+	if err != nil {
+		if deviceUnavailable(err) {
+			return godog.ErrPending
+		}
+		return err
+	}
+	pc.listener = ln
+	return nil
+}
+
+func (pc *poolContext) listenCrowded(network, address string, n int) error {
+	pc.crowded = &crowdedBackend{inbound: n, closed: make(map[uint32]bool)}
+	lc := pool.ListenConfig{Backend: pc.crowded}
+	ln, err := lc.Listen(context.Background(), network, address)
+	if err != nil {
+		return err
+	}
+	pc.listener = ln
+	return nil
+}
+
+func (pc *poolContext) crowdedClosed(n int) error {
+	pc.crowded.mu.Lock()
+	defer pc.crowded.mu.Unlock()
+	if len(pc.crowded.closed) != n {
+		return fmt.Errorf("expected %d sessions closed, got %d", n, len(pc.crowded.closed))
+	}
+	return nil
+}
+
+func (pc *poolContext) managerShards(n int) error {
+	pc.manager().SetShards(n)
+	return nil
+}
+
+func (pc *poolContext) clientsConnectManaged(n int, address string) error {
+	if !fakeBackend() {
+		return godog.ErrPending
+	}
+	d := pool.Dialer{Devices: pc.manager()}
+	for i := 0; i < n; i++ {
+		c, err := d.Dial("pool", address)
+		if err != nil {
+			return err
+		}
+		pc.pending = append(pc.pending, c.(*pool.Conn))
+	}
+	return nil
+}
+
+func (pc *poolContext) managerDevices(n int) error {
+	if got := pc.manager().NumDevices(); got != n {
+		return fmt.Errorf("expected %d open devices, got %d", n, got)
+	}
+	return nil
+}
+
+func (pc *poolContext) closePending() error {
+	for _, c := range pc.pending {
+		if err := c.Close(); err != nil {
+			return err
+		}
+	}
+	pc.pending = nil
+	return nil
+}
+
+func (pc *poolContext) closeListener() error {
+	err := pc.listener.Close()
+	pc.listener = nil
+	return err
+}
+
+func (pc *poolContext) closeWriteUnsupported() error {
+	if err := pc.conn.CloseWrite(); !errors.Is(err, errors.ErrUnsupported) {
+		return fmt.Errorf("expected an unsupported error, got %v", err)
+	}
+	return nil
+}
+
+// poolErrors names the sentinel errors scenarios match against.
+var poolErrors = map[string]error{
+	"ErrAuthFailed":  pool.ErrAuthFailed,
+	"ErrConnRefused": pool.ErrConnRefused,
+	"ErrOverload":    pool.ErrOverload,
+}
+
+func (pc *poolContext) dialRefused(address string) error {
+	_, pc.err = pool.Dial("pool", address)
+	return nil
+}
+
+func (pc *poolContext) dialOpError(address string) error {
+	var oe *pool.OpError
+	if !errors.As(pc.err, &oe) {
+		return fmt.Errorf("expected a *pool.OpError, got %T: %v", pc.err, pc.err)
+	}
+	if oe.Op != "dial" || oe.Net != "pool" || oe.Addr == nil || oe.Addr.String() != address || oe.Session != -1 {
+		return fmt.Errorf("unexpected dial error fields: %+v", oe)
+	}
+	if !errors.Is(pc.err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("%v is not caused by ECONNREFUSED", pc.err)
+	}
+	return nil
+}
+
+func (pc *poolContext) dialOpErrorCause(address, cause string) error {
+	var oe *pool.OpError
+	if !errors.As(pc.err, &oe) {
+		return fmt.Errorf("expected a *pool.OpError, got %T: %v", pc.err, pc.err)
+	}
+	if oe.Op != "dial" || oe.Addr == nil || oe.Addr.String() != address || oe.Session != -1 {
+		return fmt.Errorf("unexpected dial error fields: %+v", oe)
+	}
+	if oe.Err == nil || oe.Err.Error() != cause {
+		return fmt.Errorf("expected the cause %q, got %v", cause, oe.Err)
+	}
+	return nil
+}
+
+func (pc *poolContext) dialControlFails(address, msg string) error {
+	d := pool.Dialer{
+		Control: func(string, string, poolioc.Backend) error {
+			return errors.New(msg)
+		},
+	}
+	_, pc.err = d.Dial("pool", address)
+	return nil
+}
+
+func opErrorWithoutCause(op, network, want string) error {
+	e := &pool.OpError{Op: op, Net: network, Session: -1}
+	if got := e.Error(); got != want {
+		return fmt.Errorf("expected %q, got %q", want, got)
+	}
+	return nil
+}
+
+func nilOpError(want string) error {
+	var e *pool.OpError
+	if got := e.Error(); got != want {
+		return fmt.Errorf("expected %q, got %q", want, got)
+	}
+	return nil
+}
+
+func (pc *poolContext) errorMatches(want, not string) error {
+	if !errors.Is(pc.err, poolErrors[want]) {
+		return fmt.Errorf("%v does not match %s", pc.err, want)
+	}
+	if errors.Is(pc.err, poolErrors[not]) {
+		return fmt.Errorf("%v matches %s", pc.err, not)
+	}
+	return nil
+}
+
+func (pc *poolContext) readOpError() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	_, pc.err = pc.conn.ReadContext(ctx, make([]byte, 64))
+	var oe *pool.OpError
+	if !errors.As(pc.err, &oe) {
+		return fmt.Errorf("expected a *pool.OpError, got %T: %v", pc.err, pc.err)
+	}
+	if oe.Op != "read" || oe.Net != "pool" || oe.Session != int(pc.conn.SessionIndex()) {
+		return fmt.Errorf("unexpected read error fields: %+v", oe)
+	}
+	if oe.Addr.String() != pc.conn.RemoteAddr().String() || oe.Source.String() != pc.conn.LocalAddr().String() {
+		return fmt.Errorf("unexpected read error addresses: %v", oe)
+	}
+	return nil
+}
+
+func (pc *poolContext) opErrorTimeout() error {
+	var ne net.Error
+	if !errors.As(pc.err, &ne) || !ne.Timeout() {
+		return fmt.Errorf("expected a timeout, got %v", pc.err)
+	}
+	if !errors.Is(pc.err, pool.ErrTimeout) {
+		return fmt.Errorf("%v does not match ErrTimeout", pc.err)
+	}
+	return nil
+}
+
+// keepChannel records an allocated ChannelConn so the scenario closes
+// it.
+func (pc *poolContext) keepChannel(cc *pool.ChannelConn) {
+	if pc.chans == nil {
+		pc.chans = make(map[uint8]*pool.ChannelConn)
+	}
+	pc.chans[cc.Channel()] = cc
+	pc.alloced = append(pc.alloced, cc.Channel())
+}
+
+func (pc *poolContext) allocateChannels(n int, fromRange string) error {
+	pc.alloced = nil
+	for i := 0; i < n; i++ {
+		allocate := pc.conn.AllocateChannel
+		if fromRange != "" {
+			allocate = pc.reserved.Allocate
+		}
+		cc, err := allocate()
+		if err != nil {
+			return err
+		}
+		pc.keepChannel(cc)
+	}
+	return nil
+}
+
+func (pc *poolContext) allocateConcurrently(n int) error {
+	pc.alloced = nil
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		errs []error
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cc, err := pc.conn.AllocateChannel()
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			pc.keepChannel(cc)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (pc *poolContext) allocatedAre(list string) error {
+	var want []uint8
+	for _, n := range sizes(list) {
+		want = append(want, uint8(n))
+	}
+	if !slices.Equal(pc.alloced, want) {
+		return fmt.Errorf("expected channels %v, got %v", want, pc.alloced)
+	}
+	return nil
+}
+
+func (pc *poolContext) allocatedDiffer() error {
+	var set poolioc.ChannelSet
+	for _, ch := range pc.alloced {
+		set.Add(ch)
+	}
+	if set.Count() != len(pc.alloced) {
+		return fmt.Errorf("channels allocated twice: %v", pc.alloced)
+	}
+	return nil
+}
+
+func (pc *poolContext) reserveChannels(first, last int) error {
+	var err error
+	pc.reserved, err = pc.conn.ReserveChannels(uint8(first), uint8(last))
+	return err
+}
+
+func (pc *poolContext) reserveFails(first, last int) error {
+	if _, err := pc.conn.ReserveChannels(uint8(first), uint8(last)); !errors.Is(err, pool.ErrChannelsReserved) {
+		return fmt.Errorf("expected ErrChannelsReserved, got %v", err)
+	}
+	return nil
+}
+
+func (pc *poolContext) allocateFails() error {
+	cc, err := pc.conn.AllocateChannel()
+	if !errors.Is(err, pool.ErrNoFreeChannel) {
+		if cc != nil {
+			cc.Close()
+		}
+		return fmt.Errorf("expected ErrNoFreeChannel, got %v", err)
+	}
+	return nil
+}
+
+func (pc *poolContext) demuxUnsupported() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := pc.conn.AcceptChannel(ctx); !errors.Is(err, errors.ErrUnsupported) {
+		return fmt.Errorf("expected errors.ErrUnsupported, got %v", err)
+	}
+	return nil
+}
+
+// sizes parses a list such as "200000, 0 and 70000".
+func sizes(list string) []int {
+	var out []int
+	for _, f := range strings.FieldsFunc(list, func(r rune) bool { return r < '0' || r > '9' }) {
+		n, _ := strconv.Atoi(f)
+		out = append(out, n)
+	}
+	return out
+}
+
+// message returns size bytes of a pattern that differs per size.
+func message(size int) []byte {
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = byte(i*7 + size)
+	}
+	return b
+}
+
+func (pc *poolContext) writeMessages(list string) error {
+	for _, n := range sizes(list) {
+		if err := pc.conn.WriteMessage(context.Background(), message(n)); err != nil {
+			return fmt.Errorf("%d-byte message: %w", n, err)
+		}
+	}
+	return nil
+}
+
+func (pc *poolContext) readMessages(list string) error {
+	for _, n := range sizes(list) {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		got, err := pc.conn.ReadMessage(ctx)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("%d-byte message: %w", n, err)
+		}
+		if !bytes.Equal(got, message(n)) {
+			return fmt.Errorf("expected the %d-byte message, got %d bytes", n, len(got))
+		}
+	}
+	return nil
+}
+
+func (pc *poolContext) limitMessages(n int) error {
+	pc.conn.SetMaxMessageSize(n)
+	return nil
+}
+
+func (pc *poolContext) readMessageTooLarge() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := pc.conn.ReadMessage(ctx); !errors.Is(err, pool.ErrMessageTooLarge) {
+		return fmt.Errorf("expected ErrMessageTooLarge, got %v", err)
+	}
+	return nil
+}
+
+func (pc *poolContext) writeMessageTooLarge(n int) error {
+	if err := pc.conn.WriteMessage(context.Background(), message(n)); !errors.Is(err, pool.ErrMessageTooLarge) {
+		return fmt.Errorf("expected ErrMessageTooLarge, got %v", err)
+	}
+	return nil
+}
+
+func (pc *poolContext) peerRelaysChannel(ch int) error {
+	if pc.peer == nil {
+		return godog.ErrPending
+	}
+	cc, err := pc.peer.OpenChannel(uint8(ch))
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer cc.Close()
+		msg, err := cc.ReadMessage(context.Background())
+		if err != nil {
+			return
+		}
+		_ = cc.WriteMessage(context.Background(), msg)
+	}()
+	return nil
+}
+
+func (pc *poolContext) writeChannelMessage(size, _ int) error {
+	return pc.chanConn.(*pool.ChannelConn).WriteMessage(context.Background(), message(size))
+}
+
+func (pc *poolContext) readChannelMessage(size, _ int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	got, err := pc.chanConn.(*pool.ChannelConn).ReadMessage(ctx)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, message(size)) {
+		return fmt.Errorf("expected the %d-byte message, got %d bytes", size, len(got))
 	}
 	return nil
 }
@@ -0,0 +1,200 @@
+//go:build linux
+
+package steps
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/amosdavis/pool-go/poolfrag"
+	"github.com/cucumber/godog"
+)
+
+type poolfragContext struct {
+	msg   []byte
+	frags []poolfrag.Fragment
+	r     poolfrag.Reassembler
+	start time.Time
+	got   [][]byte
+	err   error
+}
+
+func InitializePoolfragScenario(ctx *godog.ScenarioContext) {
+	pc := &poolfragContext{start: time.Now()}
+
+	ctx.Step(`^a (\d+)-byte message split for a (\d+)-byte MTU$`, pc.split)
+	ctx.Step(`^I split a (\d+)-byte message for a (\d+)-byte MTU$`, pc.trySplit)
+	ctx.Step(`^there should be (\d+) fragments of at most (\d+) bytes$`, pc.fragmentCount)
+	ctx.Step(`^the fragments arrive in random order with duplicates$`, pc.shuffledArrival)
+	ctx.Step(`^the message should be reassembled exactly once$`, pc.reassembledOnce)
+	ctx.Step(`^the reassembler should hold no memory$`, pc.empty)
+	ctx.Step(`^fragmentation should fail with "([^"]*)"$`, pc.failedWith)
+	ctx.Step(`^all but the last fragment arrive$`, pc.allButLast)
+	ctx.Step(`^all the fragments arrive$`, pc.allArrive)
+	ctx.Step(`^nothing should expire after (\d+)ms$`, pc.nothingExpires)
+	ctx.Step(`^the message should expire after (\d+)ms$`, pc.expires)
+	ctx.Step(`^a reassembler limited to (\d+) bytes$`, pc.limit)
+	ctx.Step(`^the first fragment arrives$`, pc.firstArrives)
+	ctx.Step(`^a fragment claiming the message is (\d+) bytes arrives$`, pc.conflicting)
+	ctx.Step(`^a fragment overlapping it by (\d+) bytes arrives$`, pc.overlapping)
+	ctx.Step(`^the fragments should carry byte offsets and the message length$`, pc.byteOffsets)
+}
+
+func (pc *poolfragContext) trySplit(size, mtu int) error {
+	pc.msg = make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(pc.msg)
+	pc.frags, pc.err = poolfrag.Split(7, pc.msg, poolfrag.PayloadSize(mtu))
+	return nil
+}
+
+func (pc *poolfragContext) split(size, mtu int) error {
+	if err := pc.trySplit(size, mtu); err != nil {
+		return err
+	}
+	return pc.err
+}
+
+func (pc *poolfragContext) fragmentCount(n, size int) error {
+	if len(pc.frags) != n {
+		return fmt.Errorf("expected %d fragments, got %d", n, len(pc.frags))
+	}
+	for i, f := range pc.frags {
+		if len(f.Data) > size {
+			return fmt.Errorf("fragment %d is %d bytes", i, len(f.Data))
+		}
+		if f.Last() != (i == n-1) {
+			return fmt.Errorf("fragment %d: Last() = %v", i, f.Last())
+		}
+	}
+	return nil
+}
+
+// arrive passes a fragment through its wire encoding to the reassembler.
+func (pc *poolfragContext) arrive(f poolfrag.Fragment) error {
+	payload, err := f.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	var in poolfrag.Fragment
+	if err := in.UnmarshalBinary(payload); err != nil {
+		return err
+	}
+	msg, err := pc.r.Add(in, pc.start)
+	if err != nil {
+		pc.err = err
+		return nil
+	}
+	if msg != nil {
+		pc.got = append(pc.got, msg)
+	}
+	return nil
+}
+
+func (pc *poolfragContext) shuffledArrival() error {
+	order := append(append([]poolfrag.Fragment(nil), pc.frags...), pc.frags[3], pc.frags[0])
+	rand.New(rand.NewSource(1)).Shuffle(len(order), func(i, j int) {
+		order[i], order[j] = order[j], order[i]
+	})
+	for _, f := range order {
+		if err := pc.arrive(f); err != nil {
+			return err
+		}
+	}
+	return pc.err
+}
+
+func (pc *poolfragContext) reassembledOnce() error {
+	if len(pc.got) != 1 {
+		return fmt.Errorf("expected 1 message, got %d", len(pc.got))
+	}
+	if !bytes.Equal(pc.got[0], pc.msg) {
+		return fmt.Errorf("message corrupted: got %d bytes, want %d", len(pc.got[0]), len(pc.msg))
+	}
+	return nil
+}
+
+func (pc *poolfragContext) empty() error {
+	if n, b := pc.r.Pending(), pc.r.Buffered(); n != 0 || b != 0 {
+		return fmt.Errorf("reassembler holds %d messages in %d bytes", n, b)
+	}
+	return nil
+}
+
+func (pc *poolfragContext) failedWith(msg string) error {
+	if pc.err == nil || !strings.Contains(pc.err.Error(), msg) {
+		return fmt.Errorf("expected error %q, got %v", msg, pc.err)
+	}
+	return nil
+}
+
+func (pc *poolfragContext) allButLast() error {
+	for _, f := range pc.frags[:len(pc.frags)-1] {
+		if err := pc.arrive(f); err != nil {
+			return err
+		}
+	}
+	if pc.r.Pending() != 1 {
+		return fmt.Errorf("expected 1 pending message, got %d", pc.r.Pending())
+	}
+	return pc.err
+}
+
+func (pc *poolfragContext) allArrive() error {
+	for _, f := range pc.frags {
+		if err := pc.arrive(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (pc *poolfragContext) nothingExpires(ms int) error {
+	if ids := pc.r.Expire(pc.start.Add(time.Duration(ms) * time.Millisecond)); len(ids) != 0 {
+		return fmt.Errorf("expected nothing to expire, got %v", ids)
+	}
+	return nil
+}
+
+func (pc *poolfragContext) expires(ms int) error {
+	ids := pc.r.Expire(pc.start.Add(time.Duration(ms) * time.Millisecond))
+	if len(ids) != 1 || ids[0] != pc.frags[0].MsgID {
+		return fmt.Errorf("expected message %d to expire, got %v", pc.frags[0].MsgID, ids)
+	}
+	return nil
+}
+
+func (pc *poolfragContext) limit(n int) error {
+	pc.r.MaxBytes = n
+	return nil
+}
+
+func (pc *poolfragContext) firstArrives() error {
+	return pc.arrive(pc.frags[0])
+}
+
+func (pc *poolfragContext) conflicting(total int) error {
+	f := pc.frags[1]
+	f.TotalLen = uint16(total)
+	return pc.arrive(f)
+}
+
+func (pc *poolfragContext) overlapping(n int) error {
+	f := pc.frags[1]
+	f.FragOffset -= uint16(n)
+	return pc.arrive(f)
+}
+
+func (pc *poolfragContext) byteOffsets() error {
+	off := 0
+	for i, f := range pc.frags {
+		if int(f.FragOffset) != off || int(f.TotalLen) != len(pc.msg) {
+			return fmt.Errorf("fragment %d: offset %d of %d bytes, want %d of %d",
+				i, f.FragOffset, f.TotalLen, off, len(pc.msg))
+		}
+		off += len(f.Data)
+	}
+	return nil
+}
@@ -8,7 +8,11 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"runtime"
+	"strings"
 	"syscall"
+	"time"
+	"unsafe"
 
 	"github.com/amosdavis/pool-go/poolioc"
 	"github.com/cucumber/godog"
@@ -16,19 +20,32 @@ import (
 
 type pooliocContext struct {
 	dev        *poolioc.Device
+	peer       *poolioc.Device
 	sessionIdx int
 	recvBuf    []byte
 	err        error
 	bitmap     [poolioc.MaxChannels / 8]byte
+	set        poolioc.ChannelSet
+	events     <-chan poolioc.Event
+	stopEvents context.CancelFunc
+	snapshot   []poolioc.SessionInfo
+	diff       []poolioc.Event
+	recvs      chan error // results of receives started in the background
 }
 
 func InitializePooliocScenario(ctx *godog.ScenarioContext) {
 	pc := &pooliocContext{}
 
 	ctx.After(func(scenarioCtx context.Context, sc *godog.Scenario, err error) (context.Context, error) {
+		if pc.stopEvents != nil {
+			pc.stopEvents()
+		}
 		if pc.dev != nil {
 			_ = pc.dev.Close()
 		}
+		if pc.peer != nil {
+			_ = pc.peer.Close()
+		}
 		return scenarioCtx, nil
 	})
 
@@ -37,6 +54,8 @@ func InitializePooliocScenario(ctx *godog.ScenarioContext) {
 	ctx.Step(`^the device file descriptor should be valid$`, pc.fdValid)
 	ctx.Step(`^I close the device without error$`, pc.closeDevice)
 	ctx.Step(`^I have an open POOL device$`, pc.openDevice)
+	ctx.Step(`^I connect to "([^"]*)" with a (\d+)-second heartbeat$`, pc.connectHeartbeat)
+	ctx.Step(`^the device should refuse the options with EOPNOTSUPP$`, pc.optionsRefused)
 	ctx.Step(`^I start listening on port (\d+)$`, pc.listen)
 	ctx.Step(`^the listener should be active$`, pc.listenerActive)
 	ctx.Step(`^I stop the listener$`, pc.stopListener)
@@ -48,8 +67,14 @@ func InitializePooliocScenario(ctx *godog.ScenarioContext) {
 	ctx.Step(`^I have an established session$`, pc.haveEstablishedSession)
 	ctx.Step(`^I send "([^"]*)" on channel (\d+)$`, pc.sendOnChannel)
 	ctx.Step(`^the peer echoes the data back$`, pc.peerEchoes)
+	ctx.Step(`^a send from a raw address should fail with EFAULT on the fake backend$`, pc.rawSendFaults)
 	ctx.Step(`^I should receive "([^"]*)" on channel (\d+)$`, pc.recvOnChannel)
 	ctx.Step(`^I list sessions$`, pc.listSessions)
+	ctx.Step(`^a receive is waiting on channel (\d+)$`, pc.recvWaiting)
+	ctx.Step(`^I close the device$`, pc.closeDevice)
+	ctx.Step(`^the waiting receive should fail with os\.ErrClosed$`, pc.waitingRecvClosed)
+	ctx.Step(`^(\d+) goroutines list sessions while I close the device$`, pc.listWhileClosing)
+	ctx.Step(`^every call should have succeeded or failed with os\.ErrClosed$`, pc.callsClosed)
 	ctx.Step(`^the session list should contain at least (\d+) session$`, pc.sessionCount)
 	ctx.Step(`^the session state should be "([^"]*)"$`, pc.sessionState)
 	ctx.Step(`^I close the session$`, pc.closeSession)
@@ -61,9 +86,17 @@ func InitializePooliocScenario(ctx *godog.ScenarioContext) {
 	ctx.Step(`^I subscribe to channels (\d+), (\d+), and (\d+)$`, pc.subscribeMultiple)
 	ctx.Step(`^I list channels$`, pc.listChannels)
 	ctx.Step(`^the bitmap should show channels (\d+), (\d+), and (\d+) as active$`, pc.bitmapCheck)
+	ctx.Step(`^the channel set should be "([^"]*)" with (\d+) channels?$`, pc.channelSetIs)
+	ctx.Step(`^I add channels (\d+) and (\d+) to the set and remove (\d+)$`, pc.editChannelSet)
 	ctx.Step(`^I send a (\d+)-byte payload$`, pc.sendLargePayload)
 	ctx.Step(`^I should receive a (\d+)-byte payload$`, pc.recvLargePayload)
 	ctx.Step(`^the connection should fail with a timeout or unreachable error$`, pc.connFailed)
+	ctx.Step(`^I am watching device events$`, pc.watchEvents)
+	ctx.Step(`^I should see an? "([^"]*)" event$`, pc.sawEvent)
+	ctx.Step(`^the peer closes its session$`, pc.peerCloses)
+	ctx.Step(`^a session in state "([^"]*)" with rekey count (\d+) and config version (\d+)$`, pc.sessionSnapshot)
+	ctx.Step(`^it changes to state "([^"]*)" with rekey count (\d+) and config version (\d+)$`, pc.diffSnapshot)
+	ctx.Step(`^Diff should report "([^"]*)"$`, pc.diffReports)
 	ctx.Step(`^I convert "([^"]*)" to an IPv4-mapped IPv6 address$`, pc.convertIPv4Mapped)
 	ctx.Step(`^the result should be "([^"]*)"$`, pc.mappedResult)
 	ctx.Step(`^IsV4Mapped should return true$`, pc.isV4Mapped)
@@ -72,7 +105,13 @@ func InitializePooliocScenario(ctx *godog.ScenarioContext) {
 }
 
 func (pc *pooliocContext) moduleLoaded() error {
-	// Verified by successfully opening /dev/pool
+	// Verified by successfully opening /dev/pool. Without the kernel
+	// module, run against the in-memory emulation instead.
+	if os.Getenv(poolioc.BackendEnv) == "" {
+		if _, err := os.Stat("/dev/pool"); err != nil {
+			os.Setenv(poolioc.BackendEnv, poolioc.BackendFake)
+		}
+	}
 	return nil
 }
 
@@ -118,9 +157,51 @@ func (pc *pooliocContext) listenerStopped() error {
 	return nil
 }
 
-func (pc *pooliocContext) remotePeerListening(_ string) error {
-	// In integration tests, a peer would be set up externally
-	return godog.ErrPending
+func (pc *pooliocContext) remotePeerListening(addr string) error {
+	if os.Getenv(poolioc.BackendEnv) != poolioc.BackendFake {
+		// In integration tests, a peer would be set up externally
+		return godog.ErrPending
+	}
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := net.LookupPort("tcp", portStr)
+	if err != nil {
+		return err
+	}
+	peer, err := poolioc.Open()
+	if err != nil {
+		return err
+	}
+	pc.peer = peer
+	return peer.Listen(uint16(port))
+}
+
+func (pc *pooliocContext) connectHeartbeat(addr string, secs int) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := net.LookupPort("tcp", portStr)
+	if err != nil {
+		return err
+	}
+	req := poolioc.ConnectReq{
+		PeerPort:     uint16(port),
+		AddrFamily:   syscall.AF_INET,
+		HeartbeatSec: uint16(secs),
+	}
+	copy(req.PeerAddr[:], net.ParseIP(host).To16())
+	pc.sessionIdx, pc.err = pc.dev.Connect(req)
+	return nil
+}
+
+func (pc *pooliocContext) optionsRefused() error {
+	if !errors.Is(pc.err, syscall.EOPNOTSUPP) {
+		return fmt.Errorf("expected EOPNOTSUPP, got %v", pc.err)
+	}
+	return nil
 }
 
 func (pc *pooliocContext) connectTo(addr string) error {
@@ -147,8 +228,9 @@ func (pc *pooliocContext) connectTo(addr string) error {
 		req.AddrFamily = 10 // AF_INET6
 	}
 
+	// Failures are checked by the following Then step.
 	pc.sessionIdx, pc.err = pc.dev.Connect(req)
-	return pc.err
+	return nil
 }
 
 func (pc *pooliocContext) sessionEstablished() error {
@@ -166,15 +248,56 @@ func (pc *pooliocContext) sessionIdxNonNeg() error {
 }
 
 func (pc *pooliocContext) haveEstablishedSession() error {
-	return godog.ErrPending
+	if err := pc.openDevice(); err != nil {
+		return err
+	}
+	if err := pc.remotePeerListening("127.0.0.1:9255"); err != nil {
+		return err
+	}
+	if err := pc.connectTo("127.0.0.1:9255"); err != nil {
+		return err
+	}
+	return pc.err
 }
 
 func (pc *pooliocContext) sendOnChannel(msg string, ch int) error {
 	return pc.dev.SendBytes(uint32(pc.sessionIdx), uint8(ch), []byte(msg))
 }
 
+func (pc *pooliocContext) rawSendFaults() error {
+	if os.Getenv(poolioc.BackendEnv) != poolioc.BackendFake {
+		return godog.ErrPending
+	}
+	data := []byte("raw")
+	err := pc.dev.Send(poolioc.SendReq{
+		SessionIdx: uint32(pc.sessionIdx),
+		Len:        uint32(len(data)),
+		DataPtr:    uint64(uintptr(unsafe.Pointer(&data[0]))),
+	})
+	runtime.KeepAlive(data)
+	if !errors.Is(err, syscall.EFAULT) {
+		return fmt.Errorf("expected EFAULT, got %v", err)
+	}
+	return nil
+}
+
 func (pc *pooliocContext) peerEchoes() error {
-	return godog.ErrPending
+	if pc.peer == nil {
+		return godog.ErrPending
+	}
+	sessions, err := pc.peer.Sessions()
+	if err != nil {
+		return err
+	}
+	if len(sessions) == 0 {
+		return fmt.Errorf("peer has no sessions")
+	}
+	buf := make([]byte, poolioc.MaxPayload)
+	n, err := pc.peer.RecvBytes(sessions[0].Index, 0, buf)
+	if err != nil {
+		return err
+	}
+	return pc.peer.SendBytes(sessions[0].Index, 0, buf[:n])
 }
 
 func (pc *pooliocContext) recvOnChannel(expected string, ch int) error {
@@ -189,6 +312,68 @@ func (pc *pooliocContext) recvOnChannel(expected string, ch int) error {
 	return nil
 }
 
+func (pc *pooliocContext) recvWaiting(ch int) error {
+	pc.recvs = make(chan error, 1)
+	go func() {
+		_, err := pc.dev.RecvBytes(uint32(pc.sessionIdx), uint8(ch), make([]byte, 64))
+		pc.recvs <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case err := <-pc.recvs:
+		return fmt.Errorf("receive returned early: %v", err)
+	default:
+		return nil
+	}
+}
+
+func (pc *pooliocContext) waitingRecvClosed() error {
+	select {
+	case err := <-pc.recvs:
+		if !errors.Is(err, os.ErrClosed) {
+			return fmt.Errorf("expected os.ErrClosed, got %v", err)
+		}
+		return nil
+	case <-time.After(2 * time.Second):
+		return fmt.Errorf("the receive is still waiting")
+	}
+}
+
+// listWhileClosing closes the device while n goroutines keep issuing
+// ioctls on it, so that Close races ioctls in flight.
+func (pc *pooliocContext) listWhileClosing(n int) error {
+	dev := pc.dev
+	pc.recvs = make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			for {
+				if _, err := dev.Sessions(); err != nil {
+					pc.recvs <- err
+					return
+				}
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	err := dev.Close()
+	pc.dev = nil
+	return err
+}
+
+func (pc *pooliocContext) callsClosed() error {
+	for i := 0; i < cap(pc.recvs); i++ {
+		select {
+		case err := <-pc.recvs:
+			if !errors.Is(err, os.ErrClosed) {
+				return fmt.Errorf("expected os.ErrClosed, got %v", err)
+			}
+		case <-time.After(2 * time.Second):
+			return fmt.Errorf("a call is still running after Close")
+		}
+	}
+	return nil
+}
+
 func (pc *pooliocContext) listSessions() error {
 	_, err := pc.dev.Sessions()
 	return err
@@ -222,6 +407,95 @@ func (pc *pooliocContext) sessionState(expected string) error {
 	return fmt.Errorf("session %d not found", pc.sessionIdx)
 }
 
+func (pc *pooliocContext) watchEvents() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := pc.dev.Events(ctx)
+	if err != nil {
+		cancel()
+		return err
+	}
+	pc.events, pc.stopEvents = events, cancel
+	return nil
+}
+
+func (pc *pooliocContext) sawEvent(want string) error {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case ev, ok := <-pc.events:
+			if !ok {
+				return fmt.Errorf("event stream ended before %s", want)
+			}
+			if ev.Type.String() == want {
+				return nil
+			}
+		case <-timeout:
+			return fmt.Errorf("no %s event", want)
+		}
+	}
+}
+
+func (pc *pooliocContext) peerCloses() error {
+	if pc.peer == nil {
+		return godog.ErrPending
+	}
+	sessions, err := pc.peer.Sessions()
+	if err != nil {
+		return err
+	}
+	for _, s := range sessions {
+		if err := pc.peer.CloseSession(s.Index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshotOf returns a one-session table, or an empty one for "NONE".
+func snapshotOf(state string, rekeys, config int) ([]poolioc.SessionInfo, error) {
+	if state == "NONE" {
+		return nil, nil
+	}
+	for st := uint8(0); st <= poolioc.StateClosing; st++ {
+		if stateStringIOC(st) == state {
+			info := poolioc.SessionInfo{State: st, RekeyCount: uint32(rekeys)}
+			info.SessionID[0] = 1
+			info.Telem.ConfigVersion = uint32(config)
+			return []poolioc.SessionInfo{info}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown state %q", state)
+}
+
+func (pc *pooliocContext) sessionSnapshot(state string, rekeys, config int) error {
+	var err error
+	pc.snapshot, err = snapshotOf(state, rekeys, config)
+	return err
+}
+
+func (pc *pooliocContext) diffSnapshot(state string, rekeys, config int) error {
+	after, err := snapshotOf(state, rekeys, config)
+	if err != nil {
+		return err
+	}
+	pc.diff = poolioc.Diff(pc.snapshot, after)
+	return nil
+}
+
+func (pc *pooliocContext) diffReports(want string) error {
+	var got []string
+	for _, ev := range pc.diff {
+		got = append(got, ev.Type.String())
+	}
+	if len(got) == 0 {
+		got = append(got, "nothing")
+	}
+	if s := strings.Join(got, ", "); s != want {
+		return fmt.Errorf("expected %s, got %s", want, s)
+	}
+	return nil
+}
+
 func stateStringIOC(s uint8) string {
 	switch s {
 	case poolioc.StateIdle:
@@ -304,9 +578,38 @@ func (pc *pooliocContext) subscribeMultiple(a, b, c int) error {
 func (pc *pooliocContext) listChannels() error {
 	var err error
 	pc.bitmap, err = pc.dev.ChannelList(uint32(pc.sessionIdx))
+	pc.set = poolioc.ChannelSet(pc.bitmap)
 	return err
 }
 
+func (pc *pooliocContext) channelSetIs(want string, n int) error {
+	if got := pc.set.String(); got != want {
+		return fmt.Errorf("expected %s, got %s", want, got)
+	}
+	if pc.set.Count() != n {
+		return fmt.Errorf("expected %d channels, got %d", n, pc.set.Count())
+	}
+	var seen []uint8
+	pc.set.Iterate(func(ch uint8) bool {
+		if !pc.set.Has(ch) {
+			return false
+		}
+		seen = append(seen, ch)
+		return true
+	})
+	if len(seen) != n {
+		return fmt.Errorf("iterated %v", seen)
+	}
+	return nil
+}
+
+func (pc *pooliocContext) editChannelSet(a, b, c int) error {
+	pc.set.Add(uint8(a))
+	pc.set.Add(uint8(b))
+	pc.set.Remove(uint8(c))
+	return nil
+}
+
 func (pc *pooliocContext) bitmapCheck(a, b, c int) error {
 	for _, ch := range []int{a, b, c} {
 		byteIdx := ch / 8
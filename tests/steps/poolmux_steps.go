@@ -0,0 +1,401 @@
+//go:build linux
+
+package steps
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/amosdavis/pool-go/pool"
+	"github.com/amosdavis/pool-go/poolmux"
+	"github.com/cucumber/godog"
+)
+
+type poolmuxContext struct {
+	listener *pool.Listener
+	conns    []*pool.Conn
+	client   *poolmux.Session
+	server   *poolmux.Session
+	opened   []*poolmux.Stream // client side, in order opened
+	accepted []*poolmux.Stream // server side, in order accepted
+}
+
+func InitializePoolmuxScenario(ctx *godog.ScenarioContext) {
+	mc := &poolmuxContext{}
+
+	ctx.After(func(scenarioCtx context.Context, sc *godog.Scenario, err error) (context.Context, error) {
+		if mc.client != nil {
+			_ = mc.client.Close()
+		}
+		if mc.server != nil {
+			_ = mc.server.Close()
+		}
+		for _, c := range mc.conns {
+			_ = c.Close()
+		}
+		if mc.listener != nil {
+			_ = mc.listener.Close()
+		}
+		return scenarioCtx, nil
+	})
+
+	ctx.Step(`^a multiplexed session on "([^"]*)"$`, mc.session)
+	ctx.Step(`^a multiplexed session on "([^"]*)" over channel (\d+)$`, mc.sessionOverChannel)
+	ctx.Step(`^the server echoes every stream$`, mc.echoStreams)
+	ctx.Step(`^(\d+) streams should each echo their own message$`, mc.streamsEcho)
+	ctx.Step(`^no streams should remain open$`, mc.noStreams)
+	ctx.Step(`^a multiplexed session on "([^"]*)" with an accept backlog of (\d+)$`, mc.sessionWithBacklog)
+	ctx.Step(`^the client opens (\d+) streams?$`, mc.openStreams)
+	ctx.Step(`^the client opens (\d+) streams? the server does not accept$`, mc.openUnaccepted)
+	ctx.Step(`^writing (\d+) bytes on client stream (\d+) with a (\d+)ms deadline should stop after (\d+) bytes$`, mc.writeStalls)
+	ctx.Step(`^client stream (\d+) should reach the server with "([^"]*)"$`, mc.reachesServer)
+	ctx.Step(`^server stream (\d+) reads (\d+) bytes$`, mc.serverReads)
+	ctx.Step(`^writing (\d+) bytes on client stream (\d+) should succeed$`, mc.writeSucceeds)
+	ctx.Step(`^(client|server) stream (\d+) sends "([^"]*)" and closes its side$`, mc.sendAndCloseWrite)
+	ctx.Step(`^(client|server) stream (\d+) should read "([^"]*)" and then EOF$`, mc.readAll)
+	ctx.Step(`^(client|server) stream (\d+) sends "([^"]*)"$`, mc.send)
+	ctx.Step(`^(client|server) stream (\d+) should read "([^"]*)"$`, mc.read)
+	ctx.Step(`^client stream (\d+) is reset$`, mc.reset)
+	ctx.Step(`^reading (client|server) stream (\d+) should fail with "([^"]*)"$`, mc.readFails)
+	ctx.Step(`^writing (client|server) stream (\d+) should fail with "([^"]*)"$`, mc.writeFails)
+	ctx.Step(`^a read on client stream (\d+) with a (\d+)ms deadline should time out$`, mc.readTimesOut)
+	ctx.Step(`^client stream (\d+) clears its deadlines$`, mc.clearDeadlines)
+	ctx.Step(`^the server closes the session$`, mc.serverCloses)
+	ctx.Step(`^opening a stream should fail with "([^"]*)"$`, mc.openFails)
+}
+
+// connect returns both ends of a POOL session on the fake backend.
+func (mc *poolmuxContext) connect(addr string) (*pool.Conn, *pool.Conn, error) {
+	if !fakeBackend() {
+		return nil, nil, godog.ErrPending
+	}
+	ln, err := pool.Listen("pool", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	mc.listener = ln
+	client, err := pool.Dial("pool", "127.0.0.1"+addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	server, err := ln.Accept()
+	if err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+	mc.conns = append(mc.conns, client, server.(*pool.Conn))
+	return client, server.(*pool.Conn), nil
+}
+
+func (mc *poolmuxContext) start(client, server poolmux.Transport) error {
+	return mc.startWith(client, server, nil)
+}
+
+func (mc *poolmuxContext) startWith(client, server poolmux.Transport, cfg *poolmux.Config) error {
+	var err error
+	if mc.client, err = poolmux.Client(client, nil); err != nil {
+		return err
+	}
+	mc.server, err = poolmux.Server(server, cfg)
+	return err
+}
+
+func (mc *poolmuxContext) session(addr string) error {
+	client, server, err := mc.connect(addr)
+	if err != nil {
+		return err
+	}
+	return mc.start(client, server)
+}
+
+func (mc *poolmuxContext) sessionWithBacklog(addr string, n int) error {
+	client, server, err := mc.connect(addr)
+	if err != nil {
+		return err
+	}
+	return mc.startWith(client, server, &poolmux.Config{AcceptBacklog: n})
+}
+
+func (mc *poolmuxContext) sessionOverChannel(addr string, ch int) error {
+	client, server, err := mc.connect(addr)
+	if err != nil {
+		return err
+	}
+	cc, err := client.OpenChannel(uint8(ch))
+	if err != nil {
+		return err
+	}
+	sc, err := server.OpenChannel(uint8(ch))
+	if err != nil {
+		return err
+	}
+	return mc.start(cc, sc)
+}
+
+func (mc *poolmuxContext) echoStreams() error {
+	go func() {
+		for {
+			st, err := mc.server.AcceptStream(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				defer st.Close()
+				_, _ = io.Copy(st, st)
+			}()
+		}
+	}()
+	return nil
+}
+
+// echo sends msg on a new stream, half-closes it and checks that the
+// whole reply is msg.
+func (mc *poolmuxContext) echo(msg []byte) error {
+	st, err := mc.client.OpenStream(context.Background())
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+	if err := st.SetDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		return err
+	}
+	if _, err := st.Write(msg); err != nil {
+		return err
+	}
+	if err := st.CloseWrite(); err != nil {
+		return err
+	}
+	got, err := io.ReadAll(st)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, msg) {
+		return fmt.Errorf("stream %d: expected %q, got %q", st.StreamID(), msg, got)
+	}
+	return nil
+}
+
+func (mc *poolmuxContext) streamsEcho(n int) error {
+	const workers = 64
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+		next = make(chan int)
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				if err := mc.echo([]byte(fmt.Sprintf("stream %d", i))); err != nil {
+					mu.Lock()
+					errs = append(errs, err)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (mc *poolmuxContext) noStreams() error {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		c, s := mc.client.NumStreams(), mc.server.NumStreams()
+		if c == 0 && s == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%d client and %d server streams still open", c, s)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (mc *poolmuxContext) openStreams(n int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	for i := 0; i < n; i++ {
+		st, err := mc.client.OpenStream(ctx)
+		if err != nil {
+			return err
+		}
+		mc.opened = append(mc.opened, st)
+		if st, err = mc.server.AcceptStream(ctx); err != nil {
+			return err
+		}
+		mc.accepted = append(mc.accepted, st)
+	}
+	return nil
+}
+
+func (mc *poolmuxContext) openUnaccepted(n int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	for i := 0; i < n; i++ {
+		st, err := mc.client.OpenStream(ctx)
+		if err != nil {
+			return err
+		}
+		mc.opened = append(mc.opened, st)
+	}
+	return nil
+}
+
+// stream returns stream i (1-based) of the given side.
+func (mc *poolmuxContext) stream(side string, i int) *poolmux.Stream {
+	if side == "client" {
+		return mc.opened[i-1]
+	}
+	return mc.accepted[i-1]
+}
+
+func (mc *poolmuxContext) writeStalls(size, i, ms, want int) error {
+	st := mc.stream("client", i)
+	if err := st.SetWriteDeadline(time.Now().Add(time.Duration(ms) * time.Millisecond)); err != nil {
+		return err
+	}
+	n, err := st.Write(make([]byte, size))
+	if !isTimeout(err) {
+		return fmt.Errorf("expected a timeout, got %v", err)
+	}
+	if n != want {
+		return fmt.Errorf("wrote %d bytes before the timeout, want %d", n, want)
+	}
+	return nil
+}
+
+func (mc *poolmuxContext) reachesServer(i int, msg string) error {
+	if err := mc.send("client", i, msg); err != nil {
+		return err
+	}
+	return mc.read("server", i, msg)
+}
+
+func (mc *poolmuxContext) serverReads(i, n int) error {
+	st := mc.stream("server", i)
+	if err := st.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		return err
+	}
+	_, err := io.ReadFull(st, make([]byte, n))
+	return err
+}
+
+func (mc *poolmuxContext) writeSucceeds(n, i int) error {
+	st := mc.stream("client", i)
+	if err := st.SetWriteDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		return err
+	}
+	_, err := st.Write(make([]byte, n))
+	return err
+}
+
+func (mc *poolmuxContext) send(side string, i int, msg string) error {
+	_, err := mc.stream(side, i).Write([]byte(msg))
+	return err
+}
+
+func (mc *poolmuxContext) sendAndCloseWrite(side string, i int, msg string) error {
+	if err := mc.send(side, i, msg); err != nil {
+		return err
+	}
+	return mc.stream(side, i).CloseWrite()
+}
+
+func (mc *poolmuxContext) read(side string, i int, want string) error {
+	st := mc.stream(side, i)
+	if err := st.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		return err
+	}
+	buf := make([]byte, len(want))
+	if _, err := io.ReadFull(st, buf); err != nil {
+		return err
+	}
+	if string(buf) != want {
+		return fmt.Errorf("expected %q, got %q", want, buf)
+	}
+	return nil
+}
+
+func (mc *poolmuxContext) readAll(side string, i int, want string) error {
+	st := mc.stream(side, i)
+	if err := st.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		return err
+	}
+	got, err := io.ReadAll(st)
+	if err != nil {
+		return err
+	}
+	if string(got) != want {
+		return fmt.Errorf("expected %q, got %q", want, got)
+	}
+	return nil
+}
+
+func (mc *poolmuxContext) reset(i int) error {
+	return mc.stream("client", i).Reset()
+}
+
+func (mc *poolmuxContext) readFails(side string, i int, want string) error {
+	st := mc.stream(side, i)
+	if err := st.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		return err
+	}
+	if _, err := st.Read(make([]byte, 16)); err == nil || err.Error() != want {
+		return fmt.Errorf("expected %q, got %v", want, err)
+	}
+	return nil
+}
+
+func (mc *poolmuxContext) writeFails(side string, i int, want string) error {
+	if _, err := mc.stream(side, i).Write([]byte("x")); err == nil || err.Error() != want {
+		return fmt.Errorf("expected %q, got %v", want, err)
+	}
+	return nil
+}
+
+func (mc *poolmuxContext) readTimesOut(i, ms int) error {
+	st := mc.stream("client", i)
+	if err := st.SetReadDeadline(time.Now().Add(time.Duration(ms) * time.Millisecond)); err != nil {
+		return err
+	}
+	start := time.Now()
+	_, err := st.Read(make([]byte, 16))
+	if !isTimeout(err) {
+		return fmt.Errorf("expected a timeout, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		return fmt.Errorf("read timed out after %v", d)
+	}
+	return nil
+}
+
+func (mc *poolmuxContext) clearDeadlines(i int) error {
+	return mc.stream("client", i).SetDeadline(time.Time{})
+}
+
+func (mc *poolmuxContext) serverCloses() error {
+	return mc.server.Close()
+}
+
+func (mc *poolmuxContext) openFails(want string) error {
+	st, err := mc.client.OpenStream(context.Background())
+	if err == nil {
+		st.Close()
+	}
+	if err == nil || err.Error() != want {
+		return fmt.Errorf("expected %q, got %v", want, err)
+	}
+	return nil
+}
@@ -0,0 +1,832 @@
+//go:build linux
+
+package steps
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/amosdavis/pool-go/pool"
+	"github.com/amosdavis/pool-go/poolioc"
+	"github.com/amosdavis/pool-go/pooludp"
+	"github.com/amosdavis/pool-go/poolwire"
+	"github.com/cucumber/godog"
+)
+
+type pooludpContext struct {
+	server   *pooludp.Stack
+	client   *pooludp.Stack
+	listener *pool.Listener
+	conn     *pool.Conn
+	acks     []*pool.Ack
+	err      error
+	accepted chan *pool.Conn // the server's side, for servers that do not read
+	peer     *pool.Conn
+	writes   chan error // result of writes started in the background
+	env      *string    // previous POOL_BACKEND, restored after the scenario
+	relay    *heartbeatRelay
+	opened   poolioc.Backend // opened through poolioc.OpenBackend
+}
+
+// heartbeatRelay forwards UDP between a client and a server, keeping
+// the last HEARTBEAT the client sent. Once cut, it drops the client's
+// packets and sends the server that HEARTBEAT again instead.
+type heartbeatRelay struct {
+	conn      *net.UDPConn
+	server    *net.UDPAddr
+	mu        sync.Mutex
+	client    *net.UDPAddr
+	heartbeat []byte
+	cut       bool
+}
+
+func InitializePooludpScenario(ctx *godog.ScenarioContext) {
+	pc := &pooludpContext{}
+
+	ctx.After(func(scenarioCtx context.Context, sc *godog.Scenario, err error) (context.Context, error) {
+		if pc.conn != nil {
+			_ = pc.conn.Close()
+		}
+		if pc.peer != nil {
+			_ = pc.peer.Close()
+		}
+		if pc.listener != nil {
+			_ = pc.listener.Close()
+		}
+		if pc.client != nil {
+			_ = pc.client.Close()
+		}
+		if c, ok := pc.opened.(io.Closer); ok && pc.client == nil {
+			_ = c.Close()
+		}
+		if pc.relay != nil {
+			_ = pc.relay.conn.Close()
+		}
+		if pc.server != nil {
+			_ = pc.server.Close()
+		}
+		if pc.env != nil {
+			_ = os.Setenv(poolioc.BackendEnv, *pc.env)
+		}
+		return scenarioCtx, nil
+	})
+
+	ctx.Step(`^a userspace echo server on "([^"]*)"$`, pc.echoServer)
+	ctx.Step(`^I dial "([^"]*)" over the userspace stack$`, pc.dial)
+	ctx.Step(`^I dial "([^"]*)" over the userspace stack with a (\d+)ms timeout$`, pc.dialTimeout)
+	ctx.Step(`^I write "([^"]*)" over the userspace stack$`, pc.write)
+	ctx.Step(`^I should read "([^"]*)" over the userspace stack$`, pc.shouldRead)
+	ctx.Step(`^the userspace session should be "([^"]*)" with a measured RTT$`, pc.sessionMeasured)
+	ctx.Step(`^(\d+) numbered messages should echo back in order$`, pc.numberedEcho)
+	ctx.Step(`^a (\d+)-byte message should echo back intact$`, pc.largeEcho)
+	ctx.Step(`^reading messages should give "([^"]*)" and "([^"]*)" with increasing sequence numbers and send times$`, pc.readMsgs)
+	ctx.Step(`^I pipeline (\d+) acknowledged writes over the userspace stack, the last (\d+) bytes$`, pc.pipelineAcked)
+	ctx.Step(`^every acknowledged write over the userspace stack should complete$`, pc.acksComplete)
+	ctx.Step(`^the userspace server shuts down$`, pc.serverShutdown)
+	ctx.Step(`^an acknowledged write over the userspace stack should fail$`, pc.ackedWriteFails)
+	ctx.Step(`^the session should have sent at least (\d+) packets$`, pc.sentPackets)
+	ctx.Step(`^someone sends the server a DATA packet with a forged HMAC$`, pc.forge)
+	ctx.Step(`^someone sends the server (\d+) INITs$`, pc.floodInits)
+	ctx.Step(`^the server should hold at most (\d+) half-open sessions$`, pc.halfOpenAtMost)
+	ctx.Step(`^I close the userspace connection$`, pc.closeConn)
+	ctx.Step(`^the server should see the session closing$`, pc.serverSeesClosing)
+	ctx.Step(`^the server should see the session closing within (\d+)s$`, pc.serverSeesClosingWithin)
+	ctx.Step(`^I dial the server through a relay on "([^"]*)" with a (\d+)s keepalive$`, pc.dialRelayed)
+	ctx.Step(`^the relay cuts me off and replays my last heartbeat to the server$`, pc.replayHeartbeat)
+	ctx.Step(`^the userspace dial should fail with a timeout error$`, pc.dialTimedOut)
+	ctx.Step(`^POOL_BACKEND is "([^"]*)"$`, pc.setBackend)
+	ctx.Step(`^I enable "([^"]*)" compression over the userspace stack$`, pc.enableCompression)
+	ctx.Step(`^an acknowledged (\d+)-byte log message over the userspace stack should be sent compressed and echo back$`, pc.ackedCompressed)
+	ctx.Step(`^I open the "([^"]*)" backend through poolioc$`, pc.openBackend)
+	ctx.Step(`^it should be a userspace stack$`, pc.isStack)
+	ctx.Step(`^opening a POOL device should fail for a backend that is not a device$`, pc.openNotDevice)
+	ctx.Step(`^a userspace server that echoes every channel on "([^"]*)"$`, pc.channelEchoServer)
+	ctx.Step(`^channels? ([\d, and]+) should echo "([^"]*)" over the userspace stack$`, pc.channelsEcho)
+	ctx.Step(`^a userspace server that counts bytes until io\.EOF on "([^"]*)"$`, pc.countingServer)
+	ctx.Step(`^I close the userspace connection for writing$`, pc.closeWrite)
+	ctx.Step(`^the userspace connection should read io\.EOF$`, pc.readEOF)
+	ctx.Step(`^a userspace server that accepts without reading on "([^"]*)"$`, pc.idleServer)
+	ctx.Step(`^I write (\d+) numbered messages on channel (\d+) over the userspace stack in the background$`, pc.backgroundWrites)
+	ctx.Step(`^the writes on channel (\d+) should stall after (\d+) packets$`, pc.writesStall)
+	ctx.Step(`^"([^"]*)" written on channel (\d+) should reach the userspace server$`, pc.reachesServer)
+	ctx.Step(`^the userspace session should have lost no packets$`, pc.noLoss)
+	ctx.Step(`^the userspace server should read the (\d+) messages on channel (\d+) in order$`, pc.serverReadsInOrder)
+}
+
+func (pc *pooludpContext) echoServer(addr string) error {
+	pc.server = pooludp.New()
+	lc := pool.ListenConfig{Backend: pc.server}
+	ln, err := lc.Listen(context.Background(), "pool", addr)
+	if err != nil {
+		return err
+	}
+	pc.listener = ln
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go echoUpTo(conn, pooludp.MaxMessage)
+		}
+	}()
+	return nil
+}
+
+// channelEchoServer accepts every channel a client starts sending on
+// and echoes it on that channel.
+func (pc *pooludpContext) channelEchoServer(addr string) error {
+	pc.server = pooludp.New()
+	lc := pool.ListenConfig{Backend: pc.server}
+	ln, err := lc.Listen(context.Background(), "pool", addr)
+	if err != nil {
+		return err
+	}
+	pc.listener = ln
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					cc, err := conn.(*pool.Conn).AcceptChannel(context.Background())
+					if err != nil {
+						return
+					}
+					go echoUpTo(cc, pooludp.MaxMessage)
+				}
+			}()
+		}
+	}()
+	return nil
+}
+
+// countingServer reads each session to the end and answers with the
+// number of bytes read.
+func (pc *pooludpContext) countingServer(addr string) error {
+	pc.server = pooludp.New()
+	lc := pool.ListenConfig{Backend: pc.server}
+	ln, err := lc.Listen(context.Background(), "pool", addr)
+	if err != nil {
+		return err
+	}
+	pc.listener = ln
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				n, err := io.Copy(io.Discard, conn)
+				if err != nil {
+					return
+				}
+				fmt.Fprintf(conn, "%d bytes", n)
+			}()
+		}
+	}()
+	return nil
+}
+
+// idleServer accepts one session and leaves it to the scenario, which
+// reads nothing until told.
+func (pc *pooludpContext) idleServer(addr string) error {
+	pc.server = pooludp.New()
+	lc := pool.ListenConfig{Backend: pc.server}
+	ln, err := lc.Listen(context.Background(), "pool", addr)
+	if err != nil {
+		return err
+	}
+	pc.listener = ln
+	pc.accepted = make(chan *pool.Conn, 1)
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			pc.accepted <- conn.(*pool.Conn)
+		}
+	}()
+	return nil
+}
+
+// serverConn returns the session idleServer accepted.
+func (pc *pooludpContext) serverConn() (*pool.Conn, error) {
+	if pc.peer != nil {
+		return pc.peer, nil
+	}
+	select {
+	case pc.peer = <-pc.accepted:
+		return pc.peer, nil
+	case <-time.After(2 * time.Second):
+		return nil, fmt.Errorf("the server accepted no session")
+	}
+}
+
+func (pc *pooludpContext) backgroundWrites(n, ch int) error {
+	cc, err := pc.conn.OpenChannel(uint8(ch))
+	if err != nil {
+		return err
+	}
+	pc.writes = make(chan error, 1)
+	go func() {
+		for i := 0; i < n; i++ {
+			if _, err := cc.Write([]byte(strconv.Itoa(i))); err != nil {
+				pc.writes <- err
+				return
+			}
+		}
+		pc.writes <- nil
+	}()
+	return nil
+}
+
+func (pc *pooludpContext) writesStall(ch, n int) error {
+	sent := func() (uint64, error) {
+		info, err := pc.conn.SessionInfo()
+		return info.PacketsSent, err
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		got, err := sent()
+		if err != nil {
+			return err
+		}
+		if got >= uint64(n) {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("sent %d packets, expected %d", got, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case err := <-pc.writes:
+		return fmt.Errorf("writes on channel %d finished with nobody reading: %v", ch, err)
+	case <-time.After(300 * time.Millisecond):
+	}
+	if got, err := sent(); err != nil || got != uint64(n) {
+		return fmt.Errorf("sent %d packets (%v), expected to stall at %d", got, err, n)
+	}
+	return nil
+}
+
+func (pc *pooludpContext) reachesServer(msg string, ch int) error {
+	peer, err := pc.serverConn()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	cc, err := pc.conn.OpenChannel(uint8(ch))
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+	if _, err := cc.WriteContext(ctx, []byte(msg)); err != nil {
+		return err
+	}
+	sc, err := peer.OpenChannel(uint8(ch))
+	if err != nil {
+		return err
+	}
+	defer sc.Close()
+	buf := make([]byte, 64)
+	n, err := sc.ReadContext(ctx, buf)
+	if err != nil {
+		return err
+	}
+	if string(buf[:n]) != msg {
+		return fmt.Errorf("expected %q, got %q", msg, buf[:n])
+	}
+	return nil
+}
+
+func (pc *pooludpContext) noLoss() error {
+	info, err := pc.conn.SessionInfo()
+	if err != nil {
+		return err
+	}
+	if info.State != poolioc.StateEstablished || info.Telem.LossRatePPM != 0 {
+		return fmt.Errorf("session %s with a loss rate of %d ppm", stateStringIOC(info.State), info.Telem.LossRatePPM)
+	}
+	return nil
+}
+
+func (pc *pooludpContext) serverReadsInOrder(n, ch int) error {
+	peer, err := pc.serverConn()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	sc, err := peer.OpenChannel(uint8(ch))
+	if err != nil {
+		return err
+	}
+	defer sc.Close()
+	buf := make([]byte, 64)
+	for i := 0; i < n; i++ {
+		m, err := sc.ReadContext(ctx, buf)
+		if err != nil {
+			return fmt.Errorf("message %d: %w", i, err)
+		}
+		if want := strconv.Itoa(i); string(buf[:m]) != want {
+			return fmt.Errorf("expected message %s, got %s", want, buf[:m])
+		}
+	}
+	select {
+	case err := <-pc.writes:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("the writes did not finish")
+	}
+}
+
+func (pc *pooludpContext) closeWrite() error {
+	return pc.conn.CloseWrite()
+}
+
+func (pc *pooludpContext) readEOF() error {
+	if got, err := pc.read(); len(got) != 0 || err != io.EOF {
+		return fmt.Errorf("expected io.EOF, got %q and %v", got, err)
+	}
+	return nil
+}
+
+func (pc *pooludpContext) dial(address string) error {
+	pc.client = pooludp.New()
+	d := pool.Dialer{Backend: pc.client}
+	conn, err := d.Dial("pool", address)
+	if err != nil {
+		return err
+	}
+	pc.conn = conn.(*pool.Conn)
+	return nil
+}
+
+func (pc *pooludpContext) dialTimeout(address string, ms int) error {
+	pc.client = pooludp.New()
+	d := pool.Dialer{Backend: pc.client, Timeout: time.Duration(ms) * time.Millisecond}
+	_, pc.err = d.Dial("pool", address)
+	return nil
+}
+
+func (pc *pooludpContext) dialTimedOut() error {
+	var ne net.Error
+	if !errors.As(pc.err, &ne) || !ne.Timeout() {
+		return fmt.Errorf("expected timeout error, got %v", pc.err)
+	}
+	return nil
+}
+
+func (pc *pooludpContext) write(msg string) error {
+	_, err := pc.conn.Write([]byte(msg))
+	return err
+}
+
+func (pc *pooludpContext) read() ([]byte, error) {
+	buf := make([]byte, pooludp.MaxMessage)
+	if err := pc.conn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		return nil, err
+	}
+	n, err := pc.conn.Read(buf)
+	return buf[:n], err
+}
+
+func (pc *pooludpContext) shouldRead(expected string) error {
+	got, err := pc.read()
+	if err != nil {
+		return err
+	}
+	if string(got) != expected {
+		return fmt.Errorf("expected %q, got %q", expected, got)
+	}
+	return nil
+}
+
+func (pc *pooludpContext) channelsEcho(list, msg string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var chans []*pool.ChannelConn
+	for _, ch := range sizes(list) {
+		cc, err := pc.conn.OpenChannel(uint8(ch))
+		if err != nil {
+			return err
+		}
+		defer cc.Close()
+		if _, err := cc.WriteContext(ctx, []byte(msg)); err != nil {
+			return err
+		}
+		chans = append(chans, cc)
+	}
+	for _, cc := range chans {
+		buf := make([]byte, 64)
+		n, err := cc.ReadContext(ctx, buf)
+		if err != nil {
+			return err
+		}
+		if string(buf[:n]) != msg {
+			return fmt.Errorf("channel %d: expected %q, got %q", cc.Channel(), msg, buf[:n])
+		}
+	}
+	return nil
+}
+
+func (pc *pooludpContext) sessionMeasured(state string) error {
+	info, err := pc.conn.SessionInfo()
+	if err != nil {
+		return err
+	}
+	if got := stateStringIOC(info.State); got != state {
+		return fmt.Errorf("expected state %s, got %s", state, got)
+	}
+	if info.Telem.RTTNs == 0 {
+		return fmt.Errorf("no RTT measured")
+	}
+	return nil
+}
+
+func (pc *pooludpContext) numberedEcho(n int) error {
+	// Write everything first so that the send window and the peer's
+	// queues fill up, then read it all back.
+	errc := make(chan error, 1)
+	go func() {
+		for i := 0; i < n; i++ {
+			if _, err := pc.conn.Write([]byte(strconv.Itoa(i))); err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- nil
+	}()
+	for i := 0; i < n; i++ {
+		got, err := pc.read()
+		if err != nil {
+			return fmt.Errorf("message %d: %w", i, err)
+		}
+		if want := strconv.Itoa(i); string(got) != want {
+			return fmt.Errorf("expected message %s, got %s", want, got)
+		}
+	}
+	return <-errc
+}
+
+func (pc *pooludpContext) largeEcho(size int) error {
+	msg := bytes.Repeat([]byte("0123456789abcdef"), size/16+1)[:size]
+	if _, err := pc.conn.Write(msg); err != nil {
+		return err
+	}
+	got, err := pc.read()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, msg) {
+		return fmt.Errorf("message corrupted: got %d bytes", len(got))
+	}
+	return nil
+}
+
+func (pc *pooludpContext) readMsgs(a, b string) error {
+	var prev *pool.Message
+	for _, want := range []string{a, b} {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		m, err := pc.conn.ReadMsg(ctx)
+		cancel()
+		if err != nil {
+			return err
+		}
+		if string(m.Data) != want {
+			return fmt.Errorf("expected %q, got %q", want, m.Data)
+		}
+		if m.Seq == 0 || m.Time.IsZero() || m.Flags&poolioc.FlagEncrypted == 0 {
+			return fmt.Errorf("message %q lacks metadata: %+v", want, m)
+		}
+		if prev != nil && (m.Seq <= prev.Seq || m.Time.Before(prev.Time)) {
+			return fmt.Errorf("message %q (seq %d) does not follow seq %d", want, m.Seq, prev.Seq)
+		}
+		prev = m
+	}
+	return nil
+}
+
+func (pc *pooludpContext) sentPackets(n int) error {
+	info, err := pc.conn.SessionInfo()
+	if err != nil {
+		return err
+	}
+	if info.PacketsSent < uint64(n) {
+		return fmt.Errorf("expected at least %d packets sent, got %d", n, info.PacketsSent)
+	}
+	return nil
+}
+
+func (pc *pooludpContext) forge() error {
+	sessions, err := pc.server.Sessions()
+	if err != nil || len(sessions) == 0 {
+		return fmt.Errorf("no server session: %v", err)
+	}
+	h := poolwire.Header{
+		Version:    poolioc.Version,
+		Type:       poolioc.PktData,
+		Flags:      poolioc.FlagEncrypted,
+		Seq:        1,
+		SessionID:  sessions[0].SessionID,
+		PayloadLen: poolioc.TagSize + 4,
+	}
+	if err := h.Sign([]byte("not the session key")); err != nil {
+		return err
+	}
+	pkt, err := h.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	pkt = append(pkt, make([]byte, h.PayloadLen)...)
+
+	conn, err := net.DialUDP("udp", nil, pc.server.LocalAddr())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(pkt)
+	return err
+}
+
+// floodInits sends the server INITs for n sessions that will never
+// answer its CHALLENGE.
+func (pc *pooludpContext) floodInits(n int) error {
+	conn, err := net.DialUDP("udp", nil, pc.server.LocalAddr())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for i := 0; i < n; i++ {
+		h := poolwire.Header{
+			Version:    poolioc.Version,
+			Type:       poolioc.PktInit,
+			PayloadLen: poolioc.KeySize + 2,
+		}
+		if _, err := rand.Read(h.SessionID[:]); err != nil {
+			return err
+		}
+		pkt, err := h.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, poolioc.KeySize+2)
+		if _, err := rand.Read(key[:poolioc.KeySize]); err != nil {
+			return err
+		}
+		if _, err := conn.Write(append(pkt, key...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (pc *pooludpContext) halfOpenAtMost(n int) error {
+	count := func() (int, error) {
+		sessions, err := pc.server.Sessions()
+		return len(sessions), err
+	}
+	// Wait for the INITs to be handled, then for any stragglers.
+	deadline := time.Now().Add(time.Second)
+	for {
+		got, err := count()
+		if err != nil {
+			return err
+		}
+		if got >= n || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got, err := count(); err != nil || got > n {
+		return fmt.Errorf("the server holds %d sessions (%v), expected at most %d", got, err, n)
+	}
+	return nil
+}
+
+func (pc *pooludpContext) pipelineAcked(n, size int) error {
+	for i := 0; i < n; i++ {
+		msg := []byte(strconv.Itoa(i))
+		if i == n-1 {
+			msg = message(size)
+		}
+		a, err := pc.conn.WriteAsync(context.Background(), msg)
+		if err != nil {
+			return fmt.Errorf("write %d: %w", i, err)
+		}
+		pc.acks = append(pc.acks, a)
+	}
+	return nil
+}
+
+func (pc *pooludpContext) acksComplete() error {
+	return waitAcks(pc.acks)
+}
+
+func (pc *pooludpContext) serverShutdown() error {
+	err := pc.server.Close()
+	pc.server = nil
+	return err
+}
+
+func (pc *pooludpContext) ackedWriteFails() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	err := pc.conn.WriteAcked(ctx, []byte("too late"))
+	if err == nil || errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("expected the write to fail, got %v", err)
+	}
+	return nil
+}
+
+func (pc *pooludpContext) closeConn() error {
+	err := pc.conn.Close()
+	pc.conn = nil
+	return err
+}
+
+func (pc *pooludpContext) serverSeesClosing() error {
+	return pc.serverSeesClosingWithin(2)
+}
+
+func (pc *pooludpContext) serverSeesClosingWithin(sec int) error {
+	deadline := time.Now().Add(time.Duration(sec) * time.Second)
+	for time.Now().Before(deadline) {
+		sessions, err := pc.server.Sessions()
+		if err != nil {
+			return err
+		}
+		// The echo server closes its side once Read reports the peer
+		// gone, so the session may already have left the table.
+		if len(sessions) == 0 || sessions[0].State == poolioc.StateClosing {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return fmt.Errorf("server session did not move to CLOSING")
+}
+
+func (pc *pooludpContext) setBackend(name string) error {
+	prev := os.Getenv(poolioc.BackendEnv)
+	pc.env = &prev
+	return os.Setenv(poolioc.BackendEnv, name)
+}
+
+// dialRelayed dials the echo server through a heartbeatRelay on addr.
+func (pc *pooludpContext) dialRelayed(addr string, keepAlive int) error {
+	la, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", la)
+	if err != nil {
+		return err
+	}
+	server := pc.server.LocalAddr()
+	pc.relay = &heartbeatRelay{
+		conn:   conn,
+		server: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: server.Port},
+	}
+	go pc.relay.run()
+
+	pc.client = pooludp.New()
+	d := pool.Dialer{Backend: pc.client, KeepAlive: time.Duration(keepAlive) * time.Second}
+	c, err := d.Dial("pool", fmt.Sprintf("127.0.0.1:%d", la.Port))
+	if err != nil {
+		return err
+	}
+	pc.conn = c.(*pool.Conn)
+	return nil
+}
+
+func (r *heartbeatRelay) run() {
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		pkt := append([]byte(nil), buf[:n]...)
+		r.mu.Lock()
+		if from.Port == r.server.Port && from.IP.IsLoopback() {
+			to := r.client
+			r.mu.Unlock()
+			if to != nil {
+				_, _ = r.conn.WriteToUDP(pkt, to)
+			}
+			continue
+		}
+		r.client = from
+		cut := r.cut
+		var h poolwire.Header
+		if !cut && h.UnmarshalBinary(pkt) == nil && h.Type == poolioc.PktHeartbeat {
+			r.heartbeat = pkt
+		}
+		r.mu.Unlock()
+		if !cut {
+			_, _ = r.conn.WriteToUDP(pkt, r.server)
+		}
+	}
+}
+
+// replayHeartbeat waits for the client's first HEARTBEAT, then cuts
+// the client off and replays it to the server until the scenario ends.
+func (pc *pooludpContext) replayHeartbeat() error {
+	r := pc.relay
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r.mu.Lock()
+		pkt := r.heartbeat
+		r.cut = pkt != nil
+		r.mu.Unlock()
+		if pkt != nil {
+			go func() {
+				for {
+					if _, err := r.conn.WriteToUDP(pkt, r.server); err != nil {
+						return
+					}
+					time.Sleep(200 * time.Millisecond)
+				}
+			}()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("the client sent no HEARTBEAT")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (pc *pooludpContext) openBackend(name string) error {
+	b, err := poolioc.OpenBackend(name)
+	if err != nil {
+		return err
+	}
+	pc.opened = b
+	return nil
+}
+
+func (pc *pooludpContext) isStack() error {
+	st, ok := pc.opened.(*pooludp.Stack)
+	if !ok {
+		return fmt.Errorf("got a %T, not a Stack", pc.opened)
+	}
+	pc.client = st
+	return nil
+}
+
+func (pc *pooludpContext) openNotDevice() error {
+	dev, err := poolioc.Open()
+	if err == nil {
+		_ = dev.Close()
+		return fmt.Errorf("poolioc.Open opened a Device for POOL_BACKEND=udp")
+	}
+	return nil
+}
+
+func (pc *pooludpContext) enableCompression(list string) error {
+	codecs, err := parseCodecs(list)
+	if err != nil {
+		return err
+	}
+	return pc.conn.SetCompression(codecs...)
+}
+
+func (pc *pooludpContext) ackedCompressed(size int) error {
+	msg := logMessage(size)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := pc.conn.WriteAcked(ctx, msg); err != nil {
+		return err
+	}
+	if st := pc.conn.CompressionStats(); st.Compressed != 1 {
+		return fmt.Errorf("expected the write to be compressed, got %+v", st)
+	}
+	got := make([]byte, 0, size)
+	for len(got) < size {
+		b, err := pc.read()
+		if err != nil {
+			return fmt.Errorf("after %d bytes: %w", len(got), err)
+		}
+		got = append(got, b...)
+	}
+	if !bytes.Equal(got, msg) {
+		return fmt.Errorf("the message did not echo back intact")
+	}
+	return nil
+}
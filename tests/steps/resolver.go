@@ -0,0 +1,106 @@
+//go:build linux
+
+package steps
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+)
+
+// stubResolver answers A and AAAA queries for a fixed set of hostnames
+// from an in-process UDP DNS server.
+type stubResolver struct {
+	conn  net.PacketConn
+	hosts map[string][]net.IP
+}
+
+func newStubResolver(hosts map[string][]net.IP) (*stubResolver, error) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	r := &stubResolver{conn: conn, hosts: hosts}
+	go r.serve()
+	return r, nil
+}
+
+// Resolver returns a net.Resolver that sends every query to the stub.
+func (r *stubResolver) Resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", r.conn.LocalAddr().String())
+		},
+	}
+}
+
+func (r *stubResolver) Close() error {
+	return r.conn.Close()
+}
+
+func (r *stubResolver) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, from, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if resp := r.answer(buf[:n]); resp != nil {
+			_, _ = r.conn.WriteTo(resp, from)
+		}
+	}
+}
+
+// answer builds the response to a single-question query, or returns nil
+// if the query cannot be parsed.
+func (r *stubResolver) answer(q []byte) []byte {
+	if len(q) < 12 {
+		return nil
+	}
+	// Walk the question name to find its end.
+	var labels []string
+	off := 12
+	for off < len(q) && q[off] != 0 {
+		l := int(q[off])
+		if off+1+l > len(q) {
+			return nil
+		}
+		labels = append(labels, string(q[off+1:off+1+l]))
+		off += 1 + l
+	}
+	off++ // root label
+	if off+4 > len(q) {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(q[off:])
+	question := q[12 : off+4]
+	name := strings.ToLower(strings.Join(labels, "."))
+
+	var answers [][]byte
+	for _, ip := range r.hosts[name] {
+		if ip4 := ip.To4(); ip4 != nil && qtype == 1 {
+			answers = append(answers, ip4)
+		} else if ip4 == nil && qtype == 28 {
+			answers = append(answers, ip.To16())
+		}
+	}
+
+	resp := make([]byte, 12, 512)
+	copy(resp, q[:2])                            // ID
+	binary.BigEndian.PutUint16(resp[2:], 0x8580) // QR, AA, RD, RA
+	binary.BigEndian.PutUint16(resp[4:], 1)
+	binary.BigEndian.PutUint16(resp[6:], uint16(len(answers)))
+	resp = append(resp, question...)
+	for _, rdata := range answers {
+		rr := []byte{0xC0, 12} // pointer to the question name
+		rr = binary.BigEndian.AppendUint16(rr, qtype)
+		rr = binary.BigEndian.AppendUint16(rr, 1) // IN
+		rr = binary.BigEndian.AppendUint32(rr, 60)
+		rr = binary.BigEndian.AppendUint16(rr, uint16(len(rdata)))
+		resp = append(resp, append(rr, rdata...)...)
+	}
+	return resp
+}